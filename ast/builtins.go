@@ -41,6 +41,9 @@ var DefaultBuiltins = [...]*Builtin{
 
 	// Strings
 	Concat, FormatInt, IndexOf, Substring, Lower, Upper, Contains, StartsWith, EndsWith,
+
+	// Tracing
+	Trace,
 }
 
 // BuiltinMap provides a convenient mapping of built-in names to
@@ -270,6 +273,17 @@ var Upper = &Builtin{
 	TargetPos: []int{1},
 }
 
+/**
+ * Tracing
+ */
+
+// Trace emits a note with the given message when tracing is enabled. The
+// expression is always true.
+var Trace = &Builtin{
+	Name:    Var("trace"),
+	NumArgs: 1,
+}
+
 // Builtin represents a built-in function supported by OPA. Every
 // built-in function is uniquely identified by a name.
 type Builtin struct {
@@ -98,9 +98,11 @@ to delete policies will remove the definition file.
 	runCommand.Flags().StringVarP(&params.Eval, "eval", "e", "", "evaluate, print, exit")
 	runCommand.Flags().StringVarP(&params.HistoryPath, "history", "H", historyPath(), "set path of history file")
 	runCommand.Flags().StringVarP(&params.PolicyDir, "policy-dir", "p", "", "set directory to store policy definitions")
-	runCommand.Flags().StringVarP(&params.Addr, "addr", "a", defaultAddr, "set listening address of the server")
+	runCommand.Flags().StringVarP(&params.Addr, "addr", "a", defaultAddr, "set listening address of the server (e.g., [ip]:<port> or unix:///path/to/socket)")
 	runCommand.Flags().StringVarP(&params.OutputFormat, "format", "f", "pretty", "set shell output format, i.e, pretty, json")
 	runCommand.Flags().BoolVarP(&params.Watch, "watch", "w", false, "watch command line files for changes")
+	runCommand.Flags().StringVar(&params.CertFile, "tls-cert-file", "", "set path of TLS certificate file")
+	runCommand.Flags().StringVar(&params.KeyFile, "tls-private-key-file", "", "set path of TLS private key file")
 
 	wrapFlags(runCommand.Flags())
 	flag.Parse()
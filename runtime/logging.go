@@ -34,7 +34,8 @@ func (h *LoggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if recorder.statusCode != 0 {
 			statusCode = recorder.statusCode
 		}
-		glog.Infof("%v %v %v %v %v %vms",
+		glog.Infof("%v %v %v %v %v %v %vms",
+			recorder.Header().Get(server.RequestIDHeader),
 			r.RemoteAddr,
 			r.Method,
 			dropRequestParam(r.URL),
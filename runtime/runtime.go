@@ -9,7 +9,10 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	fsnotify "gopkg.in/fsnotify.v1"
@@ -63,6 +66,12 @@ type Params struct {
 	// interactive development.
 	Watch bool
 
+	// CertFile and KeyFile are the filenames of the TLS certificate and
+	// private key used by the server. If both are set, the server serves
+	// HTTPS instead of HTTP.
+	CertFile string
+	KeyFile  string
+
 	// Output is the output stream used when run as an interactive shell. This
 	// is mostly for test purposes.
 	Output io.Writer
@@ -154,9 +163,52 @@ func (rt *Runtime) startServer(ctx context.Context, params *Params) {
 
 	s.Handler = NewLoggingHandler(s.Handler)
 
-	if err := s.Loop(); err != nil {
+	if (params.CertFile == "") != (params.KeyFile == "") {
+		glog.Fatalf("Error creating server: --tls-cert-file and --tls-private-key-file must be set together")
+	}
+
+	done := make(chan struct{})
+	go rt.shutdownOnSignal(ctx, s, done)
+
+	if params.CertFile != "" {
+		err = s.LoopTLS(params.CertFile, params.KeyFile)
+	} else {
+		err = s.Loop()
+	}
+
+	if err != http.ErrServerClosed {
 		glog.Fatalf("Server exiting: %v", err)
 	}
+
+	// The server stops listening as soon as shutdown begins. Wait for the
+	// in-flight requests to complete before exiting.
+	<-done
+}
+
+// shutdownTimeout is the maximum amount of time the server waits for in-flight
+// requests to complete when it is shut down.
+const shutdownTimeout = 30 * time.Second
+
+// shutdownOnSignal gracefully shuts down the server when the process is
+// interrupted or terminated. The done channel is closed once the shutdown
+// completes.
+func (rt *Runtime) shutdownOnSignal(ctx context.Context, s *server.Server, done chan struct{}) {
+
+	defer close(done)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	glog.Infof("Received %v, shutting down server.", sig)
+
+	ctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		glog.Errorf("Error shutting down server: %v", err)
+	}
 }
 
 func (rt *Runtime) startRepl(ctx context.Context, params *Params) {
@@ -0,0 +1,116 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Authorizer defines the interface for deciding whether a request may be
+// handled by the server. Authorizers are invoked before any handler runs.
+// Implementations return nil to allow the request. Returning an error created
+// with Unauthenticated causes the server to respond with 401 and returning any
+// other error causes the server to respond with 403.
+type Authorizer interface {
+	Authorize(r *http.Request) error
+}
+
+// AllowAllAuthorizer implements the Authorizer interface by allowing every
+// request. This is the server's default.
+type AllowAllAuthorizer struct{}
+
+// Authorize always returns nil.
+func (AllowAllAuthorizer) Authorize(r *http.Request) error {
+	return nil
+}
+
+// BearerTokenAuthorizer implements the Authorizer interface by requiring
+// requests to carry one of a fixed set of tokens in the Authorization header,
+// e.g., "Authorization: Bearer <token>".
+type BearerTokenAuthorizer struct {
+	tokens []string
+}
+
+// NewBearerTokenAuthorizer returns a new BearerTokenAuthorizer that accepts any
+// of the given tokens.
+func NewBearerTokenAuthorizer(tokens ...string) *BearerTokenAuthorizer {
+	return &BearerTokenAuthorizer{tokens: tokens}
+}
+
+// Authorize returns nil if the request carries one of the accepted tokens.
+func (a *BearerTokenAuthorizer) Authorize(r *http.Request) error {
+
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return Unauthenticated("missing authorization header")
+	}
+
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return Unauthenticated("authorization header must use bearer scheme")
+	}
+
+	token := []byte(strings.TrimSpace(parts[1]))
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			return nil
+		}
+	}
+
+	return forbiddenError("bearer token not authorized")
+}
+
+// UnauthenticatedError represents an error condition raised by an Authorizer
+// if the request does not carry valid credentials.
+type UnauthenticatedError string
+
+// Unauthenticated returns a new UnauthenticatedError.
+func Unauthenticated(msg string) UnauthenticatedError {
+	return UnauthenticatedError(msg)
+}
+
+func (err UnauthenticatedError) Error() string {
+	return "unauthenticated: " + string(err)
+}
+
+// IsUnauthenticated returns true if the error indicates missing or malformed
+// credentials.
+func IsUnauthenticated(err error) bool {
+	_, ok := err.(UnauthenticatedError)
+	return ok
+}
+
+type forbiddenError string
+
+func (err forbiddenError) Error() string {
+	return "forbidden: " + string(err)
+}
+
+// authorizingHandler wraps the server's router and consults the server's
+// Authorizer before dispatching requests. Health checks are not authorized so
+// that probes do not need credentials.
+type authorizingHandler struct {
+	server *Server
+	inner  http.Handler
+}
+
+func (h *authorizingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	if err := h.server.authorizer.Authorize(r); err != nil {
+		if IsUnauthenticated(err) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			handleError(w, http.StatusUnauthorized, err)
+		} else {
+			handleError(w, http.StatusForbidden, err)
+		}
+		return
+	}
+	h.inner.ServeHTTP(w, r)
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestBearerTokenAuthorizer(t *testing.T) {
+
+	tests := []struct {
+		note   string
+		header string
+		code   int
+	}{
+		{"missing header", "", 401},
+		{"bad scheme", "Basic Zm9vOmJhcg==", 401},
+		{"bad token", "Bearer deadbeef", 403},
+		{"good token", "Bearer secret", 200},
+		{"good token (lowercase scheme)", "bearer secret", 200},
+	}
+
+	f := newFixture(t)
+	f.server.WithAuthorizer(NewBearerTokenAuthorizer("secret"))
+
+	for _, tc := range tests {
+		req := newReqV1("GET", "/policies", "")
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		if err := f.executeRequest(req, tc.code, ""); err != nil {
+			t.Errorf("%v: %v", tc.note, err)
+		}
+	}
+}
+
+func TestAllowAllAuthorizerDefault(t *testing.T) {
+	f := newFixture(t)
+	if err := f.v1("GET", "/policies", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+}
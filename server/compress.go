@@ -0,0 +1,151 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// defaultCompressionThreshold is the default minimum size (in bytes) of
+// response bodies that are compressed.
+const defaultCompressionThreshold = 1024
+
+// compressingHandler wraps the server's router and compresses response bodies
+// with gzip if the client accepts it. Bodies smaller than the server's
+// compression threshold are written uncompressed.
+type compressingHandler struct {
+	server *Server
+	inner  http.Handler
+}
+
+func (h *compressingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.server.compressionThreshold < 0 || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	cw := &compressingWriter{ResponseWriter: w, threshold: h.server.compressionThreshold, code: 200}
+	defer cw.Close()
+	h.inner.ServeHTTP(cw, r)
+}
+
+// acceptsGzip returns true if the Accept-Encoding header value includes gzip
+// (or the wildcard) with a non-zero quality value.
+func acceptsGzip(header string) bool {
+	for _, x := range strings.Split(header, ",") {
+		parts := strings.Split(x, ";")
+		coding := strings.TrimSpace(parts[0])
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		accepted := true
+		for _, p := range parts[1:] {
+			if q := strings.Replace(p, " ", "", -1); strings.HasPrefix(q, "q=0") && strings.Trim(q[3:], ".0") == "" {
+				accepted = false
+			}
+		}
+		return accepted
+	}
+	return false
+}
+
+// compressingWriter buffers the response body until the threshold is reached
+// and then switches to writing gzip compressed output. If the body is smaller
+// than the threshold, it is written uncompressed when the writer is closed.
+type compressingWriter struct {
+	http.ResponseWriter
+	threshold int
+	code      int
+	buf       bytes.Buffer
+	gz        *gzip.Writer
+	started   bool
+}
+
+func (w *compressingWriter) WriteHeader(code int) {
+	if !w.started {
+		w.code = code
+	}
+}
+
+func (w *compressingWriter) Write(bs []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(bs)
+		}
+		return w.ResponseWriter.Write(bs)
+	}
+	w.buf.Write(bs)
+	if w.buf.Len() >= w.threshold {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(bs), nil
+}
+
+// Flush sends buffered output to the client. Once flushed, the response is
+// compressed regardless of its size because the total size is not known.
+func (w *compressingWriter) Flush() {
+	if !w.started {
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes any buffered output and terminates the compressed stream.
+func (w *compressingWriter) Close() error {
+	if !w.started {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func (w *compressingWriter) start(compress bool) error {
+
+	w.started = true
+	headers := w.Header()
+
+	// Responses without bodies and responses that are already encoded (e.g.,
+	// policy exports) are written as-is.
+	if w.code == http.StatusNoContent || w.code == http.StatusNotModified || headers.Get("Content-Encoding") != "" || headers.Get("Content-Type") == "application/gzip" {
+		compress = false
+	}
+
+	if compress {
+		headers.Set("Content-Encoding", "gzip")
+		headers.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.code)
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
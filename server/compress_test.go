@@ -0,0 +1,112 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+
+	tests := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.00", false},
+		{"br", false},
+	}
+
+	for _, tc := range tests {
+		if result := acceptsGzip(tc.header); result != tc.expected {
+			t.Errorf("Expected acceptsGzip(%q) to be %v but got: %v", tc.header, tc.expected, result)
+		}
+	}
+}
+
+func TestCompressResponses(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithCompressionThreshold(64)
+
+	large := `[` + strings.Repeat(`"abcdefgh",`, 20) + `"abcdefgh"]`
+
+	if err := f.v1("PUT", "/data/large", large, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/data/small", `[1]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) {
+		f.reset()
+		req := newReqV1("GET", path, "")
+		req.Header.Set("Accept-Encoding", "gzip")
+		f.server.Handler.ServeHTTP(f.recorder, req)
+	}
+
+	get("/data/large")
+
+	if f.recorder.Code != 200 || f.recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected compressed response but got: %v", f.recorder)
+	}
+
+	gr, err := gzip.NewReader(f.recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result, expected interface{}
+	if err := util.UnmarshalJSON(bs, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := util.UnmarshalJSON([]byte(large), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected decompressed document but got: %s", bs)
+	}
+
+	get("/data/small")
+
+	if f.recorder.Code != 200 || f.recorder.Header().Get("Content-Encoding") != "" || f.recorder.Body.String() != `[1]` {
+		t.Fatalf("Expected uncompressed response but got: %v", f.recorder)
+	}
+
+	f.reset()
+	req := newReqV1("PUT", "/data/small", `[2]`)
+	req.Header.Set("Accept-Encoding", "gzip")
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 204 || f.recorder.Header().Get("Content-Encoding") != "" || f.recorder.Body.Len() != 0 {
+		t.Fatalf("Expected uncompressed 204 response but got: %v", f.recorder)
+	}
+
+	if err := f.v1("GET", "/data/large", "", 200, large); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.recorder.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Expected uncompressed response without Accept-Encoding but got: %v", f.recorder)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Default CORS settings applied if the allowed methods or headers are not
+// specified.
+var (
+	defaultCORSMethods = []string{"GET", "PUT", "PATCH", "POST", "DELETE"}
+	defaultCORSHeaders = []string{"Content-Type"}
+)
+
+// corsExposedHeaders are the response headers that browsers are allowed to
+// read from cross-origin responses.
+var corsExposedHeaders = []string{RequestIDHeader, EvalDurationHeader, "ETag"}
+
+// corsConfig holds the origins, methods, and headers allowed in cross-origin
+// requests.
+type corsConfig struct {
+	origins map[string]bool
+	methods []string
+	headers []string
+}
+
+func (c *corsConfig) allowsOrigin(origin string) bool {
+	return c.origins["*"] || c.origins[origin]
+}
+
+func (c *corsConfig) allowsMethod(method string) bool {
+	for _, m := range c.methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler wraps the server's router and adds CORS headers to responses
+// for requests from allowed origins. Preflight requests are answered directly
+// so that they do not need to be authorized.
+type corsHandler struct {
+	server *Server
+	inner  http.Handler
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	config := h.server.cors
+	origin := r.Header.Get("Origin")
+
+	if config == nil {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	headers := w.Header()
+	headers.Add("Vary", "Origin")
+
+	if origin == "" || !config.allowsOrigin(origin) {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	if r.Method == "OPTIONS" && method != "" {
+		// Browsers block the request if the preflight response does not
+		// include the CORS headers.
+		if config.allowsMethod(method) {
+			headers.Set("Access-Control-Allow-Origin", origin)
+			headers.Set("Access-Control-Allow-Methods", strings.Join(config.methods, ", "))
+			headers.Set("Access-Control-Allow-Headers", strings.Join(config.headers, ", "))
+		}
+		handleResponse(w, 204, nil)
+		return
+	}
+
+	headers.Set("Access-Control-Allow-Origin", origin)
+	headers.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+	h.inner.ServeHTTP(w, r)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestCORSDisabled(t *testing.T) {
+
+	f := newFixture(t)
+
+	req := newReqV1("GET", "/data", "")
+	req.Header.Set("Origin", "http://example.com")
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 200 || f.recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected response without CORS headers but got: %v", f.recorder)
+	}
+}
+
+func TestCORS(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithCORS([]string{"http://example.com"}, []string{"GET", "POST"}, nil)
+
+	tests := []struct {
+		note          string
+		method        string
+		origin        string
+		requestMethod string
+		code          int
+		allowOrigin   string
+		allowMethods  string
+		allowHeaders  string
+	}{
+		{"allowed origin", "GET", "http://example.com", "", 200, "http://example.com", "", ""},
+		{"disallowed origin", "GET", "http://other.com", "", 200, "", "", ""},
+		{"no origin", "GET", "", "", 200, "", "", ""},
+		{"preflight", "OPTIONS", "http://example.com", "POST", 204, "http://example.com", "GET, POST", "Content-Type"},
+		{"preflight disallowed method", "OPTIONS", "http://example.com", "DELETE", 204, "", "", ""},
+		{"preflight disallowed origin", "OPTIONS", "http://other.com", "POST", 404, "", "", ""},
+	}
+
+	for _, tc := range tests {
+		f.reset()
+		req := newReqV1(tc.method, "/data", "")
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+		}
+		f.server.Handler.ServeHTTP(f.recorder, req)
+		headers := f.recorder.Header()
+		if f.recorder.Code != tc.code ||
+			headers.Get("Access-Control-Allow-Origin") != tc.allowOrigin ||
+			headers.Get("Access-Control-Allow-Methods") != tc.allowMethods ||
+			headers.Get("Access-Control-Allow-Headers") != tc.allowHeaders {
+			t.Errorf("%v: unexpected response: %v", tc.note, f.recorder)
+		}
+	}
+
+	f.server.WithCORS([]string{"*"}, nil, nil)
+
+	f.reset()
+	req := newReqV1("OPTIONS", "/data", "")
+	req.Header.Set("Origin", "http://other.com")
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 204 || f.recorder.Header().Get("Access-Control-Allow-Origin") != "http://other.com" {
+		t.Fatalf("Expected wildcard origin to be allowed but got: %v", f.recorder)
+	}
+
+	if methods := f.recorder.Header().Get("Access-Control-Allow-Methods"); methods != "GET, PUT, PATCH, POST, DELETE" {
+		t.Fatalf("Expected default methods but got: %v", methods)
+	}
+}
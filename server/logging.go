@@ -0,0 +1,152 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel controls which requests are logged by the server.
+type LogLevel int
+
+const (
+	// LogLevelError logs requests that fail with a server error.
+	LogLevelError LogLevel = iota
+
+	// LogLevelInfo logs all requests.
+	LogLevelInfo
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelError:
+		return "error"
+	case LogLevelInfo:
+		return "info"
+	}
+	return "unknown"
+}
+
+// LogFields contains the structured fields describing a request handled by the
+// server. The fields include the request ID ("req_id"), the method
+// ("method"), the URL path ("path"), the response status code ("status"), the
+// number of bytes written in the response body ("bytes"), and the total
+// duration of the request in nanoseconds ("duration_ns"). If a query was
+// evaluated, the evaluation duration in nanoseconds ("eval_duration_ns") is
+// included as well.
+type LogFields map[string]interface{}
+
+// Logger defines the interface for receiving request logs from the server.
+// Loggers are called after each request is handled and must be safe for
+// concurrent use.
+type Logger interface {
+	Log(level LogLevel, fields LogFields)
+}
+
+// NewJSONLogger returns a Logger that writes each request log to w as a JSON
+// object on a single line.
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{enc: json.NewEncoder(w)}
+}
+
+type jsonLogger struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+func (l *jsonLogger) Log(level LogLevel, fields LogFields) {
+	record := make(map[string]interface{}, len(fields)+1)
+	for k, v := range fields {
+		record[k] = v
+	}
+	record["level"] = level.String()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.enc.Encode(record)
+}
+
+// loggingHandler wraps the server's router and logs each /v1 request to the
+// server's logger.
+type loggingHandler struct {
+	server *Server
+	inner  http.Handler
+}
+
+func (h *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if h.server.logger == nil || !strings.HasPrefix(r.URL.Path, "/v1/") {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+
+	t0 := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	h.inner.ServeHTTP(sw, r)
+
+	status := sw.status
+	if status == 0 {
+		status = 200
+	}
+
+	level := LogLevelInfo
+	if status >= 500 {
+		level = LogLevelError
+	}
+
+	if level > h.server.logLevel {
+		return
+	}
+
+	fields := LogFields{
+		"req_id":      w.Header().Get(RequestIDHeader),
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      status,
+		"bytes":       sw.bytes,
+		"duration_ns": time.Since(t0).Nanoseconds(),
+	}
+
+	if d, err := strconv.ParseInt(w.Header().Get(EvalDurationHeader), 10, 64); err == nil {
+		fields["eval_duration_ns"] = d
+	}
+
+	h.server.logger.Log(level, fields)
+}
+
+// statusWriter records the status code and number of bytes written in the
+// response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(bs []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(bs)
+	w.bytes += n
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+type recordingLogger struct {
+	levels  []LogLevel
+	records []LogFields
+}
+
+func (l *recordingLogger) Log(level LogLevel, fields LogFields) {
+	l.levels = append(l.levels, level)
+	l.records = append(l.records, fields)
+}
+
+func TestRequestLogging(t *testing.T) {
+
+	f := newFixture(t)
+	logger := &recordingLogger{}
+	f.server.WithLogger(logger, LogLevelInfo)
+
+	if err := f.v1("PUT", "/data/x", `{"a": 1}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x/a", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, httptest.NewRequest("GET", "/health", nil))
+
+	if len(logger.records) != 2 {
+		t.Fatalf("Expected exactly two records but got: %v", logger.records)
+	}
+
+	put, get := logger.records[0], logger.records[1]
+
+	if put["method"] != "PUT" || put["path"] != "/v1/data/x" || put["status"] != 201 || put["bytes"] != 0 || put["req_id"] == "" {
+		t.Fatalf("Unexpected record for PUT: %v", put)
+	}
+
+	if _, ok := put["eval_duration_ns"]; ok {
+		t.Fatalf("Expected no evaluation duration for PUT: %v", put)
+	}
+
+	if get["method"] != "GET" || get["path"] != "/v1/data/x/a" || get["status"] != 200 || get["bytes"] != 1 {
+		t.Fatalf("Unexpected record for GET: %v", get)
+	}
+
+	if _, ok := get["eval_duration_ns"].(int64); !ok {
+		t.Fatalf("Expected evaluation duration for GET: %v", get)
+	}
+
+	if logger.levels[0] != LogLevelInfo || logger.levels[1] != LogLevelInfo {
+		t.Fatalf("Expected info level records but got: %v", logger.levels)
+	}
+
+	logger = &recordingLogger{}
+	f.server.WithLogger(logger, LogLevelError)
+
+	if err := f.v1("GET", "/data/x/b", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.records) != 0 {
+		t.Fatalf("Expected no records at error level but got: %v", logger.records)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+
+	buf := bytes.NewBuffer(nil)
+	logger := NewJSONLogger(buf)
+	logger.Log(LogLevelInfo, LogFields{"method": "GET", "status": 200})
+	logger.Log(LogLevelError, LogFields{"method": "PUT", "status": 500})
+
+	expected := `{"level":"info","method":"GET","status":200}
+{"level":"error","method":"PUT","status":500}
+`
+
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%v\n\nGot:\n%v", expected, buf.String())
+	}
+}
@@ -0,0 +1,378 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the default upper bounds (in seconds) of histogram
+// buckets used for durations.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector writes metrics in the Prometheus text format. Collectors can be
+// registered with a Registry so that metrics kept elsewhere, e.g., in a
+// Prometheus client library registry, are exposed together with the
+// registry's metrics. Registry implements Collector so that registries can be
+// combined.
+type Collector interface {
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// Registry holds counters and histograms and exposes them in the Prometheus
+// text format. Embedders can provide their own Registry to the server so that
+// their metrics are exposed together with the server's metrics.
+type Registry struct {
+	mtx        sync.Mutex
+	families   map[string]metricFamily
+	collectors []Collector
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]metricFamily{}}
+}
+
+// Counter returns the counter with the given name, registering it if
+// necessary. The counter is partitioned by the given label names. Counter
+// panics if a metric with the same name but a different type or different
+// labels has already been registered.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	c := &Counter{metricDesc: newMetricDesc(name, help, labels), series: map[string]*counterSeries{}}
+	return r.register(c).(*Counter)
+}
+
+// Histogram returns the histogram with the given name, registering it if
+// necessary. Buckets are the upper bounds of the histogram buckets in
+// increasing order. If buckets is nil, DefaultBuckets is used. Histogram panics
+// if a metric with the same name but a different type or different labels has
+// already been registered.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{metricDesc: newMetricDesc(name, help, labels), buckets: buckets, series: map[string]*histogramSeries{}}
+	return r.register(h).(*Histogram)
+}
+
+// Register adds a collector to the registry. The collector's metrics are
+// written after the registry's own metrics. The caller is responsible for
+// avoiding metric name conflicts between the registry and its collectors.
+func (r *Registry) Register(c Collector) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes all registered metrics to w in the Prometheus text format.
+// Metrics are sorted by name and followed by the metrics of the registered
+// collectors in the order they were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	r.mtx.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]metricFamily, len(names))
+	for i, name := range names {
+		families[i] = r.families[name]
+	}
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mtx.Unlock()
+
+	var buf bytes.Buffer
+
+	for _, f := range families {
+		f.write(&buf)
+	}
+
+	for _, c := range collectors {
+		if _, err := c.WriteTo(&buf); err != nil {
+			return 0, err
+		}
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP writes the registry's metrics in the Prometheus text format. This
+// allows embedders to expose the server's metrics on their own endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		handleError(w, 500, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	buf.WriteTo(w)
+}
+
+func (r *Registry) register(f metricFamily) metricFamily {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	desc := f.desc()
+	if existing, ok := r.families[desc.name]; ok {
+		if fmt.Sprintf("%T", existing) != fmt.Sprintf("%T", f) || !existing.desc().sameLabels(desc) {
+			panic(fmt.Sprintf("metric %v already registered with different type or labels", desc.name))
+		}
+		return existing
+	}
+	r.families[desc.name] = f
+	return f
+}
+
+type metricFamily interface {
+	desc() *metricDesc
+	write(buf *bytes.Buffer)
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func newMetricDesc(name, help string, labels []string) *metricDesc {
+	return &metricDesc{name: name, help: help, labels: labels}
+}
+
+func (d *metricDesc) desc() *metricDesc {
+	return d
+}
+
+func (d *metricDesc) sameLabels(other *metricDesc) bool {
+	if len(d.labels) != len(other.labels) {
+		return false
+	}
+	for i := range d.labels {
+		if d.labels[i] != other.labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the key identifying the series with the given label values.
+func (d *metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %v expects %d label values but got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d *metricDesc) writeHeader(buf *bytes.Buffer, typ string) {
+	fmt.Fprintf(buf, "# HELP %v %v\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(buf, "# TYPE %v %v\n", d.name, typ)
+}
+
+// writeLabels writes the label pairs for the series with the given values. If
+// extra is non-empty, it is appended to the label pairs.
+func (d *metricDesc) writeLabels(buf *bytes.Buffer, values []string, extra string) {
+	if len(values) == 0 && extra == "" {
+		return
+	}
+	buf.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%v=\"%v\"", d.labels[i], escapeLabelValue(v))
+	}
+	if extra != "" {
+		if len(values) > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(extra)
+	}
+	buf.WriteByte('}')
+}
+
+// Counter is a metric whose value only increases.
+type Counter struct {
+	*metricDesc
+
+	// access to the series is guarded by mtx
+	mtx    sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+// Inc increments the series identified by the label values by one.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increments the series identified by the label values by delta. Add
+// panics if delta is negative.
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %v cannot decrease", c.name))
+	}
+	key := c.key(values)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	s.value += delta
+}
+
+func (c *Counter) write(buf *bytes.Buffer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.writeHeader(buf, "counter")
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := c.series[key]
+		buf.WriteString(c.name)
+		c.writeLabels(buf, s.values, "")
+		fmt.Fprintf(buf, " %v\n", formatFloat(s.value))
+	}
+}
+
+// Histogram is a metric that counts observations in buckets.
+type Histogram struct {
+	*metricDesc
+	buckets []float64
+
+	// access to the series is guarded by mtx
+	mtx    sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds an observation to the series identified by the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, ub := range h.buckets {
+		if v <= ub {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(buf *bytes.Buffer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.writeHeader(buf, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, ub := range h.buckets {
+			buf.WriteString(h.name + "_bucket")
+			h.writeLabels(buf, s.values, fmt.Sprintf("le=\"%v\"", formatFloat(ub)))
+			fmt.Fprintf(buf, " %d\n", s.counts[i])
+		}
+		buf.WriteString(h.name + "_bucket")
+		h.writeLabels(buf, s.values, `le="+Inf"`)
+		fmt.Fprintf(buf, " %d\n", s.count)
+		buf.WriteString(h.name + "_sum")
+		h.writeLabels(buf, s.values, "")
+		fmt.Fprintf(buf, " %v\n", formatFloat(s.sum))
+		buf.WriteString(h.name + "_count")
+		h.writeLabels(buf, s.values, "")
+		fmt.Fprintf(buf, " %d\n", s.count)
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+// httpMetrics contains the metrics recorded by the server.
+type httpMetrics struct {
+	registry     *Registry
+	requests     *Counter
+	errors       *Counter
+	evalDuration *Histogram
+}
+
+func newHTTPMetrics(registry *Registry) *httpMetrics {
+	return &httpMetrics{
+		registry:     registry,
+		requests:     registry.Counter("opa_http_requests_total", "Total number of requests handled by each /v1 route.", "route", "method"),
+		errors:       registry.Counter("opa_http_request_errors_total", "Total number of requests handled by each /v1 route that failed, by status class.", "route", "method", "class"),
+		evalDuration: registry.Histogram("opa_eval_duration_seconds", "Duration of query evaluation in seconds.", nil),
+	}
+}
+
+// observeRequest records a request handled by the route. If the status code
+// indicates an error, the error is recorded by status class, e.g., 4xx.
+func (m *httpMetrics) observeRequest(route, method string, status int) {
+	m.requests.Inc(route, method)
+	if status >= 400 {
+		m.errors.Inc(route, method, fmt.Sprintf("%dxx", status/100))
+	}
+}
+
+func (m *httpMetrics) observeEval(d time.Duration) {
+	m.evalDuration.Observe(d.Seconds())
+}
+
+func (s *Server) metricsGet(w http.ResponseWriter, r *http.Request) {
+	s.httpMetrics.registry.ServeHTTP(w, r)
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+
+	f := newFixture(t)
+	registry := NewRegistry()
+	f.server.WithMetricsRegistry(registry)
+
+	registry.Counter("embedder_events_total", "Events seen by the embedder.").Inc()
+
+	if err := f.v1("PUT", "/data/x", `{"a": 1}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x/a", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/policies/missing", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if f.recorder.Code != 200 || f.recorder.Header().Get("Content-Type") != "text/plain; version=0.0.4" {
+		t.Fatalf("Unexpected response: %v", f.recorder)
+	}
+
+	body := f.recorder.Body.String()
+
+	expected := []string{
+		"# TYPE embedder_events_total counter",
+		"embedder_events_total 1",
+		"# TYPE opa_http_requests_total counter",
+		`opa_http_requests_total{route="/v1/data/{path:.+}",method="PUT"} 1`,
+		`opa_http_requests_total{route="/v1/data/{path:.+}",method="GET"} 1`,
+		`opa_http_requests_total{route="/v1/policies/{id}",method="GET"} 1`,
+		`opa_http_request_errors_total{route="/v1/policies/{id}",method="GET",class="4xx"} 1`,
+		"# TYPE opa_eval_duration_seconds histogram",
+		`opa_eval_duration_seconds_bucket{le="+Inf"} 1`,
+		"opa_eval_duration_seconds_count 1",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q but got:\n%v", line, body)
+		}
+	}
+
+	if strings.Contains(body, `opa_http_request_errors_total{route="/v1/data/{path:.+}"`) {
+		t.Errorf("Expected no errors for data requests but got:\n%v", body)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+
+	r := NewRegistry()
+
+	c := r.Counter("requests_total", "Total requests.\nSecond line.", "path")
+	c.Inc(`/a"b`)
+	c.Add(2, `/a"b`)
+	c.Inc("/c")
+
+	if r.Counter("requests_total", "ignored", "path") != c {
+		t.Fatalf("Expected existing counter to be returned")
+	}
+
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# HELP requests_total Total requests.\nSecond line.
+# TYPE requests_total counter
+requests_total{path="/a\"b"} 3
+requests_total{path="/c"} 1
+`
+
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%v\nGot:\n%v", expected, buf.String())
+	}
+
+	// Registered collectors are written after the registry's metrics.
+	other := NewRegistry()
+	other.Counter("other_total", "Other.").Inc()
+	r.Register(other)
+
+	buf.Reset()
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected += `# HELP other_total Other.
+# TYPE other_total counter
+other_total 1
+`
+
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%v\nGot:\n%v", expected, buf.String())
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if rec.Code != 200 || rec.Body.String() != expected {
+		t.Fatalf("Expected metrics from handler but got %v:\n%v", rec.Code, rec.Body.String())
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected panic when registering counter with different labels")
+			}
+		}()
+		r.Counter("requests_total", "", "method")
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected panic when registering histogram with name of counter")
+			}
+		}()
+		r.Histogram("requests_total", "", nil, "path")
+	}()
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader is the name of the HTTP header used to correlate requests
+// handled by the server with the caller. If the header is not present on the
+// request, the server generates a new ID. The ID is always echoed in the
+// response.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request ID associated with the context.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+func newRequestID() string {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(bs)
+}
+
+// requestIDHandler wraps the server's handler and attaches a request ID to
+// each request's context and response.
+type requestIDHandler struct {
+	inner http.Handler
+}
+
+func (h *requestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+	h.inner.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+
+	var seen string
+
+	h := &requestIDHandler{inner: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = RequestIDFromContext(r.Context())
+	})}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "abc123")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	if seen != "abc123" {
+		t.Fatalf("Expected request ID in context to be abc123 but got: %q", seen)
+	}
+
+	if id := recorder.Header().Get(RequestIDHeader); id != "abc123" {
+		t.Fatalf("Expected request ID in response to be abc123 but got: %q", id)
+	}
+
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	id := recorder.Header().Get(RequestIDHeader)
+	if len(id) != 32 || id != seen {
+		t.Fatalf("Expected generated request ID in context and response but got: %q and %q", seen, id)
+	}
+}
+
+func TestRequestIDServer(t *testing.T) {
+	f := newFixture(t)
+	req := newReqV1("GET", "/policies", "")
+	req.Header.Set(RequestIDHeader, "deadbeef")
+	if err := f.executeRequest(req, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+	if id := f.recorder.Header().Get(RequestIDHeader); id != "deadbeef" {
+		t.Fatalf("Expected request ID to be echoed but got: %q", id)
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// inputSchema is a JSON schema that request documents are validated against
+// before queries are evaluated. A subset of JSON schema is supported. Schemas
+// that use keywords outside of the subset are rejected when they are
+// registered so that constraints are never silently ignored.
+type inputSchema struct {
+	raw                  interface{}
+	types                []string
+	enum                 []ast.Value
+	properties           map[string]*inputSchema
+	required             []string
+	additionalProperties *inputSchema
+	noAdditional         bool
+	items                *inputSchema
+	minimum              *float64
+	maximum              *float64
+	minLength            *int
+	maxLength            *int
+	minItems             *int
+	maxItems             *int
+}
+
+// schemaAnnotations are keywords that do not affect validation.
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+var schemaTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// newInputSchema returns the schema described by the JSON document x.
+func newInputSchema(x interface{}) (*inputSchema, error) {
+	schema, err := parseInputSchema(x, "")
+	if err != nil {
+		return nil, err
+	}
+	schema.raw = x
+	return schema, nil
+}
+
+func parseInputSchema(x interface{}, ptr string) (*inputSchema, error) {
+
+	obj, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema%v: must be an object", schemaPtrSuffix(ptr))
+	}
+
+	schema := &inputSchema{}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+
+		v := obj[k]
+		var err error
+
+		switch k {
+		case "type":
+			schema.types, err = parseSchemaTypes(v)
+		case "enum":
+			schema.enum, err = parseSchemaEnum(v)
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				err = fmt.Errorf("must be an object")
+				break
+			}
+			schema.properties = make(map[string]*inputSchema, len(props))
+			for name, prop := range props {
+				if schema.properties[name], err = parseInputSchema(prop, ptr+"/properties/"+escapeJSONPointer(name)); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			schema.required, err = parseSchemaStrings(v)
+		case "additionalProperties":
+			if b, ok := v.(bool); ok {
+				schema.noAdditional = !b
+				break
+			}
+			if schema.additionalProperties, err = parseInputSchema(v, ptr+"/additionalProperties"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if schema.items, err = parseInputSchema(v, ptr+"/items"); err != nil {
+				return nil, err
+			}
+		case "minimum":
+			schema.minimum, err = parseSchemaNumber(v)
+		case "maximum":
+			schema.maximum, err = parseSchemaNumber(v)
+		case "minLength":
+			schema.minLength, err = parseSchemaCount(v)
+		case "maxLength":
+			schema.maxLength, err = parseSchemaCount(v)
+		case "minItems":
+			schema.minItems, err = parseSchemaCount(v)
+		case "maxItems":
+			schema.maxItems, err = parseSchemaCount(v)
+		default:
+			if !schemaAnnotations[k] {
+				err = fmt.Errorf("keyword not supported")
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("schema%v: %v: %v", schemaPtrSuffix(ptr), k, err)
+		}
+	}
+
+	return schema, nil
+}
+
+func parseSchemaTypes(v interface{}) ([]string, error) {
+	var types []string
+	if s, ok := v.(string); ok {
+		types = []string{s}
+	} else {
+		var err error
+		if types, err = parseSchemaStrings(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range types {
+		if !schemaTypes[t] {
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+	}
+	return types, nil
+}
+
+func parseSchemaEnum(v interface{}) ([]ast.Value, error) {
+	xs, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be an array")
+	}
+	enum := make([]ast.Value, len(xs))
+	for i := range xs {
+		x, err := ast.InterfaceToValue(xs[i])
+		if err != nil {
+			return nil, err
+		}
+		enum[i] = x
+	}
+	return enum, nil
+}
+
+func parseSchemaStrings(v interface{}) ([]string, error) {
+	xs, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("must be an array of strings")
+	}
+	result := make([]string, len(xs))
+	for i := range xs {
+		s, ok := xs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("must be an array of strings")
+		}
+		result[i] = s
+	}
+	return result, nil
+}
+
+func parseSchemaNumber(v interface{}) (*float64, error) {
+	f, ok := schemaNumber(v)
+	if !ok {
+		return nil, fmt.Errorf("must be a number")
+	}
+	return &f, nil
+}
+
+func parseSchemaCount(v interface{}) (*int, error) {
+	f, ok := schemaNumber(v)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	n := int(f)
+	return &n, nil
+}
+
+// schemaError describes a location in a request document that does not match
+// the input schema. The path is a JSON pointer to the location.
+type schemaError struct {
+	Path    string
+	Message string
+}
+
+// validate returns the locations in the document that do not match the
+// schema. If the document matches the schema, the result is empty.
+func (s *inputSchema) validate(doc interface{}) []*schemaError {
+	var errs []*schemaError
+	s.validateRec(doc, "", &errs)
+	return errs
+}
+
+func (s *inputSchema) validateRec(doc interface{}, ptr string, errs *[]*schemaError) {
+
+	fail := func(f string, a ...interface{}) {
+		*errs = append(*errs, &schemaError{Path: ptr, Message: fmt.Sprintf(f, a...)})
+	}
+
+	if len(s.types) > 0 && !matchesSchemaTypes(doc, s.types) {
+		fail("expected %v but got %v", strings.Join(s.types, " or "), schemaTypeOf(doc))
+		return
+	}
+
+	if len(s.enum) > 0 {
+		v, err := ast.InterfaceToValue(doc)
+		found := false
+		for i := 0; err == nil && i < len(s.enum); i++ {
+			if ast.Compare(v, s.enum[i]) == 0 {
+				found = true
+			}
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := doc[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(doc))
+		for name := range doc {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			childPtr := ptr + "/" + escapeJSONPointer(name)
+			if prop, ok := s.properties[name]; ok {
+				prop.validateRec(doc[name], childPtr, errs)
+			} else if s.noAdditional {
+				*errs = append(*errs, &schemaError{Path: childPtr, Message: "additional property not allowed"})
+			} else if s.additionalProperties != nil {
+				s.additionalProperties.validateRec(doc[name], childPtr, errs)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(doc) < *s.minItems {
+			fail("expected at least %d items but got %d", *s.minItems, len(doc))
+		}
+		if s.maxItems != nil && len(doc) > *s.maxItems {
+			fail("expected at most %d items but got %d", *s.maxItems, len(doc))
+		}
+		if s.items != nil {
+			for i := range doc {
+				s.items.validateRec(doc[i], fmt.Sprintf("%v/%d", ptr, i), errs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(doc)
+		if s.minLength != nil && n < *s.minLength {
+			fail("expected at least %d characters but got %d", *s.minLength, n)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("expected at most %d characters but got %d", *s.maxLength, n)
+		}
+	default:
+		if f, ok := schemaNumber(doc); ok {
+			if s.minimum != nil && f < *s.minimum {
+				fail("expected value greater than or equal to %v", *s.minimum)
+			}
+			if s.maximum != nil && f > *s.maximum {
+				fail("expected value less than or equal to %v", *s.maximum)
+			}
+		}
+	}
+}
+
+func matchesSchemaTypes(doc interface{}, types []string) bool {
+	actual := schemaTypeOf(doc)
+	for _, t := range types {
+		if t == actual {
+			return true
+		}
+		if t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func schemaTypeOf(doc interface{}) string {
+	switch doc.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	}
+	if f, ok := schemaNumber(doc); ok {
+		if f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", doc)
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func schemaPtrSuffix(ptr string) string {
+	if ptr == "" {
+		return ""
+	}
+	return " at " + ptr
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapeJSONPointer(s string) string {
+	return jsonPointerEscaper.Replace(s)
+}
@@ -0,0 +1,248 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/util"
+)
+
+func TestInputSchemaValidate(t *testing.T) {
+
+	schema := `{
+		"type": "object",
+		"required": ["user", "action"],
+		"additionalProperties": false,
+		"properties": {
+			"user": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string", "minLength": 1},
+					"roles": {"type": "array", "items": {"enum": ["admin", "dev"]}, "maxItems": 2},
+					"a/b": {"type": "integer", "minimum": 0}
+				}
+			},
+			"action": {"type": ["string", "null"]},
+			"weight": {"type": "number", "maximum": 1.5}
+		}
+	}`
+
+	tests := []struct {
+		note     string
+		doc      string
+		expected []*schemaError
+	}{
+		{"valid", `{"user": {"name": "bob", "roles": ["dev"]}, "action": "read", "weight": 1}`, nil},
+		{"valid null", `{"user": {}, "action": null}`, nil},
+		{"wrong root type", `[]`, []*schemaError{{"", "expected object but got array"}}},
+		{"missing required", `{"user": {}}`, []*schemaError{{"", `missing required property "action"`}}},
+		{"additional", `{"user": {}, "action": "x", "extra": 1}`, []*schemaError{{"/extra", "additional property not allowed"}}},
+		{"nested", `{"user": {"name": "", "roles": ["dev", "ops", "admin"], "a/b": -1.5}, "action": 1, "weight": 2}`, []*schemaError{
+			{"/action", "expected string or null but got integer"},
+			{"/user/a~1b", "expected integer but got number"},
+			{"/user/name", "expected at least 1 characters but got 0"},
+			{"/user/roles", "expected at most 2 items but got 3"},
+			{"/user/roles/1", "value is not one of the allowed values"},
+			{"/weight", "expected value less than or equal to 1.5"},
+		}},
+	}
+
+	var raw interface{}
+	if err := util.UnmarshalJSON([]byte(schema), &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newInputSchema(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range tests {
+		var doc interface{}
+		if err := util.UnmarshalJSON([]byte(tc.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		errs := s.validate(doc)
+		if !reflect.DeepEqual(errs, tc.expected) {
+			t.Errorf("%v: Expected %v but got: %v", tc.note, schemaErrorsString(tc.expected), schemaErrorsString(errs))
+		}
+	}
+}
+
+func TestInputSchemaBad(t *testing.T) {
+
+	tests := []struct {
+		schema   string
+		expected string
+	}{
+		{`[]`, "schema: must be an object"},
+		{`{"type": "float"}`, `schema: type: unknown type "float"`},
+		{`{"pattern": "^a"}`, "schema: pattern: keyword not supported"},
+		{`{"properties": {"x": {"$ref": "#/y"}}}`, "schema at /properties/x: $ref: keyword not supported"},
+		{`{"items": {"minItems": -1}}`, "schema at /items: minItems: must be a non-negative integer"},
+		{`{"required": [1]}`, "schema: required: must be an array of strings"},
+	}
+
+	for _, tc := range tests {
+		var raw interface{}
+		if err := util.UnmarshalJSON([]byte(tc.schema), &raw); err != nil {
+			t.Fatal(err)
+		}
+		_, err := newInputSchema(raw)
+		if err == nil || err.Error() != tc.expected {
+			t.Errorf("%v: Expected error %q but got: %v", tc.schema, tc.expected, err)
+		}
+	}
+}
+
+func TestSchemasV1(t *testing.T) {
+
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/test", `package test
+	import request.user
+	p :- user = "alice"`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/data/users", `{"alice": "alice"}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	schema := `{"type": "object", "required": ["user"], "properties": {"user": {"type": "string"}}}`
+
+	if err := f.v1("PUT", "/schemas/test", schema, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/schemas/test", "", 200, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p?request=user:"alice"`, "", 200, "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p?request=user:data.users.alice`, "", 200, "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{
+		"Code": 400,
+		"Message": "request does not match input schema for /test",
+		"Errors": [{"Path": "/user", "Message": "expected string but got integer"}]
+	}`
+
+	if err := f.v1("GET", `/data/test/p?request=user:1`, "", 400, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/data/test/p", `{"input": {"user": 1}}`, 400, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/data/test/p", `{"input": {"user": "alice"}}`, 200, `{"result": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/batch/data/test/p", `[{"input": {"user": 1}}, {"input": {"user": "alice"}}]`, 200, `[
+		{"error": {
+			"Code": 400,
+			"Message": "request does not match input schema for /test",
+			"Errors": [{"Path": "/user", "Message": "expected string but got integer"}]
+		}},
+		{"result": true}
+	]`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/decision", `{"input": {"user": 1}, "paths": ["/test/p"]}`, 400, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/tenant", `package opa.acme.test
+	import request.user
+	p :- user = "alice"`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/schemas/opa/acme/test", schema, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/tenants/data/test/p?tenant=acme&request=user:"alice"`, "", 200, `{"acme": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/tenants/data/test/p?tenant=acme&request=user:1`, "", 400, `{
+		"Code": 400,
+		"Message": "request does not match input schema for /opa/acme/test",
+		"Errors": [{"Path": "/user", "Message": "expected string but got integer"}]
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p`, "", 400, `{
+		"Code": 400,
+		"Message": "request does not match input schema for /test",
+		"Errors": [{"Path": "", "Message": "missing required property \"user\""}]
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p?request=user:x`, "", 400, `{
+		"Code": 400,
+		"Message": "input schema for /test requires ground request values"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Schemas registered for the queried path take precedence.
+	if err := f.v1("PUT", "/schemas/test/p", `{}`, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p`, "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("DELETE", "/schemas/test/p", "", 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("DELETE", "/schemas/test", "", 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", `/data/test/p?request=user:1`, "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("DELETE", "/schemas/test", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/schemas/test", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/schemas/test", `{"pattern": "x"}`, 400, `{
+		"Code": 400,
+		"Message": "schema: pattern: keyword not supported"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func schemaErrorsString(errs []*schemaError) string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Path + ": " + errs[i].Message
+	}
+	return "[" + strings.Join(msgs, ", ") + "]"
+}
@@ -5,16 +5,27 @@
 package server
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/open-policy-agent/opa/ast"
@@ -26,10 +37,23 @@ import (
 	"github.com/pkg/errors"
 )
 
-// apiErrorV1 models an error response sent to the client.
+// apiErrorV1 models an error response sent to the client. If the error was
+// caused by a request parameter, the details identify the parameter.
 type apiErrorV1 struct {
 	Code    int
 	Message string
+	Details *paramErrorDetailsV1 `json:",omitempty"`
+}
+
+// paramErrorDetailsV1 identifies the request parameter that caused an error.
+// Part is either "path" or "value" and Offset is the byte offset in the
+// parameter value at which the parse error was located. If the error has no
+// location, Offset is the start of the part.
+type paramErrorDetailsV1 struct {
+	Parameter string
+	Value     string
+	Part      string
+	Offset    int
 }
 
 func (err *apiErrorV1) Bytes() []byte {
@@ -54,18 +78,113 @@ func (err *astErrorV1) Bytes() []byte {
 	return nil
 }
 
+// policyErrorV1 models a compile error that occurred while installing a
+// policy. Existing is true if the error is located in a module other than the
+// one being installed, i.e., the change would break a module that previously
+// compiled.
+type policyErrorV1 struct {
+	*ast.Error
+	Existing bool
+}
+
+// policyCompileErrorV1 models the error response sent to the client when a
+// policy cannot be installed because of compile errors.
+type policyCompileErrorV1 struct {
+	Code    int
+	Message string
+	Errors  []*policyErrorV1
+}
+
+func (err *policyCompileErrorV1) Bytes() []byte {
+	if bs, err := json.MarshalIndent(err, "", "  "); err == nil {
+		return bs
+	}
+	return nil
+}
+
 const compileModErrMsg = "error(s) occurred while compiling module(s), see Errors"
+const compileExistingModErrMsg = "error(s) occurred while compiling existing module(s) affected by this change, see Errors"
 const compileQueryErrMsg = "error(s) occurred while compiling query, see Errors"
+const patchErrMsg = "invalid patch operation(s), see Errors"
+const patchTestErrMsg = "patch test operation(s) failed, see Errors"
+
+// writeConflictErrorV1 models the error response sent to the client when a
+// write conflicts with a virtual document.
+type writeConflictErrorV1 struct {
+	Code    int
+	Message string
+	Rules   []*conflictingRuleV1
+}
+
+// conflictingRuleV1 identifies a rule that defines the virtual document a write
+// conflicted with.
+type conflictingRuleV1 struct {
+	Name     string
+	Location *ast.Location
+}
+
+// patchErrorV1 models the error response message for patches that contain
+// invalid operations.
+type patchErrorV1 struct {
+	Code    int
+	Message string
+	Errors  patchErrors
+}
+
+func (err *patchErrorV1) Bytes() []byte {
+	if bs, err := json.MarshalIndent(err, "", "  "); err == nil {
+		return bs
+	}
+	return nil
+}
+
+func (err *writeConflictErrorV1) Bytes() []byte {
+	if bs, err := json.MarshalIndent(err, "", "  "); err == nil {
+		return bs
+	}
+	return nil
+}
+
+// schemaErrorV1 models the error response sent to the client when the request
+// document does not match an input schema. Each error identifies a location in
+// the request document by JSON pointer.
+type schemaErrorV1 struct {
+	Code    int
+	Message string
+	Errors  []*schemaError
+}
+
+func (err *schemaErrorV1) Bytes() []byte {
+	if bs, err := json.MarshalIndent(err, "", "  "); err == nil {
+		return bs
+	}
+	return nil
+}
 
 // WriteConflictError represents an error condition raised if the caller
 // attempts to modify a virtual document or create a document at a path that
 // conflicts with an existing document.
 type WriteConflictError struct {
-	path storage.Path
+	path  storage.Path
+	rules []*ast.Rule
+}
+
+// Rules returns the rules that define the virtual document the write
+// conflicted with. If the write conflicted with a base document, the result is
+// empty.
+func (err WriteConflictError) Rules() []*ast.Rule {
+	return err.rules
 }
 
 func (err WriteConflictError) Error() string {
-	return fmt.Sprintf("write conflict: %v", err.path)
+	if len(err.rules) == 0 {
+		return fmt.Sprintf("write conflict: %v", err.path)
+	}
+	rule := err.rules[0]
+	if rule.Location == nil {
+		return fmt.Sprintf("write conflict: %v: virtual document defined by rule %v", err.path, rule.Name)
+	}
+	return fmt.Sprintf("write conflict: %v: virtual document defined by rule %v (%v:%v)", err.path, rule.Name, rule.Location.File, rule.Location.Row)
 }
 
 // IsWriteConflict returns true if the error indicates write conflict.
@@ -78,20 +197,107 @@ type badRequestError string
 
 // isBadRequest reqturns true if the error indicates a badly formatted request.
 func isBadRequest(err error) bool {
-	_, ok := err.(badRequestError)
-	return ok
+	switch err.(type) {
+	case badRequestError, *paramError:
+		return true
+	}
+	return false
 }
 
 func (err badRequestError) Error() string {
 	return string(err)
 }
 
-func badPatchOperationError(op string) badRequestError {
-	return badRequestError(fmt.Sprintf("bad patch operation: %v", op))
+// paramError represents a badly formatted request parameter. The details are
+// included in the error response sent to the client.
+type paramError struct {
+	err     error
+	details paramErrorDetailsV1
+}
+
+func newRequestParamError(value string, part string, offset int, err error) *paramError {
+	return &paramError{
+		err: err,
+		details: paramErrorDetailsV1{
+			Parameter: ParamRequestV1,
+			Value:     value,
+			Part:      part,
+			Offset:    offset,
+		},
+	}
+}
+
+func (err *paramError) Error() string {
+	return err.err.Error()
+}
+
+// inputSchemaError indicates that the request document does not match the
+// input schema registered for the path being queried.
+type inputSchemaError struct {
+	path string
+	errs []*schemaError
+}
+
+func (err *inputSchemaError) Error() string {
+	msgs := make([]string, len(err.errs))
+	for i := range err.errs {
+		msgs[i] = fmt.Sprintf("%v: %v", err.errs[i].Path, err.errs[i].Message)
+	}
+	return fmt.Sprintf("request does not match input schema for %v: %v", err.path, strings.Join(msgs, ", "))
+}
+
+// patchOpError identifies an invalid operation in a patch by its index.
+type patchOpError struct {
+	Index   int
+	Op      string
+	Path    string
+	Message string
+}
+
+func (err *patchOpError) Error() string {
+	return fmt.Sprintf("patch operation %d: %v", err.Index, err.Message)
+}
+
+// patchErrors represents the invalid operations found in a patch.
+type patchErrors []*patchOpError
+
+func (errs patchErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i := range errs {
+		msgs[i] = errs[i].Error()
+	}
+	return fmt.Sprintf("%d invalid patch operation(s): %v", len(errs), strings.Join(msgs, ", "))
+}
+
+func badPatchOperationError(i int, op patchV1) *patchOpError {
+	return &patchOpError{
+		Index:   i,
+		Op:      op.Op,
+		Path:    op.Path,
+		Message: fmt.Sprintf("bad patch operation: %v", op.Op),
+	}
+}
+
+func failedPatchTestError(i int, op patchV1) *patchOpError {
+	return &patchOpError{
+		Index:   i,
+		Op:      op.Op,
+		Path:    op.Path,
+		Message: fmt.Sprintf("test failed: document at %v does not match value", op.Path),
+	}
+}
+
+func badPatchPathError(i int, op patchV1) *patchOpError {
+	return &patchOpError{
+		Index:   i,
+		Op:      op.Op,
+		Path:    op.Path,
+		Message: fmt.Sprintf("bad patch path: %v", op.Path),
+	}
 }
 
-func badPatchPathError(path string) badRequestError {
-	return badRequestError(fmt.Sprintf("bad patch path: %v", path))
+func badAppendPathError(path storage.Path) badRequestError {
+	return badRequestError(fmt.Sprintf("bad append path: %v is not an array", path))
 }
 
 // patchV1 models a single patch operation against a document.
@@ -101,10 +307,214 @@ type patchV1 struct {
 	Value interface{} `json:"value"`
 }
 
+// MarshalJSON omits the value of remove operations. The value of other
+// operations is always included, even if it is null.
+func (p patchV1) MarshalJSON() ([]byte, error) {
+	if p.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{p.Op, p.Path})
+	}
+	type patch patchV1
+	return json.Marshal(patch(p))
+}
+
+// dataDiffV1 models the response message for Data API write operations that
+// include the "diff" parameter. The patch describes the changes made to the
+// existing document. Paths are JSON pointers (RFC 6901).
+type dataDiffV1 struct {
+	Changed bool
+	Patch   []patchV1
+}
+
+func (d *dataDiffV1) add(path string, value interface{}) {
+	d.Changed = true
+	d.Patch = append(d.Patch, patchV1{Op: "add", Path: path, Value: value})
+}
+
+func (d *dataDiffV1) remove(path string) {
+	d.Changed = true
+	d.Patch = append(d.Patch, patchV1{Op: "remove", Path: path})
+}
+
+func (d *dataDiffV1) replace(path string, value interface{}) {
+	d.Changed = true
+	d.Patch = append(d.Patch, patchV1{Op: "replace", Path: path, Value: value})
+}
+
+// compare records the operations required to transform a into b. Objects are
+// compared key by key. All other values, including arrays, are replaced
+// entirely if they differ.
+func (d *dataDiffV1) compare(path string, a, b interface{}) {
+
+	objA, okA := a.(map[string]interface{})
+	objB, okB := b.(map[string]interface{})
+
+	if !okA || !okB {
+		if util.Compare(a, b) != 0 {
+			d.replace(path, b)
+		}
+		return
+	}
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+
+	keys := make([]string, 0, len(objA)+len(objB))
+	for k := range objA {
+		keys = append(keys, k)
+	}
+	for k := range objB {
+		if _, ok := objA[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		va, okA := objA[k]
+		vb, okB := objB[k]
+		switch {
+		case !okB:
+			d.remove(prefix + escapeJSONPointer(k))
+		case !okA:
+			d.add(prefix+escapeJSONPointer(k), vb)
+		default:
+			d.compare(prefix+escapeJSONPointer(k), va, vb)
+		}
+	}
+}
+
+// jsonPointer returns the JSON pointer that refers to path.
+func jsonPointer(path storage.Path) string {
+	var buf bytes.Buffer
+	for i := range path {
+		buf.WriteByte('/')
+		buf.WriteString(escapeJSONPointer(path[i]))
+	}
+	return buf.String()
+}
+
 // policyV1 models a policy module in OPA.
 type policyV1 struct {
-	ID     string
-	Module *ast.Module
+	ID      string
+	Module  *ast.Module
+	Summary *policySummaryV1 `json:",omitempty"`
+}
+
+// ruleSummaryV1 models a rule defined by a policy module. The path refers to
+// the document that the rule defines.
+type ruleSummaryV1 struct {
+	Name     string        `json:"name"`
+	Path     string        `json:"path"`
+	Location *ast.Location `json:"location"`
+}
+
+// policyPageV1 models the response message for policy lists requested with a
+// limit or offset. If more policies are available, next is the offset of the
+// next page.
+type policyPageV1 struct {
+	Result []*policyV1 `json:"result"`
+	Next   *int        `json:"next,omitempty"`
+}
+
+// policySummaryV1 models the size of a policy module.
+type policySummaryV1 struct {
+	Rules   int
+	Imports int
+	Lines   int
+}
+
+func newPolicySummaryV1(parsed *ast.Module, compiled *ast.Module, raw []byte) *policySummaryV1 {
+	lines := bytes.Count(raw, []byte("\n"))
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		lines++
+	}
+	return &policySummaryV1{
+		Rules:   len(compiled.Rules),
+		Imports: len(parsed.Imports),
+		Lines:   lines,
+	}
+}
+
+// policyDiffV1 models the response message for Policy API diff operations. The
+// lists contain the names of rules that would be added, removed, or modified if
+// the proposed module was stored.
+type policyDiffV1 struct {
+	ID       string
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+func newPolicyDiffV1(id string, current, proposed *ast.Module) *policyDiffV1 {
+
+	diff := &policyDiffV1{
+		ID:       id,
+		Added:    []string{},
+		Removed:  []string{},
+		Modified: []string{},
+	}
+
+	curr := rulesByName(current)
+	prop := rulesByName(proposed)
+
+	for name, rules := range prop {
+		other, ok := curr[name]
+		if !ok {
+			diff.Added = append(diff.Added, string(name))
+		} else if !rulesEqual(rules, other) {
+			diff.Modified = append(diff.Modified, string(name))
+		}
+	}
+
+	for name := range curr {
+		if _, ok := prop[name]; !ok {
+			diff.Removed = append(diff.Removed, string(name))
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+
+	return diff
+}
+
+// rulesByName returns the rules in the module grouped by name. Each group is
+// sorted so that groups can be compared regardless of the order in which rules
+// were defined.
+func rulesByName(mod *ast.Module) map[ast.Var][]*ast.Rule {
+	result := map[ast.Var][]*ast.Rule{}
+	if mod == nil {
+		return result
+	}
+	for _, rule := range mod.Rules {
+		result[rule.Name] = append(result[rule.Name], rule)
+	}
+	for _, rules := range result {
+		sort.Sort(ruleSlice(rules))
+	}
+	return result
+}
+
+type ruleSlice []*ast.Rule
+
+func (s ruleSlice) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
+func (s ruleSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s ruleSlice) Len() int           { return len(s) }
+
+func rulesEqual(a, b []*ast.Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 func (p *policyV1) Equal(other *policyV1) bool {
@@ -118,23 +528,289 @@ type adhocQueryResultSetV1 []map[string]interface{}
 // return multiple values for the document.
 type queryResultSetV1 []*queryResultV1
 
+// newQueryResultSetV1 returns a new queryResultSetV1 for the query results. If
+// the results include traces, each result is assigned a trace ID that
+// identifies its trace.
 func newQueryResultSetV1(qrs topdown.QueryResultSet) queryResultSetV1 {
 	result := make(queryResultSetV1, len(qrs))
 	for i := range qrs {
-		result[i] = &queryResultV1{qrs[i].Result, qrs[i].Bindings}
+		result[i] = &queryResultV1{result: qrs[i].Result, bindings: qrs[i].Bindings}
+		if qrs[i].Trace != nil {
+			result[i].traceID = strconv.Itoa(i)
+		}
 	}
 	return result
 }
 
+// explainedQueryResultSetV1 models the result of a Data API query that would
+// return multiple values for the document when an explanation is requested.
+// The traces are keyed by the trace IDs of the results.
+type explainedQueryResultSetV1 struct {
+	Results queryResultSetV1
+	Traces  map[string]interface{}
+}
+
+func newExplainedQueryResultSetV1(compiler *ast.Compiler, qrs topdown.QueryResultSet, explainMode explainModeV1, traceFilter traceFilterV1) *explainedQueryResultSetV1 {
+
+	results := newQueryResultSetV1(qrs)
+	traces := make(map[string]interface{}, len(qrs))
+
+	for i := range qrs {
+		switch explainMode {
+		case explainFullV1:
+			traces[results[i].traceID] = newFilteredTraceV1(qrs[i].Trace, traceFilter)
+		case explainTruthV1:
+			traces[results[i].traceID] = newTruthExplanationV1(compiler, qrs[i].Trace)
+		case explainNotesV1:
+			traces[results[i].traceID] = newNotesV1(qrs[i].Trace)
+		}
+	}
+
+	return &explainedQueryResultSetV1{
+		Results: results,
+		Traces:  traces,
+	}
+}
+
+// newTruthExplanationV1 returns the truth explanation for the trace. If the
+// trace cannot be reduced, the full trace is returned with a warning event
+// prepended so that callers still receive debugging information.
+func newTruthExplanationV1(compiler *ast.Compiler, trace []*topdown.Event) traceV1 {
+	answer, err := explain.Truth(compiler, trace)
+	if err != nil {
+		warning := traceEventV1{
+			Op:      traceWarningOpV1,
+			Locals:  bindingsV1{},
+			Message: fmt.Sprintf("truth explanation not available, returning full explanation: %v", err),
+		}
+		return append(traceV1{warning}, newTraceV1(trace)...)
+	}
+	return newTraceV1(answer)
+}
+
+// dataResponseV1 models the response message for Data API POST operations.
+type dataResponseV1 struct {
+	Result interface{} `json:"result"`
+}
+
+// batchResultV1 models the result of one element of a batch evaluation.
+// Result is a pointer so that a null result is distinguished from an omitted
+// one. Undefined is true if the document is undefined for the element's input.
+// The error is set if the element could not be evaluated.
+type batchResultV1 struct {
+	Result    *interface{} `json:"result,omitempty"`
+	Undefined bool         `json:"undefined,omitempty"`
+	Error     errorV1      `json:"error,omitempty"`
+}
+
+// batchDeleteResponseV1 models the response message for batch deletions. The
+// missing and conflicting paths were skipped.
+type batchDeleteResponseV1 struct {
+	Missing   []string `json:"missing"`
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// queryRequestV1 models the request message for ad-hoc queries submitted in
+// the request body.
+type queryRequestV1 struct {
+	Query   string `json:"query"`
+	Explain string `json:"explain"`
+	Pretty  bool   `json:"pretty"`
+}
+
+// compileRequestV1 models the request message for partial evaluation. The
+// unknowns are references to documents that are not known when the query is
+// compiled, e.g., "request.user".
+type compileRequestV1 struct {
+	Query    string      `json:"query"`
+	Input    interface{} `json:"input"`
+	Unknowns []string    `json:"unknowns"`
+}
+
+// compileResponseV1 models the response message for partial evaluation. The
+// query is true if any of the residual queries is true. If the residual is
+// rendered as a policy module, the module is returned instead of the queries.
+type compileResponseV1 struct {
+	Queries interface{} `json:"queries,omitempty"`
+	Module  string      `json:"module,omitempty"`
+}
+
+// compileFormatV1 defines supported values for the "format" query parameter
+// of partial evaluation requests.
+type compileFormatV1 string
+
+const (
+	compileFormatTextV1 compileFormatV1 = "text"
+	compileFormatASTV1  compileFormatV1 = "ast"
+	compileFormatRegoV1 compileFormatV1 = "rego"
+)
+
+// residualPackageV1 and residualRuleV1 name the package and rule of policy
+// modules rendered from residual queries.
+var (
+	residualPackageV1 = ast.DefaultRootRef.Append(ast.StringTerm("partial"))
+	residualRuleV1    = ast.Var("residual")
+)
+
+// newResidualModuleV1 returns a policy module that defines one rule for each of
+// the residual queries. The rule is true if any of the residual queries is
+// true. Empty residual queries are rendered as "true" so that the module can
+// be parsed.
+func newResidualModuleV1(bodies []ast.Body) *ast.Module {
+	mod := &ast.Module{Package: &ast.Package{Path: residualPackageV1}}
+	for _, body := range bodies {
+		if len(body) == 0 {
+			body = ast.NewBody(ast.NewExpr(ast.BooleanTerm(true)))
+		}
+		mod.Rules = append(mod.Rules, &ast.Rule{
+			Name:  residualRuleV1,
+			Value: ast.BooleanTerm(true),
+			Body:  body,
+		})
+	}
+	return mod
+}
+
+// decisionRequestV1 models the request message for aggregated decisions. The
+// decisions at the paths are combined into a single boolean decision.
+type decisionRequestV1 struct {
+	Input   interface{} `json:"input"`
+	Paths   []string    `json:"paths"`
+	Deny    []string    `json:"deny"`
+	Combine string      `json:"combine"`
+}
+
+// decisionResponseV1 models the response message for aggregated decisions.
+// The decisions contain the value of each path or null if the path was
+// undefined.
+type decisionResponseV1 struct {
+	Result    bool                   `json:"result"`
+	Decisions map[string]interface{} `json:"decisions"`
+}
+
+// Supported values for the "combine" field of aggregated decision requests.
+const (
+	combineAllTrueV1       = "all-true"
+	combineAnyTrueV1       = "any-true"
+	combineDenyOverridesV1 = "deny-overrides"
+)
+
+// namedQuery represents a compiled query template registered with the server.
+// The first len(params) expressions of the body bind the parameters to
+// placeholder values that are replaced when the query is executed.
+type namedQuery struct {
+	params []ast.Var
+	body   ast.Body
+}
+
+// versionV1 models the response message for Version API queries.
+type versionV1 struct {
+	Version        string `json:"version"`
+	BuildCommit    string `json:"build_commit"`
+	BuildTimestamp string `json:"build_timestamp"`
+	BuildHostname  string `json:"build_hostname"`
+	GoVersion      string `json:"go_version"`
+}
+
+// versionsV1 models the response message for API version discovery. The
+// server version is described the same way as by the Version API.
+type versionsV1 struct {
+	versionV1
+	APIVersions []apiVersionV1 `json:"api_versions"`
+}
+
+// apiVersionV1 describes a version of the API mounted by the server.
+type apiVersionV1 struct {
+	Version string    `json:"version"`
+	Prefix  string    `json:"prefix"`
+	Routes  []routeV1 `json:"routes"`
+}
+
+// routeV1 describes a route mounted by the server. Path variables are
+// described by their names and patterns, e.g., /v1/policies/{id}.
+type routeV1 struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+type routeSliceV1 []routeV1
+
+func (s routeSliceV1) Less(i, j int) bool {
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	return s[i].Method < s[j].Method
+}
+
+func (s routeSliceV1) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s routeSliceV1) Len() int      { return len(s) }
+
+// metricsResultV1 models the response message for queries executed with
+// metrics enabled.
+type metricsResultV1 struct {
+	Result  interface{}      `json:"result"`
+	Metrics map[string]int64 `json:"metrics"`
+}
+
+func newMetricsResultV1(result interface{}, counters *topdown.Counters) metricsResultV1 {
+	return metricsResultV1{
+		Result: result,
+		Metrics: map[string]int64{
+			"counter_store_reads":  int64(counters.StoreReads),
+			"counter_store_writes": int64(counters.StoreWrites),
+		},
+	}
+}
+
+// echoQueryResultV1 models the response message for queries executed with the
+// "echo_query" parameter. The query is the query string that produced the
+// result.
+type echoQueryResultV1 struct {
+	Query  string      `json:"query"`
+	Result interface{} `json:"result"`
+}
+
+// truncatedResultV1 models the response message for queries executed with a
+// result limit. If evaluation stopped before all results were produced, the
+// result is marked as truncated.
+type truncatedResultV1 struct {
+	Result    interface{} `json:"result"`
+	Truncated bool        `json:"truncated"`
+}
+
+// annotatedResultV1 models the response message for Data API queries that
+// include the "echo_input", "types", or "debug_source" parameters. The input is
+// the request document that the query was evaluated with. The types describe
+// the result. The sources indicate whether the result (or its top-level keys)
+// came from base or virtual documents.
+type annotatedResultV1 struct {
+	Input   interface{} `json:"input,omitempty"`
+	Result  interface{} `json:"result"`
+	Types   interface{} `json:"types,omitempty"`
+	Sources interface{} `json:"sources,omitempty"`
+}
+
+// Values of the "sources" field in annotated results.
+const (
+	sourceBaseV1    = "base"
+	sourceVirtualV1 = "virtual"
+	sourceMixedV1   = "mixed"
+)
+
 // queryResultV1 models a single result of a Data API query that would return
 // multiple values for the document. The bindings can be used to differentiate
-// between results.
+// between results. If an explanation was requested, the trace ID identifies the
+// result's trace.
 type queryResultV1 struct {
 	result   interface{}
 	bindings map[string]interface{}
+	traceID  string
 }
 
 func (qr *queryResultV1) MarshalJSON() ([]byte, error) {
+	if qr.traceID != "" {
+		return json.Marshal([]interface{}{qr.result, qr.bindings, qr.traceID})
+	}
 	return json.Marshal([]interface{}{qr.result, qr.bindings})
 }
 
@@ -145,6 +821,15 @@ const (
 	explainOffV1   explainModeV1 = "off"
 	explainFullV1  explainModeV1 = "full"
 	explainTruthV1 explainModeV1 = "truth"
+	explainNotesV1 explainModeV1 = "notes"
+)
+
+// numberFormatV1 defines supported values for the "numbers" query parameter.
+type numberFormatV1 string
+
+const (
+	numberFormatNumberV1 numberFormatV1 = "number"
+	numberFormatStringV1 numberFormatV1 = "string"
 )
 
 // traceV1 models the trace result returned for queries that include the
@@ -171,33 +856,129 @@ func newTraceV1(trace []*topdown.Event) (result traceV1) {
 			Type:     typ,
 			Node:     trace[i].Node,
 			Locals:   newBindingsV1(trace[i].Locals),
+			Message:  trace[i].Message(),
 		}
 	}
 	return result
 }
 
-// nodeTypeV1 defines supported types for the trace event nodes.
-type nodeTypeV1 string
-
-const (
-	nodeTypeRuleV1 nodeTypeV1 = "rule"
-	nodeTypeBodyV1 nodeTypeV1 = "body"
-	nodeTypeExprV1 nodeTypeV1 = "expr"
-)
+// newNotesV1 returns the note events contained in the trace.
+func newNotesV1(trace []*topdown.Event) traceV1 {
+	notes := []*topdown.Event{}
+	for _, evt := range trace {
+		if evt.Op == topdown.NoteOp {
+			notes = append(notes, evt)
+		}
+	}
+	return newTraceV1(notes)
+}
 
-// traceEventV1 represents a step in the query evaluation process.
-type traceEventV1 struct {
-	Op       string
-	QueryID  uint64
-	ParentID uint64
-	Type     nodeTypeV1
-	Node     interface{}
-	Locals   bindingsV1
+// traceFilterV1 controls which events are included in full explanations. If
+// ops is nil, events are not filtered by operation. If maxDepth or maxEvents is
+// zero, the trace is not limited by depth or number of events respectively.
+type traceFilterV1 struct {
+	ops       map[topdown.Op]bool
+	maxDepth  int
+	maxEvents int
 }
 
-func (te *traceEventV1) UnmarshalJSON(bs []byte) error {
+// traceTruncatedOpV1 is the operation of the event appended to traces that
+// were truncated by a traceFilterV1.
+const traceTruncatedOpV1 = "Truncated"
 
-	keys := map[string]json.RawMessage{}
+// traceWarningOpV1 is the operation of the event prepended to truth
+// explanations that fell back to the full trace.
+const traceWarningOpV1 = "Warning"
+
+// newFilteredTraceV1 returns the trace events that are selected by f. The
+// depth of an event is the number of queries enclosing the event's query,
+// starting at 1 for the top-level query. Events are filtered before they are
+// converted so that omitted events do not cost anything. If events are omitted
+// because of the depth or event limits, an event is appended to indicate that
+// the trace was truncated.
+func newFilteredTraceV1(trace []*topdown.Event, f traceFilterV1) traceV1 {
+
+	if f.ops == nil && f.maxDepth <= 0 && f.maxEvents <= 0 {
+		return newTraceV1(trace)
+	}
+
+	selected := []*topdown.Event{}
+	depths := map[uint64]int{}
+	omitted := 0
+
+	for _, evt := range trace {
+
+		depth, ok := depths[evt.QueryID]
+		if !ok {
+			depth = 1
+			if parent, ok := depths[evt.ParentID]; ok && evt.ParentID != evt.QueryID {
+				depth = parent + 1
+			}
+			depths[evt.QueryID] = depth
+		}
+
+		if f.ops != nil && !f.ops[evt.Op] {
+			continue
+		}
+
+		if (f.maxDepth > 0 && depth > f.maxDepth) || (f.maxEvents > 0 && len(selected) >= f.maxEvents) {
+			omitted++
+			continue
+		}
+
+		selected = append(selected, evt)
+	}
+
+	result := newTraceV1(selected)
+
+	if omitted > 0 {
+		result = append(result, traceEventV1{
+			Op:      traceTruncatedOpV1,
+			Locals:  bindingsV1{},
+			Message: fmt.Sprintf("trace truncated: %d events omitted", omitted),
+		})
+	}
+
+	return result
+}
+
+// limited returns the trace with an event appended to indicate that evaluation
+// stopped at the result limit if ok is true. Otherwise, the trace is returned
+// unchanged.
+func (t traceV1) limited(ok bool) traceV1 {
+	if !ok {
+		return t
+	}
+	return append(t, traceEventV1{
+		Op:      traceTruncatedOpV1,
+		Locals:  bindingsV1{},
+		Message: "trace truncated: evaluation stopped at result limit",
+	})
+}
+
+// nodeTypeV1 defines supported types for the trace event nodes.
+type nodeTypeV1 string
+
+const (
+	nodeTypeRuleV1 nodeTypeV1 = "rule"
+	nodeTypeBodyV1 nodeTypeV1 = "body"
+	nodeTypeExprV1 nodeTypeV1 = "expr"
+)
+
+// traceEventV1 represents a step in the query evaluation process.
+type traceEventV1 struct {
+	Op       string
+	QueryID  uint64
+	ParentID uint64
+	Type     nodeTypeV1
+	Node     interface{}
+	Locals   bindingsV1
+	Message  string `json:",omitempty"`
+}
+
+func (te *traceEventV1) UnmarshalJSON(bs []byte) error {
+
+	keys := map[string]json.RawMessage{}
 
 	if err := util.UnmarshalJSON(bs, &keys); err != nil {
 		return err
@@ -219,6 +1000,12 @@ func (te *traceEventV1) UnmarshalJSON(bs []byte) error {
 		return err
 	}
 
+	if msg, ok := keys["Message"]; ok {
+		if err := util.UnmarshalJSON(msg, &te.Message); err != nil {
+			return err
+		}
+	}
+
 	switch te.Type {
 	case nodeTypeBodyV1:
 		var body ast.Body
@@ -272,14 +1059,28 @@ type patchImpl struct {
 	path  storage.Path
 	op    storage.PatchOp
 	value interface{}
+	test  bool
 }
 
 const (
 	// ParamRequestV1 defines the name of the HTTP URL parameter that specifies
 	// values for the "request" document.
 	ParamRequestV1 = "request"
+
+	// ParamTenantV1 defines the name of the HTTP URL parameter that specifies
+	// the tenants to evaluate a query for.
+	ParamTenantV1 = "tenant"
+
+	// EvalDurationHeader is the name of the HTTP response header that reports
+	// how long query evaluation took in nanoseconds. The duration does not
+	// include parsing the request or serializing the response.
+	EvalDurationHeader = "X-OPA-Eval-Duration-Ns"
 )
 
+// tenantRootV1 defines the base document under which each tenant's data and
+// policies are rooted, i.e., data.opa.<tenant>.
+const tenantRootV1 = "opa"
+
 // Server represents an instance of OPA running in server mode.
 type Server struct {
 	Handler http.Handler
@@ -292,33 +1093,166 @@ type Server struct {
 	compiler *ast.Compiler
 
 	store *storage.Storage
+
+	// access to the input profiles is guarded by profilesMtx
+	profilesMtx sync.RWMutex
+	profiles    map[string]interface{}
+
+	// access to the input schemas is guarded by schemasMtx. Schemas are keyed
+	// by the slash separated path of the document they apply to.
+	schemasMtx sync.RWMutex
+	schemas    map[string]*inputSchema
+
+	// access to the named queries is guarded by queriesMtx
+	queriesMtx sync.RWMutex
+	queries    map[string]*namedQuery
+
+	// access to the readiness flag is guarded by readyMtx
+	readyMtx  sync.Mutex
+	ready     bool
+	readyPath storage.Path
+
+	authorizer    Authorizer
+	strictImports bool
+	healthQuery   ast.Body
+	foldPaths     bool
+	memoryLimit   int64
+	depthLimit    int
+	evalTimeout   time.Duration
+
+	maxRequestParams int
+
+	// builtin functions that policies and queries may call. If allowedBuiltins
+	// is nil, all builtins not in deniedBuiltins are allowed.
+	allowedBuiltins map[ast.Var]bool
+	deniedBuiltins  map[ast.Var]bool
+
+	builtinOverrides bool
+
+	spanExporter SpanExporter
+
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	maxHeaderBytes int
+
+	maxRequestBodyBytes int64
+
+	compressionThreshold int
+
+	responseBufferMaxPooledSize int
+
+	logger   Logger
+	logLevel LogLevel
+
+	cors *corsConfig
+
+	watchers *watchers
+
+	httpMetrics *httpMetrics
+
+	// routes mounted by registerHandlerV1
+	routesV1 []routeV1
+
+	// access to the HTTP server is guarded by srvMtx
+	srvMtx sync.Mutex
+	srv    *http.Server
 }
 
+// defaultMaxRequestParams is the default maximum number of request parameters
+// accepted by the server.
+const defaultMaxRequestParams = 1000
+
+// Default connection settings applied to the HTTP server. The timeouts prevent
+// slow or idle clients from holding connections open indefinitely.
+const (
+	defaultReadTimeout    = 30 * time.Second
+	defaultWriteTimeout   = 60 * time.Second
+	defaultIdleTimeout    = 120 * time.Second
+	defaultMaxHeaderBytes = 1 << 20
+)
+
+// defaultMaxRequestBodyBytes is the default maximum size of request bodies
+// accepted by the server.
+const defaultMaxRequestBodyBytes = 64 << 20
+
+// defaultHealthQuery is the canary query evaluated by health checks that
+// request it.
+var defaultHealthQuery = ast.MustParseBody("data.system.health")
+
 // New returns a new Server.
 func New(ctx context.Context, store *storage.Storage, addr string, persist bool) (*Server, error) {
 
 	s := &Server{
-		addr:    addr,
-		persist: persist,
-		store:   store,
+		addr:             addr,
+		persist:          persist,
+		store:            store,
+		profiles:         map[string]interface{}{},
+		schemas:          map[string]*inputSchema{},
+		queries:          map[string]*namedQuery{},
+		authorizer:       AllowAllAuthorizer{},
+		healthQuery:      defaultHealthQuery,
+		ready:            true,
+		maxRequestParams: defaultMaxRequestParams,
+		readTimeout:      defaultReadTimeout,
+		writeTimeout:     defaultWriteTimeout,
+		idleTimeout:      defaultIdleTimeout,
+		maxHeaderBytes:   defaultMaxHeaderBytes,
+
+		maxRequestBodyBytes: defaultMaxRequestBodyBytes,
+
+		compressionThreshold: defaultCompressionThreshold,
+
+		responseBufferMaxPooledSize: defaultResponseBufferMaxPooledSize,
 	}
 
+	s.watchers = newWatchers(s)
+	s.httpMetrics = newHTTPMetrics(NewRegistry())
+
 	// Initialize HTTP handlers.
 	router := mux.NewRouter()
+	s.registerHandlerV1(router, "/batch/delete", "POST", s.v1DataBatchDelete)
+	s.registerHandlerV1(router, "/batch/data/{path:.+}", "POST", s.v1DataBatchPost)
+	s.registerHandlerV1(router, "/compile", "POST", s.v1CompilePost)
 	s.registerHandlerV1(router, "/data/{path:.+}", "PUT", s.v1DataPut)
 	s.registerHandlerV1(router, "/data", "PUT", s.v1DataPut)
 	s.registerHandlerV1(router, "/data/{path:.+}", "GET", s.v1DataGet)
 	s.registerHandlerV1(router, "/data", "GET", s.v1DataGet)
 	s.registerHandlerV1(router, "/data/{path:.+}", "PATCH", s.v1DataPatch)
+	s.registerHandlerV1(router, "/data/{path:.+}", "DELETE", s.v1DataDelete)
+	s.registerHandlerV1(router, "/decision", "POST", s.v1DecisionPost)
+	s.registerHandlerV1(router, "/data/{path:.+}", "POST", s.v1DataPost)
 	s.registerHandlerV1(router, "/data", "PATCH", s.v1DataPatch)
 	s.registerHandlerV1(router, "/policies", "GET", s.v1PoliciesList)
+	s.registerHandlerV1(router, "/policies/compile", "POST", s.v1PoliciesCompile)
+	s.registerHandlerV1(router, "/policies/export", "GET", s.v1PoliciesExport)
+	s.registerHandlerV1(router, "/policies/reload", "POST", s.v1PoliciesReload)
 	s.registerHandlerV1(router, "/policies/{id}", "DELETE", s.v1PoliciesDelete)
 	s.registerHandlerV1(router, "/policies/{id}", "GET", s.v1PoliciesGet)
 	s.registerHandlerV1(router, "/policies/{id}/raw", "GET", s.v1PoliciesRawGet)
+	s.registerHandlerV1(router, "/policies/{id}/rules", "GET", s.v1PoliciesRulesGet)
+	s.registerHandlerV1(router, "/policies/{id}/diff", "POST", s.v1PoliciesDiff)
+	s.registerHandlerV1(router, "/policies/{id}/query", "GET", s.v1PoliciesQuery)
+	s.registerHandlerV1(router, "/policies", "PUT", s.v1PoliciesPutBulk)
 	s.registerHandlerV1(router, "/policies/{id}", "PUT", s.v1PoliciesPut)
+	s.registerHandlerV1(router, "/profiles/{name}", "DELETE", s.v1ProfilesDelete)
+	s.registerHandlerV1(router, "/profiles/{name}", "GET", s.v1ProfilesGet)
+	s.registerHandlerV1(router, "/profiles/{name}", "PUT", s.v1ProfilesPut)
+	s.registerHandlerV1(router, "/queries/{name}", "DELETE", s.v1QueriesDelete)
+	s.registerHandlerV1(router, "/queries/{name}", "GET", s.v1QueriesGet)
+	s.registerHandlerV1(router, "/queries/{name}", "PUT", s.v1QueriesPut)
 	s.registerHandlerV1(router, "/query", "GET", s.v1QueryGet)
+	s.registerHandlerV1(router, "/query", "POST", s.v1QueryPost)
+	s.registerHandlerV1(router, "/schemas/{path:.+}", "DELETE", s.v1SchemasDelete)
+	s.registerHandlerV1(router, "/schemas/{path:.+}", "GET", s.v1SchemasGet)
+	s.registerHandlerV1(router, "/schemas/{path:.+}", "PUT", s.v1SchemasPut)
+	s.registerHandlerV1(router, "/tenants/data/{path:.+}", "GET", s.v1TenantsDataGet)
+	s.registerHandlerV1(router, "/version", "GET", s.v1VersionGet)
+	router.HandleFunc("/health", s.healthGet).Methods("GET")
+	router.HandleFunc("/metrics", s.metricsGet).Methods("GET")
+	router.HandleFunc("/versions", s.versionsGet).Methods("GET")
 	router.HandleFunc("/", s.indexGet).Methods("GET")
-	s.Handler = router
+	s.Handler = &requestIDHandler{inner: &loggingHandler{server: s, inner: &corsHandler{server: s, inner: &compressingHandler{server: s, inner: &yamlHandler{inner: &authorizingHandler{server: s, inner: router}}}}}}
 
 	// Initialize compiler with policies found in storage.
 	txn, err := s.store.NewTransaction(ctx)
@@ -337,6 +1271,10 @@ func New(ctx context.Context, store *storage.Storage, addr string, persist bool)
 
 	s.setCompiler(compiler)
 
+	if err := s.watchers.registerTrigger(txn); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
@@ -352,14 +1290,453 @@ func (s *Server) Compiler() *ast.Compiler {
 	return s.compiler
 }
 
-// Loop starts the server. This function does not return.
+// WithAuthorizer sets the Authorizer that is consulted before each request is
+// handled. Health checks (GET /health) are not authorized. This must be called
+// before the server starts handling requests.
+func (s *Server) WithAuthorizer(authorizer Authorizer) *Server {
+	s.authorizer = authorizer
+	return s
+}
+
+// WithStrictImports controls whether policies are rejected if they import data
+// that is not defined by a loaded module or base document. By default, imports
+// are not checked so that policies can be loaded incrementally. This must be
+// called before the server starts handling requests.
+func (s *Server) WithStrictImports(enabled bool) *Server {
+	s.strictImports = enabled
+	return s
+}
+
+// WithHealthQuery sets the canary query evaluated by health checks that
+// include the "query" parameter. The check succeeds if the query is satisfied
+// and every expression in it that is a single term evaluates to true.
+// Defaults to "data.system.health". This must be called before the server
+// starts handling requests.
+func (s *Server) WithHealthQuery(query ast.Body) *Server {
+	s.healthQuery = query
+	return s
+}
+
+// WithReadyPath sets the path of a document that must exist before the server
+// reports that it is ready. Until the document exists (or MarkReady is
+// called), readiness checks respond with 503. This must be called before the
+// server starts handling requests.
+func (s *Server) WithReadyPath(path storage.Path) *Server {
+	s.readyMtx.Lock()
+	defer s.readyMtx.Unlock()
+	s.ready = false
+	s.readyPath = path
+	return s
+}
+
+// MarkReady marks the server as ready to handle requests regardless of the
+// ready path.
+func (s *Server) MarkReady() {
+	s.readyMtx.Lock()
+	defer s.readyMtx.Unlock()
+	s.ready = true
+}
+
+// isReady returns true if the server has been marked ready or if the ready
+// path exists. Once the server is ready, it remains ready.
+func (s *Server) isReady(ctx context.Context, txn storage.Transaction) (bool, error) {
+	s.readyMtx.Lock()
+	defer s.readyMtx.Unlock()
+	if s.ready {
+		return true, nil
+	}
+	if s.readyPath == nil {
+		return false, nil
+	}
+	if _, err := s.store.Read(ctx, txn, s.readyPath); err != nil {
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	s.ready = true
+	return true, nil
+}
+
+// WithCaseInsensitivePaths controls whether Data API reads that do not find a
+// document retry the lookup by matching path elements against existing keys
+// case-insensitively. By default, paths are matched exactly. This must be
+// called before the server starts handling requests.
+func (s *Server) WithCaseInsensitivePaths(enabled bool) *Server {
+	s.foldPaths = enabled
+	return s
+}
+
+// WithMemoryLimit sets the approximate number of bytes that a single query may
+// accumulate during evaluation. Queries that exceed the limit are aborted and
+// the server responds with 507. By default, there is no limit. This must be
+// called before the server starts handling requests.
+func (s *Server) WithMemoryLimit(bytes int64) *Server {
+	s.memoryLimit = bytes
+	return s
+}
+
+// WithDepthLimit sets the maximum depth of nested queries (e.g., rule bodies and
+// comprehensions) that a single query may evaluate. Queries that exceed the
+// limit are aborted and the server responds with 500. By default, there is no
+// limit. This must be called before the server starts handling requests.
+func (s *Server) WithDepthLimit(n int) *Server {
+	s.depthLimit = n
+	return s
+}
+
+// WithEvalTimeout sets the maximum amount of time that evaluation of a single
+// request may take. Requests that exceed the timeout are aborted and the server
+// responds with 503. By default, there is no timeout. This must be called before
+// the server starts handling requests.
+func (s *Server) WithEvalTimeout(d time.Duration) *Server {
+	s.evalTimeout = d
+	return s
+}
+
+// evalContext returns a context for evaluating a request that expires after
+// the evaluation timeout. The caller must call the returned cancel function
+// when evaluation is finished.
+func (s *Server) evalContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.evalTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.evalTimeout)
+}
+
+// newMemoryBudget returns a new memory budget for evaluating a query or nil
+// if the server does not limit memory.
+func (s *Server) newMemoryBudget() *topdown.MemoryBudget {
+	if s.memoryLimit <= 0 {
+		return nil
+	}
+	return topdown.NewMemoryBudget(s.memoryLimit)
+}
+
+// WithMaxRequestParams sets the maximum number of request parameters that may
+// be provided to a single query. Queries that exceed the limit are rejected
+// with 400. If n is zero or less, there is no limit. By default, the limit is
+// 1000. This must be called before the server starts handling requests.
+func (s *Server) WithMaxRequestParams(n int) *Server {
+	s.maxRequestParams = n
+	return s
+}
+
+// WithBuiltinAllowlist restricts the built-in functions that policies and
+// queries may call to names. Policies and queries that call other built-in
+// functions are rejected with 403. By default, all built-in functions are
+// allowed. This must be called before the server starts handling requests.
+func (s *Server) WithBuiltinAllowlist(names ...string) *Server {
+	s.allowedBuiltins = map[ast.Var]bool{}
+	for _, name := range names {
+		s.allowedBuiltins[ast.Var(name)] = true
+	}
+	return s
+}
+
+// WithBuiltinDenylist prevents policies and queries from calling the built-in
+// functions in names. Policies and queries that call these functions are
+// rejected with 403. The denylist takes precedence over the allowlist. This
+// must be called before the server starts handling requests.
+func (s *Server) WithBuiltinDenylist(names ...string) *Server {
+	s.deniedBuiltins = map[ast.Var]bool{}
+	for _, name := range names {
+		s.deniedBuiltins[ast.Var(name)] = true
+	}
+	return s
+}
+
+// WithBuiltinOverrides enables the builtin parameter on the Data API which
+// replaces built-in functions with canned values for the duration of a query.
+// This is intended for testing policies that call built-in functions with
+// side effects and should not be enabled in production. This must be called
+// before the server starts handling requests.
+func (s *Server) WithBuiltinOverrides(enabled bool) *Server {
+	s.builtinOverrides = enabled
+	return s
+}
+
+// WithSpanExporter sets the exporter that receives spans describing the
+// evaluation of Data API and Query API queries. By default, spans are not
+// recorded. This must be called before the server starts handling requests.
+func (s *Server) WithSpanExporter(exporter SpanExporter) *Server {
+	s.spanExporter = exporter
+	return s
+}
+
+// WithMetricsRegistry sets the registry that the server records metrics in and
+// exposes at /metrics. Embedders can use this to expose their own metrics
+// together with the server's metrics, either by recording them in the registry
+// or by registering a Collector. Conversely, the registry can be served on
+// another endpoint since it implements http.Handler. By default, the server
+// uses a new, empty registry. This must be called before the server starts
+// handling requests.
+func (s *Server) WithMetricsRegistry(registry *Registry) *Server {
+	s.httpMetrics = newHTTPMetrics(registry)
+	return s
+}
+
+// WithLogger sets the logger that receives a structured log for each /v1
+// request handled by the server. Requests are logged if their level is at or
+// below the given level, e.g., if level is LogLevelError, only requests that
+// fail with a server error are logged. By default, requests are not logged.
+// This must be called before the server starts handling requests.
+func (s *Server) WithLogger(logger Logger, level LogLevel) *Server {
+	s.logger = logger
+	s.logLevel = level
+	return s
+}
+
+// WithCORS enables Cross-Origin Resource Sharing (CORS) so that browsers may
+// call the API from pages served by the given origins. If origins includes
+// "*", all origins are allowed. If methods or headers are empty, the methods
+// used by the API and the Content-Type header are allowed. By default, CORS is
+// disabled. This must be called before the server starts handling requests.
+func (s *Server) WithCORS(origins, methods, headers []string) *Server {
+	if len(origins) == 0 {
+		s.cors = nil
+		return s
+	}
+	config := &corsConfig{
+		origins: make(map[string]bool, len(origins)),
+		methods: methods,
+		headers: headers,
+	}
+	for _, origin := range origins {
+		config.origins[origin] = true
+	}
+	if len(config.methods) == 0 {
+		config.methods = defaultCORSMethods
+	}
+	if len(config.headers) == 0 {
+		config.headers = defaultCORSHeaders
+	}
+	s.cors = config
+	return s
+}
+
+// WithReadTimeout sets the maximum duration for reading an entire request,
+// including the body. If d is zero, there is no timeout. By default, the
+// timeout is 30 seconds. This must be called before the server starts handling
+// requests.
+func (s *Server) WithReadTimeout(d time.Duration) *Server {
+	s.readTimeout = d
+	return s
+}
+
+// WithWriteTimeout sets the maximum duration before timing out writes of the
+// response. If d is zero, there is no timeout. By default, the timeout is 60
+// seconds. This must be called before the server starts handling requests.
+func (s *Server) WithWriteTimeout(d time.Duration) *Server {
+	s.writeTimeout = d
+	return s
+}
+
+// WithIdleTimeout sets the maximum amount of time to wait for the next request
+// on a keep-alive connection. If d is zero, the read timeout is used. By
+// default, the timeout is 120 seconds. This must be called before the server
+// starts handling requests.
+func (s *Server) WithIdleTimeout(d time.Duration) *Server {
+	s.idleTimeout = d
+	return s
+}
+
+// WithMaxHeaderBytes sets the maximum number of bytes the server will read
+// parsing request headers. By default, the limit is 1MB. This must be called
+// before the server starts handling requests.
+func (s *Server) WithMaxHeaderBytes(n int) *Server {
+	s.maxHeaderBytes = n
+	return s
+}
+
+// WithMaxRequestBodyBytes sets the maximum number of bytes the server will
+// read from request bodies. Requests with larger bodies are rejected with 413.
+// By default, the limit is 64MB. If n is zero or negative, request bodies are
+// not limited. This must be called before the server starts handling requests.
+func (s *Server) WithMaxRequestBodyBytes(n int64) *Server {
+	s.maxRequestBodyBytes = n
+	return s
+}
+
+// WithCompressionThreshold sets the minimum size (in bytes) of response bodies
+// that are compressed when the client accepts gzip encoding. Defaults to 1KB.
+// If the threshold is negative, responses are never compressed. This must be
+// called before the server starts handling requests.
+func (s *Server) WithCompressionThreshold(n int) *Server {
+	s.compressionThreshold = n
+	return s
+}
+
+// WithResponseBufferMaxPooledSize sets the capacity (in bytes) above which
+// buffers used to serialize JSON responses are not reused. Defaults to 1MB. If
+// n is negative, buffers are never reused. This must be called before the
+// server starts handling requests.
+func (s *Server) WithResponseBufferMaxPooledSize(n int) *Server {
+	s.responseBufferMaxPooledSize = n
+	return s
+}
+
+// Loop starts the server. This function does not return unless the server
+// fails or is shut down, in which case http.ErrServerClosed is returned.
+//
+// If the server's address is of the form unix:///path/to/socket, the server
+// listens on a Unix domain socket instead of TCP. The socket file must not
+// exist and is removed when the server is shut down.
 func (s *Server) Loop() error {
-	return http.ListenAndServe(s.addr, s.Handler)
+	l, err := s.listen(":http")
+	if err != nil {
+		return err
+	}
+	return s.getHTTPServer().Serve(l)
+}
+
+// LoopTLS starts the server and serves HTTPS using the certificate and private
+// key in the given files. The files are loaded before the server starts
+// listening so that misconfiguration is reported immediately. This function
+// does not return unless the files cannot be loaded.
+func (s *Server) LoopTLS(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to load TLS certificate")
+	}
+	server := s.getHTTPServer()
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	l, err := s.listen(":https")
+	if err != nil {
+		return err
+	}
+	return server.Serve(tls.NewListener(l, server.TLSConfig))
+}
+
+// Shutdown gracefully shuts down the server. The server stops accepting new
+// connections and waits for in-flight requests (e.g., Data API evaluations) to
+// complete. Clients watching documents are disconnected. If the context
+// expires before the requests complete, the context's error is returned. Once
+// the server has been shut down, Loop returns http.ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.watchers.close()
+	return s.getHTTPServer().Shutdown(ctx)
+}
+
+// unixSocketPath returns the path of the Unix domain socket referred to by addr
+// (e.g., unix:///var/run/opa.sock). If addr does not refer to a Unix domain
+// socket, false is returned.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix://"), true
+}
+
+// listenUnix returns a listener for the Unix domain socket at path. The socket
+// file is removed when the listener is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("unix socket already exists: %v", path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listen returns a listener for the server's address. If the address is
+// empty, defaultAddr is used.
+func (s *Server) listen(defaultAddr string) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if path, ok := unixSocketPath(s.addr); ok {
+		l, err = listenUnix(path)
+	} else {
+		addr := s.addr
+		if addr == "" {
+			addr = defaultAddr
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return connListener{l}, nil
+}
+
+// connListener wraps the connections it accepts so that handlers can reach
+// them from requests (see clearWriteDeadline). TCP connections use keep-alives
+// the same way as http.ListenAndServe.
+type connListener struct {
+	net.Listener
+}
+
+func (l connListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(3 * time.Minute)
+	}
+	return &trackedConn{Conn: c, addr: &connAddr{Addr: c.LocalAddr(), conn: c}}, nil
 }
 
-func (s *Server) execQuery(ctx context.Context, compiler *ast.Compiler, txn storage.Transaction, query ast.Body, explainMode explainModeV1) (interface{}, error) {
+// trackedConn reports its local address as a connAddr. The HTTP server stores
+// the local address in the request context (http.LocalAddrContextKey), which
+// makes the connection available to handlers.
+type trackedConn struct {
+	net.Conn
+	addr *connAddr
+}
+
+func (c *trackedConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// connAddr is the local address of a connection accepted by connListener.
+type connAddr struct {
+	net.Addr
+	conn net.Conn
+}
+
+// clearWriteDeadline removes the write deadline that the HTTP server sets on
+// the connection serving r. If the connection was not accepted by
+// connListener, the deadline is left unchanged.
+func clearWriteDeadline(r *http.Request) {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*connAddr); ok {
+		addr.conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// getHTTPServer returns the HTTP server that handles requests. The HTTP server
+// is created the first time it is needed so that the connection settings can be
+// configured after New returns.
+func (s *Server) getHTTPServer() *http.Server {
+	s.srvMtx.Lock()
+	defer s.srvMtx.Unlock()
+	if s.srv == nil {
+		s.srv = s.httpServer()
+	}
+	return s.srv
+}
+
+func (s *Server) httpServer() *http.Server {
+	return &http.Server{
+		Addr:           s.addr,
+		Handler:        s.Handler,
+		ReadTimeout:    s.readTimeout,
+		WriteTimeout:   s.writeTimeout,
+		IdleTimeout:    s.idleTimeout,
+		MaxHeaderBytes: s.maxHeaderBytes,
+	}
+}
+
+// execQuery evaluates the query and returns the result set or explanation. If
+// limit is positive, evaluation stops after limit results have been collected.
+func (s *Server) execQuery(ctx context.Context, compiler *ast.Compiler, txn storage.Transaction, query ast.Body, explainMode explainModeV1, traceFilter traceFilterV1, counters *topdown.Counters, limit int) (interface{}, error) {
+
+	ctx, cancel := s.evalContext(ctx)
+	defer cancel()
 
-	t := topdown.New(ctx, query, s.Compiler(), s.store, txn)
+	t := topdown.New(ctx, query, compiler, s.store, txn)
+	t.Budget = s.newMemoryBudget()
+	t.DepthLimit = s.depthLimit
+	t.Counters = counters
 
 	var buf *topdown.BufferTracer
 
@@ -368,6 +1745,10 @@ func (s *Server) execQuery(ctx context.Context, compiler *ast.Compiler, txn stor
 		t.Tracer = buf
 	}
 
+	spans := s.newSpanTracer()
+	t.Tracer = withSpanTracer(t.Tracer, spans)
+	defer s.exportSpans(ctx, spans)
+
 	resultSet := adhocQueryResultSetV1{}
 
 	err := topdown.Eval(t, func(t *topdown.Topdown) error {
@@ -395,88 +1776,194 @@ func (s *Server) execQuery(ctx context.Context, compiler *ast.Compiler, txn stor
 		if len(result) > 0 {
 			resultSet = append(resultSet, result)
 		}
+		if limit > 0 && len(resultSet) >= limit {
+			return topdown.ErrLimitReached
+		}
 		return nil
 	})
 
-	if err != nil {
+	if err != nil && err != topdown.ErrLimitReached {
 		return nil, err
 	}
 
+	// If evaluation stopped at the limit, the trace does not cover the
+	// remaining results.
+	limited := err == topdown.ErrLimitReached
+
 	switch explainMode {
 	case explainFullV1:
-		return newTraceV1(*buf), nil
+		return newFilteredTraceV1(*buf, traceFilter).limited(limited), nil
 	case explainTruthV1:
-		answer, err := explain.Truth(compiler, *buf)
-		if err != nil {
-			return nil, err
-		}
-		return newTraceV1(answer), nil
+		return newTruthExplanationV1(compiler, *buf), nil
+	case explainNotesV1:
+		return newNotesV1(*buf).limited(limited), nil
 	default:
 		return resultSet, nil
 	}
 }
 
-func (s *Server) indexGet(w http.ResponseWriter, r *http.Request) {
-
-	renderHeader(w)
-	renderBanner(w)
-	renderVersion(w)
-
-	values := r.URL.Query()
-	qStrs := values["q"]
-	explainMode := getExplain(r.URL.Query()["explain"])
-	ctx := r.Context()
+func (s *Server) healthGet(w http.ResponseWriter, r *http.Request) {
 
-	renderQueryForm(w, qStrs, explainMode)
+	compiler := s.Compiler()
+	if compiler == nil {
+		handleErrorf(w, 503, "compiler not initialized")
+		return
+	}
 
-	if len(qStrs) > 0 {
-		qStr := qStrs[len(qStrs)-1]
-		t0 := time.Now()
+	checkQuery := getBool(r.URL.Query()["query"])
+	checkReady := getBool(r.URL.Query()["ready"])
 
-		var results interface{}
-		txn, err := s.store.NewTransaction(ctx)
+	if !checkQuery && !checkReady {
+		handleResponse(w, 200, nil)
+		return
+	}
 
-		if err == nil {
-			var query ast.Body
-			query, err = ast.ParseBody(qStr)
-			if err == nil {
-				compiler := s.Compiler()
-				query, err = compiler.QueryCompiler().Compile(query)
-				if err == nil {
-					results, err = s.execQuery(ctx, compiler, txn, query, explainMode)
-				}
-			}
-			s.store.Close(ctx, txn)
-		}
+	ctx := r.Context()
 
-		dt := time.Since(t0)
-		renderQueryResult(w, results, err, dt)
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleError(w, 503, err)
+		return
 	}
 
-	renderFooter(w)
-}
+	defer s.store.Close(ctx, txn)
+
+	if checkReady {
+		ready, err := s.isReady(ctx, txn)
+		if err != nil {
+			handleError(w, 503, err)
+			return
+		}
+		if !ready {
+			handleErrorf(w, 503, "server not ready")
+			return
+		}
+	}
+
+	if !checkQuery {
+		handleResponse(w, 200, nil)
+		return
+	}
+
+	query, err := compiler.QueryCompiler().Compile(healthCheckQuery(s.healthQuery))
+	if err != nil {
+		handleError(w, 503, err)
+		return
+	}
+
+	t := topdown.New(ctx, query, compiler, s.store, txn)
+	satisfied := false
+
+	err = topdown.Eval(t, func(*topdown.Topdown) error {
+		satisfied = true
+		return nil
+	})
+
+	if err != nil {
+		handleError(w, 503, err)
+		return
+	}
+
+	if !satisfied {
+		handleErrorf(w, 503, "health check query not satisfied: %v", s.healthQuery)
+		return
+	}
+
+	handleResponse(w, 200, nil)
+}
+
+// healthCheckQuery returns a copy of the health query where each expression
+// that is a single term is compared with true, e.g., "data.system.health" is
+// evaluated as "data.system.health = true". Otherwise, any value other than
+// false, e.g., a string, would satisfy the check.
+func healthCheckQuery(query ast.Body) ast.Body {
+	result := query.Copy()
+	for _, expr := range result {
+		if term, ok := expr.Terms.(*ast.Term); ok {
+			expr.Terms = ast.Equality.Expr(term, ast.BooleanTerm(true)).Terms
+		}
+	}
+	return result
+}
+
+func (s *Server) indexGet(w http.ResponseWriter, r *http.Request) {
+
+	if acceptsJSON(r.Header.Get("Accept")) {
+		s.versionsGet(w, r)
+		return
+	}
+
+	renderHeader(w)
+	renderBanner(w)
+	renderVersion(w)
+
+	values := r.URL.Query()
+	qStrs := values["q"]
+	explainMode := getExplain(r.URL.Query()["explain"])
+	echoQuery := getBool(values["echo_query"])
+	ctx := r.Context()
+
+	renderQueryForm(w, qStrs, explainMode)
+
+	if len(qStrs) > 0 {
+		qStr := qStrs[len(qStrs)-1]
+		t0 := time.Now()
+
+		var results interface{}
+		txn, err := s.store.NewTransaction(ctx)
+
+		if err == nil {
+			var query ast.Body
+			query, err = ast.ParseBody(qStr)
+			if err == nil {
+				compiler := s.Compiler()
+				query, err = compiler.QueryCompiler().Compile(query)
+				if err == nil {
+					if errs := s.checkBuiltins(query); len(errs) > 0 {
+						err = errs
+					}
+				}
+				if err == nil {
+					results, err = s.execQuery(ctx, compiler, txn, query, explainMode, traceFilterV1{}, nil, 0)
+				}
+			}
+			s.store.Close(ctx, txn)
+		}
+
+		if err == nil && echoQuery {
+			results = echoQueryResultV1{Query: qStr, Result: results}
+		}
+
+		dt := time.Since(t0)
+		renderQueryResult(w, results, err, dt)
+	}
+
+	renderFooter(w)
+}
 
 func (s *Server) registerHandlerV1(router *mux.Router, path string, method string, h func(http.ResponseWriter, *http.Request)) {
-	router.HandleFunc("/v1"+path, h).Methods(method)
+	s.routesV1 = append(s.routesV1, routeV1{Method: method, Path: "/v1" + path})
+	router.HandleFunc("/v1"+path, func(w http.ResponseWriter, r *http.Request) {
+		if s.maxRequestBodyBytes > 0 {
+			r.Body = newMaxBytesReader(r.Body, s.maxRequestBodyBytes)
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = 200
+		}
+		s.httpMetrics.observeRequest("/v1"+path, method, status)
+	}).Methods(method)
 }
 
 func (s *Server) v1DataGet(w http.ResponseWriter, r *http.Request) {
 
 	// Gather request parameters.
 	ctx := r.Context()
-	vars := mux.Vars(r)
-	path := stringPathToDataRef(vars["path"])
-	pretty := getPretty(r.URL.Query()["pretty"])
-	explainMode := getExplain(r.URL.Query()["explain"])
-	request, nonGround, err := parseRequest(r.URL.Query()[ParamRequestV1])
-
+	p, err := s.parseDataGetParams(r)
 	if err != nil {
-		handleError(w, 400, err)
-		return
-	}
-
-	if nonGround && explainMode != explainOffV1 {
-		handleError(w, 400, fmt.Errorf("explanations with non-ground request values not supported"))
+		handleErrorAuto(w, err)
 		return
 	}
 
@@ -487,101 +1974,292 @@ func (s *Server) v1DataGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	defer s.store.Close(ctx, txn)
+	if err := s.validateRequest(ctx, txn, p.path, p.request, p.nonGround); err != nil {
+		s.store.Close(ctx, txn)
+		handleErrorAuto(w, err)
+		return
+	}
+
+	if p.watch {
+		// Watches evaluate the document in a new transaction for each
+		// change.
+		s.store.Close(ctx, txn)
+		s.watchData(w, r, p.path, p.request)
+		return
+	}
+
+	// The transaction is closed before streamed results are written so that
+	// slow clients do not block other transactions.
+	closed := false
+	closeTxn := func() {
+		if !closed {
+			s.store.Close(ctx, txn)
+			closed = true
+		}
+	}
+
+	defer closeTxn()
 
 	compiler := s.Compiler()
-	params := topdown.NewQueryParams(ctx, compiler, s.store, txn, request, path)
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
+
+	params := topdown.NewQueryParams(evalCtx, compiler, s.store, txn, p.request, p.path)
+	params.Budget = s.newMemoryBudget()
+	params.DepthLimit = s.depthLimit
+	params.BuiltinOverrides = p.overrides
+	params.Types = p.types
+	params.Limit = limitPlusOne(p.limit)
+
+	var counters *topdown.Counters
+	if p.metrics {
+		counters = topdown.NewCounters()
+		params.Counters = counters
+	}
+
+	// Successful responses carry an ETag derived from the evaluated result so
+	// that clients can cache documents and decisions.
+	respond := func(code int, v interface{}) {
+		if counters != nil {
+			v = newMetricsResultV1(v, counters)
+		}
+		if code == 200 {
+			s.handleResponseJSONWithETag(w, r, code, v, p.pretty)
+			return
+		}
+		s.handleResponseJSON(w, code, v, p.pretty)
+	}
 
 	var buf *topdown.BufferTracer
-	if explainMode != explainOffV1 {
+	if p.explainMode != explainOffV1 {
 		buf = topdown.NewBufferTracer()
 		params.Tracer = buf
 	}
 
+	spans := s.newSpanTracer()
+	params.Tracer = withSpanTracer(params.Tracer, spans)
+	defer s.exportSpans(ctx, spans)
+
+	if p.stream {
+		params.Limit = p.limit
+		t0 := time.Now()
+		results, err := evalStreamResults(params, p.selection, p.numbers, p.flatten)
+		s.setEvalDuration(w, time.Since(t0))
+		closeTxn()
+		if err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+		writeStreamResults(w, results)
+		return
+	}
+
 	// Execute query.
+	t0 := time.Now()
 	qrs, err := topdown.Query(params)
 
+	if err == nil && qrs.Undefined() && s.foldPaths {
+		if folded := s.foldPath(ctx, txn, compiler, p.path); !folded.Equal(p.path) {
+			if buf != nil {
+				*buf = (*buf)[:0]
+			}
+			params.Path = folded
+			params.Budget = s.newMemoryBudget()
+			qrs, err = topdown.Query(params)
+		}
+	}
+
+	s.setEvalDuration(w, time.Since(t0))
+
 	// Handle results.
 	if err != nil {
 		handleErrorAuto(w, err)
 		return
 	}
 
+	truncated := p.limit > 0 && len(qrs) > p.limit
+	if truncated {
+		qrs = qrs[:p.limit]
+	}
+
 	if qrs.Undefined() {
-		if explainMode == explainFullV1 {
-			handleResponseJSON(w, 404, newTraceV1(*buf), pretty)
+		if p.explainMode == explainFullV1 {
+			respond(404, newFilteredTraceV1(*buf, p.traceFilter))
+		} else if p.explainMode == explainNotesV1 {
+			respond(404, newNotesV1(*buf))
 		} else {
 			handleResponse(w, 404, nil)
 		}
 		return
 	}
 
-	if nonGround {
-		handleResponseJSON(w, 200, newQueryResultSetV1(qrs), pretty)
+	if p.selection != nil && p.explainMode == explainOffV1 {
+		if qrs = selectResults(qrs, p.selection); qrs.Undefined() {
+			handleResponse(w, 404, nil)
+			return
+		}
+	}
+
+	if p.numbers == numberFormatStringV1 {
+		for _, qr := range qrs {
+			qr.Result = stringifyNumbers(qr.Result)
+			if qr.Bindings != nil {
+				qr.Bindings = stringifyNumbers(qr.Bindings).(map[string]interface{})
+			}
+		}
+	}
+
+	if p.flatten && p.explainMode == explainOffV1 {
+		for _, qr := range qrs {
+			qr.Result = flattenDocument(qr.Result)
+		}
+	}
+
+	if p.nonGround {
+		var result interface{}
+		if p.explainMode == explainOffV1 {
+			result = newQueryResultSetV1(qrs)
+		} else {
+			result = newExplainedQueryResultSetV1(compiler, qrs, p.explainMode, p.traceFilter)
+		}
+		if p.limit > 0 {
+			result = truncatedResultV1{Result: result, Truncated: truncated}
+		}
+		respond(200, result)
 		return
 	}
 
 	result := qrs[0].Result
 
-	switch explainMode {
+	switch p.explainMode {
 	case explainOffV1:
-		handleResponseJSON(w, 200, result, pretty)
-	case explainFullV1:
-		handleResponseJSON(w, 200, newTraceV1(*buf), pretty)
-	case explainTruthV1:
-		answer, err := explain.Truth(compiler, *buf)
-		if err != nil {
-			handleErrorAuto(w, err)
+		if !p.echoInput && !p.types && !p.debugSource {
+			respond(200, result)
 			return
 		}
-		handleResponseJSON(w, 200, newTraceV1(answer), pretty)
+		annotated := annotatedResultV1{Result: result, Types: qrs[0].Types}
+		if p.debugSource {
+			ref := params.Path.Copy()
+			for _, x := range p.selection {
+				ref = append(ref, ast.StringTerm(x))
+			}
+			annotated.Sources = s.documentSources(ctx, txn, compiler, ref, result)
+		}
+		if p.echoInput {
+			input, err := topdown.ValueToInterface(p.request, topdown.New(ctx, nil, compiler, s.store, txn))
+			if err != nil {
+				handleErrorAuto(w, err)
+				return
+			}
+			if p.numbers == numberFormatStringV1 {
+				input = stringifyNumbers(input)
+			}
+			annotated.Input = input
+		}
+		respond(200, annotated)
+	case explainFullV1:
+		respond(200, newFilteredTraceV1(*buf, p.traceFilter))
+	case explainTruthV1:
+		respond(200, newTruthExplanationV1(compiler, *buf))
+	case explainNotesV1:
+		respond(200, newNotesV1(*buf))
 	}
 }
 
-func (s *Server) v1DataPatch(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	vars := mux.Vars(r)
+// evalStreamResults returns the results of a non-ground query for streaming.
+// The results are evaluated in full before any of them are written so that the
+// transaction is not held open while the client reads the response.
+func evalStreamResults(params *topdown.QueryParams, selection []string, numbers numberFormatV1, flatten bool) ([]*queryResultV1, error) {
 
-	ops := []patchV1{}
-	if err := util.NewJSONDecoder(r.Body).Decode(&ops); err != nil {
-		handleError(w, 400, err)
-		return
-	}
+	results := []*queryResultV1{}
 
-	txn, err := s.store.NewTransaction(ctx)
-	if err != nil {
-		handleErrorAuto(w, err)
-		return
-	}
+	err := topdown.QueryEach(params, func(qr *topdown.QueryResult) error {
 
-	defer s.store.Close(ctx, txn)
+		result, bindings := qr.Result, qr.Bindings
 
-	patches, err := s.prepareV1PatchSlice(vars["path"], ops)
-	if err != nil {
-		handleErrorAuto(w, err)
+		if selection != nil {
+			var ok bool
+			if result, ok = selectValue(result, selection); !ok {
+				return nil
+			}
+		}
+
+		if numbers == numberFormatStringV1 {
+			result = stringifyNumbers(result)
+			bindings = stringifyNumbers(bindings).(map[string]interface{})
+		}
+
+		if flatten {
+			result = flattenDocument(result)
+		}
+
+		results = append(results, &queryResultV1{result: result, bindings: bindings})
+		return nil
+	})
+
+	return results, err
+}
+
+// writeStreamResults writes the results as newline delimited JSON. If the
+// response writer supports flushing, each result is flushed so that clients
+// receive results incrementally. Otherwise, the results are buffered by the
+// response writer.
+func writeStreamResults(w http.ResponseWriter, results []*queryResultV1) {
+
+	if len(results) == 0 {
+		handleResponse(w, 404, nil)
 		return
 	}
 
-	for _, patch := range patches {
-		if err := s.store.Write(ctx, txn, patch.op, patch.path, patch.value); err != nil {
-			handleErrorAuto(w, err)
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
 			return
 		}
+		if flusher != nil {
+			flusher.Flush()
+		}
 	}
-
-	handleResponse(w, 204, nil)
 }
 
-func (s *Server) v1DataPut(w http.ResponseWriter, r *http.Request) {
+func (s *Server) v1DataPost(w http.ResponseWriter, r *http.Request) {
+
+	// Gather request parameters.
 	ctx := r.Context()
 	vars := mux.Vars(r)
+	path := stringPathToDataRef(vars["path"])
+	pretty := getPretty(r.URL.Query()["pretty"])
 
-	var value interface{}
-	if err := util.NewJSONDecoder(r.Body).Decode(&value); err != nil {
-		handleError(w, 400, err)
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, 500, err)
 		return
 	}
 
+	// The request body is optional. If the body does not specify an input,
+	// the query is evaluated without a request document.
+	var request ast.Value
+
+	if len(bytes.TrimSpace(bs)) > 0 {
+		var body map[string]interface{}
+		if err := util.UnmarshalJSON(bs, &body); err != nil {
+			handleError(w, 400, err)
+			return
+		}
+		if input, ok := body["input"]; ok {
+			if request, err = ast.InterfaceToValue(input); err != nil {
+				handleError(w, 400, err)
+				return
+			}
+		}
+	}
+
+	// Prepare for query.
 	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
 		handleErrorAuto(w, err)
@@ -590,108 +2268,156 @@ func (s *Server) v1DataPut(w http.ResponseWriter, r *http.Request) {
 
 	defer s.store.Close(ctx, txn)
 
-	path, ok := storage.ParsePath("/" + strings.Trim(vars["path"], "/"))
-	if !ok {
-		handleErrorf(w, 400, "bad path format %v", vars["path"])
+	if err := s.validateRequest(ctx, txn, path, request, false); err != nil {
+		handleErrorAuto(w, err)
 		return
 	}
 
-	_, err = s.store.Read(ctx, txn, path)
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
+
+	params := topdown.NewQueryParams(evalCtx, s.Compiler(), s.store, txn, request, path)
+	params.Budget = s.newMemoryBudget()
+	params.DepthLimit = s.depthLimit
 
+	// Execute query.
+	qrs, err := topdown.Query(params)
 	if err != nil {
-		if !storage.IsNotFound(err) {
-			handleErrorAuto(w, err)
-			return
-		}
-		if err := s.makeDir(ctx, txn, path[:len(path)-1]); err != nil {
-			handleErrorAuto(w, err)
-			return
-		}
-	} else if r.Header.Get("If-None-Match") == "*" {
-		handleResponse(w, 304, nil)
+		handleErrorAuto(w, err)
 		return
 	}
 
-	if err := s.store.Write(ctx, txn, storage.AddOp, path, value); err != nil {
-		handleErrorAuto(w, err)
+	if qrs.Undefined() {
+		handleResponse(w, 404, nil)
 		return
 	}
 
-	handleResponse(w, 204, nil)
+	s.handleResponseJSON(w, 200, dataResponseV1{Result: qrs[0].Result}, pretty)
 }
 
-func (s *Server) v1PoliciesDelete(w http.ResponseWriter, r *http.Request) {
+func (s *Server) v1DataBatchPost(w http.ResponseWriter, r *http.Request) {
+
+	// Gather request parameters.
 	ctx := r.Context()
 	vars := mux.Vars(r)
-	id := vars["id"]
+	path := stringPathToDataRef(vars["path"])
+	pretty := getPretty(r.URL.Query()["pretty"])
 
-	txn, err := s.store.NewTransaction(ctx)
-	if err != nil {
-		handleErrorAuto(w, err)
+	// The elements are parsed individually so that a malformed element is
+	// reported in the results instead of failing the batch.
+	items := []json.RawMessage{}
+	if err := util.NewJSONDecoder(r.Body).Decode(&items); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad batch"))
 		return
 	}
 
-	defer s.store.Close(ctx, txn)
-
-	_, _, err = s.store.GetPolicy(txn, id)
+	// Prepare for queries. All of the elements are evaluated in the same
+	// transaction so that they observe the same data.
+	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
 		handleErrorAuto(w, err)
 		return
 	}
 
-	mods := s.store.ListPolicies(txn)
-	delete(mods, id)
+	defer s.store.Close(ctx, txn)
 
-	c := ast.NewCompiler()
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
 
-	if c.Compile(mods); c.Failed() {
-		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
-		return
-	}
+	compiler := s.Compiler()
+	results := make([]batchResultV1, len(items))
 
-	if err := s.store.DeletePolicy(txn, id); err != nil {
-		handleErrorAuto(w, err)
-		return
-	}
+	for i := range items {
 
-	s.setCompiler(c)
+		request, err := parseBatchInput(items[i])
+		if err != nil {
+			results[i].Error = newErrorV1(400, err)
+			continue
+		}
 
-	handleResponse(w, 204, nil)
+		if err := s.validateRequest(ctx, txn, path, request, false); err != nil {
+			_, results[i].Error = newErrorAutoV1(err)
+			continue
+		}
+
+		params := topdown.NewQueryParams(evalCtx, compiler, s.store, txn, request, path)
+		params.Budget = s.newMemoryBudget()
+		params.DepthLimit = s.depthLimit
+
+		qrs, err := topdown.Query(params)
+		if err != nil {
+			_, results[i].Error = newErrorAutoV1(err)
+			continue
+		}
+
+		if qrs.Undefined() {
+			results[i].Undefined = true
+		} else {
+			results[i].Result = &qrs[0].Result
+		}
+	}
+
+	s.handleResponseJSON(w, 200, results, pretty)
 }
 
-func (s *Server) v1PoliciesGet(w http.ResponseWriter, r *http.Request) {
+// parseBatchInput returns the input of a batch element. Elements have the same
+// format as Data API POST request bodies. If the element does not specify an
+// input, the result is nil.
+func parseBatchInput(bs []byte) (ast.Value, error) {
+	var x interface{}
+	if err := util.UnmarshalJSON(bs, &x); err != nil {
+		return nil, errors.Wrap(err, "bad batch element")
+	}
+	body, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("bad batch element: must be an object")
+	}
+	input, ok := body["input"]
+	if !ok {
+		return nil, nil
+	}
+	return ast.InterfaceToValue(input)
+}
+
+func (s *Server) v1CompilePost(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	vars := mux.Vars(r)
-	id := vars["id"]
+	pretty := getPretty(r.URL.Query()["pretty"])
 
-	txn, err := s.store.NewTransaction(ctx)
+	format, err := getCompileFormat(r.URL.Query()["format"])
 	if err != nil {
-		handleErrorAuto(w, err)
+		handleError(w, 400, err)
 		return
 	}
 
-	defer s.store.Close(ctx, txn)
-
-	_, _, err = s.store.GetPolicy(txn, id)
-	if err != nil {
-		handleErrorAuto(w, err)
+	var request compileRequestV1
+	if err := util.NewStrictJSONDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad compile request"))
 		return
 	}
 
-	c := s.Compiler()
-
-	policy := &policyV1{
-		ID:     id,
-		Module: c.Modules[id],
+	if request.Query == "" {
+		handleErrorf(w, 400, "bad compile request: missing query")
+		return
 	}
 
-	handleResponseJSON(w, 200, policy, true)
-}
+	unknowns := make([]ast.Ref, len(request.Unknowns))
+	for i := range request.Unknowns {
+		ref, err := ast.ParseRef(request.Unknowns[i])
+		if err != nil {
+			handleErrorf(w, 400, "bad compile request: bad unknown: %v", err)
+			return
+		}
+		unknowns[i] = ref
+	}
 
-func (s *Server) v1PoliciesRawGet(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	vars := mux.Vars(r)
-	id := vars["id"]
+	var input ast.Value
+	if request.Input != nil {
+		var err error
+		if input, err = ast.InterfaceToValue(request.Input); err != nil {
+			handleError(w, 400, err)
+			return
+		}
+	}
 
 	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
@@ -701,63 +2427,112 @@ func (s *Server) v1PoliciesRawGet(w http.ResponseWriter, r *http.Request) {
 
 	defer s.store.Close(ctx, txn)
 
-	_, bs, err := s.store.GetPolicy(txn, id)
+	compiler := s.Compiler()
 
+	query, err := ast.ParseBody(request.Query)
 	if err != nil {
-		handleErrorAuto(w, err)
+		handleCompileError(w, err)
 		return
 	}
 
-	handleResponse(w, 200, bs)
-}
+	compiled, err := compiler.QueryCompiler().Compile(query)
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
 
-func (s *Server) v1PoliciesList(w http.ResponseWriter, r *http.Request) {
+	if errs := s.checkBuiltins(compiled); len(errs) > 0 {
+		handleErrorAST(w, 403, compileQueryErrMsg, errs)
+		return
+	}
 
-	policies := []*policyV1{}
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
 
-	c := s.Compiler()
+	t := topdown.New(evalCtx, compiled, compiler, s.store, txn)
+	t.Request = input
+	t.Budget = s.newMemoryBudget()
+	t.DepthLimit = s.depthLimit
 
-	for id, mod := range c.Modules {
-		policy := &policyV1{
-			ID:     id,
-			Module: mod,
+	t0 := time.Now()
+	bodies, err := topdown.PartialEval(t, unknowns)
+	s.setEvalDuration(w, time.Since(t0))
+
+	if err != nil {
+		if topdown.IsPartialEvalErr(err) {
+			handleError(w, 400, err)
+			return
 		}
-		policies = append(policies, policy)
+		handleErrorAuto(w, err)
+		return
+	}
+
+	var resp compileResponseV1
+
+	switch format {
+	case compileFormatASTV1:
+		queries := []ast.Body{}
+		for _, body := range bodies {
+			if body == nil {
+				body = ast.Body{}
+			}
+			queries = append(queries, body)
+		}
+		resp.Queries = queries
+	case compileFormatRegoV1:
+		resp.Module = newResidualModuleV1(bodies).String()
+	default:
+		queries := []string{}
+		for _, body := range bodies {
+			queries = append(queries, body.String())
+		}
+		resp.Queries = queries
 	}
 
-	handleResponseJSON(w, 200, policies, true)
+	s.handleResponseJSON(w, 200, resp, pretty)
 }
 
-func (s *Server) v1PoliciesPut(w http.ResponseWriter, r *http.Request) {
+func (s *Server) v1DecisionPost(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	vars := mux.Vars(r)
-	id := vars["id"]
+	pretty := getPretty(r.URL.Query()["pretty"])
 
-	buf, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		handleError(w, 500, err)
+	var decision decisionRequestV1
+	if err := util.NewStrictJSONDecoder(r.Body).Decode(&decision); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad decision request"))
 		return
 	}
 
-	parsedMod, err := ast.ParseModule(id, string(buf))
+	if decision.Combine == "" {
+		decision.Combine = combineAllTrueV1
+	}
 
-	if err != nil {
-		switch err := err.(type) {
-		case ast.Errors:
-			handleErrorAST(w, 400, compileModErrMsg, err)
-		default:
-			handleError(w, 400, err)
+	switch decision.Combine {
+	case combineAllTrueV1, combineAnyTrueV1:
+		if len(decision.Deny) > 0 {
+			handleErrorf(w, 400, "bad decision request: deny paths require %v", combineDenyOverridesV1)
+			return
 		}
+	case combineDenyOverridesV1:
+	default:
+		handleErrorf(w, 400, "bad decision request: unknown combine value: %v", decision.Combine)
 		return
 	}
 
-	if parsedMod == nil {
-		handleErrorf(w, 400, "refusing to add empty module")
+	if len(decision.Paths) == 0 {
+		handleErrorf(w, 400, "bad decision request: paths must be non-empty")
 		return
 	}
 
-	txn, err := s.store.NewTransaction(ctx)
+	var request ast.Value
+	if decision.Input != nil {
+		var err error
+		if request, err = ast.InterfaceToValue(decision.Input); err != nil {
+			handleError(w, 400, err)
+			return
+		}
+	}
 
+	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
 		handleErrorAuto(w, err)
 		return
@@ -765,43 +2540,86 @@ func (s *Server) v1PoliciesPut(w http.ResponseWriter, r *http.Request) {
 
 	defer s.store.Close(ctx, txn)
 
-	mods := s.store.ListPolicies(txn)
-	mods[id] = parsedMod
+	for _, paths := range [][]string{decision.Paths, decision.Deny} {
+		for _, p := range paths {
+			path := stringPathToDataRef(strings.Trim(p, "/"))
+			if err := s.validateRequest(ctx, txn, path, request, false); err != nil {
+				handleErrorAuto(w, err)
+				return
+			}
+		}
+	}
 
-	c := ast.NewCompiler()
+	compiler := s.Compiler()
+	resp := decisionResponseV1{Decisions: map[string]interface{}{}}
+
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
+
+	// eval returns true if the documents at all of the paths (or any of the
+	// paths if any is true) are true. Undefined documents are treated as false.
+	eval := func(paths []string, any bool) (bool, error) {
+		result := !any
+		for _, p := range paths {
+			path := stringPathToDataRef(strings.Trim(p, "/"))
+			params := topdown.NewQueryParams(evalCtx, compiler, s.store, txn, request, path)
+			params.Budget = s.newMemoryBudget()
+			params.DepthLimit = s.depthLimit
+			qrs, err := topdown.Query(params)
+			if err != nil {
+				return false, err
+			}
+			var value interface{}
+			if !qrs.Undefined() {
+				value = qrs[0].Result
+			}
+			resp.Decisions[p] = value
+			if any {
+				result = result || value == true
+			} else {
+				result = result && value == true
+			}
+		}
+		return result, nil
+	}
 
-	if c.Compile(mods); c.Failed() {
-		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
-		return
+	switch decision.Combine {
+	case combineAllTrueV1:
+		resp.Result, err = eval(decision.Paths, false)
+	case combineAnyTrueV1:
+		resp.Result, err = eval(decision.Paths, true)
+	case combineDenyOverridesV1:
+		var allowed, denied bool
+		if allowed, err = eval(decision.Paths, true); err == nil {
+			if denied, err = eval(decision.Deny, true); err == nil {
+				resp.Result = allowed && !denied
+			}
+		}
 	}
 
-	if err := s.store.InsertPolicy(txn, id, parsedMod, buf, s.persist); err != nil {
+	if err != nil {
 		handleErrorAuto(w, err)
 		return
 	}
 
-	s.setCompiler(c)
-
-	policy := &policyV1{
-		ID:     id,
-		Module: c.Modules[id],
-	}
-
-	handleResponseJSON(w, 200, policy, true)
+	s.handleResponseJSON(w, 200, resp, pretty)
 }
 
-func (s *Server) v1QueryGet(w http.ResponseWriter, r *http.Request) {
+func (s *Server) v1DataPatch(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	values := r.URL.Query()
-	pretty := getPretty(r.URL.Query()["pretty"])
-	explainMode := getExplain(r.URL.Query()["explain"])
-	qStrs := values["q"]
-	if len(qStrs) == 0 {
-		handleErrorf(w, 400, "missing query parameter 'q'")
+	vars := mux.Vars(r)
+
+	body, err := jsonBody(r)
+	if err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad patch"))
 		return
 	}
 
-	qStr := qStrs[len(qStrs)-1]
+	ops := []patchV1{}
+	if err := util.NewStrictJSONDecoder(body).Decode(&ops); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad patch"))
+		return
+	}
 
 	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
@@ -811,255 +2629,2973 @@ func (s *Server) v1QueryGet(w http.ResponseWriter, r *http.Request) {
 
 	defer s.store.Close(ctx, txn)
 
-	compiler := s.Compiler()
-
-	query, err := ast.ParseBody(qStr)
-	if err != nil {
-		handleCompileError(w, err)
+	patches, err := s.prepareV1PatchSlice(vars["path"], ops)
+	if errs, ok := err.(patchErrors); ok {
+		handlePatchErrors(w, 400, patchErrMsg, errs)
+		return
+	} else if err != nil {
+		handleErrorAuto(w, err)
 		return
 	}
 
-	compiled, err := compiler.QueryCompiler().Compile(query)
-	if err != nil {
-		handleCompileError(w, err)
+	// The storage layer does not support aborting transactions so the inverse
+	// of each applied operation is recorded and the applied operations are
+	// undone if any of the operations (including tests) fail. As a result, the
+	// patch is applied all-or-nothing.
+	var undo patchUndoLog
+
+	for i, patch := range patches {
+
+		var err error
+
+		if patch.test {
+			var ok bool
+			if ok, err = s.testPatch(ctx, txn, patch); err == nil && !ok {
+				err = patchErrors{failedPatchTestError(i, ops[i])}
+			}
+		} else {
+			err = undo.apply(ctx, s.store, txn, patch)
+		}
+
+		if err != nil {
+			if rerr := undo.rollback(ctx, s.store, txn); rerr != nil {
+				handleError(w, 500, errors.Wrapf(rerr, "cannot undo failed patch (%v)", err))
+				return
+			}
+			if errs, ok := err.(patchErrors); ok {
+				handlePatchErrors(w, 409, patchTestErrMsg, errs)
+				return
+			}
+			handleErrorAuto(w, err)
+			return
+		}
+	}
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1DataDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	path, ok := storage.ParsePath("/" + strings.Trim(vars["path"], "/"))
+	if !ok || len(path) == 0 {
+		handleErrorf(w, 400, "bad path format %v", vars["path"])
 		return
 	}
 
-	results, err := s.execQuery(ctx, compiler, txn, compiled, explainMode)
+	txn, err := s.store.NewTransaction(ctx)
 	if err != nil {
 		handleErrorAuto(w, err)
 		return
 	}
 
-	handleResponseJSON(w, 200, results, pretty)
-}
+	defer s.store.Close(ctx, txn)
 
-func handleCompileError(w http.ResponseWriter, err error) {
-	switch err := err.(type) {
-	case ast.Errors:
-		handleErrorAST(w, 400, compileQueryErrMsg, err)
-	default:
-		handleError(w, 400, err)
+	if err := s.writeConflict(storage.RemoveOp, path, nil); err != nil {
+		handleErrorAuto(w, err)
+		return
 	}
-}
 
-func (s *Server) setCompiler(compiler *ast.Compiler) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	s.compiler = compiler
+	if err := s.store.Write(ctx, txn, storage.RemoveOp, path, nil); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	handleResponse(w, 204, nil)
 }
 
-func (s *Server) makeDir(ctx context.Context, txn storage.Transaction, path storage.Path) error {
+func (s *Server) v1DataBatchDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pretty := getPretty(r.URL.Query()["pretty"])
+	atomic := getBool(r.URL.Query()["atomic"])
 
-	node, err := s.store.Read(ctx, txn, path)
-	if err == nil {
-		if _, ok := node.(map[string]interface{}); ok {
-			return nil
+	strs := []string{}
+	if err := util.NewStrictJSONDecoder(r.Body).Decode(&strs); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad paths"))
+		return
+	}
+
+	paths := make([]storage.Path, len(strs))
+	for i, str := range strs {
+		path, ok := storage.ParsePath(str)
+		if !ok || len(path) == 0 {
+			handleErrorf(w, 400, "bad path: %v", str)
+			return
 		}
-		return WriteConflictError{path}
+		paths[i] = path
 	}
 
-	if !storage.IsNotFound(err) {
-		return err
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
 	}
 
-	if err := s.makeDir(ctx, txn, path[:len(path)-1]); err != nil {
-		return err
+	defer s.store.Close(ctx, txn)
+
+	// Check all of the paths before removing any documents so that the batch
+	// is not partially applied if it fails.
+	resp := batchDeleteResponseV1{Missing: []string{}}
+	removals := []storage.Path{}
+
+	for i, path := range paths {
+		if err := s.writeConflict(storage.RemoveOp, path, nil); err != nil {
+			if atomic {
+				handleErrorAuto(w, err)
+				return
+			}
+			resp.Conflicts = append(resp.Conflicts, strs[i])
+			continue
+		}
+		if _, err := s.store.Read(ctx, txn, path); err != nil {
+			if !storage.IsNotFound(err) || atomic {
+				handleErrorAuto(w, err)
+				return
+			}
+			resp.Missing = append(resp.Missing, strs[i])
+			continue
+		}
+		removals = append(removals, path)
 	}
 
-	if err := s.writeConflict(storage.AddOp, path); err != nil {
-		return err
+	for _, path := range removals {
+		// The document may have been removed along with a parent earlier in
+		// the batch.
+		if err := s.store.Write(ctx, txn, storage.RemoveOp, path, nil); err != nil && !storage.IsNotFound(err) {
+			handleErrorAuto(w, err)
+			return
+		}
 	}
 
-	return s.store.Write(ctx, txn, storage.AddOp, path, map[string]interface{}{})
+	s.handleResponseJSON(w, 200, resp, pretty)
 }
 
-func (s *Server) prepareV1PatchSlice(root string, ops []patchV1) (result []patchImpl, err error) {
+func (s *Server) v1DataPut(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
 
-	root = "/" + strings.Trim(root, "/")
+	body, err := jsonBody(r)
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
 
-	for _, op := range ops {
-		impl := patchImpl{
-			value: op.Value,
-		}
+	var value interface{}
+	if err := util.NewJSONDecoder(body).Decode(&value); err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	path, ok := storage.ParsePath("/" + strings.Trim(vars["path"], "/"))
+	if !ok {
+		handleErrorf(w, 400, "bad path format %v", vars["path"])
+		return
+	}
+
+	if err := s.writeConflict(storage.AddOp, path, value); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	var diff *dataDiffV1
+	if getBool(r.URL.Query()["diff"]) {
+		diff = &dataDiffV1{Patch: []patchV1{}}
+	}
+
+	// created is set to the path of the new document if the document did not
+	// exist before.
+	var created storage.Path
+
+	if isAppendPath(path) {
+		// The final path element refers to the end of an array. The array is
+		// created if it does not exist yet.
+		if err := s.makeArray(ctx, txn, path[:len(path)-1]); err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+		arr, err := s.store.Read(ctx, txn, path[:len(path)-1])
+		if err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+		created = append(created, path[:len(path)-1]...)
+		created = append(created, strconv.Itoa(len(arr.([]interface{}))))
+		if diff != nil {
+			diff.add(jsonPointer(path), value)
+		}
+	} else if current, err := s.store.Read(ctx, txn, path); err != nil {
+		if !storage.IsNotFound(err) {
+			handleErrorAuto(w, err)
+			return
+		}
+		if err := s.makeDir(ctx, txn, path[:len(path)-1]); err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+		created = path
+		if diff != nil {
+			diff.add(jsonPointer(path), value)
+		}
+	} else if r.Header.Get("If-None-Match") == "*" {
+		handleResponse(w, 304, nil)
+		return
+	} else if diff != nil {
+		if diff.compare(jsonPointer(path), current, value); !diff.Changed {
+			s.handleResponseJSON(w, 200, diff, false)
+			return
+		}
+	}
+
+	if err := s.store.Write(ctx, txn, storage.AddOp, path, value); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	if created != nil {
+		location := url.URL{Path: "/v1/data" + created.String()}
+		w.Header().Set("Location", location.String())
+		if diff != nil {
+			s.handleResponseJSON(w, 201, diff, false)
+			return
+		}
+		handleResponse(w, 201, nil)
+		return
+	}
+
+	if diff != nil {
+		s.handleResponseJSON(w, 200, diff, false)
+		return
+	}
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1PoliciesCompile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	// The result of compilation is discarded. The server's compiler is not
+	// modified.
+	c := ast.NewCompiler()
+
+	if c.Compile(s.store.ListPolicies(txn)); c.Failed() {
+		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
+		return
+	}
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1PoliciesDiff(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, 500, err)
+		return
+	}
+
+	parsedMod, err := ast.ParseModule(id, string(buf))
+
+	if err != nil {
+		switch err := err.(type) {
+		case ast.Errors:
+			handleErrorAST(w, 400, compileModErrMsg, err)
+		default:
+			handleError(w, 400, err)
+		}
+		return
+	}
+
+	if parsedMod == nil {
+		handleErrorf(w, 400, "refusing to diff empty module")
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	mods := s.store.ListPolicies(txn)
+	mods[id] = parsedMod
+
+	// The result of compilation is discarded. The server's compiler is not
+	// modified.
+	c := ast.NewCompiler()
+
+	if c.Compile(mods); c.Failed() {
+		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, newPolicyDiffV1(id, s.Compiler().Modules[id], c.Modules[id]), true)
+}
+
+func (s *Server) v1PoliciesReload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	var c *ast.Compiler
+
+	// The reloaded modules are subject to the same checks as modules that are
+	// created through the API. Forbidden is set if a module uses a built-in
+	// function that is not allowed.
+	var forbidden bool
+
+	err = s.store.ReloadPolicies(txn, func(mods map[string]*ast.Module) error {
+
+		c = ast.NewCompiler()
+		if c.Compile(mods); c.Failed() {
+			return c.Errors
+		}
+
+		ids := make([]string, 0, len(mods))
+		for id := range mods {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		var errs ast.Errors
+
+		if s.strictImports {
+			for _, id := range ids {
+				errs = append(errs, s.checkImports(ctx, txn, c, mods[id])...)
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+		}
+
+		for _, id := range ids {
+			errs = append(errs, s.checkBuiltins(mods[id])...)
+		}
+
+		if len(errs) > 0 {
+			forbidden = true
+			return errs
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		switch err := err.(type) {
+		case ast.Errors:
+			if forbidden {
+				handleErrorAST(w, 403, compileModErrMsg, err)
+			} else {
+				handleErrorAST(w, 400, compileModErrMsg, err)
+			}
+		default:
+			handleErrorAuto(w, err)
+		}
+		return
+	}
+
+	// The compiler is not set if policies are not persisted.
+	if c != nil {
+		s.setCompiler(c)
+	}
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1PoliciesDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	_, _, err = s.store.GetPolicy(txn, id)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	mods := s.store.ListPolicies(txn)
+	delete(mods, id)
+
+	c := ast.NewCompiler()
+
+	if c.Compile(mods); c.Failed() {
+		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
+		return
+	}
+
+	if err := s.store.DeletePolicy(txn, id); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	s.setCompiler(c)
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1PoliciesGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	_, _, err = s.store.GetPolicy(txn, id)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	c := s.Compiler()
+
+	policy := &policyV1{
+		ID:     id,
+		Module: c.Modules[id],
+	}
+
+	s.handleResponseJSON(w, 200, policy, true)
+}
+
+func (s *Server) v1PoliciesQuery(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+	values := r.URL.Query()
+	pretty := getPretty(values["pretty"])
+
+	qStrs := values["q"]
+	if len(qStrs) == 0 {
+		handleErrorf(w, 400, "missing query parameter 'q'")
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	if _, _, err := s.store.GetPolicy(txn, id); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	// The module is compiled along with the modules it imports. Other policies
+	// are ignored. The server's compiler is not modified.
+	c := ast.NewCompiler()
+
+	if c.Compile(isolatedModules(s.store.ListPolicies(txn), id)); c.Failed() {
+		handleErrorAST(w, 400, compileModErrMsg, c.Errors)
+		return
+	}
+
+	query, err := ast.ParseBody(qStrs[len(qStrs)-1])
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
+
+	compiled, err := c.QueryCompiler().Compile(query)
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
+
+	if errs := s.checkBuiltins(compiled); len(errs) > 0 {
+		handleErrorAST(w, 403, compileQueryErrMsg, errs)
+		return
+	}
+
+	results, err := s.execQuery(ctx, c, txn, compiled, explainOffV1, traceFilterV1{}, nil, 0)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, results, pretty)
+}
+
+// isolatedModules returns the module identified by id along with the modules
+// that it imports (directly or indirectly). A module is imported if its package
+// is contained in, or contains, the document referred to by an import.
+func isolatedModules(mods map[string]*ast.Module, id string) map[string]*ast.Module {
+
+	result := map[string]*ast.Module{}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+		if _, ok := result[curr]; ok {
+			continue
+		}
+		result[curr] = mods[curr]
+		for _, imp := range mods[curr].Imports {
+			ref, ok := imp.Path.Value.(ast.Ref)
+			if !ok || !ref[0].Equal(ast.DefaultRootDocument) {
+				continue
+			}
+			for other, mod := range mods {
+				if ref.HasPrefix(mod.Package.Path) || mod.Package.Path.HasPrefix(ref) {
+					queue = append(queue, other)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func (s *Server) v1PoliciesRawGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	_, bs, err := s.store.GetPolicy(txn, id)
+
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	handleResponse(w, 200, bs)
+}
+
+func (s *Server) v1PoliciesRulesGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+	pretty := getPretty(r.URL.Query()["pretty"])
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	_, _, err = s.store.GetPolicy(txn, id)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	mod := s.Compiler().Modules[id]
+	rules := make([]ruleSummaryV1, len(mod.Rules))
+
+	for i, rule := range mod.Rules {
+		rules[i] = ruleSummaryV1{
+			Name:     string(rule.Name),
+			Path:     rule.Path(mod.Package.Path).String(),
+			Location: rule.Location,
+		}
+	}
+
+	s.handleResponseJSON(w, 200, rules, pretty)
+}
+
+// reservedPolicyIDs contains the names of the policy actions that are routed
+// alongside policy IDs, e.g., GET /v1/policies/export. Policies with these IDs
+// could not be addressed by the Policy API.
+var reservedPolicyIDs = map[string]struct{}{
+	"compile": {},
+	"export":  {},
+	"reload":  {},
+}
+
+// checkPolicyID returns an error if the ID cannot be used for a policy. IDs
+// must not be reserved and must be valid file names because they are used as
+// file names when policies are persisted.
+func checkPolicyID(id string) error {
+	if _, ok := reservedPolicyIDs[id]; ok {
+		return badRequestError(fmt.Sprintf("bad policy id %q: reserved", id))
+	}
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return badRequestError(fmt.Sprintf("bad policy id %q: must be a valid file name", id))
+	}
+	return nil
+}
+
+// exportEntryName returns the name of the archive entry for the policy. The ID
+// is escaped so that each policy is a single file in the archive, even if it
+// was loaded from storage without being checked.
+func exportEntryName(id string) string {
+	name := url.PathEscape(id)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return name
+}
+
+func (s *Server) v1PoliciesExport(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	ids := []string{}
+	for id := range s.store.ListPolicies(txn) {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	// Copy all of the raw policies before writing the response so that
+	// storage errors can still be reported to the client and so that the
+	// transaction is not held open while the archive is sent to the client.
+	raws := make([][]byte, len(ids))
+	for i, id := range ids {
+		_, raw, err := s.store.GetPolicy(txn, id)
+		if err != nil {
+			s.store.Close(ctx, txn)
+			handleErrorAuto(w, err)
+			return
+		}
+		raws[i] = append([]byte(nil), raw...)
+	}
+
+	s.store.Close(ctx, txn)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="policies.tar.gz"`)
+	w.WriteHeader(200)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+
+	for i, id := range ids {
+		hdr := &tar.Header{
+			Name:    exportEntryName(id),
+			Mode:    0644,
+			Size:    int64(len(raws[i])),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return
+		}
+		if _, err := tw.Write(raws[i]); err != nil {
+			return
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return
+	}
+
+	gw.Close()
+}
+
+func (s *Server) v1PoliciesList(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+	values := r.URL.Query()
+	summary := getBool(values["summary"])
+	prefix := values.Get("prefix")
+	paginate := len(values["limit"]) > 0 || len(values["offset"]) > 0
+	policies := []*policyV1{}
+
+	limit, err := getLimit(values["limit"])
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	offset, err := getOffset(values["offset"])
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	// A transaction is only needed to read the raw modules for summaries.
+	var txn storage.Transaction
+
+	if summary {
+		txn, err = s.store.NewTransaction(ctx)
+		if err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+		defer s.store.Close(ctx, txn)
+	}
+
+	c := s.Compiler()
+
+	// The policies are listed in order of ID so that pages are stable.
+	ids := []string{}
+	for id, mod := range c.Modules {
+		if prefix != "" && !strings.HasPrefix(id, prefix) && !strings.HasPrefix(packagePath(mod.Package), prefix) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	var next *int
+
+	if offset > len(ids) {
+		offset = len(ids)
+	}
+
+	ids = ids[offset:]
+
+	if limit > 0 && limit < len(ids) {
+		ids = ids[:limit]
+		n := offset + limit
+		next = &n
+	}
+
+	for _, id := range ids {
+		mod := c.Modules[id]
+		policy := &policyV1{
+			ID:     id,
+			Module: mod,
+		}
+		if summary {
+			parsed, raw, err := s.store.GetPolicy(txn, id)
+			if err != nil {
+				handleErrorAuto(w, err)
+				return
+			}
+			policy.Summary = newPolicySummaryV1(parsed, mod, raw)
+		}
+		policies = append(policies, policy)
+	}
+
+	if paginate {
+		s.handleResponseJSON(w, 200, policyPageV1{Result: policies, Next: next}, true)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, policies, true)
+}
+
+// packagePath returns the dotted path of the package without the leading data
+// root, e.g., "com.example".
+func packagePath(pkg *ast.Package) string {
+	parts := make([]string, 0, len(pkg.Path)-1)
+	for _, x := range pkg.Path[1:] {
+		if str, ok := x.Value.(ast.String); ok {
+			parts = append(parts, string(str))
+		} else {
+			parts = append(parts, x.String())
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s *Server) v1PoliciesPut(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	id := vars["id"]
+	dryRun := getBool(r.URL.Query()["dryrun"])
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, 500, err)
+		return
+	}
+
+	if err := checkPolicyID(id); err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	parsedMod, err := ast.ParseModule(id, string(buf))
+
+	if err != nil {
+		switch err := err.(type) {
+		case ast.Errors:
+			handleErrorAST(w, 400, compileModErrMsg, err)
+		default:
+			handleError(w, 400, err)
+		}
+		return
+	}
+
+	if parsedMod == nil {
+		handleErrorf(w, 400, "refusing to add empty module")
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	mods := s.store.ListPolicies(txn)
+	mods[id] = parsedMod
+
+	c := ast.NewCompiler()
+
+	if c.Compile(mods); c.Failed() {
+		handleErrorPolicy(w, 400, c.Errors, id)
+		return
+	}
+
+	if s.strictImports {
+		if errs := s.checkImports(ctx, txn, c, parsedMod); len(errs) > 0 {
+			handleErrorAST(w, 400, compileModErrMsg, errs)
+			return
+		}
+	}
+
+	if errs := s.checkBuiltins(parsedMod); len(errs) > 0 {
+		handleErrorAST(w, 403, compileModErrMsg, errs)
+		return
+	}
+
+	policy := &policyV1{
+		ID:     id,
+		Module: c.Modules[id],
+	}
+
+	// A dry run performs all of the checks but leaves the store and the
+	// server's compiler unchanged.
+	if dryRun {
+		s.handleResponseJSON(w, 200, policy, true)
+		return
+	}
+
+	if err := s.store.InsertPolicy(txn, id, parsedMod, buf, s.persist); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	s.setCompiler(c)
+
+	s.handleResponseJSON(w, 200, policy, true)
+}
+
+func (s *Server) v1PoliciesPutBulk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	sources := map[string]string{}
+	if err := util.NewJSONDecoder(r.Body).Decode(&sources); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad policies"))
+		return
+	}
+
+	if len(sources) == 0 {
+		handleErrorf(w, 400, "refusing to add empty set of modules")
+		return
+	}
+
+	ids := make([]string, 0, len(sources))
+	for id := range sources {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if err := checkPolicyID(id); err != nil {
+			handleError(w, 400, err)
+			return
+		}
+	}
+
+	parsed := make(map[string]*ast.Module, len(ids))
+	var parseErrs ast.Errors
+
+	for _, id := range ids {
+		mod, err := ast.ParseModule(id, sources[id])
+		if err != nil {
+			switch err := err.(type) {
+			case ast.Errors:
+				parseErrs = append(parseErrs, err...)
+			default:
+				handleError(w, 400, err)
+				return
+			}
+			continue
+		}
+		if mod == nil {
+			handleErrorf(w, 400, "refusing to add empty module: %v", id)
+			return
+		}
+		parsed[id] = mod
+	}
+
+	if len(parseErrs) > 0 {
+		handleErrorAST(w, 400, compileModErrMsg, parseErrs)
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	// The modules are compiled together with the existing modules so that the
+	// set is accepted if it compiles as a whole, regardless of the order the
+	// modules would have been created in individually.
+	mods := s.store.ListPolicies(txn)
+	for id, mod := range parsed {
+		mods[id] = mod
+	}
+
+	c := ast.NewCompiler()
+
+	if c.Compile(mods); c.Failed() {
+		handleErrorPolicy(w, 400, c.Errors, ids...)
+		return
+	}
+
+	var errs ast.Errors
+
+	if s.strictImports {
+		for _, id := range ids {
+			errs = append(errs, s.checkImports(ctx, txn, c, parsed[id])...)
+		}
+		if len(errs) > 0 {
+			handleErrorAST(w, 400, compileModErrMsg, errs)
+			return
+		}
+	}
+
+	for _, id := range ids {
+		errs = append(errs, s.checkBuiltins(parsed[id])...)
+	}
+
+	if len(errs) > 0 {
+		handleErrorAST(w, 403, compileModErrMsg, errs)
+		return
+	}
+
+	// The previous versions of the modules are saved so that the modules
+	// inserted before a failure can be restored. Otherwise the policy store
+	// would contain modules that the compiler does not.
+	type previous struct {
+		mod    *ast.Module
+		raw    []byte
+		exists bool
+	}
+
+	prev := make([]previous, len(ids))
+	for i, id := range ids {
+		mod, raw, err := s.store.GetPolicy(txn, id)
+		if err == nil {
+			prev[i] = previous{mod, raw, true}
+		} else if !storage.IsNotFound(err) {
+			handleErrorAuto(w, err)
+			return
+		}
+	}
+
+	policies := make([]*policyV1, len(ids))
+
+	for i, id := range ids {
+		if err := s.store.InsertPolicy(txn, id, parsed[id], []byte(sources[id]), s.persist); err != nil {
+			// The module is installed even if it cannot be persisted so it
+			// must be restored along with the modules inserted before it.
+			for j := i; j >= 0; j-- {
+				var rerr error
+				if prev[j].exists {
+					rerr = s.store.InsertPolicy(txn, ids[j], prev[j].mod, prev[j].raw, s.persist)
+				} else {
+					rerr = s.store.DeletePolicy(txn, ids[j])
+				}
+				if rerr != nil {
+					handleError(w, 500, errors.Wrapf(rerr, "cannot undo failed policy update (%v)", err))
+					return
+				}
+			}
+			handleErrorAuto(w, err)
+			return
+		}
+		policies[i] = &policyV1{
+			ID:     id,
+			Module: c.Modules[id],
+		}
+	}
+
+	s.setCompiler(c)
+
+	s.handleResponseJSON(w, 200, policies, true)
+}
+
+func (s *Server) v1ProfilesDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	s.profilesMtx.Lock()
+	defer s.profilesMtx.Unlock()
+
+	if _, ok := s.profiles[name]; !ok {
+		handleErrorf(w, 404, "profile not found: %v", name)
+		return
+	}
+
+	delete(s.profiles, name)
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1ProfilesGet(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	pretty := getPretty(r.URL.Query()["pretty"])
+
+	s.profilesMtx.RLock()
+	profile, ok := s.profiles[name]
+	s.profilesMtx.RUnlock()
+
+	if !ok {
+		handleErrorf(w, 404, "profile not found: %v", name)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, profile, pretty)
+}
+
+func (s *Server) v1ProfilesPut(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var profile interface{}
+	if err := util.NewJSONDecoder(r.Body).Decode(&profile); err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	s.profilesMtx.Lock()
+	defer s.profilesMtx.Unlock()
+
+	s.profiles[name] = profile
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1SchemasDelete(w http.ResponseWriter, r *http.Request) {
+	key := schemaKey(mux.Vars(r)["path"])
+
+	s.schemasMtx.Lock()
+	defer s.schemasMtx.Unlock()
+
+	if _, ok := s.schemas[key]; !ok {
+		handleErrorf(w, 404, "schema not found: %v", key)
+		return
+	}
+
+	delete(s.schemas, key)
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1SchemasGet(w http.ResponseWriter, r *http.Request) {
+	key := schemaKey(mux.Vars(r)["path"])
+	pretty := getPretty(r.URL.Query()["pretty"])
+
+	s.schemasMtx.RLock()
+	schema, ok := s.schemas[key]
+	s.schemasMtx.RUnlock()
+
+	if !ok {
+		handleErrorf(w, 404, "schema not found: %v", key)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, schema.raw, pretty)
+}
+
+func (s *Server) v1SchemasPut(w http.ResponseWriter, r *http.Request) {
+	key := schemaKey(mux.Vars(r)["path"])
+
+	var raw interface{}
+	if err := util.NewJSONDecoder(r.Body).Decode(&raw); err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	schema, err := newInputSchema(raw)
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	s.schemasMtx.Lock()
+	defer s.schemasMtx.Unlock()
+
+	s.schemas[key] = schema
+
+	handleResponse(w, 204, nil)
+}
+
+// schemaKey returns the key that identifies the schema for the document at the
+// slash separated path.
+func schemaKey(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+// inputSchemaFor returns the input schema that applies to the document
+// referred to by path. The schema registered for the path itself takes
+// precedence over schemas registered for enclosing documents. If no schema
+// applies, nil is returned.
+func (s *Server) inputSchemaFor(path ast.Ref) (*inputSchema, string) {
+
+	s.schemasMtx.RLock()
+	defer s.schemasMtx.RUnlock()
+
+	if len(s.schemas) == 0 {
+		return nil, ""
+	}
+
+	keys := []string{}
+	key := ""
+
+	for _, x := range path[1:] {
+		str, ok := x.Value.(ast.String)
+		if !ok {
+			break
+		}
+		key += "/" + string(str)
+		keys = append(keys, key)
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		if schema, ok := s.schemas[keys[i]]; ok {
+			return schema, keys[i]
+		}
+	}
+
+	return nil, ""
+}
+
+// validateRequest checks the request document against the input schema that
+// applies to the document referred to by path. If no schema applies, the
+// request is not checked. References to data in the request are resolved in
+// txn, i.e., the transaction the query is evaluated in.
+func (s *Server) validateRequest(ctx context.Context, txn storage.Transaction, path ast.Ref, request ast.Value, nonGround bool) error {
+
+	schema, key := s.inputSchemaFor(path)
+	if schema == nil {
+		return nil
+	}
+
+	if nonGround {
+		return badRequestError(fmt.Sprintf("input schema for %v requires ground request values", key))
+	}
+
+	var doc interface{}
+
+	if request != nil {
+		var err error
+		doc, err = topdown.ValueToInterface(request, topdown.New(ctx, nil, s.Compiler(), s.store, txn))
+		if err != nil {
+			return err
+		}
+	}
+
+	if errs := schema.validate(doc); len(errs) > 0 {
+		return &inputSchemaError{path: key, errs: errs}
+	}
+
+	return nil
+}
+
+func (s *Server) v1QueriesDelete(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	s.queriesMtx.Lock()
+	defer s.queriesMtx.Unlock()
+
+	if _, ok := s.queries[name]; !ok {
+		handleErrorf(w, 404, "query not found: %v", name)
+		return
+	}
+
+	delete(s.queries, name)
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1QueriesGet(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["name"]
+	values := r.URL.Query()
+	pretty := getPretty(values["pretty"])
+	explainMode := getExplain(values["explain"])
+
+	s.queriesMtx.RLock()
+	template, ok := s.queries[name]
+	s.queriesMtx.RUnlock()
+
+	if !ok {
+		handleErrorf(w, 404, "query not found: %v", name)
+		return
+	}
+
+	query, err := template.bind(values["param"])
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	results, err := s.execQuery(ctx, s.Compiler(), txn, query, explainMode, traceFilterV1{}, nil, 0)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	s.handleResponseJSON(w, 200, results, pretty)
+}
+
+func (s *Server) v1QueriesPut(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		handleError(w, 500, err)
+		return
+	}
+
+	query, err := ast.ParseBody(string(buf))
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
+
+	template, err := newNamedQuery(s.Compiler(), query, r.URL.Query()["param"])
+	if err != nil {
+		if _, ok := err.(badRequestError); ok {
+			handleError(w, 400, err)
+		} else {
+			handleCompileError(w, err)
+		}
+		return
+	}
+
+	if errs := s.checkBuiltins(template.body); len(errs) > 0 {
+		handleErrorAST(w, 403, compileQueryErrMsg, errs)
+		return
+	}
+
+	s.queriesMtx.Lock()
+	defer s.queriesMtx.Unlock()
+
+	s.queries[name] = template
+
+	handleResponse(w, 204, nil)
+}
+
+func (s *Server) v1QueryGet(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	pretty := getPretty(values["pretty"])
+	explainMode := getExplain(values["explain"])
+	qStrs := values["q"]
+	if len(qStrs) == 0 {
+		handleErrorf(w, 400, "missing query parameter 'q'")
+		return
+	}
+
+	s.v1Query(w, r, qStrs[len(qStrs)-1], explainMode, pretty)
+}
+
+func (s *Server) v1QueryPost(w http.ResponseWriter, r *http.Request) {
+
+	var request queryRequestV1
+	if err := util.NewStrictJSONDecoder(r.Body).Decode(&request); err != nil {
+		handleError(w, 400, errors.Wrap(err, "bad query request"))
+		return
+	}
+
+	if request.Query == "" {
+		handleErrorf(w, 400, "bad query request: missing query")
+		return
+	}
+
+	s.v1Query(w, r, request.Query, getExplain([]string{request.Explain}), request.Pretty)
+}
+
+// v1Query evaluates an ad-hoc query. The remaining options are read from the
+// URL query parameters so that GET and POST requests behave the same.
+func (s *Server) v1Query(w http.ResponseWriter, r *http.Request, qStr string, explainMode explainModeV1, pretty bool) {
+	ctx := r.Context()
+	values := r.URL.Query()
+	numbers := getNumberFormat(values["numbers"])
+	metrics := getBool(values["metrics"])
+	echoQuery := getBool(values["echo_query"])
+
+	limit, err := getLimit(values["limit"])
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	traceFilter, err := getTraceFilter(values, explainMode)
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	compiler := s.Compiler()
+
+	query, err := ast.ParseBody(qStr)
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
+
+	compiled, err := compiler.QueryCompiler().Compile(query)
+	if err != nil {
+		handleCompileError(w, err)
+		return
+	}
+
+	if errs := s.checkBuiltins(compiled); len(errs) > 0 {
+		handleErrorAST(w, 403, compileQueryErrMsg, errs)
+		return
+	}
+
+	if root := strings.Trim(values.Get("data_root"), "/"); root != "" {
+		if compiled, err = rebaseDataRefs(compiled, stringPathToDataRef(root)); err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+	}
+
+	var counters *topdown.Counters
+	if metrics {
+		counters = topdown.NewCounters()
+	}
+
+	// Evaluate one result past the limit to determine if the result set was
+	// truncated.
+	t0 := time.Now()
+	results, err := s.execQuery(ctx, compiler, txn, compiled, explainMode, traceFilter, counters, limitPlusOne(limit))
+	s.setEvalDuration(w, time.Since(t0))
+
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	if rs, ok := results.(adhocQueryResultSetV1); ok && numbers == numberFormatStringV1 {
+		for i := range rs {
+			rs[i] = stringifyNumbers(rs[i]).(map[string]interface{})
+		}
+	}
+
+	if rs, ok := results.(adhocQueryResultSetV1); ok && limit > 0 {
+		truncated := len(rs) > limit
+		if truncated {
+			rs = rs[:limit]
+		}
+		results = truncatedResultV1{Result: rs, Truncated: truncated}
+	}
+
+	if echoQuery {
+		results = echoQueryResultV1{Query: qStr, Result: results}
+	}
+
+	if counters != nil {
+		results = newMetricsResultV1(results, counters)
+	}
+
+	s.handleResponseJSON(w, 200, results, pretty)
+}
+
+func (s *Server) v1TenantsDataGet(w http.ResponseWriter, r *http.Request) {
+
+	// Gather request parameters.
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	pretty := getPretty(r.URL.Query()["pretty"])
+	tenants := r.URL.Query()[ParamTenantV1]
+
+	if len(tenants) == 0 {
+		handleErrorf(w, 400, "missing query parameter '%v'", ParamTenantV1)
+		return
+	}
+
+	for _, tenant := range tenants {
+		if tenant == "" || strings.Contains(tenant, "/") {
+			handleErrorf(w, 400, "bad tenant identifier %q", tenant)
+			return
+		}
+	}
+
+	request, nonGround, err := s.parseRequestParams(r.URL.Query()[ParamRequestV1])
+	if err != nil {
+		handleError(w, 400, err)
+		return
+	}
+
+	// Prepare for queries. All tenants are evaluated inside the same
+	// transaction so that results are consistent with each other.
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	compiler := s.Compiler()
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
+
+	results := map[string]interface{}{}
+
+	for _, tenant := range tenants {
+
+		path := tenantDataRef(tenant, vars["path"])
+		if err := s.validateRequest(ctx, txn, path, request, nonGround); err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+
+		params := topdown.NewQueryParams(evalCtx, compiler, s.store, txn, request, path)
+		params.Budget = s.newMemoryBudget()
+		params.DepthLimit = s.depthLimit
+
+		qrs, err := topdown.Query(params)
+		if err != nil {
+			handleErrorAuto(w, err)
+			return
+		}
+
+		// Tenants for which the document is undefined are omitted.
+		if qrs.Undefined() {
+			continue
+		}
+
+		if nonGround {
+			results[tenant] = newQueryResultSetV1(qrs)
+		} else {
+			results[tenant] = qrs[0].Result
+		}
+	}
+
+	s.handleResponseJSON(w, 200, results, pretty)
+}
+
+func (s *Server) v1VersionGet(w http.ResponseWriter, r *http.Request) {
+	pretty := getPretty(r.URL.Query()["pretty"])
+	s.handleResponseJSON(w, 200, newVersionV1(), pretty)
+}
+
+func newVersionV1() versionV1 {
+	return versionV1{
+		Version:        version.Version,
+		BuildCommit:    version.Vcs,
+		BuildTimestamp: version.Timestamp,
+		BuildHostname:  version.Hostname,
+		GoVersion:      runtime.Version(),
+	}
+}
+
+// versionsGet describes the server version and the API versions and routes
+// mounted by the server so that clients can discover supported features.
+func (s *Server) versionsGet(w http.ResponseWriter, r *http.Request) {
+
+	pretty := getPretty(r.URL.Query()["pretty"])
+
+	routes := make([]routeV1, len(s.routesV1))
+	copy(routes, s.routesV1)
+	sort.Sort(routeSliceV1(routes))
+
+	s.handleResponseJSON(w, 200, versionsV1{
+		versionV1: newVersionV1(),
+		APIVersions: []apiVersionV1{
+			{Version: "v1", Prefix: "/v1", Routes: routes},
+		},
+	}, pretty)
+}
+
+// acceptsJSON returns true if the Accept header value prefers JSON (or YAML)
+// over HTML. The media types are considered in the order they are listed.
+func acceptsJSON(header string) bool {
+	for _, x := range strings.Split(header, ",") {
+		mediaType := strings.TrimSpace(strings.Split(x, ";")[0])
+		if mediaType == "application/json" || isYAMLMediaType(mediaType) {
+			return true
+		}
+		if mediaType == "text/html" {
+			return false
+		}
+	}
+	return false
+}
+
+func handleCompileError(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case ast.Errors:
+		handleErrorAST(w, 400, compileQueryErrMsg, err)
+	default:
+		handleError(w, 400, err)
+	}
+}
+
+func (s *Server) setCompiler(compiler *ast.Compiler) {
+	s.mtx.Lock()
+	s.compiler = compiler
+	s.mtx.Unlock()
+
+	// Policy changes may affect any document.
+	s.watchers.notify(nil)
+}
+
+// checkImports returns errors for imports in the module that do not refer to a
+// package, rule, or base document known to the server. Imports of the request
+// document are always allowed.
+func (s *Server) checkImports(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, module *ast.Module) (errs ast.Errors) {
+
+	for _, imp := range module.Imports {
+
+		ref, ok := imp.Path.Value.(ast.Ref)
+		if !ok || !ref[0].Equal(ast.DefaultRootDocument) {
+			continue
+		}
+
+		if s.importResolves(ctx, txn, compiler, ref) {
+			continue
+		}
+
+		errs = append(errs, ast.NewError(ast.CompileErr, imp.Location, "import %v cannot be resolved", ref))
+	}
+
+	return errs
+}
+
+// checkBuiltins returns errors for calls to built-in functions under x that
+// the server does not allow.
+func (s *Server) checkBuiltins(x interface{}) (errs ast.Errors) {
+
+	if s.allowedBuiltins == nil && len(s.deniedBuiltins) == 0 {
+		return nil
+	}
+
+	ast.WalkBodies(x, func(body ast.Body) bool {
+		for _, expr := range body {
+			ts, ok := expr.Terms.([]*ast.Term)
+			if !ok {
+				continue
+			}
+			name, ok := ts[0].Value.(ast.Var)
+			if !ok || s.builtinAllowed(name) {
+				continue
+			}
+			errs = append(errs, ast.NewError(ast.CompileErr, expr.Location, "built-in function %v not allowed", name))
+		}
+		return false
+	})
+
+	return errs
+}
+
+// builtinAllowed returns true if the built-in function may be called. Equality
+// is always allowed because it is used for unification.
+func (s *Server) builtinAllowed(name ast.Var) bool {
+	if name.Equal(ast.Equality.Name) {
+		return true
+	}
+	if s.deniedBuiltins[name] {
+		return false
+	}
+	return s.allowedBuiltins == nil || s.allowedBuiltins[name]
+}
+
+func (s *Server) importResolves(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, ref ast.Ref) bool {
+
+	// Check if the import refers to a package or a namespace containing
+	// packages.
+	node := compiler.ModuleTree
+	for _, x := range ref {
+		if node = node.Children[x.Value]; node == nil {
+			break
+		}
+	}
+
+	if node != nil {
+		return true
+	}
+
+	// Check if the import refers to a virtual document (or a document
+	// contained inside one).
+	if compiler.GetRulesForVirtualDocument(ref) != nil {
+		return true
+	}
+
+	// Check if the import refers to a base document.
+	path, err := storage.NewPathForRef(ref)
+	if err != nil {
+		return false
+	}
+
+	_, err = s.store.Read(ctx, txn, path)
+	return err == nil
+}
+
+func (s *Server) makeDir(ctx context.Context, txn storage.Transaction, path storage.Path) error {
+
+	node, err := s.store.Read(ctx, txn, path)
+	if err == nil {
+		if _, ok := node.(map[string]interface{}); ok {
+			return nil
+		}
+		return WriteConflictError{path: path}
+	}
+
+	if !storage.IsNotFound(err) {
+		return err
+	}
+
+	if err := s.makeDir(ctx, txn, path[:len(path)-1]); err != nil {
+		return err
+	}
+
+	if err := s.writeConflict(storage.AddOp, path, map[string]interface{}{}); err != nil {
+		return err
+	}
+
+	return s.store.Write(ctx, txn, storage.AddOp, path, map[string]interface{}{})
+}
+
+// makeArray ensures that an array exists at path so that values can be appended
+// to it. If the path does not refer to an existing document, an empty array is
+// created (along with any necessary containing documents).
+func (s *Server) makeArray(ctx context.Context, txn storage.Transaction, path storage.Path) error {
+
+	node, err := s.store.Read(ctx, txn, path)
+	if err == nil {
+		if _, ok := node.([]interface{}); ok {
+			return nil
+		}
+		return badAppendPathError(path)
+	}
+
+	if !storage.IsNotFound(err) {
+		return err
+	}
+
+	if err := s.makeDir(ctx, txn, path[:len(path)-1]); err != nil {
+		return err
+	}
+
+	if err := s.writeConflict(storage.AddOp, path, []interface{}{}); err != nil {
+		return err
+	}
+
+	return s.store.Write(ctx, txn, storage.AddOp, path, []interface{}{})
+}
+
+// documentSources returns the source of the document referred to by ref. If
+// the document is an object, the result maps each top-level key to the source
+// of the value under that key.
+func (s *Server) documentSources(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, ref ast.Ref, doc interface{}) interface{} {
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return s.documentSource(ctx, txn, compiler, ref)
+	}
+	sources := make(map[string]string, len(obj))
+	for k := range obj {
+		sources[k] = s.documentSource(ctx, txn, compiler, append(ref.Copy(), ast.StringTerm(k)))
+	}
+	return sources
+}
+
+// documentSource returns "virtual" if the document referred to by ref is
+// produced by rules, "base" if the document is stored, and "mixed" if the
+// document contains both base and virtual documents.
+func (s *Server) documentSource(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, ref ast.Ref) string {
+
+	node := compiler.RuleTree
+	for _, x := range ref {
+		if node = node.Children[x.Value]; node == nil {
+			break
+		}
+		if len(node.Rules) > 0 {
+			return sourceVirtualV1
+		}
+	}
+
+	base := false
+	if path, err := storage.NewPathForRef(ref); err == nil {
+		_, err := s.store.Read(ctx, txn, path)
+		base = err == nil
+	}
+
+	switch {
+	case node != nil && base:
+		return sourceMixedV1
+	case node != nil:
+		return sourceVirtualV1
+	default:
+		return sourceBaseV1
+	}
+}
+
+// foldPath returns a copy of ref where string elements that do not match an
+// existing key are replaced by the key that matches case-insensitively. Both
+// base and virtual documents are considered. If no key or more than one key
+// matches, the element is left unchanged.
+func (s *Server) foldPath(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, ref ast.Ref) ast.Ref {
+
+	result := ast.Ref{ref[0]}
+
+	for i := 1; i < len(ref); i++ {
+
+		str, ok := ref[i].Value.(ast.String)
+		if !ok {
+			result = append(result, ref[i])
+			continue
+		}
+
+		keys := s.childKeys(ctx, txn, compiler, result)
+		if _, ok := keys[string(str)]; ok {
+			result = append(result, ref[i])
+			continue
+		}
+
+		var match string
+		var count int
+
+		for k := range keys {
+			if strings.EqualFold(k, string(str)) {
+				match = k
+				count++
+			}
+		}
+
+		if count == 1 {
+			result = append(result, ast.StringTerm(match))
+		} else {
+			result = append(result, ref[i])
+		}
+	}
+
+	return result
+}
+
+// childKeys returns the set of keys of the base and virtual documents
+// contained directly under ref.
+func (s *Server) childKeys(ctx context.Context, txn storage.Transaction, compiler *ast.Compiler, ref ast.Ref) map[string]struct{} {
+
+	keys := map[string]struct{}{}
+
+	if path, err := storage.NewPathForRef(ref); err == nil {
+		if node, err := s.store.Read(ctx, txn, path); err == nil {
+			if obj, ok := node.(map[string]interface{}); ok {
+				for k := range obj {
+					keys[k] = struct{}{}
+				}
+			}
+		}
+	}
+
+	node := compiler.RuleTree
+	for _, x := range ref {
+		if node = node.Children[x.Value]; node == nil {
+			return keys
+		}
+	}
+
+	for k := range node.Children {
+		if str, ok := k.(ast.String); ok {
+			keys[string(str)] = struct{}{}
+		}
+	}
+
+	return keys
+}
+
+func (s *Server) prepareV1PatchSlice(root string, ops []patchV1) (result []patchImpl, err error) {
+
+	root = "/" + strings.Trim(root, "/")
+
+	var errs patchErrors
+
+	for i, op := range ops {
+		impl := patchImpl{
+			value: op.Value,
+		}
+
+		// Map patch operation.
+		switch op.Op {
+		case "add":
+			impl.op = storage.AddOp
+		case "remove":
+			impl.op = storage.RemoveOp
+		case "replace":
+			impl.op = storage.ReplaceOp
+		case "test":
+			impl.test = true
+		default:
+			errs = append(errs, badPatchOperationError(i, op))
+			continue
+		}
+
+		// Construct patch path.
+		path := strings.Trim(op.Path, "/")
+		if len(path) > 0 {
+			path = root + "/" + path
+		} else {
+			path = root
+		}
+
+		var ok bool
+		impl.path, ok = storage.ParsePath(path)
+		if !ok {
+			errs = append(errs, badPatchPathError(i, op))
+			continue
+		}
+
+		// Write conflicts are only reported once all operations are valid.
+		if len(errs) == 0 && !impl.test {
+			if err := s.writeConflict(impl.op, impl.path, impl.value); err != nil {
+				return nil, err
+			}
+		}
+
+		result = append(result, impl)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return result, nil
+}
+
+// testPatch returns true if the document at the patch path equals the patch
+// value. Missing documents do not equal any value.
+func (s *Server) testPatch(ctx context.Context, txn storage.Transaction, patch patchImpl) (bool, error) {
+
+	doc, err := s.store.Read(ctx, txn, patch.path)
+	if storage.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	a, err := ast.InterfaceToValue(doc)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := ast.InterfaceToValue(patch.value)
+	if err != nil {
+		return false, badRequestError(err.Error())
+	}
+
+	return ast.Compare(a, b) == 0, nil
+}
+
+// patchUndoLog records the inverse of each operation applied by a patch so
+// that the operations can be undone if a later operation fails.
+type patchUndoLog []patchImpl
+
+// apply writes the patch to storage and records the inverse operation. The
+// previous value is read from the built-in store because writes are not
+// applied to mounted stores.
+func (u *patchUndoLog) apply(ctx context.Context, store *storage.Storage, txn storage.Transaction, patch patchImpl) error {
+
+	inverse, ok, err := patchInverse(ctx, store, txn, patch)
+	if err != nil {
+		return err
+	}
+
+	if err := store.Write(ctx, txn, patch.op, patch.path, patch.value); err != nil {
+		return err
+	}
+
+	// The inverse cannot be determined if the parent of the document does not
+	// exist, in which case the write fails.
+	if ok {
+		*u = append(*u, inverse)
+	}
+
+	return nil
+}
+
+// rollback undoes the applied operations in reverse order.
+func (u patchUndoLog) rollback(ctx context.Context, store *storage.Storage, txn storage.Transaction) error {
+	for i := len(u) - 1; i >= 0; i-- {
+		if err := store.Write(ctx, txn, u[i].op, u[i].path, u[i].value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchInverse returns the operation that undoes the patch. If the parent of
+// the document at the patch path does not exist or is not a collection, the
+// inverse is not returned.
+func patchInverse(ctx context.Context, store *storage.Storage, txn storage.Transaction, patch patchImpl) (patchImpl, bool, error) {
+
+	if len(patch.path) == 0 {
+		prev, err := store.ReadBuiltin(ctx, txn, patch.path)
+		if err != nil {
+			return patchImpl{}, false, err
+		}
+		return patchImpl{op: storage.ReplaceOp, path: patch.path, value: prev}, true, nil
+	}
+
+	parent, err := store.ReadBuiltin(ctx, txn, patch.path[:len(patch.path)-1])
+	if storage.IsNotFound(err) {
+		return patchImpl{}, false, nil
+	} else if err != nil {
+		return patchImpl{}, false, err
+	}
+
+	key := patch.path[len(patch.path)-1]
+
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		prev, exists := parent[key]
+		switch {
+		case patch.op == storage.AddOp && !exists:
+			return patchImpl{op: storage.RemoveOp, path: patch.path}, true, nil
+		case patch.op == storage.RemoveOp && exists:
+			return patchImpl{op: storage.AddOp, path: patch.path, value: prev}, true, nil
+		case exists:
+			return patchImpl{op: storage.ReplaceOp, path: patch.path, value: prev}, true, nil
+		}
+	case []interface{}:
+		if patch.op == storage.AddOp && key == "-" {
+			path := append(patch.path[:len(patch.path)-1:len(patch.path)-1], strconv.Itoa(len(parent)))
+			return patchImpl{op: storage.RemoveOp, path: path}, true, nil
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i > len(parent) {
+			return patchImpl{}, false, nil
+		}
+		switch {
+		case patch.op == storage.AddOp:
+			return patchImpl{op: storage.RemoveOp, path: patch.path}, true, nil
+		case i == len(parent):
+			return patchImpl{}, false, nil
+		case patch.op == storage.RemoveOp:
+			return patchImpl{op: storage.AddOp, path: patch.path, value: parent[i]}, true, nil
+		default:
+			return patchImpl{op: storage.ReplaceOp, path: patch.path, value: parent[i]}, true, nil
+		}
+	}
+
+	return patchImpl{}, false, nil
+}
+
+// TODO(tsandall): this ought to be enforced by the storage layer.
+func (s *Server) writeConflict(op storage.PatchOp, path storage.Path, value interface{}) error {
+
+	appending := op == storage.AddOp && isAppendPath(path)
+	if appending {
+		path = path[:len(path)-1]
+	}
+
+	// The path conflicts if it refers to a virtual document or a document
+	// contained inside one.
+	node := s.Compiler().RuleTree
+	for i, x := range path.Ref(ast.DefaultRootDocument) {
+		if node = node.Children[x.Value]; node == nil {
+			return nil
+		}
+		if len(node.Rules) > 0 {
+			return WriteConflictError{path: path[:i], rules: node.Rules}
+		}
+	}
+
+	if op == storage.RemoveOp || appending {
+		return nil
+	}
+
+	// The value may define documents under the path that overlap with virtual
+	// documents, e.g., writing {"a": {"q": 1}} to /x conflicts with rule q in
+	// package x.a.
+	if conflict, rs := overlappingRules(path, node, value); rs != nil {
+		return WriteConflictError{path: conflict, rules: rs}
+	}
+
+	return nil
+}
+
+// overlappingRules returns the path and rules of a virtual document under node
+// that would overlap with value if value were written to path. Non-object
+// values replace all documents under path so they overlap with any virtual
+// document under node.
+func overlappingRules(path storage.Path, node *ast.RuleTreeNode, value interface{}) (storage.Path, []*ast.Rule) {
+
+	if len(node.Rules) > 0 {
+		return path, node.Rules
+	}
+
+	obj, isObject := value.(map[string]interface{})
+
+	keys := make([]string, 0, len(node.Children))
+	for k := range node.Children {
+		if s, ok := k.(ast.String); ok {
+			keys = append(keys, string(s))
+		}
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var child interface{}
+		if isObject {
+			var ok bool
+			if child, ok = obj[k]; !ok {
+				continue
+			}
+		}
+		childPath := append(append(storage.Path{}, path...), k)
+		if conflict, rs := overlappingRules(childPath, node.Children[ast.String(k)], child); rs != nil {
+			return conflict, rs
+		}
+	}
+
+	return nil, nil
+}
+
+// isAppendPath returns true if the last element of path refers to the end of
+// an array, i.e., "-".
+func isAppendPath(path storage.Path) bool {
+	return len(path) > 0 && path[len(path)-1] == "-"
+}
+
+// rebaseDataRefs returns a copy of query where references to the data document
+// are rewritten to refer to the same documents under root, e.g., with a root of
+// data.tenants.acme, data.a.b becomes data.tenants.acme.a.b.
+func rebaseDataRefs(query ast.Body, root ast.Ref) (ast.Body, error) {
+	result, err := ast.TransformRefs(query.Copy(), func(ref ast.Ref) (ast.Value, error) {
+		if !ref.HasPrefix(ast.DefaultRootRef) {
+			return ref, nil
+		}
+		rebased := append(ast.Ref{}, root...)
+		return append(rebased, ref[1:]...), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(ast.Body), nil
+}
+
+func stringPathToDataRef(s string) (r ast.Ref) {
+	result := ast.Ref{ast.DefaultRootDocument}
+	result = append(result, stringPathToRef(s)...)
+	return result
+}
+
+// tenantDataRef returns a reference to the document at path under the tenant's
+// root. The tenant identifier is always treated as a string key.
+func tenantDataRef(tenant string, path string) ast.Ref {
+	result := ast.Ref{ast.DefaultRootDocument, ast.StringTerm(tenantRootV1), ast.StringTerm(tenant)}
+	return append(result, stringPathToRef(path)...)
+}
+
+func stringPathToRef(s string) (r ast.Ref) {
+	if len(s) == 0 {
+		return r
+	}
+	p := strings.Split(s, "/")
+	for _, x := range p {
+		if x == "" {
+			continue
+		}
+		i, err := strconv.Atoi(x)
+		if err != nil {
+			r = append(r, ast.StringTerm(x))
+		} else {
+			r = append(r, ast.IntNumberTerm(i))
+		}
+	}
+	return r
+}
+
+func handleError(w http.ResponseWriter, code int, err error) {
+	if isRequestBodyTooLarge(err) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(newErrorV1(code, err).Bytes())
+}
+
+// errRequestBodyTooLarge is returned by maxBytesReader when the request body
+// exceeds the server's limit.
+var errRequestBodyTooLarge = errors.New("http: request body too large")
+
+// isRequestBodyTooLarge returns true if the error (or its cause) indicates
+// that the request body exceeded the server's limit.
+func isRequestBodyTooLarge(err error) bool {
+	return errors.Cause(err) == errRequestBodyTooLarge
+}
+
+// maxBytesReader limits the number of bytes read from a request body. Unlike
+// a plain io.LimitedReader, reading past the limit returns an error instead of
+// io.EOF so that truncated bodies are not mistaken for complete ones.
+type maxBytesReader struct {
+	r   io.ReadCloser
+	n   int64
+	err error
+}
+
+func newMaxBytesReader(r io.ReadCloser, n int64) *maxBytesReader {
+	return &maxBytesReader{r: r, n: n}
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// Read one byte past the limit to detect bodies that exceed it.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		l.err = err
+		return n, err
+	}
+	n = int(l.n)
+	l.n = 0
+	l.err = errRequestBodyTooLarge
+	return n, l.err
+}
+
+func (l *maxBytesReader) Close() error {
+	return l.r.Close()
+}
+
+func handleErrorAuto(w http.ResponseWriter, err error) {
+	code, e := newErrorAutoV1(err)
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(e.Bytes())
+}
+
+// statusClientClosedRequest is the status code recorded when evaluation stops
+// because the client closed the request. The client never receives the
+// response, so the code only appears in logs and metrics.
+const statusClientClosedRequest = 499
+
+// errorV1 is implemented by the error response messages.
+type errorV1 interface {
+	Bytes() []byte
+}
+
+// newErrorAutoV1 returns the status code and error response message for err.
+// The code is determined by the first error in err's cause chain that has a
+// known mapping. Errors without a mapping are reported as internal errors.
+func newErrorAutoV1(err error) (int, errorV1) {
+	var prev error
+	for curr := err; curr != prev; {
+		if storage.IsNotFound(curr) {
+			return 404, newErrorV1(404, err)
+		}
+		if IsWriteConflict(curr) {
+			return 404, newWriteConflictErrorV1(404, err, curr.(WriteConflictError))
+		}
+		if isBadRequest(curr) {
+			return http.StatusBadRequest, newErrorV1(http.StatusBadRequest, err)
+		}
+		if e, ok := curr.(*inputSchemaError); ok {
+			return http.StatusBadRequest, newInputSchemaErrorV1(http.StatusBadRequest, e)
+		}
+		if storage.IsInvalidPatch(curr) {
+			return 400, newErrorV1(400, err)
+		}
+		if topdown.IsMemoryLimitErr(curr) {
+			return http.StatusInsufficientStorage, newErrorV1(http.StatusInsufficientStorage, err)
+		}
+		if storage.IsTransactionLimit(curr) {
+			return http.StatusServiceUnavailable, newErrorV1(http.StatusServiceUnavailable, err)
+		}
+		if topdown.IsDeadlineErr(curr) {
+			return http.StatusServiceUnavailable, &apiErrorV1{Code: http.StatusServiceUnavailable, Message: "evaluation timed out"}
+		}
+		if topdown.IsCancelErr(curr) {
+			return statusClientClosedRequest, &apiErrorV1{Code: statusClientClosedRequest, Message: "request cancelled"}
+		}
+		prev = curr
+		curr = errors.Cause(prev)
+	}
+	if isRequestBodyTooLarge(err) {
+		return http.StatusRequestEntityTooLarge, newErrorV1(http.StatusRequestEntityTooLarge, err)
+	}
+	return 500, newErrorV1(500, err)
+}
+
+// newErrorV1 returns the error response message for err. If err was caused by
+// a request parameter, the message identifies the parameter.
+func newErrorV1(code int, err error) *apiErrorV1 {
+	if pe, ok := errors.Cause(err).(*paramError); ok {
+		details := pe.details
+		return &apiErrorV1{Code: code, Message: pe.Error(), Details: &details}
+	}
+	return &apiErrorV1{Code: code, Message: err.Error()}
+}
+
+func handleErrorf(w http.ResponseWriter, code int, f string, a ...interface{}) {
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	e := &apiErrorV1{Code: code, Message: fmt.Sprintf(f, a...)}
+	w.WriteHeader(code)
+	w.Write(e.Bytes())
+}
+
+func handleErrorAST(w http.ResponseWriter, code int, msg string, errs ast.Errors) {
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	sorted := make(astErrorSlice, len(errs))
+	copy(sorted, errs)
+	sort.Stable(sorted)
+	e := &astErrorV1{
+		Code:    code,
+		Message: msg,
+		Errors:  sorted,
+	}
+	w.WriteHeader(code)
+	w.Write(e.Bytes())
+}
+
+// astErrorSlice sorts errors by location (file, row, column) so that clients
+// can display them in source order. Errors without a location sort last.
+type astErrorSlice []*ast.Error
+
+func (s astErrorSlice) Len() int      { return len(s) }
+func (s astErrorSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s astErrorSlice) Less(i, j int) bool {
+	a, b := s[i].Location, s[j].Location
+	if a == nil || b == nil {
+		return a != nil && b == nil
+	}
+	if a.File != b.File {
+		return a.File < b.File
+	}
+	if a.Row != b.Row {
+		return a.Row < b.Row
+	}
+	return a.Col < b.Col
+}
+
+// handleErrorPolicy writes the compile errors that occurred while installing
+// the policies identified by ids. Each error is annotated with whether it is
+// located in an existing module.
+func handleErrorPolicy(w http.ResponseWriter, code int, errs ast.Errors, ids ...string) {
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	sorted := make(astErrorSlice, len(errs))
+	copy(sorted, errs)
+	sort.Stable(sorted)
+	e := &policyCompileErrorV1{
+		Code:    code,
+		Message: compileModErrMsg,
+		Errors:  make([]*policyErrorV1, len(sorted)),
+	}
+	submitted := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		submitted[id] = struct{}{}
+	}
+	for i := range sorted {
+		existing := false
+		if sorted[i].Location != nil {
+			_, ok := submitted[sorted[i].Location.File]
+			existing = !ok
+		}
+		if existing {
+			e.Message = compileExistingModErrMsg
+		}
+		e.Errors[i] = &policyErrorV1{
+			Error:    sorted[i],
+			Existing: existing,
+		}
+	}
+	w.WriteHeader(code)
+	w.Write(e.Bytes())
+}
+
+// newWriteConflictErrorV1 returns the error response message for a write that
+// conflicts with a virtual document. The message identifies the rules that
+// define the document, if any.
+func newWriteConflictErrorV1(code int, err error, conflict WriteConflictError) errorV1 {
+	rules := conflict.Rules()
+	if len(rules) == 0 {
+		return newErrorV1(code, err)
+	}
+	e := &writeConflictErrorV1{
+		Code:    code,
+		Message: err.Error(),
+		Rules:   make([]*conflictingRuleV1, len(rules)),
+	}
+	for i := range rules {
+		e.Rules[i] = &conflictingRuleV1{
+			Name:     string(rules[i].Name),
+			Location: rules[i].Location,
+		}
+	}
+	return e
+}
+
+func newInputSchemaErrorV1(code int, err *inputSchemaError) *schemaErrorV1 {
+	return &schemaErrorV1{
+		Code:    code,
+		Message: fmt.Sprintf("request does not match input schema for %v", err.path),
+		Errors:  err.errs,
+	}
+}
+
+func handlePatchErrors(w http.ResponseWriter, code int, msg string, errs patchErrors) {
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+	e := &patchErrorV1{
+		Code:    code,
+		Message: msg,
+		Errors:  errs,
+	}
+	w.WriteHeader(code)
+	w.Write(e.Bytes())
+}
+
+func handleResponse(w http.ResponseWriter, code int, bs []byte) {
+	w.WriteHeader(code)
+	if code == 204 {
+		return
+	}
+	w.Write(bs)
+}
+
+// responseBufferPool holds buffers used to serialize JSON responses so that
+// they can be reused across requests.
+var responseBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// defaultResponseBufferMaxPooledSize is the default capacity above which
+// buffers are not returned to the pool. This prevents occasional large
+// responses from pinning memory.
+const defaultResponseBufferMaxPooledSize = 1 << 20
+
+func (s *Server) handleResponseJSON(w http.ResponseWriter, code int, v interface{}, pretty bool) {
+	s.writeResponseJSON(w, nil, code, v, pretty)
+}
+
+// handleResponseJSONWithETag is like handleResponseJSON except that the ETag
+// header is set to a hash of the serialized response. If the request includes
+// an If-None-Match header that matches the ETag, the server responds with 304
+// and no body.
+func (s *Server) handleResponseJSONWithETag(w http.ResponseWriter, r *http.Request, code int, v interface{}, pretty bool) {
+	s.writeResponseJSON(w, r, code, v, pretty)
+}
+
+func (s *Server) writeResponseJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}, pretty bool) {
+
+	buf := responseBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	defer func() {
+		if buf.Cap() <= s.responseBufferMaxPooledSize {
+			responseBufferPool.Put(buf)
+		}
+	}()
+
+	enc := json.NewEncoder(buf)
+
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+
+	if err := enc.Encode(v); err != nil {
+		handleErrorAuto(w, err)
+		return
+	}
+
+	// The encoder terminates the value with a newline. Drop it so that the
+	// output is identical to json.Marshal.
+	bs := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+	headers := w.Header()
+	headers.Add("Content-Type", "application/json")
+
+	if r != nil {
+		etag := newETag(bs)
+		headers.Set("ETag", etag)
+		if matchesETag(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(304)
+			return
+		}
+	}
+
+	handleResponse(w, code, bs)
+}
+
+// newETag returns a weak entity tag for the response body. The tag is weak
+// because it is computed before the body is transformed, e.g., compressed or
+// converted to YAML, so representations that differ byte for byte share it.
+func newETag(bs []byte) string {
+	return fmt.Sprintf(`W/"%x"`, sha256.Sum256(bs))
+}
+
+// matchesETag returns true if the If-None-Match header value matches the
+// entity tag. Weak comparison is used as defined by RFC 7232.
+func matchesETag(header string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, x := range strings.Split(header, ",") {
+		x = strings.TrimPrefix(strings.TrimSpace(x), "W/")
+		if x == "*" || x == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setEvalDuration reports the duration of query evaluation in the response and
+// records it in the server's metrics. This must be called before the response
+// is written.
+func (s *Server) setEvalDuration(w http.ResponseWriter, d time.Duration) {
+	s.httpMetrics.observeEval(d)
+	w.Header().Set(EvalDurationHeader, strconv.FormatInt(d.Nanoseconds(), 10))
+}
+
+func getPretty(p []string) bool {
+	return getBool(p)
+}
+
+func getBool(p []string) bool {
+	for _, x := range p {
+		if strings.ToLower(x) == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+func getExplain(p []string) explainModeV1 {
+	for _, x := range p {
+		switch x {
+		case string(explainFullV1):
+			return explainFullV1
+		case string(explainTruthV1):
+			return explainTruthV1
+		case string(explainNotesV1):
+			return explainNotesV1
+		}
+	}
+	return explainOffV1
+}
+
+// getExplainOps returns the set of trace operations to include in full
+// explanations. The parameter value is a comma separated list of operations,
+// e.g., "enter,fail". If the parameter is not specified, nil is returned.
+func getExplainOps(p []string) (map[topdown.Op]bool, error) {
+
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	ops := map[topdown.Op]bool{}
+
+	for _, x := range p {
+		for _, name := range strings.Split(x, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := false
+			for _, op := range []topdown.Op{topdown.EnterOp, topdown.ExitOp, topdown.EvalOp, topdown.RedoOp, topdown.FailOp, topdown.NoteOp} {
+				if strings.EqualFold(name, string(op)) {
+					ops[op] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, badRequestError(fmt.Sprintf("bad explain_ops parameter: unknown operation %q", name))
+			}
+		}
+	}
+
+	return ops, nil
+}
+
+// getTraceFilter returns the filter to apply to full explanations based on the
+// explain_ops, explain_max_depth, and explain_max_events parameters. The limits
+// are rejected for other explanation modes because they would be ignored.
+func getTraceFilter(values url.Values, explainMode explainModeV1) (traceFilterV1, error) {
+
+	if explainMode != explainFullV1 {
+		for _, name := range []string{"explain_ops", "explain_max_depth", "explain_max_events"} {
+			if len(values[name]) > 0 {
+				return traceFilterV1{}, badRequestError(fmt.Sprintf("bad %v parameter: only supported with explain=full", name))
+			}
+		}
+	}
+
+	ops, err := getExplainOps(values["explain_ops"])
+	if err != nil {
+		return traceFilterV1{}, err
+	}
+
+	maxDepth, err := getExplainLimit("explain_max_depth", values["explain_max_depth"])
+	if err != nil {
+		return traceFilterV1{}, err
+	}
+
+	maxEvents, err := getExplainLimit("explain_max_events", values["explain_max_events"])
+	if err != nil {
+		return traceFilterV1{}, err
+	}
+
+	return traceFilterV1{ops: ops, maxDepth: maxDepth, maxEvents: maxEvents}, nil
+}
+
+// getExplainLimit returns the value of the named explanation limit. If the
+// parameter is not specified, zero is returned.
+func getExplainLimit(name string, p []string) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s := p[len(p)-1]
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, badRequestError(fmt.Sprintf("bad %v parameter %q: must be a positive integer", name, s))
+	}
+	return n, nil
+}
+
+// getCompileFormat returns the format of residual queries in partial evaluation
+// responses. If the parameter is not specified, the queries are returned as
+// strings.
+func getCompileFormat(p []string) (compileFormatV1, error) {
+	if len(p) == 0 {
+		return compileFormatTextV1, nil
+	}
+	switch f := compileFormatV1(p[len(p)-1]); f {
+	case compileFormatTextV1, compileFormatASTV1, compileFormatRegoV1:
+		return f, nil
+	default:
+		return "", badRequestError(fmt.Sprintf("bad format parameter %q: must be one of text, ast, or rego", f))
+	}
+}
+
+func getNumberFormat(p []string) numberFormatV1 {
+	for _, x := range p {
+		if x == string(numberFormatStringV1) {
+			return numberFormatStringV1
+		}
+	}
+	return numberFormatNumberV1
+}
+
+// stringifyNumbers returns a copy of v where numbers have been replaced by
+// their exact decimal representation as strings. This allows clients that
+// decode JSON numbers into floating-point values to avoid precision loss.
+func stringifyNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		return string(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i := range v {
+			result[i] = stringifyNumbers(v[i])
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k := range v {
+			result[k] = stringifyNumbers(v[k])
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// getLimit returns the value of the "limit" query parameter. If the parameter
+// is not set, the result is zero.
+func getLimit(p []string) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s := p[len(p)-1]
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad limit parameter %q: must be a positive integer", s)
+	}
+	return n, nil
+}
+
+// getOffset returns the number of results to skip. If the parameter is not
+// specified, the offset is zero.
+func getOffset(p []string) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s := p[len(p)-1]
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad offset parameter %q: must be a non-negative integer", s)
+	}
+	return n, nil
+}
+
+// limitPlusOne returns the number of results to evaluate for the limit. One
+// extra result is evaluated so that truncation can be detected.
+func limitPlusOne(limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return limit + 1
+}
+
+// flattenDocument returns a copy of v where nested objects and arrays have been
+// flattened into a single object keyed by dotted paths, e.g., {"a": {"b": [1]}}
+// becomes {"a.b.0": 1}. Empty objects and arrays are kept as values. If v is
+// not an object or array, it is returned unchanged.
+func flattenDocument(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		result := map[string]interface{}{}
+		flattenDocumentRec(result, "", v)
+		return result
+	default:
+		return v
+	}
+}
+
+func flattenDocumentRec(result map[string]interface{}, prefix string, v interface{}) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 && prefix != "" {
+			result[prefix] = v
+		}
+		for k := range v {
+			flattenDocumentRec(result, join(k), v[k])
+		}
+	case []interface{}:
+		if len(v) == 0 && prefix != "" {
+			result[prefix] = v
+		}
+		for i := range v {
+			flattenDocumentRec(result, join(strconv.Itoa(i)), v[i])
+		}
+	default:
+		result[prefix] = v
+	}
+}
+
+// getSelect returns the path elements of the "select" query parameter. If the
+// parameter is not set, the result is nil.
+func getSelect(p []string) ([]string, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	s := p[len(p)-1]
+	sel := strings.Split(s, ".")
+	for _, x := range sel {
+		if x == "" {
+			return nil, fmt.Errorf("bad select parameter %q: path elements must be non-empty", s)
+		}
+	}
+	return sel, nil
+}
+
+// selectResults returns the subset of query results where the selection is
+// defined. The result values are replaced by the selected documents.
+func selectResults(qrs topdown.QueryResultSet, sel []string) topdown.QueryResultSet {
+	result := topdown.QueryResultSet{}
+	for _, qr := range qrs {
+		if v, ok := selectValue(qr.Result, sel); ok {
+			result.Add(&topdown.QueryResult{Result: v, Bindings: qr.Bindings, Types: selectTypes(qr.Types, sel)})
+		}
+	}
+	return result
+}
 
-		// Map patch operation.
-		switch op.Op {
-		case "add":
-			impl.op = storage.AddOp
-		case "remove":
-			impl.op = storage.RemoveOp
-		case "replace":
-			impl.op = storage.ReplaceOp
+// selectValue returns the document contained in v at the path identified by
+// sel. Path elements are object keys or array indices.
+func selectValue(v interface{}, sel []string) (interface{}, bool) {
+	for _, x := range sel {
+		switch curr := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = curr[x]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(x)
+			if err != nil || i < 0 || i >= len(curr) {
+				return nil, false
+			}
+			v = curr[i]
 		default:
-			return nil, badPatchOperationError(op.Op)
+			return nil, false
 		}
+	}
+	return v, true
+}
 
-		// Construct patch path.
-		path := strings.Trim(op.Path, "/")
-		if len(path) > 0 {
-			path = root + "/" + path
-		} else {
-			path = root
+// selectTypes returns the type annotations for the document selected by sel.
+// See topdown.ValueToTypes for the format of the annotations.
+func selectTypes(types interface{}, sel []string) interface{} {
+	for _, x := range sel {
+		obj, ok := types.(map[string]interface{})
+		if !ok {
+			return nil
 		}
-
-		var ok bool
-		impl.path, ok = storage.ParsePath(path)
+		if props, ok := obj["properties"].(map[string]interface{}); ok {
+			types = props[x]
+			continue
+		}
+		items, ok := obj["items"].([]interface{})
 		if !ok {
-			return nil, badPatchPathError(op.Path)
+			return nil
 		}
-
-		if err := s.writeConflict(impl.op, impl.path); err != nil {
-			return nil, err
+		i, err := strconv.Atoi(x)
+		if err != nil || i < 0 || i >= len(items) {
+			return nil
 		}
-
-		result = append(result, impl)
+		types = items[i]
 	}
+	return types
+}
 
-	return result, nil
+// dataGetParamsV1 models the query parameters of Data API GET requests.
+type dataGetParamsV1 struct {
+	path        ast.Ref
+	pretty      bool
+	explainMode explainModeV1
+	traceFilter traceFilterV1
+	numbers     numberFormatV1
+	echoInput   bool
+	types       bool
+	metrics     bool
+	debugSource bool
+	flatten     bool
+	stream      bool
+	watch       bool
+	request     ast.Value
+	nonGround   bool
+	selection   []string
+	limit       int
+	overrides   map[ast.Var]ast.Value
 }
 
-// TODO(tsandall): this ought to be enforced by the storage layer.
-func (s *Server) writeConflict(op storage.PatchOp, path storage.Path) error {
+// parseDataGetParams returns the query parameters of the Data API GET request.
+// Parameters that are invalid or that cannot be combined are reported as bad
+// requests.
+func (s *Server) parseDataGetParams(r *http.Request) (*dataGetParamsV1, error) {
 
-	if op == storage.AddOp && len(path) > 0 && path[len(path)-1] == "-" {
-		path = path[:len(path)-1]
+	values := r.URL.Query()
+
+	p := &dataGetParamsV1{
+		path:        stringPathToDataRef(mux.Vars(r)["path"]),
+		pretty:      getPretty(values["pretty"]),
+		explainMode: getExplain(values["explain"]),
+		numbers:     getNumberFormat(values["numbers"]),
+		echoInput:   getBool(values["echo_input"]),
+		types:       getBool(values["types"]),
+		metrics:     getBool(values["metrics"]),
+		debugSource: getBool(values["debug_source"]),
+		flatten:     getBool(values["flatten"]),
+		stream:      getBool(values["stream"]),
+		watch:       getBool(values["watch"]),
 	}
 
-	ref := path.Ref(ast.DefaultRootDocument)
+	var err error
 
-	if rs := s.Compiler().GetRulesForVirtualDocument(ref); rs != nil {
-		return WriteConflictError{path}
+	if p.request, p.nonGround, err = s.parseRequestParams(values[ParamRequestV1]); err != nil {
+		return nil, asBadRequest(err)
 	}
 
-	return nil
-}
+	if p.traceFilter, err = getTraceFilter(values, p.explainMode); err != nil {
+		return nil, asBadRequest(err)
+	}
 
-func stringPathToDataRef(s string) (r ast.Ref) {
-	result := ast.Ref{ast.DefaultRootDocument}
-	result = append(result, stringPathToRef(s)...)
-	return result
-}
+	if p.selection, err = getSelect(values["select"]); err != nil {
+		return nil, asBadRequest(err)
+	}
 
-func stringPathToRef(s string) (r ast.Ref) {
-	if len(s) == 0 {
-		return r
+	if p.limit, err = getLimit(values["limit"]); err != nil {
+		return nil, asBadRequest(err)
 	}
-	p := strings.Split(s, "/")
-	for _, x := range p {
-		if x == "" {
-			continue
+
+	if name := values.Get("profile"); name != "" {
+		s.profilesMtx.RLock()
+		profile, ok := s.profiles[name]
+		s.profilesMtx.RUnlock()
+		if !ok {
+			return nil, badRequestError(fmt.Sprintf("unknown profile: %v", name))
 		}
-		i, err := strconv.Atoi(x)
+		base, err := ast.InterfaceToValue(profile)
 		if err != nil {
-			r = append(r, ast.StringTerm(x))
-		} else {
-			r = append(r, ast.IntNumberTerm(i))
+			return nil, err
 		}
+		p.request = overlayRequest(base, p.request)
 	}
-	return r
-}
 
-func handleError(w http.ResponseWriter, code int, err error) {
-	handleErrorf(w, code, err.Error())
-}
+	if p.overrides, err = s.parseBuiltinOverrides(values["builtin"]); err != nil {
+		return nil, asBadRequest(err)
+	}
 
-func handleErrorAuto(w http.ResponseWriter, err error) {
-	var prev error
-	for curr := err; curr != prev; {
-		if storage.IsNotFound(curr) {
-			handleError(w, 404, err)
-			return
-		}
-		if IsWriteConflict(curr) {
-			handleError(w, 404, err)
-			return
-		}
-		if isBadRequest(curr) {
-			handleError(w, http.StatusBadRequest, err)
-			return
-		}
-		if storage.IsInvalidPatch(curr) {
-			handleError(w, 400, err)
-			return
-		}
-		prev = curr
-		curr = errors.Cause(prev)
+	if err := p.check(); err != nil {
+		return nil, err
 	}
-	handleError(w, 500, err)
-}
 
-func handleErrorf(w http.ResponseWriter, code int, f string, a ...interface{}) {
-	headers := w.Header()
-	headers.Add("Content-Type", "application/json")
-	e := &apiErrorV1{Code: code, Message: fmt.Sprintf(f, a...)}
-	w.WriteHeader(code)
-	w.Write(e.Bytes())
+	return p, nil
 }
 
-func handleErrorAST(w http.ResponseWriter, code int, msg string, errs ast.Errors) {
-	headers := w.Header()
-	headers.Add("Content-Type", "application/json")
-	e := &astErrorV1{
-		Code:    code,
-		Message: msg,
-		Errors:  errs,
+// check returns an error if the parameters cannot be combined.
+func (p *dataGetParamsV1) check() error {
+
+	if p.stream && (!p.nonGround || p.explainMode != explainOffV1 || p.metrics || p.types || p.echoInput || p.debugSource) {
+		return badRequestError("stream requires non-ground request values and is not supported with explanations, metrics, types, echo_input, or debug_source")
 	}
-	w.WriteHeader(code)
-	w.Write(e.Bytes())
-}
 
-func handleResponse(w http.ResponseWriter, code int, bs []byte) {
-	w.WriteHeader(code)
-	if code == 204 {
-		return
+	if p.nonGround && p.echoInput {
+		return badRequestError("echo_input with non-ground request values not supported")
 	}
-	w.Write(bs)
-}
 
-func handleResponseJSON(w http.ResponseWriter, code int, v interface{}, pretty bool) {
+	if p.nonGround && p.types {
+		return badRequestError("types with non-ground request values not supported")
+	}
 
-	var bs []byte
-	var err error
+	if p.flatten && p.types {
+		return badRequestError("flatten with types not supported")
+	}
 
-	if pretty {
-		bs, err = json.MarshalIndent(v, "", "  ")
-	} else {
-		bs, err = json.Marshal(v)
+	if p.nonGround && p.debugSource {
+		return badRequestError("debug_source with non-ground request values not supported")
 	}
 
-	if err != nil {
-		handleErrorAuto(w, err)
-		return
+	if !p.nonGround && p.limit > 0 {
+		return badRequestError("limit with ground request values not supported")
 	}
-	headers := w.Header()
-	headers.Add("Content-Type", "application/json")
-	handleResponse(w, code, bs)
+
+	if p.watch && (p.nonGround || p.stream || p.explainMode != explainOffV1 || p.metrics || p.types || p.echoInput || p.debugSource || len(p.overrides) > 0 || p.selection != nil || p.flatten || p.numbers == numberFormatStringV1) {
+		return badRequestError("watch requires ground request values and is not supported with other query parameters")
+	}
+
+	return nil
 }
 
-func getPretty(p []string) bool {
-	for _, x := range p {
-		if strings.ToLower(x) == "true" {
-			return true
-		}
+// asBadRequest returns err as a bad request error. Errors that already
+// indicate a bad request are returned unchanged so that parameter details are
+// preserved.
+func asBadRequest(err error) error {
+	if isBadRequest(err) {
+		return err
 	}
-	return false
+	return badRequestError(err.Error())
 }
 
-func getExplain(p []string) explainModeV1 {
-	for _, x := range p {
-		switch x {
-		case string(explainFullV1):
-			return explainFullV1
-		case string(explainTruthV1):
-			return explainTruthV1
-		}
+// parseRequestParams returns the request document for the request parameters
+// after checking that the number of parameters is within the server's limit.
+func (s *Server) parseRequestParams(p []string) (ast.Value, bool, error) {
+	if s.maxRequestParams > 0 && len(p) > s.maxRequestParams {
+		return nil, false, badRequestError(fmt.Sprintf("too many request parameters: %d exceeds limit of %d", len(p), s.maxRequestParams))
 	}
-	return explainOffV1
+	return parseRequest(p)
 }
 
 var errRequestPathFormat = fmt.Errorf("request parameter format is [[<path>]:]<value> where <path> is either var or ref")
 
+// parseRequest returns the request document built from the request parameter
+// values in s. Each value is interpreted using the first of the following
+// rules that applies:
+//
+// 1. If the value starts with ':', the remainder is parsed as the entire request.
+// 2. If the value parses as a term, it is used as the entire request.
+// 3. Otherwise, the value is split on the first ':' into <path> and <value>.
+//
+// The split is made on the first ':' that is preceded by a var or ref so that
+// paths may contain colons, e.g., a["b:c"]:1 is split into a["b:c"] and 1.
+// Values containing colons (e.g., URLs or timestamps) must therefore be quoted
+// to be parsed correctly.
 func parseRequest(s []string) (ast.Value, bool, error) {
 
 	pairs := make([][2]*ast.Term, len(s))
@@ -1074,27 +5610,32 @@ func parseRequest(s []string) (ast.Value, bool, error) {
 		if s[i][0] == ':' {
 			k = ast.NewTerm(ast.EmptyRef())
 			v, err = ast.ParseTerm(s[i][1:])
+			if err != nil {
+				return nil, false, newRequestParamError(s[i], "value", 1+parseErrorOffset(s[i][1:], err), err)
+			}
 		} else {
 			v, err = ast.ParseTerm(s[i])
 			if err == nil {
 				k = ast.NewTerm(ast.EmptyRef())
 			} else {
-				vs := strings.SplitN(s[i], ":", 2)
+				vs := splitRequestParam(s[i])
 				if len(vs) != 2 {
-					return nil, false, errRequestPathFormat
+					return nil, false, newRequestParamError(s[i], "path", 0, errRequestPathFormat)
 				}
-				k, err = ast.ParseTerm(ast.RequestRootDocument.String() + "." + vs[0])
-				if err != nil {
-					return nil, false, errRequestPathFormat
+				k, err = parseRequestPath(vs[0])
+				if err == errRequestPathFormat {
+					_, perr := ast.ParseTerm(vs[0])
+					return nil, false, newRequestParamError(s[i], "path", parseErrorOffset(vs[0], perr), ambiguousRequestError(s[i], vs, err))
+				} else if err != nil {
+					return nil, false, newRequestParamError(s[i], "path", 0, err)
 				}
 				v, err = ast.ParseTerm(vs[1])
+				if err != nil {
+					return nil, false, newRequestParamError(s[i], "value", len(vs[0])+1+parseErrorOffset(vs[1], err), ambiguousRequestError(s[i], vs, err))
+				}
 			}
 		}
 
-		if err != nil {
-			return nil, false, err
-		}
-
 		pairs[i] = [...]*ast.Term{k, v}
 
 		if !nonGround {
@@ -1116,6 +5657,246 @@ func parseRequest(s []string) (ast.Value, bool, error) {
 	return request, nonGround, nil
 }
 
+// parseErrorOffset returns the byte offset in s of the first located parse
+// error in err. If err does not contain a location, the result is zero, i.e.,
+// the error is reported at the start of s.
+func parseErrorOffset(s string, err error) int {
+	errs, ok := errors.Cause(err).(ast.Errors)
+	if !ok {
+		return 0
+	}
+	for _, e := range errs {
+		if e.Location == nil {
+			continue
+		}
+		offset := 0
+		for row := 1; row < e.Location.Row; row++ {
+			i := strings.IndexByte(s[offset:], '\n')
+			if i < 0 {
+				return len(s)
+			}
+			offset += i + 1
+		}
+		for col := 1; col < e.Location.Col && offset < len(s); col++ {
+			_, n := utf8.DecodeRuneInString(s[offset:])
+			offset += n
+		}
+		return offset
+	}
+	return 0
+}
+
+// parseBuiltinOverrides returns the built-in function overrides specified by
+// the builtin parameter values in p. Each value has the format <name>:<value>
+// where <value> is ground.
+func (s *Server) parseBuiltinOverrides(p []string) (map[ast.Var]ast.Value, error) {
+
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	if !s.builtinOverrides {
+		return nil, badRequestError("builtin parameter not enabled")
+	}
+
+	overrides := map[ast.Var]ast.Value{}
+
+	for _, x := range p {
+		vs := strings.SplitN(x, ":", 2)
+		if len(vs) != 2 {
+			return nil, badRequestError(fmt.Sprintf("bad builtin parameter %q: format is <name>:<value>", x))
+		}
+		name := ast.Var(vs[0])
+		if _, ok := ast.BuiltinMap[name]; !ok {
+			return nil, badRequestError(fmt.Sprintf("bad builtin parameter %q: unknown built-in function %v", x, name))
+		}
+		v, err := ast.ParseTerm(vs[1])
+		if err != nil {
+			return nil, badRequestError(fmt.Sprintf("bad builtin parameter %q: %v", x, err))
+		}
+		if !v.IsGround() {
+			return nil, badRequestError(fmt.Sprintf("bad builtin parameter %q: value must be ground", x))
+		}
+		overrides[name] = v.Value
+	}
+
+	return overrides, nil
+}
+
+// newNamedQuery returns a named query compiled from the query template. The
+// parameters are bound to null placeholders so that the template can be
+// compiled before the parameter values are known.
+func newNamedQuery(compiler *ast.Compiler, query ast.Body, params []string) (*namedQuery, error) {
+
+	vars := make([]ast.Var, len(params))
+	exprs := make([]*ast.Expr, 0, len(params)+len(query))
+
+	for i, x := range params {
+		v, err := ast.ParseTerm(x)
+		if err != nil {
+			return nil, badRequestError(fmt.Sprintf("bad param parameter %q: %v", x, err))
+		}
+		name, ok := v.Value.(ast.Var)
+		if !ok || name.IsWildcard() {
+			return nil, badRequestError(fmt.Sprintf("bad param parameter %q: must be a variable name", x))
+		}
+		for _, prev := range vars[:i] {
+			if prev.Equal(name) {
+				return nil, badRequestError(fmt.Sprintf("bad param parameter %q: duplicate variable %v", x, name))
+			}
+		}
+		vars[i] = name
+		exprs = append(exprs, ast.Equality.Expr(ast.NewTerm(name), ast.NullTerm()))
+	}
+
+	compiled, err := compiler.QueryCompiler().Compile(ast.NewBody(append(exprs, query...)...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &namedQuery{params: vars, body: compiled}, nil
+}
+
+// bind returns a copy of the compiled query where the placeholders have been
+// replaced by the values of the "param" query parameters. The parameters are
+// formatted as <name>:<value> where the value must be ground. All of the
+// query's parameters must be provided.
+func (q *namedQuery) bind(p []string) (ast.Body, error) {
+
+	values := map[ast.Var]*ast.Term{}
+
+	for _, x := range p {
+		vs := strings.SplitN(x, ":", 2)
+		if len(vs) != 2 {
+			return nil, fmt.Errorf("bad param parameter %q: format is <name>:<value>", x)
+		}
+		v, err := ast.ParseTerm(vs[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad param parameter %q: %v", x, err)
+		}
+		if !v.IsGround() {
+			return nil, fmt.Errorf("bad param parameter %q: value must be ground", x)
+		}
+		values[ast.Var(vs[0])] = v
+	}
+
+	body := q.body.Copy()
+
+	for i, name := range q.params {
+		v, ok := values[name]
+		if !ok {
+			return nil, fmt.Errorf("missing param parameter for %v", name)
+		}
+		delete(values, name)
+		body[i] = ast.Equality.Expr(ast.NewTerm(name), v)
+		body[i].Index = i
+	}
+
+	for name := range values {
+		return nil, fmt.Errorf("bad param parameter: unknown query parameter %v", name)
+	}
+
+	return body, nil
+}
+
+// overlayRequest returns the request document obtained by overlaying x on top
+// of base. Objects are merged recursively. Otherwise, values in x take
+// precedence.
+func overlayRequest(base, x ast.Value) ast.Value {
+
+	objX, ok := x.(ast.Object)
+	if !ok {
+		return x
+	}
+
+	objBase, ok := base.(ast.Object)
+	if !ok {
+		if len(objX) == 0 {
+			return base
+		}
+		return x
+	}
+
+	result := ast.Object{}
+
+	for _, item := range objBase {
+		if v := objX.Get(item[0]); v != nil {
+			result = append(result, ast.Item(item[0], ast.NewTerm(overlayRequest(item[1].Value, v.Value))))
+		} else {
+			result = append(result, item)
+		}
+	}
+
+	for _, item := range objX {
+		if objBase.Get(item[0]) == nil {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// parseRequestPath returns a reference to the request document for the path
+// given in a request parameter. Paths are relative to the request document
+// but may also include the request root explicitly, e.g., "request.a.b".
+// Paths rooted at other documents, e.g., "data.a.b", are rejected.
+func parseRequestPath(s string) (*ast.Term, error) {
+
+	path, err := ast.ParseTerm(s)
+	if err != nil {
+		return nil, errRequestPathFormat
+	}
+
+	var head ast.Var
+
+	switch p := path.Value.(type) {
+	case ast.Var:
+		head = p
+	case ast.Ref:
+		head = p[0].Value.(ast.Var)
+	default:
+		return nil, errRequestPathFormat
+	}
+
+	switch {
+	case head.Equal(ast.RequestRootDocument.Value):
+		if ref, ok := path.Value.(ast.Ref); ok && len(ref) > 1 {
+			return path, nil
+		}
+		return ast.NewTerm(ast.EmptyRef()), nil
+	case head.Equal(ast.DefaultRootDocument.Value):
+		return nil, badRequestError(fmt.Sprintf("request parameter path %v must be rooted at %v document", path, ast.RequestRootDocument))
+	}
+
+	return ast.ParseTerm(ast.RequestRootDocument.String() + "." + s)
+}
+
+// ambiguousRequestError returns an error describing how the request parameter
+// value s was split into a path and value before parsing failed.
+func ambiguousRequestError(s string, vs []string, err error) error {
+	return badRequestError(fmt.Sprintf("bad request parameter %q: interpreted as path %q and value %q: %v (values containing colons must be quoted, e.g., x:\"a:b\")", s, vs[0], vs[1], err))
+}
+
+// splitRequestParam splits the request parameter value s into path and value
+// on the first ':' that is preceded by a var or ref. If there is no such ':',
+// s is split on the first ':'.
+func splitRequestParam(s string) []string {
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		path, err := ast.ParseTerm(s[:i])
+		if err != nil {
+			continue
+		}
+		switch path.Value.(type) {
+		case ast.Var, ast.Ref:
+			return []string{s[:i], s[i+1:]}
+		}
+	}
+	return strings.SplitN(s, ":", 2)
+}
+
 func renderBanner(w http.ResponseWriter) {
 	fmt.Fprintln(w, `<pre>
  ________      ________    ________
@@ -1148,7 +5929,7 @@ func renderQueryForm(w http.ResponseWriter, qStrs []string, explain explainModeV
 		input = qStrs[len(qStrs)-1]
 	}
 
-	explainRadioCheck := []string{"", "", ""}
+	explainRadioCheck := []string{"", "", "", ""}
 	switch explain {
 	case explainOffV1:
 		explainRadioCheck[0] = "checked"
@@ -1156,6 +5937,8 @@ func renderQueryForm(w http.ResponseWriter, qStrs []string, explain explainModeV
 		explainRadioCheck[1] = "checked"
 	case explainTruthV1:
 		explainRadioCheck[2] = "checked"
+	case explainNotesV1:
+		explainRadioCheck[3] = "checked"
 	}
 
 	fmt.Fprintf(w, `
@@ -1166,7 +5949,8 @@ func renderQueryForm(w http.ResponseWriter, qStrs []string, explain explainModeV
 	<input type="radio" name="explain" value="off" %v>Off
 	<input type="radio" name="explain" value="full" %v>Full
 	<input type="radio" name="explain" value="truth" %v>Truth
-	</form>`, input, explainRadioCheck[0], explainRadioCheck[1], explainRadioCheck[2])
+	<input type="radio" name="explain" value="notes" %v>Notes
+	</form>`, input, explainRadioCheck[0], explainRadioCheck[1], explainRadioCheck[2], explainRadioCheck[3])
 }
 
 func renderQueryResult(w io.Writer, results interface{}, err error, d time.Duration) {
@@ -0,0 +1,70 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func BenchmarkDataGetV1(b *testing.B) {
+	runDataGetBenchmark(b, false)
+}
+
+func BenchmarkDataGetV1Pretty(b *testing.B) {
+	runDataGetBenchmark(b, true)
+}
+
+func runDataGetBenchmark(b *testing.B, pretty bool) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	server, err := New(ctx, store, ":8182", false)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	servers := make([]string, 100)
+	for i := range servers {
+		servers[i] = fmt.Sprintf(`{"id": "s%d", "name": "app", "ports": ["p1", "p2", "p3"], "protocols": ["https", "ssh"]}`, i)
+	}
+
+	put, err := http.NewRequest("PUT", "/v1/data/servers", strings.NewReader("["+strings.Join(servers, ",")+"]"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.Handler.ServeHTTP(recorder, put)
+	if recorder.Code != 201 {
+		b.Fatalf("Unexpected response to PUT: %v", recorder)
+	}
+
+	path := "/v1/data/servers"
+	if pretty {
+		path += "?pretty=true"
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		get, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, get)
+		if recorder.Code != 200 {
+			b.Fatalf("Unexpected response to GET: %v", recorder)
+		}
+	}
+}
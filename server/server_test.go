@@ -5,20 +5,34 @@
 package server
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/topdown"
 	"github.com/open-policy-agent/opa/util"
 	"github.com/open-policy-agent/opa/util/test"
+	"github.com/open-policy-agent/opa/version"
 )
 
 var policyDir string
@@ -126,21 +140,38 @@ func TestDataV1(t *testing.T) {
 			tr{"GET", "/data", "", 200, `{"foo": [1,2,3]}`},
 		}},
 		{"put deep makedir", []tr{
-			tr{"PUT", "/data/a/b/c/d", `1`, 204, ""},
+			tr{"PUT", "/data/a/b/c/d", `1`, 201, ""},
 			tr{"GET", "/data/a/b/c", "", 200, `{"d": 1}`},
 		}},
 		{"put deep makedir partial", []tr{
-			tr{"PUT", "/data/a/b", `{}`, 204, ""},
-			tr{"PUT", "/data/a/b/c/d", `0`, 204, ""},
+			tr{"PUT", "/data/a/b", `{}`, 201, ""},
+			tr{"PUT", "/data/a/b/c/d", `0`, 201, ""},
 			tr{"GET", "/data/a/b/c", "", 200, `{"d": 0}`},
 		}},
 		{"put exists overwrite", []tr{
-			tr{"PUT", "/data/a/b/c", `"hello"`, 204, ""},
+			tr{"PUT", "/data/a/b/c", `"hello"`, 201, ""},
 			tr{"PUT", "/data/a/b", `"goodbye"`, 204, ""},
 			tr{"GET", "/data/a", "", 200, `{"b": "goodbye"}`},
 		}},
+		{"put append", []tr{
+			tr{"PUT", "/data/a/b", `[1]`, 201, ""},
+			tr{"PUT", "/data/a/b/-", `2`, 201, ""},
+			tr{"GET", "/data/a/b", "", 200, `[1,2]`},
+		}},
+		{"put append makearray", []tr{
+			tr{"PUT", "/data/a/b/-", `{"c": 1}`, 201, ""},
+			tr{"PUT", "/data/a/b/-", `{"c": 2}`, 201, ""},
+			tr{"GET", "/data/a", "", 200, `{"b": [{"c": 1}, {"c": 2}]}`},
+		}},
+		{"put append non-array", []tr{
+			tr{"PUT", "/data/a/b", `{}`, 201, ""},
+			tr{"PUT", "/data/a/b/-", `1`, 400, `{
+				"Code": 400,
+				"Message": "bad append path: /a/b is not an array"
+			}`},
+		}},
 		{"put base write conflict", []tr{
-			tr{"PUT", "/data/a/b", `[1,2,3,4]`, 204, ""},
+			tr{"PUT", "/data/a/b", `[1,2,3,4]`, 201, ""},
 			tr{"PUT", "/data/a/b/c/d", "0", 404, `{
 				"Code": 404,
 				"Message": "write conflict: /a/b"
@@ -150,8 +181,56 @@ func TestDataV1(t *testing.T) {
 			tr{"PUT", "/policies/test", testMod2, 200, ""},
 			tr{"PUT", "/data/testmod/q/x", "0", 404, `{
 				"Code": 404,
-				"Message": "write conflict: /testmod/q"
+				"Message": "write conflict: /testmod/q: virtual document defined by rule q (test:4)",
+				"Rules": [{"Name": "q", "Location": {"File": "test", "Row": 4, "Col": 2}}]
+			}`},
+		}},
+		{"put virtual write conflict (exact)", []tr{
+			tr{"PUT", "/policies/test", testMod2, 200, ""},
+			tr{"PUT", "/data/testmod/q", "0", 404, `{
+				"Code": 404,
+				"Message": "write conflict: /testmod/q: virtual document defined by rule q (test:4)",
+				"Rules": [{"Name": "q", "Location": {"File": "test", "Row": 4, "Col": 2}}]
+			}`},
+			tr{"GET", "/data/testmod/q", "", 200, ""},
+		}},
+		{"put virtual write conflict (contained)", []tr{
+			tr{"PUT", "/policies/test", testMod2, 200, ""},
+			tr{"PUT", "/data/testmod", `{"q": 0}`, 404, `{
+				"Code": 404,
+				"Message": "write conflict: /testmod/q: virtual document defined by rule q (test:4)",
+				"Rules": [{"Name": "q", "Location": {"File": "test", "Row": 4, "Col": 2}}]
+			}`},
+			tr{"PUT", "/data/testmod", `{"deadbeef": 0}`, 201, ""},
+		}},
+		{"put virtual write conflict (variable key)", []tr{
+			tr{"PUT", "/policies/test", "package foo.a\nbar = true :- true", 200, ""},
+			tr{"PUT", "/data/foo", `{"b": {"bar": 1}}`, 201, ""},
+			tr{"PUT", "/data/foo", `{"a": {"bar": 1}}`, 404, `{
+				"Code": 404,
+				"Message": "write conflict: /foo/a/bar: virtual document defined by rule bar (test:2)",
+				"Rules": [{"Name": "bar", "Location": {"File": "test", "Row": 2, "Col": 1}}]
 			}`},
+			tr{"PUT", "/data", `{"foo": {"a": {"bar": 1}}}`, 404, ""},
+			tr{"PUT", "/data/foo", `[1, 2, 3]`, 404, ""},
+		}},
+		{"put virtual write conflict (partial rule keys)", []tr{
+			tr{"PUT", "/policies/test", "package foo\np[x] :- x = \"a\"\nq[k] = v :- k = \"a\", v = 1", 200, ""},
+			tr{"PUT", "/data/foo/p/a", "true", 404, `{
+				"Code": 404,
+				"Message": "write conflict: /foo/p: virtual document defined by rule p (test:2)",
+				"Rules": [{"Name": "p", "Location": {"File": "test", "Row": 2, "Col": 1}}]
+			}`},
+			tr{"PUT", "/data/foo/q/b", "1", 404, ""},
+			tr{"PATCH", "/data/foo", `[{"op": "add", "path": "/q/a/b", "value": 1}]`, 404, ""},
+			tr{"PUT", "/data/foo", `{"q": {"b": 1}}`, 404, ""},
+			tr{"PUT", "/data/foo", `{"r": {"b": 1}}`, 201, ""},
+		}},
+		{"patch virtual write conflict (contained)", []tr{
+			tr{"PUT", "/policies/test", "package foo.a\nbar = true :- true", 200, ""},
+			tr{"PATCH", "/data/foo", `[{"op": "add", "path": "/", "value": {"a": {"bar": 1}}}]`, 404, ""},
+			tr{"PATCH", "/data/foo", `[{"op": "add", "path": "/", "value": {"b": {"bar": 1}}}]`, 204, ""},
+			tr{"PATCH", "/data/foo", `[{"op": "remove", "path": "/b"}]`, 204, ""},
 		}},
 		{"get virtual", []tr{
 			tr{"PUT", "/policies/test", testMod1, 200, ""},
@@ -162,7 +241,103 @@ func TestDataV1(t *testing.T) {
 			tr{"PUT", "/policies/test", testMod1, 200, ""},
 			tr{"PATCH", "/data/testmod/p", `[{"op": "add", "path": "-", "value": 1}]`, 404, `{
                 "Code": 404,
-                "Message": "write conflict: /testmod/p"
+                "Message": "write conflict: /testmod/p: virtual document defined by rule p (test:2)",
+                "Rules": [{"Name": "p", "Location": {"File": "test", "Row": 2, "Col": 17}}]
+            }`},
+		}},
+		{"patch bad operations", []tr{
+			tr{"PUT", "/policies/test", testMod1, 200, ""},
+			tr{"PATCH", "/data/x", `[
+				{"op": "foo", "path": "/a", "value": 1},
+				{"op": "add", "path": "/b", "value": 2},
+				{"op": "bar", "path": "/c"}
+			]`, 400, `{
+                "Code": 400,
+                "Message": "invalid patch operation(s), see Errors",
+                "Errors": [
+                    {"Index": 0, "Op": "foo", "Path": "/a", "Message": "bad patch operation: foo"},
+                    {"Index": 2, "Op": "bar", "Path": "/c", "Message": "bad patch operation: bar"}
+                ]
+            }`},
+			tr{"PATCH", "/data/testmod/p", `[
+				{"op": "foo", "path": "/a"},
+				{"op": "add", "path": "-", "value": 1}
+			]`, 400, ""},
+		}},
+		{"patch test", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": {"c": [1, 2]}}`, 201, ""},
+			tr{"PATCH", "/data/x", `[
+				{"op": "test", "path": "/b", "value": {"c": [1, 2]}},
+				{"op": "replace", "path": "/a", "value": 2}
+			]`, 204, ""},
+			tr{"GET", "/data/x/a", "", 200, "2"},
+			tr{"PATCH", "/data/x", `[
+				{"op": "test", "path": "/a", "value": 1},
+				{"op": "replace", "path": "/a", "value": 3}
+			]`, 409, `{
+                "Code": 409,
+                "Message": "patch test operation(s) failed, see Errors",
+                "Errors": [
+                    {"Index": 0, "Op": "test", "Path": "/a", "Message": "test failed: document at /a does not match value"}
+                ]
+            }`},
+			tr{"GET", "/data/x/a", "", 200, "2"},
+			tr{"PATCH", "/data/x", `[
+				{"op": "add", "path": "/d", "value": 1},
+				{"op": "test", "path": "/d", "value": 1},
+				{"op": "replace", "path": "/a", "value": 3},
+				{"op": "test", "path": "/a", "value": 3}
+			]`, 204, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 3, "b": {"c": [1, 2]}, "d": 1}`},
+			tr{"PATCH", "/data/x", `[
+				{"op": "replace", "path": "/a", "value": 4},
+				{"op": "test", "path": "/a", "value": 3},
+				{"op": "remove", "path": "/d"}
+			]`, 409, `{
+                "Code": 409,
+                "Message": "patch test operation(s) failed, see Errors",
+                "Errors": [
+                    {"Index": 1, "Op": "test", "Path": "/a", "Message": "test failed: document at /a does not match value"}
+                ]
+            }`},
+			tr{"GET", "/data/x", "", 200, `{"a": 3, "b": {"c": [1, 2]}, "d": 1}`},
+		}},
+		{"patch atomic", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": [1, 2]}`, 201, ""},
+			tr{"PATCH", "/data/x", `[
+				{"op": "add", "path": "/c", "value": 3},
+				{"op": "add", "path": "/b/-", "value": 3},
+				{"op": "remove", "path": "/d"}
+			]`, 404, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 1, "b": [1, 2]}`},
+			tr{"PATCH", "/data", `[
+				{"op": "add", "path": "/y", "value": 1},
+				{"op": "replace", "path": "/x/a", "value": 2},
+				{"op": "remove", "path": "/z"}
+			]`, 404, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 1, "b": [1, 2]}`},
+			tr{"GET", "/data/y", "", 404, ""},
+			tr{"PATCH", "/data/x", `[
+				{"op": "add", "path": "/b/0", "value": 0},
+				{"op": "remove", "path": "/b/1"},
+				{"op": "add", "path": "/b/-", "value": 3},
+				{"op": "replace", "path": "/b/0", "value": 4},
+				{"op": "add", "path": "/a", "value": 5},
+				{"op": "remove", "path": "/a"},
+				{"op": "remove", "path": "/d"}
+			]`, 404, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 1, "b": [1, 2]}`},
+			tr{"PATCH", "/data", `[
+				{"op": "replace", "path": "/", "value": {"z": 1}},
+				{"op": "remove", "path": "/x"}
+			]`, 404, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 1, "b": [1, 2]}`},
+			tr{"GET", "/data/z", "", 404, ""},
+		}},
+		{"patch unknown field", []tr{
+			tr{"PATCH", "/data/x", `[{"operation": "add", "path": "/", "value": 1}]`, 400, `{
+                "Code": 400,
+                "Message": "bad patch: json: unknown field \"operation\""
             }`},
 		}},
 		{"get with request", []tr{
@@ -196,13 +371,15 @@ func TestDataV1(t *testing.T) {
 		{"get with request (bad format)", []tr{
 			tr{"GET", `/data/deadbeef?request="foo`, "", 400, `{
 				"Code": 400,
-				"Message": "request parameter format is [[<path>]:]<value> where <path> is either var or ref"
+				"Message": "request parameter format is [[<path>]:]<value> where <path> is either var or ref",
+				"Details": {"Parameter": "request", "Value": "\"foo", "Part": "path", "Offset": 0}
 			}`},
 		}},
 		{"get with request (path error)", []tr{
 			tr{"GET", `/data/deadbeef?request="foo:1`, "", 400, `{
 				"Code": 400,
-				"Message": "request parameter format is [[<path>]:]<value> where <path> is either var or ref"
+				"Message": "bad request parameter \"\\\"foo:1\": interpreted as path \"\\\"foo\" and value \"1\": request parameter format is [[<path>]:]<value> where <path> is either var or ref (values containing colons must be quoted, e.g., x:\"a:b\")",
+				"Details": {"Parameter": "request", "Value": "\"foo:1", "Part": "path", "Offset": 1}
 			}`},
 		}},
 		{"get undefined", []tr{
@@ -235,7 +412,7 @@ func TestDataV1(t *testing.T) {
 
 func TestDataPutV1IfNoneMatch(t *testing.T) {
 	f := newFixture(t)
-	if err := f.v1("PUT", "/data/a/b/c", "0", 204, ""); err != nil {
+	if err := f.v1("PUT", "/data/a/b/c", "0", 201, ""); err != nil {
 		t.Fatalf("Unexpected error from PUT /data/a/b/c: %v", err)
 	}
 	req := newReqV1("PUT", "/data/a/b/c", "1")
@@ -245,335 +422,3596 @@ func TestDataPutV1IfNoneMatch(t *testing.T) {
 	}
 }
 
-func TestDataGetExplainFull(t *testing.T) {
+func TestDataPutV1Location(t *testing.T) {
+
 	f := newFixture(t)
 
-	f.v1("PUT", "/data/x", `{"a":1,"b":2}`, 204, "")
+	tests := []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/data/x/y", 201, "/v1/data/x/y"},
+		{"/data/x/y", 204, ""},
+		{"/data/x/a b", 201, "/v1/data/x/a%20b"},
+		{"/data/x/z/-", 201, "/v1/data/x/z/0"},
+		{"/data/x/z/-", 201, "/v1/data/x/z/1"},
+	}
 
-	req := newReqV1("GET", "/data/x?explain=full", "")
-	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	for _, tc := range tests {
+		if err := f.v1("PUT", tc.path, `1`, tc.code, ""); err != nil {
+			t.Fatal(err)
+		}
+		if location := f.recorder.Header().Get("Location"); location != tc.location {
+			t.Fatalf("Expected location %q for %v but got: %q", tc.location, tc.path, location)
+		}
+	}
 
-	var result traceV1
+	req := newReqV1("PUT", "/data/x/y", `2`)
+	req.Header.Set("If-None-Match", "*")
 
-	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
-		t.Fatalf("Unexpected JSON decode error: %v", err)
+	if err := f.executeRequest(req, 304, ""); err != nil {
+		t.Fatal(err)
 	}
+}
 
-	if len(result) != 3 {
-		t.Fatalf("Expected exactly 3 events but got %d", len(result))
+func TestDataPutV1Diff(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"new document", []tr{
+			tr{"PUT", "/data/x?diff=true", `{"a": 1}`, 201, `{"Changed": true, "Patch": [{"op": "add", "path": "/x", "value": {"a": 1}}]}`},
+			tr{"GET", "/data/x", "", 200, `{"a": 1}`},
+		}},
+		{"no change", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": [1, 2]}`, 201, ""},
+			tr{"PUT", "/data/x?diff=true", `{"b": [1, 2], "a": 1}`, 200, `{"Changed": false, "Patch": []}`},
+		}},
+		{"object changes", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": {"c": 2, "d": 3}, "e": [1]}`, 201, ""},
+			tr{"PUT", "/data/x?diff=true", `{"b": {"c": 2, "d": 4}, "e": [1, 2], "f": true}`, 200, `{"Changed": true, "Patch": [
+				{"op": "remove", "path": "/x/a"},
+				{"op": "replace", "path": "/x/b/d", "value": 4},
+				{"op": "replace", "path": "/x/e", "value": [1, 2]},
+				{"op": "add", "path": "/x/f", "value": true}
+			]}`},
+			tr{"GET", "/data/x", "", 200, `{"b": {"c": 2, "d": 4}, "e": [1, 2], "f": true}`},
+		}},
+		{"escaped keys", []tr{
+			tr{"PUT", "/data/x~y", `{"a/b": 1, "c~d": 2}`, 201, ""},
+			tr{"PUT", "/data/x~y?diff=true", `{"a/b": null}`, 200, `{"Changed": true, "Patch": [
+				{"op": "replace", "path": "/x~0y/a~1b", "value": null},
+				{"op": "remove", "path": "/x~0y/c~0d"}
+			]}`},
+		}},
+		{"scalar change", []tr{
+			tr{"PUT", "/data/x", `1`, 201, ""},
+			tr{"PUT", "/data/x?diff=true", `"one"`, 200, `{"Changed": true, "Patch": [{"op": "replace", "path": "/x", "value": "one"}]}`},
+		}},
+		{"append", []tr{
+			tr{"PUT", "/data/x/-?diff=true", `1`, 201, `{"Changed": true, "Patch": [{"op": "add", "path": "/x/-", "value": 1}]}`},
+		}},
 	}
 
-	_, ok := result[2].Node.(ast.Body)
-	if !ok {
-		t.Fatalf("Expected body for node but got: %v", result[2].Node)
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
 	}
+}
 
-	if len(result[2].Locals) != 1 {
-		t.Fatalf("Expected one binding but got: %v", result[2].Locals)
+func TestDataGetV1NullVersusUndefined(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `{"y": null}`, 201, ""); err != nil {
+		t.Fatalf("Unexpected error from PUT /data/x: %v", err)
 	}
 
-	req = newReqV1("GET", "/data/deadbeef?explain=full", "")
-	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	// Documents that are defined but null are returned with 200.
+	if err := f.v1("GET", "/data/x/y", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	result = traceV1{}
+	if body := f.recorder.Body.String(); body != "null" {
+		t.Fatalf("Expected null body for null document but got: %q", body)
+	}
 
-	if f.recorder.Code != 404 {
-		t.Fatalf("Expected status code to be 404 but got: %v", f.recorder.Code)
+	// Documents that are undefined are returned with 404 and no body.
+	if err := f.v1("GET", "/data/x/z", "", 404, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
-		t.Fatalf("Unexpected JSON decode error: %v", err)
+	if body := f.recorder.Body.String(); body != "" {
+		t.Fatalf("Expected empty body for undefined document but got: %q", body)
 	}
+}
 
-	if len(result) != 3 {
-		t.Fatalf("Expected exactly 3 events but got %d", len(result))
+func TestTenantsDataGetV1(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"multiple tenants", []tr{
+			tr{"PUT", "/data/opa", `{"acme": {"x": 1}, "globex": {"x": 2}, "100": {"x": 3}}`, 201, ""},
+			tr{"GET", "/tenants/data/x?tenant=acme&tenant=globex&tenant=100&tenant=initech", "", 200, `{"acme": 1, "globex": 2, "100": 3}`},
+		}},
+		{"missing tenant", []tr{
+			tr{"GET", "/tenants/data/x", "", 400, ""},
+		}},
+		{"bad tenant", []tr{
+			tr{"GET", "/tenants/data/x?tenant=a/b", "", 400, ""},
+		}},
 	}
 
-	if result[2].Op != "Fail" {
-		t.Fatalf("Expected last event to be 'Fail' but got: %v", result[2])
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1CaseInsensitivePaths(t *testing.T) {
+
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/Users", `{"Alice": {"roles": ["admin"]}, "bob": 1, "BOB": 2}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package Acme\nAllow = true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups are exact by default.
+	if err := f.v1("GET", "/data/users/alice/roles", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server.WithCaseInsensitivePaths(true)
+
+	tests := []struct {
+		path string
+		code int
+		resp string
+	}{
+		{"/data/users/alice/roles", 200, `["admin"]`},
+		{"/data/USERS/Alice/ROLES/0", 200, `"admin"`},
+		{"/data/acme/allow", 200, `true`},
+		{"/data/users/bob", 200, `1`},
+		{"/data/users/Bob", 404, ``},
+		{"/data/users/carol", 404, ``},
 	}
 
+	for _, tc := range tests {
+		if err := f.v1("GET", tc.path, "", tc.code, tc.resp); err != nil {
+			t.Error(err)
+		}
+	}
 }
 
-func TestDataGetExplainTruth(t *testing.T) {
+func TestV1NumberFormat(t *testing.T) {
+
 	f := newFixture(t)
 
-	f.v1("PUT", "/policies/test", `package test
-	p :- a = [1,2,3,4], a[_] = x, x > 1
-	`, 204, "")
+	if err := f.v1("PUT", "/data/x", `{"id": 12345678901234567890123, "f": 0.10000000000000000555, "s": [1]}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/data/x", `{"f":0.10000000000000000555,"id":12345678901234567890123,"s":[1]}`},
+		{"/data/x?numbers=string", `{"f":"0.10000000000000000555","id":"12345678901234567890123","s":["1"]}`},
+		{"/data/x/id?request=a:data.x.s[i]&numbers=string", `[["12345678901234567890123",{"i":"0"}]]`},
+		{"/query?q=data.x.id%20=%20y", `[{"y":12345678901234567890123}]`},
+		{"/query?q=data.x.id%20=%20y&numbers=string", `[{"y":"12345678901234567890123"}]`},
+	}
+
+	for _, tc := range tests {
+		if err := f.v1("GET", tc.path, "", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+		if result := f.recorder.Body.String(); result != tc.expected {
+			t.Errorf("GET %v: expected %v but got: %v", tc.path, tc.expected, result)
+		}
+	}
+}
+
+func TestDataGetV1Select(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"object", []tr{
+			tr{"PUT", "/data/x", `{"user": {"name": "alice", "roles": ["admin", "dev"]}}`, 201, ""},
+			tr{"GET", "/data/x?select=user.roles", "", 200, `["admin", "dev"]`},
+			tr{"GET", "/data/x?select=user.roles.1", "", 200, `"dev"`},
+		}},
+		{"undefined", []tr{
+			tr{"PUT", "/data/x", `{"user": {"name": "alice", "roles": ["admin", "dev"]}}`, 201, ""},
+			tr{"GET", "/data/x?select=user.groups", "", 404, ""},
+			tr{"GET", "/data/x?select=user.roles.2", "", 404, ""},
+			tr{"GET", "/data/x?select=user.name.first", "", 404, ""},
+		}},
+		{"non-ground", []tr{
+			tr{"PUT", "/data/x", `[{"a": 1}, {"b": 2}, {"a": 3}]`, 201, ""},
+			tr{"PUT", "/policies/test", "package test\nimport request.y\np = y :- true", 200, ""},
+			tr{"GET", "/data/test/p?request=y:data.x[i]&select=a", "", 200, `[[1, {"i": 0}], [3, {"i": 2}]]`},
+			tr{"GET", "/data/test/p?request=y:data.x[i]&select=c", "", 404, ""},
+		}},
+		{"bad select", []tr{
+			tr{"PUT", "/data/x", `{}`, 201, ""},
+			tr{"GET", "/data/x?select=user..roles", "", 400, ""},
+			tr{"GET", "/data/x?select=", "", 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+
+	tests := []struct {
+		note     string
+		request  []string
+		expected interface{}
+	}{
+		{"var", []string{`hello:"world"`}, `{"hello": "world"}`},
+		{"ref", []string{`a.b.c:"c"`, `a.b.d:"d"`}, `{"a": {"b": {"c": "c", "d": "d"}}}`},
+		{"root", []string{`:[1,2,3]`}, `[1,2,3]`},
+		{"explicit root", []string{`request.a.b:1`, `x:2`}, `{"a": {"b": 1}, "x": 2}`},
+		{"explicit root only", []string{`request:{"a": 1}`}, `{"a": 1}`},
+		{"data root",
+			[]string{`data.a.b:1`},
+			fmt.Errorf("request parameter path data.a.b must be rooted at request document")},
+		{"data root only",
+			[]string{`data:1`},
+			fmt.Errorf("request parameter path data must be rooted at request document")},
+		{"bad path",
+			[]string{`"a":1`},
+			fmt.Errorf(`bad request parameter "\"a\":1": interpreted as path "\"a\"" and value "1": %v (values containing colons must be quoted, e.g., x:"a:b")`, errRequestPathFormat)},
+		{"no separator",
+			[]string{`a b`},
+			errRequestPathFormat},
+		{"quoted colon value", []string{`x:"http://example.com"`}, `{"x": "http://example.com"}`},
+		{"quoted colon root", []string{`"2016-01-01T00:00:00Z"`}, `"2016-01-01T00:00:00Z"`},
+		{"quoted colon ref", []string{`user.last_login:"2016-01-02T15:04:05Z"`}, `{"user": {"last_login": "2016-01-02T15:04:05Z"}}`},
+		{"colon in path", []string{`headers["x:y"]:"a:b"`}, `{"headers": {"x:y": "a:b"}}`},
+		{"nested object value", []string{`user:{"name": "bob", "meta": {"url": "http://example.com", "tags": ["a:b"]}}`}, `{"user": {"name": "bob", "meta": {"url": "http://example.com", "tags": ["a:b"]}}}`},
+		{"array index", []string{`a[0]:1`}, `{"a": [1]}`},
+		{"array index mixed", []string{`a.b[2].c:"x"`, `a.b[0]:true`}, `{"a": {"b": [true, null, {"c": "x"}]}}`},
+		{"nested object value with ref", []string{`a.b:{"c": {"d": "e:f"}}`, `a.x:1`}, `{"a": {"b": {"c": {"d": "e:f"}}, "x": 1}}`},
+		{"unquoted colon root",
+			[]string{`2016-01-01T00:00:00Z`},
+			fmt.Errorf(`bad request parameter "2016-01-01T00:00:00Z": interpreted as path "2016-01-01T00" and value "00:00Z": %v (values containing colons must be quoted, e.g., x:"a:b")`, errRequestPathFormat)},
+	}
+
+	for i, tc := range tests {
+
+		request, _, err := parseRequest(tc.request)
+
+		switch e := tc.expected.(type) {
+		case error:
+			if err == nil {
+				t.Errorf("%v (#%d): Expected error %v but got: %v", tc.note, i+1, e, request)
+				continue
+			}
+			if err.Error() != e.Error() {
+				t.Errorf("%v (#%d): Expected error %v but got: %v", tc.note, i+1, e, err)
+			}
+		case string:
+			if err != nil {
+				t.Errorf("%v (#%d): Unexpected error: %v", tc.note, i+1, err)
+				continue
+			}
+			expected := ast.MustParseTerm(e)
+			if !expected.Value.Equal(request) {
+				t.Errorf("%v (#%d): Expected request to equal %v but got: %v", tc.note, i+1, expected, request)
+			}
+		}
+	}
+
+	f := newFixture(t)
+
+	if err := f.v1("GET", "/data/x?request=data.a:1", "", 400, `{
+		"Code": 400,
+		"Message": "request parameter path data.a must be rooted at request document",
+		"Details": {"Parameter": "request", "Value": "data.a:1", "Part": "path", "Offset": 0}
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x?request=x:http://example.com", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(f.recorder.Body.String(), `interpreted as path \"x\" and value \"http://example.com\"`) {
+		t.Fatalf("Expected error to describe interpretation of request parameter but got: %v", f.recorder.Body.String())
+	}
+
+	var result apiErrorV1
+	if err := util.UnmarshalJSON(f.recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := paramErrorDetailsV1{Parameter: "request", Value: "x:http://example.com", Part: "value", Offset: 7}
+	if result.Details == nil || *result.Details != expected {
+		t.Fatalf("Expected details %+v but got: %+v", expected, result.Details)
+	}
+
+	if err := f.v1("GET", "/data/x?request=:[1,", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	result = apiErrorV1{}
+	if err := util.UnmarshalJSON(f.recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = paramErrorDetailsV1{Parameter: "request", Value: ":[1,", Part: "value", Offset: 2}
+	if result.Details == nil || *result.Details != expected {
+		t.Fatalf("Expected details %+v but got: %+v", expected, result.Details)
+	}
+
+	if err := f.v1("GET", "/data/x?request=a:1", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(f.recorder.Body.String(), `"Details"`) {
+		t.Fatalf("Expected no error details but got: %v", f.recorder.Body.String())
+	}
+}
+
+func TestDataGetV1MemoryLimit(t *testing.T) {
+	f := newFixture(t)
+	f.server.WithMemoryLimit(1024)
+
+	if err := f.v1("PUT", "/data/x", `[1,2,3,4,5,6,7,8,9,10]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", `package test
+
+small = [x | data.x[_] = x]
+large = [[x, y, z] | data.x[_] = x, data.x[_] = y, data.x[_] = z]`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/small", "", 200, `[1,2,3,4,5,6,7,8,9,10]`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/large", "", 507, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.test.large=x", "", 507, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataGetV1DepthLimit(t *testing.T) {
+	f := newFixture(t)
+	f.server.WithDepthLimit(2)
+
+	if err := f.v1("PUT", "/policies/test", `package test
+
+shallow :- true
+deep :- a
+a :- b
+b :- c
+c :- true`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/shallow", "", 200, `true`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/deep", "", 500, `{
+		"Code": 500,
+		"Message": "evaluation error (code: 4): evaluation exceeded depth limit of 2 nested queries: check for deeply nested rules or comprehensions"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.test.deep=x", "", 500, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/data/test/deep", "", 500, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataGetV1EvalTimeout(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `[1, 2, 3]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x", "", 200, `[1, 2, 3]`); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server.WithEvalTimeout(time.Nanosecond)
+
+	expected := `{"Code": 503, "Message": "evaluation timed out"}`
+
+	if err := f.v1("GET", "/data/x", "", 503, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.x[i]", "", 503, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/data/x", "", 503, expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type channelLogger chan LogFields
+
+func (l channelLogger) Log(level LogLevel, fields LogFields) {
+	l <- fields
+}
+
+func TestEvalCancelledOnDisconnect(t *testing.T) {
+	f := newFixture(t)
+
+	xs := make([]string, 100)
+	for i := range xs {
+		xs[i] = strconv.Itoa(i)
+	}
+
+	if err := f.v1("PUT", "/data/x", "["+strings.Join(xs, ",")+"]", 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := make(channelLogger, 1)
+	f.server.WithLogger(logger, LogLevelInfo)
+
+	// The server is closed only if evaluation stops because closing the
+	// server waits for active requests to complete.
+	ts := httptest.NewServer(f.server.Handler)
+
+	// The query enumerates 100^4 combinations so it would not complete
+	// before the test times out unless evaluation is aborted.
+	q := url.QueryEscape("data.x[a] = _, data.x[b] = _, data.x[c] = _, data.x[d] = _, a = -1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", ts.URL+"/v1/query?q="+q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req.WithContext(ctx))
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	if err := <-done; err == nil {
+		t.Fatalf("Expected client error after cancellation")
+	}
+
+	select {
+	case fields := <-logger:
+		if fields["path"] != "/v1/query" || fields["status"] != statusClientClosedRequest {
+			t.Fatalf("Unexpected record: %v", fields)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected evaluation to stop after client disconnected")
+	}
+
+	ts.Close()
+
+	// Disconnects are not server errors.
+	var buf bytes.Buffer
+	f.server.httpMetrics.registry.WriteTo(&buf)
+	if strings.Contains(buf.String(), `class="5xx"`) {
+		t.Fatalf("Expected disconnect not to be counted as a server error:\n%v", buf.String())
+	}
+}
+
+func TestEvalDurationHeader(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `[1, 2, 3]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := f.recorder.Header().Get(EvalDurationHeader); d != "" {
+		t.Fatalf("Expected no evaluation duration for write but got: %v", d)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/data/x", 200},
+		{"/data/y", 404},
+		{"/query?q=data.x[i]", 200},
+	}
+
+	for _, tc := range tests {
+		if err := f.v1("GET", tc.path, "", tc.code, ""); err != nil {
+			t.Fatal(err)
+		}
+		d, err := strconv.ParseInt(f.recorder.Header().Get(EvalDurationHeader), 10, 64)
+		if err != nil || d < 0 {
+			t.Fatalf("Expected evaluation duration for %v but got: %v", tc.path, f.recorder.Header())
+		}
+	}
+}
+
+func TestDataGetV1ETag(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `{"a": 1}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package test\nimport request.y\np = y :- true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	acceptEncoding := ""
+
+	get := func(path string, ifNoneMatch string, code int) string {
+		f.reset()
+		req := newReqV1("GET", path, "")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		f.server.Handler.ServeHTTP(f.recorder, req)
+		if f.recorder.Code != code {
+			t.Fatalf("Expected %v from GET %v (If-None-Match: %v) but got: %v", code, path, ifNoneMatch, f.recorder)
+		}
+		return f.recorder.Header().Get("ETag")
+	}
+
+	etag := get("/data/x", "", 200)
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("Expected weak ETag but got: %v", f.recorder.Header())
+	}
+
+	if get("/data/x", etag, 304) != etag || f.recorder.Body.Len() != 0 {
+		t.Fatalf("Expected not modified response without body but got: %v", f.recorder)
+	}
+
+	get("/data/x", `"other", `+strings.TrimPrefix(etag, "W/"), 304)
+
+	// Compressed responses carry the same weak ETag.
+	f.server.WithCompressionThreshold(0)
+	acceptEncoding = "gzip"
+
+	if get("/data/x", "", 200) != etag || f.recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected compressed response with ETag %v but got: %v", etag, f.recorder.Header())
+	}
+
+	get("/data/x", etag, 304)
+	acceptEncoding = ""
+
+	get("/data/x", `*`, 304)
+	get("/data/x", `"other"`, 200)
+
+	if err := f.v1("PUT", "/data/x/a", `2`, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if get("/data/x", etag, 200) == etag {
+		t.Fatalf("Expected ETag to change after write")
+	}
+
+	etag = get("/data/test/p?request=y:1", "", 200)
+	get("/data/test/p?request=y:1", etag, 304)
+
+	if get("/data/test/p?request=y:2", etag, 200) == etag {
+		t.Fatalf("Expected ETag to change with request value")
+	}
+
+	if get("/data/y", "", 404) != "" {
+		t.Fatalf("Expected no ETag for undefined document but got: %v", f.recorder.Header())
+	}
+}
+
+func TestDataGetV1TransactionLimit(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig().WithMaxTransactions(1, 0))
+	server, err := New(ctx, store, ":8182", false)
+	if err != nil {
+		panic(err)
+	}
+
+	f := &fixture{server: server, recorder: httptest.NewRecorder(), t: t}
+
+	if err := f.v1("PUT", "/data/x", `1`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.NewTransactionOrDie(ctx, store)
+
+	if err := f.v1("GET", "/data/x", "", 503, `{
+		"Code": 503,
+		"Message": "storage error (code: 8): transaction limit of 1 exceeded"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Close(ctx, txn)
+
+	if err := f.v1("GET", "/data/x", "", 200, `1`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataGetV1EchoInput(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"no request", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/data/x?echo_input=true", "", 200, `{"input": {}, "result": {"a": 1}}`},
+		}},
+		{"request", []tr{
+			tr{"PUT", "/policies/test", `package test
+import request.x
+p = y :- y = x`, 200, ""},
+			tr{"GET", "/data/test/p?echo_input=true&request=x:1&request=z:[1,2]", "", 200, `{"input": {"x": 1, "z": [1, 2]}, "result": 1}`},
+		}},
+		{"request references", []tr{
+			tr{"PUT", "/data/x", `{"a": [1, 2]}`, 201, ""},
+			tr{"PUT", "/policies/test", `package test
+import request.x
+p = y :- y = x`, 200, ""},
+			tr{"GET", "/data/test/p?echo_input=true&request=x:data.x.a", "", 200, `{"input": {"x": [1, 2]}, "result": [1, 2]}`},
+		}},
+		{"undefined", []tr{
+			tr{"GET", "/data/deadbeef?echo_input=true&request=x:1", "", 404, ""},
+		}},
+		{"non-ground", []tr{
+			tr{"GET", "/data/x?echo_input=true&request=x:data.x[i]", "", 400, `{
+				"Code": 400,
+				"Message": "echo_input with non-ground request values not supported"
+			}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1Profile(t *testing.T) {
+
+	policy := `package test
+import request.a
+import request.b
+p = [a, b] :- true`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"crud", []tr{
+			tr{"GET", "/profiles/foo", "", 404, ""},
+			tr{"PUT", "/profiles/foo", `{"a": 1}`, 204, ""},
+			tr{"GET", "/profiles/foo", "", 200, `{"a": 1}`},
+			tr{"PUT", "/profiles/foo", `{"a": 2}`, 204, ""},
+			tr{"GET", "/profiles/foo", "", 200, `{"a": 2}`},
+			tr{"DELETE", "/profiles/foo", "", 204, ""},
+			tr{"GET", "/profiles/foo", "", 404, ""},
+			tr{"DELETE", "/profiles/foo", "", 404, ""},
+		}},
+		{"profile", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"PUT", "/profiles/foo", `{"a": 1, "b": {"c": 2, "d": 3}}`, 204, ""},
+			tr{"GET", "/data/test/p?profile=foo", "", 200, `[1, {"c": 2, "d": 3}]`},
+		}},
+		{"override", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"PUT", "/profiles/foo", `{"a": 1, "b": {"c": 2, "d": 3}}`, 204, ""},
+			tr{"GET", "/data/test/p?profile=foo&request=a:10&request=b.d:30&request=b.e:40", "", 200, `[10, {"c": 2, "d": 30, "e": 40}]`},
+		}},
+		{"override root", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"PUT", "/profiles/foo", `{"a": 1, "b": 2}`, 204, ""},
+			tr{"GET", "/data/test/p?profile=foo&request=:{\"a\":3,\"b\":4}", "", 200, `[3, 4]`},
+		}},
+		{"unknown", []tr{
+			tr{"GET", "/data/test/p?profile=deadbeef", "", 400, `{
+				"Code": 400,
+				"Message": "unknown profile: deadbeef"
+			}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1MaxRequestParams(t *testing.T) {
+	f := newFixture(t)
+	f.server.WithMaxRequestParams(2)
+
+	if err := f.v1("PUT", "/data/x", `1`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x?request=a:1&request=b:2", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x?request=a:1&request=b:2&request=c:3", "", 400, `{
+		"Code": 400,
+		"Message": "too many request parameters: 3 exceeds limit of 2"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/tenants/data/x?tenant=t1&request=a:1&request=b:2&request=c:3", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server.WithMaxRequestParams(0)
+
+	if err := f.v1("GET", "/data/x?request=a:1&request=b:2&request=c:3", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataV1Decision(t *testing.T) {
+
+	policy := `package authz
+import request.user
+allow :- user = "alice"
+deny = false :- true`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"post allow", []tr{
+			tr{"PUT", "/policies/authz", policy, 200, ""},
+			tr{"POST", "/data/authz/allow", `{"input": {"user": "alice"}}`, 200, `{"result": true}`},
+		}},
+		{"post undefined", []tr{
+			tr{"PUT", "/policies/authz", policy, 200, ""},
+			tr{"POST", "/data/authz/allow", `{"input": {"user": "bob"}}`, 404, ""},
+			tr{"POST", "/data/authz/allow", `{}`, 404, ""},
+			tr{"POST", "/data/authz/deadbeef", `{"input": {"user": "alice"}}`, 404, ""},
+		}},
+		{"post false", []tr{
+			tr{"PUT", "/policies/authz", policy, 200, ""},
+			tr{"POST", "/data/authz/deny", `{"input": {"user": "alice"}}`, 200, `{"result": false}`},
+			tr{"POST", "/data/authz/deny", "", 200, `{"result": false}`},
+		}},
+		{"post bad input", []tr{
+			tr{"PUT", "/policies/authz", policy, 200, ""},
+			tr{"POST", "/data/authz/allow", `{"input": `, 400, ""},
+		}},
+		{"get allow", []tr{
+			tr{"PUT", "/policies/authz", policy, 200, ""},
+			tr{"GET", `/data/authz/allow?request=user:"alice"`, "", 200, `true`},
+			tr{"GET", `/data/authz/allow?request=user:"bob"`, "", 404, ""},
+			tr{"GET", `/data/authz/deny`, "", 200, `false`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1Metrics(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"base document", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/data/x?metrics=true", "", 200, `{"result": {"a": 1}, "metrics": {"counter_store_reads": 2, "counter_store_writes": 0}}`},
+		}},
+		{"virtual document", []tr{
+			tr{"PUT", "/data/x", `[{"a": 1}, {"a": 2}, {"a": 3}]`, 201, ""},
+			tr{"PUT", "/policies/test", `package test
+p[i] :- data.x[i].a = 1`, 200, ""},
+			tr{"GET", "/data/test/p?metrics=true", "", 200, `{"result": [0], "metrics": {"counter_store_reads": 2, "counter_store_writes": 1}}`},
+		}},
+		{"disabled", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/data/x?metrics=false", "", 200, `{"a": 1}`},
+		}},
+		{"query", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/query?q=data.x.a%20=%20y&metrics=true", "", 200, `{"result": [{"y": 1}], "metrics": {"counter_store_reads": 2, "counter_store_writes": 0}}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1Limit(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"truncated", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"GET", "/data/x?request=y:data.x[i]&limit=2", "", 200, `{"result": [[[1, 2, 3], {"i": 0}], [[1, 2, 3], {"i": 1}]], "truncated": true}`},
+		}},
+		{"not truncated", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"GET", "/data/x?request=y:data.x[i]&limit=3", "", 200, `{"result": [[[1, 2, 3], {"i": 0}], [[1, 2, 3], {"i": 1}], [[1, 2, 3], {"i": 2}]], "truncated": false}`},
+		}},
+		{"ground", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"GET", "/data/x?request=y:1&limit=2", "", 400, `{
+				"Code": 400,
+				"Message": "limit with ground request values not supported"
+			}`},
+		}},
+		{"bad limit", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"GET", "/data/x?request=y:data.x[i]&limit=0", "", 400, `{
+				"Code": 400,
+				"Message": "bad limit parameter \"0\": must be a positive integer"
+			}`},
+			tr{"GET", "/query?q=data.x[i]&limit=abc", "", 400, ""},
+		}},
+		{"query", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"GET", "/query?q=data.x[i]%20=%20y&limit=1", "", 200, `{"result": [{"i": 0, "y": 1}], "truncated": true}`},
+			tr{"GET", "/query?q=data.x[i]%20=%20y&limit=5", "", 200, `{"result": [{"i": 0, "y": 1}, {"i": 1, "y": 2}, {"i": 2, "y": 3}], "truncated": false}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+
+	// Traces of evaluations stopped by the limit are marked as truncated.
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `[1, 2, 3]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	lastOp := func(path string) string {
+		if err := f.v1("GET", path, "", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+		var trace traceV1
+		if err := util.UnmarshalJSON(f.recorder.Body.Bytes(), &trace); err != nil {
+			t.Fatal(err)
+		}
+		if len(trace) == 0 {
+			t.Fatalf("Expected trace from GET %v", path)
+		}
+		return trace[len(trace)-1].Op
+	}
+
+	if op := lastOp("/query?q=data.x[i]%20=%20y&limit=1&explain=full"); op != traceTruncatedOpV1 {
+		t.Fatalf("Expected truncated trace but last event was: %v", op)
+	}
+
+	if op := lastOp("/query?q=data.x[i]%20=%20y&limit=5&explain=full"); op == traceTruncatedOpV1 {
+		t.Fatalf("Expected complete trace")
+	}
+}
+
+func TestQueryGetV1EchoQuery(t *testing.T) {
+
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `[1, 2]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.x[i]%20=%202&echo_query=true", "", 200, `{"query": "data.x[i] = 2", "result": [{"i": 1}]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.x[i]%20=%202&echo_query=false", "", 200, `[{"i": 1}]`); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reset()
+
+	get, err := http.NewRequest("GET", `/?q=x%20=%201&echo_query=true`, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	f.server.Handler.ServeHTTP(f.recorder, get)
+
+	if f.recorder.Code != 200 || !strings.Contains(f.recorder.Body.String(), `"query": "x = 1"`) {
+		t.Fatalf("Expected echoed query in response but got: %v", f.recorder.Body.String())
+	}
+}
+
+func TestQueryPostV1(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"basic", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"POST", "/query", `{"query": "data.x[i] = 2"}`, 200, `[{"i": 1}]`},
+			tr{"POST", "/query", `{"query": "data.x[i] = 4"}`, 200, `[]`},
+		}},
+		{"url parameters", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3]`, 201, ""},
+			tr{"POST", "/query?limit=1", `{"query": "data.x[i]"}`, 200, `{"result": [{"i": 0}], "truncated": true}`},
+		}},
+		{"bad requests", []tr{
+			tr{"POST", "/query", `{}`, 400, `{"Code": 400, "Message": "bad query request: missing query"}`},
+			tr{"POST", "/query", `{"q": "x = 1"}`, 400, ""},
+			tr{"POST", "/query", `{"query": "x = "}`, 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+
+	f := newFixture(t)
+
+	if err := f.v1("POST", "/query", `{"query": "x = 1", "explain": "full", "pretty": true}`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := f.recorder.Body.String(); !strings.Contains(body, `"Op": "Enter"`) {
+		t.Fatalf("Expected pretty full explanation in response but got: %v", body)
+	}
+}
+
+func TestDataGetV1DebugSource(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"base and virtual", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"PUT", "/policies/test", "package x\np = 2 :- true", 200, ""},
+			tr{"GET", "/data/x?debug_source=true", "", 200, `{"result": {"a": 1, "p": 2}, "sources": {"a": "base", "p": "virtual"}}`},
+			tr{"GET", "/data/x/p?debug_source=true", "", 200, `{"result": 2, "sources": "virtual"}`},
+			tr{"GET", "/data/x/a?debug_source=true", "", 200, `{"result": 1, "sources": "base"}`},
+		}},
+		{"mixed", []tr{
+			tr{"PUT", "/data/m/n", `{"c": 1}`, 201, ""},
+			tr{"PUT", "/policies/test", "package m.n\nr = 2 :- true", 200, ""},
+			tr{"GET", "/data/m?debug_source=true", "", 200, `{"result": {"n": {"c": 1, "r": 2}}, "sources": {"n": "mixed"}}`},
+		}},
+		{"select", []tr{
+			tr{"PUT", "/data/x", `{"a": {"b": 1}}`, 201, ""},
+			tr{"GET", "/data/x?debug_source=true&select=a", "", 200, `{"result": {"b": 1}, "sources": {"b": "base"}}`},
+		}},
+		{"non-ground", []tr{
+			tr{"PUT", "/data/x", `[1, 2]`, 201, ""},
+			tr{"GET", "/data/x?debug_source=true&request=y:data.x[i]", "", 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataBatchPostV1(t *testing.T) {
+
+	policy := `package test
+import request.a
+import request.b
+p = a :- true
+p = b :- true`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"results", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/batch/data/test/p", `[{"input": {"a": 1, "b": 1}}, {"input": {}}, {}, {"input": {"a": "x", "b": "x"}}, {"input": {"a": null, "b": null}}]`, 200, `[
+				{"result": 1},
+				{"undefined": true},
+				{"undefined": true},
+				{"result": "x"},
+				{"result": null}
+			]`},
+			tr{"POST", "/batch/data/test/p", `[]`, 200, `[]`},
+		}},
+		{"partial failure", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/batch/data/test/p", `[{"input": {"a": 1, "b": 1}}, "bad", {"input": {"a": 1, "b": 2}}, {"input": {"a": 2, "b": 2}}]`, 200, `[
+				{"result": 1},
+				{"error": {"Code": 400, "Message": "bad batch element: must be an object"}},
+				{"error": {"Code": 500, "Message": "evaluation error (code: 1): multiple values for data.test.p: rules must produce exactly one value for complete documents: check rule definition(s): p"}},
+				{"result": 2}
+			]`},
+		}},
+		{"bad batch", []tr{
+			tr{"POST", "/batch/data/test/p", `{"input": {}}`, 400, ""},
+		}},
+		{"data path", []tr{
+			tr{"PUT", "/data/x/batch", `{"y": 1}`, 201, ""},
+			tr{"POST", "/data/x/batch", `{"input": {}}`, 200, `{"result": {"y": 1}}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataDeleteV1(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"remove", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": [1, 2]}`, 201, ""},
+			tr{"DELETE", "/data/x/a", "", 204, ""},
+			tr{"DELETE", "/data/x/b/0", "", 204, ""},
+			tr{"GET", "/data/x", "", 200, `{"b": [2]}`},
+			tr{"DELETE", "/data/x", "", 204, ""},
+			tr{"GET", "/data/x", "", 404, ""},
+		}},
+		{"not found", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"DELETE", "/data/x/z", "", 404, ""},
+			tr{"DELETE", "/data/y/z", "", 404, ""},
+		}},
+		{"conflict", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"PUT", "/policies/test", "package x\np = 1 :- true", 200, ""},
+			tr{"DELETE", "/data/x/p", "", 404, ""},
+			tr{"DELETE", "/data/x/p/a", "", 404, ""},
+			tr{"GET", "/data/x/a", "", 200, `1`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataBatchDeleteV1(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"remove", []tr{
+			tr{"PUT", "/data/x", `{"a": 1, "b": 2, "c": 3}`, 201, ""},
+			tr{"POST", "/batch/delete", `["/x/a", "/x/b", "/x/z"]`, 200, `{"missing": ["/x/z"]}`},
+			tr{"GET", "/data/x", "", 200, `{"c": 3}`},
+		}},
+		{"parent and child", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"POST", "/batch/delete", `["/x", "/x/a"]`, 200, `{"missing": []}`},
+			tr{"GET", "/data/x", "", 404, ""},
+		}},
+		{"atomic missing", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"POST", "/batch/delete?atomic=true", `["/x/a", "/x/z"]`, 404, ""},
+			tr{"GET", "/data/x", "", 200, `{"a": 1}`},
+		}},
+		{"conflict", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"PUT", "/policies/test", "package x\np = 1 :- true", 200, ""},
+			tr{"POST", "/batch/delete?atomic=true", `["/x/a", "/x/p"]`, 404, ""},
+			tr{"GET", "/data/x/a", "", 200, `1`},
+			tr{"POST", "/batch/delete", `["/x/a", "/x/p"]`, 200, `{"missing": [], "conflicts": ["/x/p"]}`},
+			tr{"GET", "/data/x/a", "", 404, ""},
+		}},
+		{"data path", []tr{
+			tr{"PUT", "/data/batch-delete", `{"q": 2}`, 201, ""},
+			tr{"POST", "/data/batch-delete", `{"input": {}}`, 200, `{"result": {"q": 2}}`},
+		}},
+		{"bad paths", []tr{
+			tr{"POST", "/batch/delete", `["x"]`, 400, ""},
+			tr{"POST", "/batch/delete", `["/"]`, 400, ""},
+			tr{"POST", "/batch/delete", `{"path": "/x"}`, 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1Flatten(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"object", []tr{
+			tr{"PUT", "/data/x", `{"a": {"b": {"c": 1}, "d": [true, {"e": "f"}]}, "g": {}, "h": []}`, 201, ""},
+			tr{"GET", "/data/x?flatten=true", "", 200, `{"a.b.c": 1, "a.d.0": true, "a.d.1.e": "f", "g": {}, "h": []}`},
+		}},
+		{"array", []tr{
+			tr{"PUT", "/data/x", `[1, [2, 3]]`, 201, ""},
+			tr{"GET", "/data/x?flatten=true", "", 200, `{"0": 1, "1.0": 2, "1.1": 3}`},
+		}},
+		{"scalar", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/data/x/a?flatten=true", "", 200, `1`},
+		}},
+		{"non-ground", []tr{
+			tr{"PUT", "/data/x", `[{"a": {"b": 1}}]`, 201, ""},
+			tr{"GET", "/data/x?flatten=true&request=y:data.x[i]", "", 200, `[[{"0.a.b": 1}, {"i": 0}]]`},
+		}},
+		{"types", []tr{
+			tr{"PUT", "/data/x", `{"a": 1}`, 201, ""},
+			tr{"GET", "/data/x?flatten=true&types=true", "", 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDecisionPostV1(t *testing.T) {
+
+	policy := `package authz
+import request.user
+allow :- user = "alice"
+allow :- user = "bob"
+admin :- user = "alice"
+deny :- user = "bob"
+`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"all-true", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/decision", `{"input": {"user": "alice"}, "paths": ["/authz/allow", "/authz/admin"], "combine": "all-true"}`, 200, `{"result": true, "decisions": {"/authz/allow": true, "/authz/admin": true}}`},
+			tr{"POST", "/decision", `{"input": {"user": "bob"}, "paths": ["/authz/allow", "/authz/admin"]}`, 200, `{"result": false, "decisions": {"/authz/allow": true, "/authz/admin": null}}`},
+		}},
+		{"any-true", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/decision", `{"input": {"user": "bob"}, "paths": ["/authz/allow", "/authz/admin"], "combine": "any-true"}`, 200, `{"result": true, "decisions": {"/authz/allow": true, "/authz/admin": null}}`},
+			tr{"POST", "/decision", `{"input": {"user": "eve"}, "paths": ["/authz/allow", "/authz/admin"], "combine": "any-true"}`, 200, `{"result": false, "decisions": {"/authz/allow": null, "/authz/admin": null}}`},
+		}},
+		{"deny-overrides", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/decision", `{"input": {"user": "alice"}, "paths": ["/authz/allow"], "deny": ["/authz/deny"], "combine": "deny-overrides"}`, 200, `{"result": true, "decisions": {"/authz/allow": true, "/authz/deny": null}}`},
+			tr{"POST", "/decision", `{"input": {"user": "bob"}, "paths": ["/authz/allow"], "deny": ["/authz/deny"], "combine": "deny-overrides"}`, 200, `{"result": false, "decisions": {"/authz/allow": true, "/authz/deny": true}}`},
+		}},
+		{"bad request", []tr{
+			tr{"POST", "/decision", `{"paths": ["/authz/allow"], "combine": "majority"}`, 400, `{"Code": 400, "Message": "bad decision request: unknown combine value: majority"}`},
+			tr{"POST", "/decision", `{"paths": ["/authz/allow"], "deny": ["/authz/deny"]}`, 400, `{"Code": 400, "Message": "bad decision request: deny paths require deny-overrides"}`},
+			tr{"POST", "/decision", `{"paths": []}`, 400, ""},
+			tr{"POST", "/decision", `{"path": ["/authz/allow"]}`, 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestResidualModuleV1(t *testing.T) {
+
+	bodies := []ast.Body{
+		ast.MustParseBody(`request.user = "alice"`),
+		ast.MustParseBody(`data.admins[__local1__] = request.user, not request.guest`),
+		nil,
+	}
+
+	src := newResidualModuleV1(bodies).String()
+
+	mod, err := ast.ParseModule("residual.rego", src)
+	if err != nil {
+		t.Fatalf("Expected residual module to parse but got: %v\n\n%v", err, src)
+	}
+
+	compiler := ast.NewCompiler()
+	if compiler.Compile(map[string]*ast.Module{"residual": mod}); compiler.Failed() {
+		t.Fatalf("Expected residual module to compile but got: %v\n\n%v", compiler.Errors, src)
+	}
+
+	if len(mod.Rules) != len(bodies) {
+		t.Fatalf("Expected one rule per residual query but got:\n\n%v", src)
+	}
+}
+
+func TestCompilePostV1(t *testing.T) {
+
+	policy := `package authz
+import request.user
+import request.method
+allow :- user = "alice"
+allow :- method = "GET", data.admins[_] = user
+deny :- not allow
+`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"residual", []tr{
+			tr{"PUT", "/data/admins", `["bob"]`, 201, ""},
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/compile", `{"query": "data.authz.allow", "input": {"method": "GET"}, "unknowns": ["request.user"]}`, 200, `{"queries": ["eq(request.user, \"alice\")", "eq(\"bob\", request.user)"]}`},
+			tr{"POST", "/compile", `{"query": "data.authz.allow", "input": {"method": "PUT"}, "unknowns": ["request.user"]}`, 200, `{"queries": ["eq(request.user, \"alice\")"]}`},
+		}},
+		{"known", []tr{
+			tr{"PUT", "/data/admins", `["bob"]`, 201, ""},
+			tr{"POST", "/compile", `{"query": "data.admins[_] = \"bob\"", "unknowns": ["request.user"]}`, 200, `{"queries": [""]}`},
+			tr{"POST", "/compile", `{"query": "data.admins[_] = \"eve\"", "unknowns": ["request.user"]}`, 200, `{"queries": []}`},
+		}},
+		{"base document unknowns", []tr{
+			tr{"PUT", "/data/admins", `["bob"]`, 201, ""},
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/compile", `{"query": "data.authz.allow", "input": {"method": "GET", "user": "carol"}, "unknowns": ["data.admins"]}`, 200, `{"queries": ["eq(data.admins[__local1__], \"carol\")"]}`},
+			tr{"POST", "/compile", `{"query": "data.authz.allow", "input": {"method": "GET", "user": "alice"}, "unknowns": ["data.admins"]}`, 200, `{"queries": ["", "eq(data.admins[__local1__], \"alice\")"]}`},
+		}},
+		{"unsupported", []tr{
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/compile", `{"query": "data.authz.deny", "unknowns": ["request.user"]}`, 400, ""},
+			tr{"POST", "/compile", `{"query": "data.authz.allow", "unknowns": ["data.authz"]}`, 400, `{"Code": 400, "Message": "evaluation error (code: 6): unknown data.authz must not refer to virtual documents"}`},
+		}},
+		{"rego format", []tr{
+			tr{"PUT", "/data/admins", `["bob"]`, 201, ""},
+			tr{"PUT", "/policies/test", policy, 200, ""},
+			tr{"POST", "/compile?format=rego", `{"query": "data.authz.allow", "input": {"method": "GET"}, "unknowns": ["request.user"]}`, 200, `{"module": "package partial\n\nresidual = true :- eq(request.user, \"alice\")\nresidual = true :- eq(\"bob\", request.user)"}`},
+			tr{"POST", "/compile?format=rego", `{"query": "data.admins[_] = \"bob\"", "unknowns": ["request.user"]}`, 200, `{"module": "package partial\n\nresidual = true :- true"}`},
+			tr{"POST", "/compile?format=rego", `{"query": "data.admins[_] = \"eve\"", "unknowns": ["request.user"]}`, 200, `{"module": "package partial"}`},
+		}},
+		{"ast format", []tr{
+			tr{"PUT", "/data/admins", `["bob"]`, 201, ""},
+			tr{"POST", "/compile?format=ast", `{"query": "data.admins[_] = \"bob\"", "unknowns": ["request.user"]}`, 200, `{"queries": [[]]}`},
+			tr{"POST", "/compile?format=ast", `{"query": "data.admins[_] = \"eve\"", "unknowns": ["request.user"]}`, 200, `{"queries": []}`},
+			tr{"POST", "/compile?format=ast", `{"query": "request.user = \"alice\"", "unknowns": ["request.user"]}`, 200, `{"queries": [[{"Index": 0, "Terms": [{"Type": "var", "Value": "eq"}, {"Type": "ref", "Value": [{"Type": "var", "Value": "request"}, {"Type": "string", "Value": "user"}]}, {"Type": "string", "Value": "alice"}]}]]}`},
+		}},
+		{"bad request", []tr{
+			tr{"POST", "/compile?format=sql", `{"query": "x = 1"}`, 400, `{"Code": 400, "Message": "bad format parameter \"sql\": must be one of text, ast, or rego"}`},
+			tr{"POST", "/compile", `{}`, 400, `{"Code": 400, "Message": "bad compile request: missing query"}`},
+			tr{"POST", "/compile", `{"query": "x = 1", "unknowns": ["request["]}`, 400, ""},
+			tr{"POST", "/compile", `{"query": "x = ", "unknowns": []}`, 400, ""},
+			tr{"POST", "/compile", `{"q": "x = 1"}`, 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+// nonFlushingWriter hides the http.Flusher implementation of the underlying
+// response writer.
+type nonFlushingWriter struct {
+	http.ResponseWriter
+}
+
+func TestDataGetV1Stream(t *testing.T) {
+
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/data/x", `[{"a": 1}, {"a": 2}, {"b": 3}]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package test\nimport request.y\np = y :- true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := func(w http.ResponseWriter, path string) {
+		req, err := http.NewRequest("GET", "/v1"+path, nil)
+		if err != nil {
+			panic(err)
+		}
+		f.server.Handler.ServeHTTP(w, req)
+	}
+
+	tests := []struct {
+		note     string
+		path     string
+		code     int
+		expected string
+	}{
+		{"results", "/data/test/p?stream=true&request=y:data.x[i]&select=a", 200, "[1,{\"i\":0}]\n[2,{\"i\":1}]\n"},
+		{"limit", "/data/test/p?stream=true&request=y:data.x[i]&limit=1", 200, "[{\"a\":1},{\"i\":0}]\n"},
+		{"undefined", "/data/test/p?stream=true&request=y:data.x[i]&select=c", 404, ""},
+		{"ground", "/data/x?stream=true", 400, ""},
+		{"explain", "/data/x?stream=true&request=y:data.x[i]&explain=full", 400, ""},
+		{"types", "/data/x?stream=true&request=y:data.x[i]&types=true", 400, ""},
+		{"echo_input", "/data/x?stream=true&request=y:data.x[i]&echo_input=true", 400, ""},
+		{"debug_source", "/data/x?stream=true&request=y:data.x[i]&debug_source=true", 400, ""},
+	}
+
+	for _, tc := range tests {
+		f.reset()
+		stream(f.recorder, tc.path)
+		if f.recorder.Code != tc.code {
+			t.Errorf("%v: Expected code %v but got: %v", tc.note, tc.code, f.recorder)
+			continue
+		}
+		if tc.code == 400 && !strings.Contains(f.recorder.Body.String(), "stream requires") {
+			t.Errorf("%v: Expected stream error but got: %v", tc.note, f.recorder.Body.String())
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if f.recorder.Body.String() != tc.expected {
+			t.Errorf("%v: Expected body %q but got: %q", tc.note, tc.expected, f.recorder.Body.String())
+		}
+		if !f.recorder.Flushed {
+			t.Errorf("%v: Expected response to be flushed", tc.note)
+		}
+		if ct := f.recorder.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("%v: Expected newline delimited JSON content type but got: %v", tc.note, ct)
+		}
+	}
+
+	// Responses are buffered if the writer does not support flushing.
+	f.reset()
+	stream(nonFlushingWriter{f.recorder}, "/data/test/p?stream=true&request=y:data.x[i]&select=a")
+
+	if f.recorder.Code != 200 || f.recorder.Flushed || f.recorder.Body.String() != "[1,{\"i\":0}]\n[2,{\"i\":1}]\n" {
+		t.Fatalf("Expected buffered response but got: %v (flushed: %v)", f.recorder.Body.String(), f.recorder.Flushed)
+	}
+}
+
+func TestParseDataGetParams(t *testing.T) {
+
+	f := newFixture(t)
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"request=x:1&select=a", ""},
+		{"request=x:y&limit=0", "bad limit parameter"},
+		{"stream=true", "stream requires non-ground request values"},
+		{"request=x:y&echo_input=true", "echo_input with non-ground request values not supported"},
+		{"flatten=true&types=true", "flatten with types not supported"},
+		{"limit=1", "limit with ground request values not supported"},
+		{"watch=true&select=a", "watch requires ground request values"},
+		{"profile=missing", "unknown profile: missing"},
+		{"request=x:", "request"},
+	}
+
+	for _, tc := range tests {
+		_, err := f.server.parseDataGetParams(newReqV1("GET", "/data/a?"+tc.query, ""))
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("%v: Unexpected error: %v", tc.query, err)
+			}
+			continue
+		}
+		if err == nil || !isBadRequest(err) || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%v: Expected bad request containing %q but got: %v", tc.query, tc.expected, err)
+		}
+	}
+}
+
+func TestDataGetV1StreamTransactionClosed(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig().WithMaxTransactions(1, 0))
+	server, err := New(ctx, store, ":8182", false)
+	if err != nil {
+		panic(err)
+	}
+
+	f := &fixture{server: server, recorder: httptest.NewRecorder(), t: t}
+
+	if err := f.v1("PUT", "/data/x", `[1, 2]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package test\nimport request.y\np = y :- true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &txnCheckingWriter{ResponseRecorder: httptest.NewRecorder(), store: store}
+	server.Handler.ServeHTTP(w, newReqV1("GET", "/data/test/p?stream=true&request=y:data.x[i]", ""))
+
+	if w.Code != 200 || w.Body.String() != "[1,{\"i\":0}]\n[2,{\"i\":1}]\n" {
+		t.Fatalf("Expected streamed results but got: %v", w.ResponseRecorder)
+	}
+
+	if w.err != nil {
+		t.Fatalf("Expected transaction to be closed while writing results but got: %v", w.err)
+	}
+}
+
+func TestQueryGetV1DataRoot(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"base documents", []tr{
+			tr{"PUT", "/data/tenants", `{"acme": {"users": ["alice"]}, "globex": {"users": ["bob"]}}`, 201, ""},
+			tr{"GET", "/query?q=data.users[i]%20=%20x&data_root=tenants/acme", "", 200, `[{"i": 0, "x": "alice"}]`},
+			tr{"GET", "/query?q=data.users[i]%20=%20x&data_root=/tenants/globex/", "", 200, `[{"i": 0, "x": "bob"}]`},
+			tr{"GET", "/query?q=data.users[i]%20=%20x&data_root=tenants/initech", "", 200, `[]`},
+		}},
+		{"virtual documents", []tr{
+			tr{"PUT", "/data/tenants/acme", `{"limit": 1}`, 201, ""},
+			tr{"PUT", "/policies/test", "package tenants.acme\nallow :- data.tenants.acme.limit = 1", 200, ""},
+			tr{"GET", "/query?q=data.allow%20=%20x&data_root=tenants/acme", "", 200, `[{"x": true}]`},
+		}},
+		{"without root", []tr{
+			tr{"PUT", "/data/tenants/acme", `{"x": 1}`, 201, ""},
+			tr{"GET", "/query?q=data.x%20=%20y&data_root=tenants/acme", "", 200, `[{"y": 1}]`},
+			tr{"GET", "/query?q=data.x%20=%20y", "", 200, `[]`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestDataGetV1BuiltinOverrides(t *testing.T) {
+
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/test", `package test
+p = y :- to_number("deadbeef", x), plus(x, 1, y)`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/p?builtin=to_number:7", "", 400, `{
+		"Code": 400,
+		"Message": "builtin parameter not enabled"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server.WithBuiltinOverrides(true)
+
+	tests := []struct {
+		note string
+		path string
+		code int
+		resp string
+	}{
+		{"override", "/data/test/p?builtin=to_number:7", 200, `8`},
+		{"not overridden", "/data/test/p", 500, ""},
+		{"unknown", "/data/test/p?builtin=deadbeef:7", 400, `{
+			"Code": 400,
+			"Message": "bad builtin parameter \"deadbeef:7\": unknown built-in function deadbeef"
+		}`},
+		{"non-ground", "/data/test/p?builtin=to_number:x", 400, `{
+			"Code": 400,
+			"Message": "bad builtin parameter \"to_number:x\": value must be ground"
+		}`},
+		{"bad format", "/data/test/p?builtin=to_number", 400, `{
+			"Code": 400,
+			"Message": "bad builtin parameter \"to_number\": format is <name>:<value>"
+		}`},
+	}
+
+	for _, tc := range tests {
+		if err := f.v1("GET", tc.path, "", tc.code, tc.resp); err != nil {
+			t.Errorf("%v: %v", tc.note, err)
+		}
+	}
+}
+
+func TestDataGetV1Types(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"base document", []tr{
+			tr{"PUT", "/data/x", `{"a": [1, 2.5], "b": "c", "d": null, "e": true}`, 201, ""},
+			tr{"GET", "/data/x?types=true", "", 200, `{
+				"result": {"a": [1, 2.5], "b": "c", "d": null, "e": true},
+				"types": {"type": "object", "properties": {
+					"a": {"type": "array", "items": ["integer", "float"]},
+					"b": "string",
+					"d": "null",
+					"e": "boolean"
+				}}
+			}`},
+		}},
+		{"virtual document", []tr{
+			tr{"PUT", "/data/x", `[1, 2]`, 201, ""},
+			tr{"PUT", "/policies/test", `package test
+p[x] :- data.x[_] = x
+q = {"a": y, "b": data.x} :- y = 1.5`, 200, ""},
+			tr{"GET", "/data/test/p?types=true", "", 200, `{
+				"result": [1, 2],
+				"types": {"type": "set", "items": ["integer", "integer"]}
+			}`},
+			tr{"GET", "/data/test/q?types=true", "", 200, `{
+				"result": {"a": 1.5, "b": [1, 2]},
+				"types": {"type": "object", "properties": {
+					"a": "float",
+					"b": {"type": "array", "items": ["integer", "integer"]}
+				}}
+			}`},
+			tr{"GET", "/data/test/q?types=true&select=b.0", "", 200, `{"result": 1, "types": "integer"}`},
+		}},
+		{"echo input", []tr{
+			tr{"PUT", "/data/x", `1`, 201, ""},
+			tr{"GET", "/data/x?types=true&echo_input=true&request=y:1", "", 200, `{"input": {"y": 1}, "result": 1, "types": "integer"}`},
+		}},
+		{"non-ground", []tr{
+			tr{"GET", "/data/x?types=true&request=x:data.x[i]", "", 400, `{
+				"Code": 400,
+				"Message": "types with non-ground request values not supported"
+			}`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestTruthExplanationFallback(t *testing.T) {
+
+	compiler := ast.NewCompiler()
+	body := ast.MustParseBody("true")
+	expr := ast.MustParseBody(`x = 1`)[0]
+
+	// The redo event cannot be linked to a restart in the trace so the truth
+	// explanation cannot be produced.
+	trace := []*topdown.Event{
+		{Op: topdown.EnterOp, Node: body, QueryID: 1},
+		{Op: topdown.RedoOp, Node: expr, QueryID: 2, ParentID: 1},
+	}
+
+	result := newTruthExplanationV1(compiler, trace)
+
+	if len(result) != len(trace)+1 || result[0].Op != traceWarningOpV1 {
+		t.Fatalf("Expected warning followed by full explanation but got: %v", result)
+	}
+
+	if !strings.HasPrefix(result[0].Message, "truth explanation not available") {
+		t.Fatalf("Expected warning but got: %v", result[0].Message)
+	}
+
+	if result := newTruthExplanationV1(compiler, trace[:1]); len(result) > 0 && result[0].Op == traceWarningOpV1 {
+		t.Fatalf("Expected truth explanation for valid trace but got: %v", result)
+	}
+}
+
+func TestServerConnectionSettings(t *testing.T) {
+
+	f := newFixture(t)
+
+	hs := f.server.httpServer()
+	if hs.ReadTimeout != defaultReadTimeout || hs.WriteTimeout != defaultWriteTimeout || hs.IdleTimeout != defaultIdleTimeout || hs.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Fatalf("Expected default connection settings but got: %+v", hs)
+	}
+
+	f.server.WithReadTimeout(time.Second).WithWriteTimeout(2 * time.Second).WithIdleTimeout(3 * time.Second).WithMaxHeaderBytes(1024)
+
+	hs = f.server.httpServer()
+	if hs.ReadTimeout != time.Second || hs.WriteTimeout != 2*time.Second || hs.IdleTimeout != 3*time.Second || hs.MaxHeaderBytes != 1024 {
+		t.Fatalf("Expected configured connection settings but got: %+v", hs)
+	}
+
+	if hs.Handler != f.server.Handler {
+		t.Fatalf("Expected server handler to be used")
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithMaxRequestBodyBytes(32)
+
+	large := `{"a": "` + strings.Repeat("x", 32) + `"}`
+	msg := `{"Code": 413, "Message": "http: request body too large"}`
+
+	if err := f.v1("PUT", "/data/x", large, 413, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/data/x", `{"a": 1}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PATCH", "/data/x", `[{"op": "add", "path": "/b", "value": "`+strings.Repeat("x", 32)+`"}]`, 413, `{"Code": 413, "Message": "bad patch: http: request body too large"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package test\np :- "+strings.Repeat("true, ", 8)+"true", 413, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	f.server.WithMaxRequestBodyBytes(0)
+
+	if err := f.v1("PUT", "/data/x", large, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxBytesReader(t *testing.T) {
+
+	tests := []struct {
+		note  string
+		body  string
+		limit int64
+		err   error
+	}{
+		{"under limit", "abc", 4, nil},
+		{"at limit", "abcd", 4, nil},
+		{"over limit", "abcde", 4, errRequestBodyTooLarge},
+	}
+
+	for _, tc := range tests {
+		r := newMaxBytesReader(ioutil.NopCloser(strings.NewReader(tc.body)), tc.limit)
+		bs, err := ioutil.ReadAll(r)
+		if err != tc.err {
+			t.Errorf("%v: expected error %v but got: %v", tc.note, tc.err, err)
+		}
+		if tc.err == nil && string(bs) != tc.body {
+			t.Errorf("%v: expected %q but got: %q", tc.note, tc.body, bs)
+		}
+	}
+}
+
+func TestHandleErrorASTSorted(t *testing.T) {
+
+	errs := ast.Errors{
+		ast.NewError(ast.CompileErr, nil, "no location"),
+		ast.NewError(ast.CompileErr, ast.NewLocation(nil, "b", 1, 1), "b:1:1"),
+		ast.NewError(ast.CompileErr, ast.NewLocation(nil, "a", 2, 5), "a:2:5"),
+		ast.NewError(ast.CompileErr, ast.NewLocation(nil, "a", 2, 1), "a:2:1"),
+		ast.NewError(ast.CompileErr, ast.NewLocation(nil, "a", 1, 9), "a:1:9"),
+	}
+
+	recorder := httptest.NewRecorder()
+	handleErrorAST(recorder, 400, compileModErrMsg, errs)
+
+	var result astErrorV1
+	if err := util.NewJSONDecoder(recorder.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a:1:9", "a:2:1", "a:2:5", "b:1:1", "no location"}
+
+	for i := range expected {
+		if result.Errors[i].Message != expected[i] {
+			t.Fatalf("Expected errors in order %v but got: %v", expected, result.Errors)
+		}
+	}
+
+	if errs[0].Message != "no location" {
+		t.Fatalf("Expected caller's errors to be unmodified but got: %v", errs)
+	}
+}
+
+func TestDataGetExplainFull(t *testing.T) {
+	f := newFixture(t)
+
+	f.v1("PUT", "/data/x", `{"a":1,"b":2}`, 201, "")
+
+	req := newReqV1("GET", "/data/x?explain=full", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	var result traceV1
+
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(result) != 3 {
+		t.Fatalf("Expected exactly 3 events but got %d", len(result))
+	}
+
+	_, ok := result[2].Node.(ast.Body)
+	if !ok {
+		t.Fatalf("Expected body for node but got: %v", result[2].Node)
+	}
+
+	if len(result[2].Locals) != 1 {
+		t.Fatalf("Expected one binding but got: %v", result[2].Locals)
+	}
+
+	req = newReqV1("GET", "/data/deadbeef?explain=full", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	result = traceV1{}
+
+	if f.recorder.Code != 404 {
+		t.Fatalf("Expected status code to be 404 but got: %v", f.recorder.Code)
+	}
+
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(result) != 3 {
+		t.Fatalf("Expected exactly 3 events but got %d", len(result))
+	}
+
+	if result[2].Op != "Fail" {
+		t.Fatalf("Expected last event to be 'Fail' but got: %v", result[2])
+	}
+
+}
+
+func TestDataGetExplainNotes(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/test", `package test
+p :- trace("checking p"), x = 1, trace("x is one")
+q :- trace("checking q"), false`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		note     string
+		path     string
+		code     int
+		messages []string
+	}{
+		{"data", "/data/test/p?explain=notes", 200, []string{"checking p", "x is one"}},
+		{"undefined", "/data/test/q?explain=notes", 404, []string{"checking q"}},
+		{"query", "/query?q=data.test.p&explain=notes", 200, []string{"checking p", "x is one"}},
+	}
+
+	for _, tc := range tests {
+
+		req := newReqV1("GET", tc.path, "")
+		f.reset()
+		f.server.Handler.ServeHTTP(f.recorder, req)
+
+		if f.recorder.Code != tc.code {
+			t.Fatalf("%v: Expected status code %v but got: %v", tc.note, tc.code, f.recorder)
+		}
+
+		var result traceV1
+
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+			t.Fatalf("%v: Unexpected JSON decode error: %v", tc.note, err)
+		}
+
+		messages := []string{}
+		for _, evt := range result {
+			if evt.Op != "Note" {
+				t.Fatalf("%v: Expected only Note events but got: %v", tc.note, evt)
+			}
+			messages = append(messages, evt.Message)
+		}
+
+		if !reflect.DeepEqual(messages, tc.messages) {
+			t.Fatalf("%v: Expected messages %v but got: %v", tc.note, tc.messages, messages)
+		}
+	}
+}
+
+func TestDataGetExplainOps(t *testing.T) {
+	f := newFixture(t)
+
+	f.v1("PUT", "/data/x", `{"a":1,"b":2}`, 201, "")
+
+	tests := []struct {
+		note string
+		path string
+		ops  []string
+	}{
+		{"enter", "/data/x?explain=full&explain_ops=enter", []string{"Enter"}},
+		{"multiple", "/data/deadbeef?explain=full&explain_ops=enter,fail", []string{"Enter", "Fail"}},
+		{"repeated", "/data/deadbeef?explain=full&explain_ops=Eval&explain_ops=Fail", []string{"Eval", "Fail"}},
+		{"query", "/query?q=data.x.a=1&explain=full&explain_ops=exit", []string{"Exit"}},
+	}
+
+	for _, tc := range tests {
+
+		req := newReqV1("GET", tc.path, "")
+		f.reset()
+		f.server.Handler.ServeHTTP(f.recorder, req)
+
+		var result traceV1
+
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+			t.Fatalf("%v: Unexpected JSON decode error: %v", tc.note, err)
+		}
+
+		if len(result) == 0 {
+			t.Fatalf("%v: Expected at least one event", tc.note)
+		}
+
+		for _, evt := range result {
+			found := false
+			for _, op := range tc.ops {
+				if evt.Op == op {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("%v: Expected only %v events but got: %v", tc.note, tc.ops, evt)
+			}
+		}
+	}
+
+	if err := f.v1("GET", "/data/x?explain=full&explain_ops=enter,bad", "", 400, `{
+		"Code": 400,
+		"Message": "bad explain_ops parameter: unknown operation \"bad\""
+	}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataGetExplainLimits(t *testing.T) {
+	f := newFixture(t)
+
+	f.v1("PUT", "/data/x", `[1, 2, 3]`, 201, "")
+	f.v1("PUT", "/policies/test", `package test
+	p :- q[x], x > 1
+	q[x] :- data.x[_] = x`, 200, "")
+
+	getTrace := func(path string) traceV1 {
+		req := newReqV1("GET", path, "")
+		f.reset()
+		f.server.Handler.ServeHTTP(f.recorder, req)
+		if f.recorder.Code != 200 {
+			t.Fatalf("Expected success for %v but got: %v", path, f.recorder)
+		}
+		var result traceV1
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+			t.Fatalf("Unexpected JSON decode error for %v: %v", path, err)
+		}
+		return result
+	}
+
+	full := getTrace("/data/test/p?explain=full")
+
+	if full[len(full)-1].Op == traceTruncatedOpV1 {
+		t.Fatalf("Expected trace without limits to be complete but got: %v", full)
+	}
+
+	events := getTrace("/data/test/p?explain=full&explain_max_events=3")
+
+	if len(events) != 4 || events[3].Op != traceTruncatedOpV1 {
+		t.Fatalf("Expected three events followed by truncation marker but got: %v", events)
+	}
+
+	expected := fmt.Sprintf("trace truncated: %d events omitted", len(full)-3)
+	if events[3].Message != expected {
+		t.Fatalf("Expected marker message %q but got: %v", expected, events[3].Message)
+	}
+
+	depth := getTrace("/data/test/p?explain=full&explain_max_depth=1")
+
+	if depth[len(depth)-1].Op != traceTruncatedOpV1 {
+		t.Fatalf("Expected trace to be truncated but got: %v", depth)
+	}
+
+	for _, evt := range depth[:len(depth)-1] {
+		if evt.QueryID != depth[0].QueryID {
+			t.Fatalf("Expected only top-level events but got: %v", evt)
+		}
+	}
+
+	query := getTrace("/query?q=data.test.p&explain=full&explain_max_events=2&explain_ops=enter")
+
+	if len(query) != 3 || query[0].Op != "Enter" || query[1].Op != "Enter" || query[2].Op != traceTruncatedOpV1 {
+		t.Fatalf("Expected two enter events followed by truncation marker but got: %v", query)
+	}
+
+	if err := f.v1("GET", "/data/test/p?explain=full&explain_max_depth=0", "", 400, `{
+		"Code": 400,
+		"Message": "bad explain_max_depth parameter \"0\": must be a positive integer"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.test.p&explain=full&explain_max_events=x", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/p?explain=truth&explain_max_events=2", "", 400, `{
+		"Code": 400,
+		"Message": "bad explain_max_events parameter: only supported with explain=full"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.test.p&explain=notes&explain_max_depth=1", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/p?explain=truth&explain_ops=enter", "", 400, `{
+		"Code": 400,
+		"Message": "bad explain_ops parameter: only supported with explain=full"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataGetExplainNonGround(t *testing.T) {
+	f := newFixture(t)
+
+	f.v1("PUT", "/data/x", `[1, 2, 3]`, 201, "")
+	f.v1("PUT", "/policies/test", `package test
+import request.y
+p = y :- y > 1`, 200, "")
+
+	for _, mode := range []string{"full", "truth"} {
+
+		req := newReqV1("GET", "/data/test/p?request=y:data.x[i]&explain="+mode, "")
+		f.reset()
+		f.server.Handler.ServeHTTP(f.recorder, req)
+
+		if f.recorder.Code != 200 {
+			t.Fatalf("Expected success for %v but got: %v", mode, f.recorder)
+		}
+
+		var result struct {
+			Results [][]interface{}
+			Traces  map[string]traceV1
+		}
+
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+			t.Fatalf("Unexpected JSON decode error: %v", err)
+		}
+
+		if len(result.Results) != 2 || len(result.Traces) != 2 {
+			t.Fatalf("Expected two results and traces for %v but got: %v", mode, result)
+		}
+
+		for _, r := range result.Results {
+			if len(r) != 3 {
+				t.Fatalf("Expected result to include trace ID for %v but got: %v", mode, r)
+			}
+			id, ok := r[2].(string)
+			if !ok {
+				t.Fatalf("Expected string trace ID for %v but got: %v", mode, r[2])
+			}
+			trace, ok := result.Traces[id]
+			if !ok || len(trace) == 0 {
+				t.Fatalf("Expected trace for ID %v for %v but got: %v", id, mode, result.Traces)
+			}
+			if trace[0].Op != "Enter" {
+				t.Fatalf("Expected trace for %v to begin with Enter event but got: %v", mode, trace[0])
+			}
+		}
+	}
+}
+
+func TestDataGetExplainTruth(t *testing.T) {
+	f := newFixture(t)
+
+	f.v1("PUT", "/policies/test", `package test
+	p :- a = [1,2,3,4], a[_] = x, x > 1
+	`, 204, "")
+
+	req := newReqV1("GET", "/data/test/p?explain=truth", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	var result traceV1
+
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(result) != 8 {
+		t.Fatalf("Expected exactly 9 events but got %d", len(result))
+	}
+
+	req = newReqV1("GET", "/data/deadbeef?explain=truth", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 404 {
+		t.Fatalf("Expected status code to be 404 but got: %v", f.recorder)
+	}
+}
+
+func TestV1Pretty(t *testing.T) {
+
+	f := newFixture(t)
+	f.v1("PATCH", "/data/x", `[{"op": "add", "path":"/", "value": [1,2,3,4]}]`, 204, "")
+
+	req := newReqV1("GET", "/data/x?pretty=true", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	lines := strings.Split(f.recorder.Body.String(), "\n")
+	if len(lines) != 6 {
+		t.Errorf("Expected 5 lines in output but got %d:\n%v", len(lines), lines)
+	}
+
+	req = newReqV1("GET", "/query?q=data.x[i]&pretty=true", "")
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	lines = strings.Split(f.recorder.Body.String(), "\n")
+	if len(lines) != 14 {
+		t.Errorf("Expected 14 lines of output but got %d:\n%v", len(lines), lines)
+	}
+}
+
+func TestHandleResponseJSON(t *testing.T) {
+
+	s := &Server{responseBufferMaxPooledSize: defaultResponseBufferMaxPooledSize}
+
+	v := map[string]interface{}{
+		"a": []interface{}{1, "<b>", 2.5},
+		"c": map[string]interface{}{"d": nil, "e": "&"},
+	}
+
+	for _, pretty := range []bool{false, true} {
+
+		var expected []byte
+		var err error
+
+		if pretty {
+			expected, err = json.MarshalIndent(v, "", "  ")
+		} else {
+			expected, err = json.Marshal(v)
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		// Serialize twice to exercise buffer reuse.
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			s.handleResponseJSON(recorder, 200, v, pretty)
+			if result := recorder.Body.String(); result != string(expected) {
+				t.Fatalf("Expected (pretty=%v):\n\n%s\n\nGot:\n\n%s", pretty, expected, result)
+			}
+		}
+	}
+}
+
+func TestHealthGet(t *testing.T) {
+
+	f := newFixture(t)
+
+	health := func(path string, code int) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			panic(err)
+		}
+		if err := f.executeRequest(req, code, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	health("/health", 200)
+	health("/health?query=true", 503)
+
+	if err := f.v1("PUT", "/data/system/health", "false", 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	health("/health", 200)
+	health("/health?query=true", 503)
+
+	if err := f.v1("PUT", "/data/system/health", "true", 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	health("/health?query=true", 200)
+
+	// Only true satisfies the check.
+	if err := f.v1("PUT", "/data/system/health", `"ok"`, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	health("/health?query=true", 503)
+
+	f.server.WithHealthQuery(ast.MustParseBody("data.system.ready"))
+	health("/health?query=true", 503)
+
+	// Health checks do not require credentials.
+	f.server.WithAuthorizer(NewBearerTokenAuthorizer("secret"))
+	health("/health", 200)
+
+	if err := f.v1("GET", "/policies", "", 401, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthGetReady(t *testing.T) {
+
+	f := newFixture(t)
+
+	health := func(path string, code int) {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			panic(err)
+		}
+		if err := f.executeRequest(req, code, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	health("/health?ready=true", 200)
+
+	path, _ := storage.ParsePath("/x/loaded")
+	f.server.WithReadyPath(path)
+
+	health("/health", 200)
+	health("/health?ready=true", 503)
+
+	if err := f.v1("PUT", "/data/x/loaded", "true", 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	health("/health?ready=true", 200)
+
+	// The server remains ready after the document is removed.
+	if err := f.v1("PUT", "/data/x", "{}", 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	health("/health?ready=true", 200)
+	health("/health?ready=true&query=true", 503)
+
+	f.server.WithReadyPath(path)
+	health("/health?ready=true", 503)
+	f.server.MarkReady()
+	health("/health?ready=true", 200)
+}
+
+func TestShutdown(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	s, err := New(ctx, store, addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Block requests until released so that the request is in-flight when
+	// the server is shut down.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	inner := s.Handler
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		inner.ServeHTTP(w, r)
+	})
+
+	loopErr := make(chan error, 1)
+	go func() {
+		loopErr <- s.Loop()
+	}()
+
+	waitForListener(t, "tcp", addr)
+
+	respCode := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/v1/data")
+		if err != nil {
+			respCode <- 0
+			return
+		}
+		resp.Body.Close()
+		respCode <- resp.StatusCode
+	}()
+
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+
+	if err := <-loopErr; err != http.ErrServerClosed {
+		t.Fatalf("Expected server closed error but got: %v", err)
+	}
+
+	close(release)
+
+	if code := <-respCode; code != 200 {
+		t.Fatalf("Expected in-flight request to complete but got: %v", code)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Unexpected shutdown error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + addr + "/v1/data"); err == nil {
+		t.Fatalf("Expected new connections to be rejected after shutdown")
+	}
+}
+
+func TestLoopUnixSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "server_test_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "opa.sock")
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	s, err := New(ctx, store, "unix://"+path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loopErr := make(chan error, 1)
+	go func() {
+		loopErr <- s.Loop()
+	}()
+
+	waitForListener(t, "unix", path)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://opa/v1/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected OK but got: %v", resp.StatusCode)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-loopErr; err != http.ErrServerClosed {
+		t.Fatalf("Expected server closed error but got: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected socket file to be removed but got: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = New(ctx, store, "unix://"+path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Loop(); err == nil || !strings.Contains(err.Error(), "unix socket already exists") {
+		t.Fatalf("Expected error for existing socket file but got: %v", err)
+	}
+}
+
+func waitForListener(t *testing.T, network, addr string) {
+	for i := 0; ; i++ {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.Close()
+			return
+		} else if i == 100 {
+			t.Fatalf("Server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoopTLSBadCertificate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "server_test_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	f := newFixture(t)
+
+	if err := f.server.LoopTLS(certFile, keyFile); err == nil || !strings.Contains(err.Error(), "unable to load TLS certificate") {
+		t.Fatalf("Expected load error for missing files but got: %v", err)
+	}
+
+	for _, filename := range []string{certFile, keyFile} {
+		if err := ioutil.WriteFile(filename, []byte("not pem"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.server.LoopTLS(certFile, keyFile); err == nil || !strings.Contains(err.Error(), "unable to load TLS certificate") {
+		t.Fatalf("Expected load error for bad files but got: %v", err)
+	}
+}
+
+func TestVersionGetV1(t *testing.T) {
+
+	f := newFixture(t)
+
+	expected := fmt.Sprintf(`{
+		"version": %q,
+		"build_commit": %q,
+		"build_timestamp": %q,
+		"build_hostname": %q,
+		"go_version": %q
+	}`, version.Version, version.Vcs, version.Timestamp, version.Hostname, runtime.Version())
+
+	if err := f.v1("GET", "/version", "", 200, expected); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVersionsGet(t *testing.T) {
+
+	f := newFixture(t)
+
+	for _, accept := range []string{"", "application/json", "application/json, text/html"} {
+
+		f.reset()
+
+		var req *http.Request
+		if accept == "" {
+			req = httptest.NewRequest("GET", "/versions", nil)
+		} else {
+			req = httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept", accept)
+		}
+
+		f.server.Handler.ServeHTTP(f.recorder, req)
+
+		if f.recorder.Code != 200 {
+			t.Fatalf("Expected success for %q but got: %v", accept, f.recorder)
+		}
+
+		var result versionsV1
+		if err := util.UnmarshalJSON(f.recorder.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Unexpected error for %q: %v", accept, err)
+		}
+
+		if result.versionV1 != newVersionV1() || len(result.APIVersions) != 1 {
+			t.Fatalf("Unexpected versions for %q: %+v", accept, result)
+		}
+
+		v1 := result.APIVersions[0]
+
+		if !sort.IsSorted(routeSliceV1(v1.Routes)) {
+			t.Fatalf("Expected routes to be sorted for %q: %+v", accept, v1.Routes)
+		}
+		found := false
+
+		for _, route := range v1.Routes {
+			if route.Method == "GET" && route.Path == "/v1/data/{path:.+}" {
+				found = true
+			}
+		}
+
+		if v1.Version != "v1" || v1.Prefix != "/v1" || !found {
+			t.Fatalf("Unexpected API version for %q: %+v", accept, v1)
+		}
+	}
+
+	f.reset()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/html, application/json")
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 200 || !strings.Contains(f.recorder.Body.String(), "<html") {
+		t.Fatalf("Expected HTML page but got: %v", f.recorder)
+	}
+}
+
+func TestQueriesV1(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"put and execute", []tr{
+			tr{"PUT", "/data/x", `[1, 2, 3, 4]`, 201, ""},
+			tr{"PUT", "/queries/above?param=min", "data.x[i] = y, y > min", 204, ""},
+			tr{"GET", "/queries/above?param=min:2", "", 200, `[{"i": 2, "min": 2, "y": 3}, {"i": 3, "min": 2, "y": 4}]`},
+			tr{"GET", "/queries/above?param=min:3", "", 200, `[{"i": 3, "min": 3, "y": 4}]`},
+		}},
+		{"no params", []tr{
+			tr{"PUT", "/data/x", `[1, 2]`, 201, ""},
+			tr{"PUT", "/queries/all", "data.x[i] = 2", 204, ""},
+			tr{"GET", "/queries/all", "", 200, `[{"i": 1}]`},
+		}},
+		{"bad params", []tr{
+			tr{"PUT", "/data/x", `[1, 2]`, 201, ""},
+			tr{"PUT", "/queries/above?param=min", "data.x[i] = y, y > min", 204, ""},
+			tr{"GET", "/queries/above", "", 400, `{"Code": 400, "Message": "missing param parameter for min"}`},
+			tr{"GET", "/queries/above?param=min:1&param=max:2", "", 400, `{"Code": 400, "Message": "bad param parameter: unknown query parameter max"}`},
+			tr{"GET", "/queries/above?param=min:x", "", 400, ""},
+			tr{"GET", "/queries/above?param=min", "", 400, ""},
+			tr{"PUT", "/queries/bad?param=1", "data.x[i] = y", 400, ""},
+			tr{"PUT", "/queries/bad?param=a&param=a", "data.x[i] = a", 400, ""},
+		}},
+		{"compile error", []tr{
+			tr{"PUT", "/queries/bad", "y > min", 400, ""},
+			tr{"GET", "/queries/bad", "", 404, ""},
+		}},
+		{"delete", []tr{
+			tr{"PUT", "/queries/q", "x = 1", 204, ""},
+			tr{"DELETE", "/queries/q", "", 204, ""},
+			tr{"GET", "/queries/q", "", 404, ""},
+			tr{"DELETE", "/queries/q", "", 404, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestResponseBufferMaxPooledSize(t *testing.T) {
+
+	f := newFixture(t)
+
+	if f.server.responseBufferMaxPooledSize != defaultResponseBufferMaxPooledSize {
+		t.Fatalf("Expected default size but got: %v", f.server.responseBufferMaxPooledSize)
+	}
+
+	f.server.WithResponseBufferMaxPooledSize(-1)
+
+	if err := f.v1("PUT", "/data/x", `{"a": [1, 2, 3]}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Responses are still serialized correctly when buffers are not reused.
+	for i := 0; i < 2; i++ {
+		if err := f.v1("GET", "/data/x", "", 200, `{"a": [1, 2, 3]}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndexGet(t *testing.T) {
+	f := newFixture(t)
+	get, err := http.NewRequest("GET", `/?q=foo = 1`, strings.NewReader(""))
+	if err != nil {
+		panic(err)
+	}
+	f.server.Handler.ServeHTTP(f.recorder, get)
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got: %v", f.recorder)
+		return
+	}
+	page := f.recorder.Body.String()
+	if !strings.Contains(page, "Query result") {
+		t.Errorf("Expected page to contain 'Query result' but got: %v", page)
+		return
+	}
+}
+
+func TestIndexGetCompileError(t *testing.T) {
+	f := newFixture(t)
+	// "foo" is not bound
+	get, err := http.NewRequest("GET", `/?q=foo`, strings.NewReader(""))
+	if err != nil {
+		panic(err)
+	}
+	f.server.Handler.ServeHTTP(f.recorder, get)
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got: %v", f.recorder)
+		return
+	}
+	page := f.recorder.Body.String()
+	if !strings.Contains(page, "foo is unsafe") {
+		t.Errorf("Expected page to contain 'foo is unsafe' but got: %v", page)
+		return
+	}
+}
+
+func TestPoliciesPutV1(t *testing.T) {
+	f := newFixture(t)
+	req := newReqV1("PUT", "/policies/1", testMod)
+
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	policy := f.loadPolicy()
+	expected := newPolicy("1", testMod)
+	if !expected.Equal(policy) {
+		t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected, policy)
+	}
+}
+
+func TestPoliciesPutV1DryRun(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"success", []tr{
+			tr{"PUT", "/policies/test?dryrun=true", "package test\np = 1 :- true", 200, ""},
+			tr{"GET", "/policies/test", "", 404, ""},
+			tr{"GET", "/data/test/p", "", 404, ""},
+		}},
+		{"compile error", []tr{
+			tr{"PUT", "/policies/test?dryrun=true", "package test\np :- q", 400, ""},
+		}},
+		{"existing modules", []tr{
+			tr{"PUT", "/policies/a", "package a\np = 1 :- true", 200, ""},
+			tr{"PUT", "/policies/b?dryrun=true", "package b\nq = x :- data.a.p = x", 200, ""},
+			tr{"PUT", "/policies/a?dryrun=true", "package a\np = 2 :- true", 200, ""},
+			tr{"GET", "/data/a/p", "", 200, `1`},
+			tr{"GET", "/policies/b", "", 404, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestPoliciesPutV1Bulk(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"success", []tr{
+			tr{"PUT", "/policies/a", "package a\np[x] :- x = 1", 200, ""},
+			tr{"PUT", "/policies", `{
+				"b": "package b\nq[x] :- data.a.p[x]",
+				"a": "package a\np[x] :- x = 2"
+			}`, 200, ""},
+			tr{"GET", "/data/b/q", "", 200, `[2]`},
+			tr{"GET", "/policies/b/raw", "", 200, ""},
+		}},
+		{"compile error", []tr{
+			tr{"PUT", "/policies/a", "package a\np = 1 :- true", 200, ""},
+			tr{"PUT", "/policies", `{
+				"a": "package a\np[x] :- data.b.q[x]",
+				"b": "package b\nq[x] :- data.a.p[x]"
+			}`, 400, ""},
+			tr{"GET", "/data/a/p", "", 200, `1`},
+			tr{"GET", "/policies/b", "", 404, ""},
+		}},
+		{"parse error", []tr{
+			tr{"PUT", "/policies", `{"a": "package a\np = 1 :- true", "b": "package b\nq ;- true"}`, 400, ""},
+			tr{"GET", "/policies/a", "", 404, ""},
+		}},
+		{"empty module", []tr{
+			tr{"PUT", "/policies", `{"a": "package a\np = 1 :- true", "b": ""}`, 400, `{
+				"Code": 400,
+				"Message": "refusing to add empty module: b"
+			}`},
+		}},
+		{"empty set", []tr{
+			tr{"PUT", "/policies", `{}`, 400, ""},
+		}},
+		{"bad request", []tr{
+			tr{"PUT", "/policies", `["package a"]`, 400, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestPoliciesPutV1BulkInsertError(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "server_test_bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	f := newFixture(t)
+	f.server.store = storage.New(storage.InMemoryConfig().WithPolicyDir(dir))
+	f.server.persist = true
+
+	if err := f.v1("PUT", "/policies/a", "package a\np = 1 :- true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second module cannot be persisted because a directory exists in
+	// place of its file.
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies", `{"a": "package a\np = 2 :- true", "b": "package b\nq = 1 :- true"}`, 500, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/policies", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var policies []*policyV1
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&policies); err != nil {
+		t.Fatal(err)
+	} else if len(policies) != 1 || policies[0].ID != "a" {
+		t.Fatalf("Expected only policy a to exist but got: %v", policies)
+	}
+
+	if err := f.v1("GET", "/policies/a/raw", "", 200, ""); err != nil {
+		t.Fatal(err)
+	} else if f.recorder.Body.String() != "package a\np = 1 :- true" {
+		t.Fatalf("Expected original module to be restored but got: %v", f.recorder.Body.String())
+	}
+
+	if err := f.v1("GET", "/data/a/p", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(bs) != "package a\np = 1 :- true" {
+		t.Fatalf("Expected original module to be persisted but got: %s", bs)
+	}
+}
+
+func TestPoliciesPutV1BadID(t *testing.T) {
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"reserved", []tr{
+			tr{"PUT", "/policies/export", testMod, 400, `{"Code": 400, "Message": "bad policy id \"export\": reserved"}`},
+			tr{"PUT", "/policies", `{"compile": "package a\np = 1 :- true"}`, 400, `{"Code": 400, "Message": "bad policy id \"compile\": reserved"}`},
+		}},
+		{"path separator", []tr{
+			tr{"PUT", "/policies", `{"a": "package a\np = 1 :- true", "../../x": "package b\nq = 1 :- true"}`, 400, `{"Code": 400, "Message": "bad policy id \"../../x\": must be a valid file name"}`},
+			tr{"GET", "/policies", "", 200, `[]`},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestPoliciesPutV1Empty(t *testing.T) {
+	f := newFixture(t)
+	req := newReqV1("PUT", "/policies/1", "")
+
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 400 {
+		t.Errorf("Expected bad request but got %v", f.recorder)
+		return
+	}
+}
+
+func TestPoliciesPutV1ParseError(t *testing.T) {
+	f := newFixture(t)
+	req := newReqV1("PUT", "/policies/test", `
+    package a.b.c
+
+    p ;- true
+    `)
+
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 400 {
+		t.Errorf("Expected bad request but got %v", f.recorder)
+		return
+	}
+
+	errs := astErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	expected := ast.NewLocation(nil, "test", 4, 8)
+
+	if !reflect.DeepEqual(errs.Errors[0].Location, expected) {
+		t.Errorf("Expected error location to be %v but got: %v", expected, errs)
+	}
+}
+
+func TestPoliciesPutV1CompileError(t *testing.T) {
+	f := newFixture(t)
+	req := newReqV1("PUT", "/policies/test", `
+    package a.b.c
+    p[x] :- q[x]
+    q[x] :- p[x]
+    `)
+
+	f.server.Handler.ServeHTTP(f.recorder, req)
+
+	if f.recorder.Code != 400 {
+		t.Fatalf("Expected bad request but got %v", f.recorder)
+	}
+
+	errs := astErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	expected := ast.NewLocation(nil, "test", 3, 5)
+
+	if len(errs.Errors) != 2 {
+		t.Fatalf("Expected exactly two errors but got %d: %v", len(errs.Errors), errs)
+	}
+
+	found := false
+
+	for _, err := range errs.Errors {
+		if reflect.DeepEqual(err.Location, expected) {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("Missing expected error %v: %v", expected, errs)
+	}
+}
+
+func TestPoliciesPutV1CompileErrorExisting(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/a", "package a\np[x] :- data.b.q[x]", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/b", "package b\nq[x] :- x = 1", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, newReqV1("PUT", "/policies/b", "package b\nq[x] :- data.a.p[x]"))
+
+	if f.recorder.Code != 400 {
+		t.Fatalf("Expected bad request but got %v", f.recorder)
+	}
+
+	errs := policyCompileErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if errs.Message != compileExistingModErrMsg || len(errs.Errors) != 2 {
+		t.Fatalf("Expected errors in existing module but got: %v", f.recorder)
+	}
+
+	for _, err := range errs.Errors {
+		if err.Existing != (err.Location.File == "a") {
+			t.Fatalf("Expected only errors in module a to be marked existing but got: %v", f.recorder)
+		}
+	}
+
+	if err := f.v1("GET", "/data/b/q", "", 200, "[1]"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesPutV1Builtins(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithBuiltinAllowlist("count", "plus").WithBuiltinDenylist("plus")
+
+	mod := `package a.b.c
+	p :- x = [1, 2], count(x, n), plus(n, 1, m), m > 2, c = [y | z = x[_], to_number(z, y)]`
+
+	if err := f.v1("PUT", "/policies/test", mod, 403, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := astErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(errs.Errors) != 3 {
+		t.Fatalf("Expected exactly three errors but got: %v", errs)
+	}
+
+	if err := f.v1("PUT", "/policies/test", "package a.b.c\np :- x = [1, 2], count(x, 2)", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=plus(1,2,x)", "", 403, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=count([1,2],x)", "", 200, `[{"x": 2}]`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesPutV1StrictImports(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithStrictImports(true)
+
+	mod := `package a.b.c
+	import data.x.y
+	import data.d.e.p
+	import request.z
+	q :- y[_] = z, p`
+
+	if err := f.v1("PUT", "/policies/test", mod, 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := astErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(errs.Errors) != 2 {
+		t.Fatalf("Expected exactly two errors but got: %v", errs)
+	}
+
+	if err := f.v1("PUT", "/data/x/y", `[1,2,3]`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test2", "package d.e\np = true", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/policies/test", mod, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesCompileV1(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/1", testMod, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("POST", "/policies/compile", "", 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write a module directly into storage that does not compile.
+	ctx := context.Background()
+	bad := "package a.b.c\np[x] :- q2[x]\nq2[x] :- p[x]"
+	if err := storage.InsertPolicy(ctx, f.server.store, "2", ast.MustParseModule(bad), []byte(bad), false); err != nil {
+		panic(err)
+	}
+
+	if err := f.v1("POST", "/policies/compile", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := astErrorV1{}
+	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
+		t.Fatalf("Unexpected JSON decode error: %v", err)
+	}
+
+	if len(errs.Errors) == 0 {
+		t.Fatalf("Expected compile errors but got: %v", errs)
+	}
+
+	// The live compiler must not be affected.
+	if _, ok := f.server.Compiler().Modules["2"]; ok {
+		t.Fatalf("Expected server compiler to be unchanged")
+	}
+}
+
+func TestPoliciesListV1(t *testing.T) {
+	f := newFixture(t)
+	put := newReqV1("PUT", "/policies/1", testMod)
+	f.server.Handler.ServeHTTP(f.recorder, put)
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+	f.reset()
+	list := newReqV1("GET", "/policies", "")
+
+	f.server.Handler.ServeHTTP(f.recorder, list)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	var policies []*policyV1
+	err := util.NewJSONDecoder(f.recorder.Body).Decode(&policies)
+	if err != nil {
+		t.Errorf("Expected policy list but got error: %v", err)
+		return
+	}
+
+	expected := []*policyV1{
+		newPolicy("1", testMod),
+	}
+	if len(expected) != len(policies) {
+		t.Errorf("Expected %d policies but got: %v", len(expected), policies)
+		return
+	}
+	for i := range expected {
+		if !expected[i].Equal(policies[i]) {
+			t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected[i], policies[i])
+		}
+	}
+}
+
+func TestPoliciesListV1Summary(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.v1("PUT", "/policies/1", testMod, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, summary := range []bool{false, true} {
+
+		if err := f.v1("GET", fmt.Sprintf("/policies?summary=%v", summary), "", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		var policies []*policyV1
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&policies); err != nil {
+			t.Fatalf("Unexpected JSON decode error: %v", err)
+		}
+
+		if len(policies) != 1 {
+			t.Fatalf("Expected exactly one policy but got: %v", policies)
+		}
+
+		result := policies[0].Summary
+
+		if !summary {
+			if result != nil {
+				t.Fatalf("Expected no summary but got: %v", result)
+			}
+			continue
+		}
+
+		expected := &policySummaryV1{Rules: 2, Imports: 2, Lines: 6}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected summary %v but got: %v", expected, result)
+		}
+	}
+}
+
+func TestPoliciesListV1TransactionLimit(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig().WithMaxTransactions(1, 0))
+	server, err := New(ctx, store, ":8182", false)
+	if err != nil {
+		panic(err)
+	}
+
+	f := &fixture{server: server, recorder: httptest.NewRecorder(), t: t}
+
+	if err := f.v1("PUT", "/policies/1", testMod, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	// Only summaries read from the store.
+	if err := f.v1("GET", "/policies", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/policies?summary=true", "", 503, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesListV1Prefix(t *testing.T) {
+	f := newFixture(t)
+
+	mods := map[string]string{
+		"a":             "package com.example.a\np = true",
+		"b":             "package com.example.b\np = true",
+		"c":             "package com.other\np = true",
+		"com.example.d": "package d\np = true",
+	}
+
+	for id, mod := range mods {
+		if err := f.v1("PUT", "/policies/"+id, mod, 200, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"a", "b", "c", "com.example.d"}},
+		{"com.example", []string{"a", "b", "com.example.d"}},
+		{"com.example.a", []string{"a"}},
+		{"c", []string{"a", "b", "c", "com.example.d"}},
+		{"deadbeef", []string{}},
+	}
+
+	for _, tc := range tests {
+
+		if err := f.v1("GET", "/policies?prefix="+tc.prefix, "", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		var policies []*policyV1
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&policies); err != nil {
+			t.Fatalf("Unexpected JSON decode error: %v", err)
+		}
+
+		ids := []string{}
+		for _, policy := range policies {
+			ids = append(ids, policy.ID)
+		}
+
+		sort.Strings(ids)
+
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("Expected policies %v for prefix %q but got: %v", tc.expected, tc.prefix, ids)
+		}
+	}
+}
+
+func TestPoliciesListV1Pagination(t *testing.T) {
+	f := newFixture(t)
+
+	for _, id := range []string{"d", "b", "e", "a", "c"} {
+		if err := f.v1("PUT", "/policies/"+id, "package "+id+"\np = true", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+		next     int
+	}{
+		{"limit=2", []string{"a", "b"}, 2},
+		{"limit=2&offset=2", []string{"c", "d"}, 4},
+		{"limit=2&offset=4", []string{"e"}, 0},
+		{"offset=3", []string{"d", "e"}, 0},
+		{"limit=10&offset=10", []string{}, 0},
+		{"limit=2&prefix=b", []string{"b"}, 0},
+	}
+
+	for _, tc := range tests {
+
+		if err := f.v1("GET", "/policies?"+tc.query, "", 200, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		var page struct {
+			Result []*policyV1 `json:"result"`
+			Next   int         `json:"next"`
+		}
+
+		if err := util.NewJSONDecoder(f.recorder.Body).Decode(&page); err != nil {
+			t.Fatalf("Unexpected JSON decode error: %v", err)
+		}
+
+		ids := []string{}
+		for _, policy := range page.Result {
+			ids = append(ids, policy.ID)
+		}
+
+		if !reflect.DeepEqual(ids, tc.expected) || page.Next != tc.next {
+			t.Errorf("Expected policies %v and next %v for %q but got: %v and %v", tc.expected, tc.next, tc.query, ids, page.Next)
+		}
+	}
+
+	if err := f.v1("GET", "/policies?limit=0", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/policies?offset=-1", "", 400, `{
+		"Code": 400,
+		"Message": "bad offset parameter \"-1\": must be a non-negative integer"
+	}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoliciesGetV1(t *testing.T) {
+	f := newFixture(t)
+	put := newReqV1("PUT", "/policies/1", testMod)
+	f.server.Handler.ServeHTTP(f.recorder, put)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	f.reset()
+	get := newReqV1("GET", "/policies/1", "")
+
+	f.server.Handler.ServeHTTP(f.recorder, get)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	policy := f.loadPolicy()
+	expected := newPolicy("1", testMod)
+	if !expected.Equal(policy) {
+		t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected, policy)
+	}
+}
+
+func TestPoliciesRulesGetV1(t *testing.T) {
+
+	mod := `package a.b
+
+import request.x
+
+p = true :- x = 1
+q[y] :- y = x
+p = false :- x = 2`
+
+	tests := []struct {
+		note string
+		reqs []tr
+	}{
+		{"rules", []tr{
+			tr{"PUT", "/policies/test", mod, 200, ""},
+			tr{"GET", "/policies/test/rules", "", 200, `[
+				{"name": "p", "path": "data.a.b.p", "location": {"File": "test", "Row": 5, "Col": 1}},
+				{"name": "q", "path": "data.a.b.q", "location": {"File": "test", "Row": 6, "Col": 1}},
+				{"name": "p", "path": "data.a.b.p", "location": {"File": "test", "Row": 7, "Col": 1}}
+			]`},
+		}},
+		{"no rules", []tr{
+			tr{"PUT", "/policies/test", "package a.b", 200, ""},
+			tr{"GET", "/policies/test/rules", "", 200, `[]`},
+		}},
+		{"not found", []tr{
+			tr{"GET", "/policies/deadbeef/rules", "", 404, ""},
+		}},
+	}
+
+	for _, tc := range tests {
+		test.Subtest(t, tc.note, func(t *testing.T) {
+			executeRequests(t, tc.reqs)
+		})
+	}
+}
+
+func TestPoliciesGetRawV1(t *testing.T) {
+	f := newFixture(t)
+	put := newReqV1("PUT", "/policies/1", testMod)
+	f.server.Handler.ServeHTTP(f.recorder, put)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	f.reset()
+	get := newReqV1("GET", "/policies/1/raw", "")
+
+	f.server.Handler.ServeHTTP(f.recorder, get)
+
+	if f.recorder.Code != 200 {
+		t.Errorf("Expected success but got %v", f.recorder)
+		return
+	}
+
+	raw := f.recorder.Body.String()
+	if raw != testMod {
+		t.Errorf("Expected raw string to equal testMod:\n\nExpected:\n\n%v\n\nGot:\n\n%v\n", testMod, raw)
+	}
 
-	req := newReqV1("GET", "/data/test/p?explain=truth", "")
-	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+}
 
-	var result traceV1
+func TestPoliciesExportV1(t *testing.T) {
+	f := newFixture(t)
 
-	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&result); err != nil {
-		t.Fatalf("Unexpected JSON decode error: %v", err)
+	mods := map[string]string{
+		"1": testMod,
+		"2": "package b\n\nq = true :- true\n",
 	}
 
-	if len(result) != 8 {
-		t.Fatalf("Expected exactly 9 events but got %d", len(result))
+	for id, mod := range mods {
+		if err := f.v1("PUT", "/policies/"+id, mod, 200, ""); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	req = newReqV1("GET", "/data/deadbeef?explain=truth", "")
 	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	f.server.Handler.ServeHTTP(f.recorder, newReqV1("GET", "/policies/export", ""))
 
-	if f.recorder.Code != 404 {
-		t.Fatalf("Expected status code to be 404 but got: %v", f.recorder)
+	if f.recorder.Code != 200 {
+		t.Fatalf("Expected success but got %v", f.recorder)
 	}
-}
 
-func TestV1Pretty(t *testing.T) {
+	if ct := f.recorder.Header().Get("Content-Type"); ct != "application/gzip" {
+		t.Fatalf("Expected gzip content type but got: %v", ct)
+	}
 
-	f := newFixture(t)
-	f.v1("PATCH", "/data/x", `[{"op": "add", "path":"/", "value": [1,2,3,4]}]`, 204, "")
+	gr, err := gzip.NewReader(f.recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	req := newReqV1("GET", "/data/x?pretty=true", "")
-	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	tr := tar.NewReader(gr)
+	result := map[string]string{}
 
-	lines := strings.Split(f.recorder.Body.String(), "\n")
-	if len(lines) != 6 {
-		t.Errorf("Expected 5 lines in output but got %d:\n%v", len(lines), lines)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[hdr.Name] = string(bs)
 	}
 
-	req = newReqV1("GET", "/query?q=data.x[i]&pretty=true", "")
-	f.reset()
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	if !reflect.DeepEqual(result, mods) {
+		t.Fatalf("Expected exported policies to equal %v but got: %v", mods, result)
+	}
+}
 
-	lines = strings.Split(f.recorder.Body.String(), "\n")
-	if len(lines) != 14 {
-		t.Errorf("Expected 14 lines of output but got %d:\n%v", len(lines), lines)
+// txnCheckingWriter records whether a transaction could be opened when the
+// response body was written.
+type txnCheckingWriter struct {
+	*httptest.ResponseRecorder
+	store *storage.Storage
+	err   error
+}
+
+func (w *txnCheckingWriter) Write(bs []byte) (int, error) {
+	if txn, err := w.store.NewTransaction(context.Background()); err != nil {
+		w.err = err
+	} else {
+		w.store.Close(context.Background(), txn)
 	}
+	return w.ResponseRecorder.Write(bs)
 }
 
-func TestIndexGet(t *testing.T) {
-	f := newFixture(t)
-	get, err := http.NewRequest("GET", `/?q=foo = 1`, strings.NewReader(""))
+func TestPoliciesExportV1TransactionClosed(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig().WithMaxTransactions(1, 0))
+	server, err := New(ctx, store, ":8182", false)
 	if err != nil {
 		panic(err)
 	}
-	f.server.Handler.ServeHTTP(f.recorder, get)
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got: %v", f.recorder)
-		return
+
+	f := &fixture{server: server, recorder: httptest.NewRecorder(), t: t}
+
+	if err := f.v1("PUT", "/policies/1", testMod, 200, ""); err != nil {
+		t.Fatal(err)
 	}
-	page := f.recorder.Body.String()
-	if !strings.Contains(page, "Query result") {
-		t.Errorf("Expected page to contain 'Query result' but got: %v", page)
-		return
+
+	w := &txnCheckingWriter{ResponseRecorder: httptest.NewRecorder(), store: store}
+	server.Handler.ServeHTTP(w, newReqV1("GET", "/policies/export", ""))
+
+	if w.Code != 200 {
+		t.Fatalf("Expected success but got %v", w.ResponseRecorder)
 	}
-}
 
-func TestIndexGetCompileError(t *testing.T) {
-	f := newFixture(t)
-	// "foo" is not bound
-	get, err := http.NewRequest("GET", `/?q=foo`, strings.NewReader(""))
-	if err != nil {
-		panic(err)
+	if w.err != nil {
+		t.Fatalf("Expected transaction to be closed while writing archive but got: %v", w.err)
 	}
-	f.server.Handler.ServeHTTP(f.recorder, get)
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got: %v", f.recorder)
-		return
+}
+
+func TestExportEntryName(t *testing.T) {
+
+	tests := map[string]string{
+		"a.rego":  "a.rego",
+		"../../x": "..%2F..%2Fx",
+		"..":      "%2E%2E",
+		`a\b`:     "a%5Cb",
 	}
-	page := f.recorder.Body.String()
-	if !strings.Contains(page, "foo is unsafe") {
-		t.Errorf("Expected page to contain 'foo is unsafe' but got: %v", page)
-		return
+
+	for id, expected := range tests {
+		if result := exportEntryName(id); result != expected {
+			t.Errorf("Expected entry name for %q to be %q but got: %q", id, expected, result)
+		}
 	}
 }
 
-func TestPoliciesPutV1(t *testing.T) {
-	f := newFixture(t)
-	req := newReqV1("PUT", "/policies/1", testMod)
+func TestPoliciesDiffV1(t *testing.T) {
 
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	f := newFixture(t)
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	if err := f.v1("PUT", "/policies/test", `package test
+p[x] :- x = 1
+p[x] :- x = 2
+q = true
+r = 1`, 200, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	policy := f.loadPolicy()
-	expected := newPolicy("1", testMod)
-	if !expected.Equal(policy) {
-		t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected, policy)
+	tests := []struct {
+		note string
+		id   string
+		mod  string
+		code int
+		resp string
+	}{
+		{"no change", "test", `package test
+r = 1
+q = true
+p[x] :- x = 2
+p[x] :- x = 1`, 200, `{"ID": "test", "Added": [], "Removed": [], "Modified": []}`},
+		{"changes", "test", `package test
+p[x] :- x = 1
+p[x] :- x = 3
+q = true
+s = 2`, 200, `{"ID": "test", "Added": ["s"], "Removed": ["r"], "Modified": ["p"]}`},
+		{"new module", "test2", `package test2
+a = 1`, 200, `{"ID": "test2", "Added": ["a"], "Removed": [], "Modified": []}`},
+		{"compile error", "test", `package test
+p :- x`, 400, ""},
 	}
-}
 
-func TestPoliciesPutV1Empty(t *testing.T) {
-	f := newFixture(t)
-	req := newReqV1("PUT", "/policies/1", "")
+	for _, tc := range tests {
+		if err := f.v1("POST", "/policies/"+tc.id+"/diff", tc.mod, tc.code, tc.resp); err != nil {
+			t.Errorf("%v: %v", tc.note, err)
+		}
+	}
 
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	// The proposed modules must not be stored.
+	if err := f.v1("GET", "/policies/test2", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	if f.recorder.Code != 400 {
-		t.Errorf("Expected bad request but got %v", f.recorder)
-		return
+	if err := f.v1("GET", "/data/test/r", "", 200, `1`); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestPoliciesPutV1ParseError(t *testing.T) {
+func TestPoliciesQueryV1(t *testing.T) {
+
 	f := newFixture(t)
-	req := newReqV1("PUT", "/policies/test", `
-    package a.b.c
 
-    p ;- true
-    `)
+	mods := map[string]string{
+		"a1": "package a\np[x] :- x = 1",
+		"a2": "package a\np[x] :- x = 2",
+		"b":  "package b\nimport data.a.p\nq[x] :- p[x]",
+		"c":  "package c\nr[x] :- data.a.p[x]",
+	}
 
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	for id, mod := range mods {
+		if err := f.v1("PUT", "/policies/"+id, mod, 200, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	if f.recorder.Code != 400 {
-		t.Errorf("Expected bad request but got %v", f.recorder)
-		return
+	tests := []struct {
+		note string
+		path string
+		code int
+		resp string
+	}{
+		{"all policies", "/query?q=count(data.a.p,n)", 200, `[{"n": 2}]`},
+		{"isolated", "/policies/a1/query?q=count(data.a.p,n)", 200, `[{"n": 1}]`},
+		{"imports", "/policies/b/query?q=count(data.b.q,n)", 200, `[{"n": 2}]`},
+		{"no imports", "/policies/c/query?q=count(data.c.r,n)", 200, `[{"n": 0}]`},
+		{"missing query", "/policies/a1/query", 400, ""},
+		{"missing policy", "/policies/deadbeef/query?q=true", 404, ""},
 	}
 
-	errs := astErrorV1{}
-	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
-		t.Fatalf("Unexpected JSON decode error: %v", err)
+	for _, tc := range tests {
+		if err := f.v1("GET", tc.path, "", tc.code, tc.resp); err != nil {
+			t.Errorf("%v: %v", tc.note, err)
+		}
 	}
+}
 
-	expected := ast.NewLocation(nil, "test", 4, 8)
+func TestPoliciesReloadV1(t *testing.T) {
 
-	if !reflect.DeepEqual(errs.Errors[0].Location, expected) {
-		t.Errorf("Expected error location to be %v but got: %v", expected, errs)
+	dir, err := ioutil.TempDir("", "server_test_reload")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestPoliciesPutV1CompileError(t *testing.T) {
-	f := newFixture(t)
-	req := newReqV1("PUT", "/policies/test", `
-    package a.b.c
-    p[x] :- q[x]
-    q[x] :- p[x]
-    `)
+	defer os.RemoveAll(dir)
 
-	f.server.Handler.ServeHTTP(f.recorder, req)
+	f := newFixture(t)
+	f.server.store = storage.New(storage.InMemoryConfig().WithPolicyDir(dir))
 
-	if f.recorder.Code != 400 {
-		t.Fatalf("Expected bad request but got %v", f.recorder)
+	if err := f.v1("PUT", "/policies/1", testMod, 200, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	errs := astErrorV1{}
-	if err := util.NewJSONDecoder(f.recorder.Body).Decode(&errs); err != nil {
-		t.Fatalf("Unexpected JSON decode error: %v", err)
+	filename := filepath.Join(dir, "2")
+	if err := ioutil.WriteFile(filename, []byte("package b\n\nq = true :- true\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	expected := ast.NewLocation(nil, "test", 3, 5)
+	if err := f.v1("GET", "/data/b/q", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	if len(errs.Errors) != 2 {
-		t.Fatalf("Expected exactly two errors but got %d: %v", len(errs.Errors), errs)
+	if err := f.v1("POST", "/policies/reload", "", 204, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	found := false
+	if err := f.v1("GET", "/data/b/q", "", 200, "true"); err != nil {
+		t.Fatal(err)
+	}
 
-	for _, err := range errs.Errors {
-		if reflect.DeepEqual(err.Location, expected) {
-			found = true
-		}
+	if err := f.v1("GET", "/policies/1", "", 200, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	if !found {
-		t.Fatalf("Missing expected error %v: %v", expected, errs)
+	if err := ioutil.WriteFile(filename, []byte("package b\n\nq = true :- deadbeef\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestPoliciesListV1(t *testing.T) {
-	f := newFixture(t)
-	put := newReqV1("PUT", "/policies/1", testMod)
-	f.server.Handler.ServeHTTP(f.recorder, put)
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	if err := f.v1("POST", "/policies/reload", "", 400, ""); err != nil {
+		t.Fatal(err)
 	}
-	f.reset()
-	list := newReqV1("GET", "/policies", "")
 
-	f.server.Handler.ServeHTTP(f.recorder, list)
+	if err := f.v1("GET", "/data/b/q", "", 200, "true"); err != nil {
+		t.Fatal(err)
+	}
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	// Policies whose files were deleted are removed.
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
 	}
 
-	var policies []*policyV1
-	err := util.NewJSONDecoder(f.recorder.Body).Decode(&policies)
-	if err != nil {
-		t.Errorf("Expected policy list but got error: %v", err)
-		return
+	if err := f.v1("POST", "/policies/reload", "", 204, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	expected := []*policyV1{
-		newPolicy("1", testMod),
+	if err := f.v1("GET", "/policies/2", "", 404, ""); err != nil {
+		t.Fatal(err)
 	}
-	if len(expected) != len(policies) {
-		t.Errorf("Expected %d policies but got: %v", len(expected), policies)
-		return
+
+	if err := f.v1("GET", "/data/b/q", "", 404, ""); err != nil {
+		t.Fatal(err)
 	}
-	for i := range expected {
-		if !expected[i].Equal(policies[i]) {
-			t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected[i], policies[i])
-		}
+
+	if err := f.v1("GET", "/policies/1", "", 200, ""); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestPoliciesGetV1(t *testing.T) {
-	f := newFixture(t)
-	put := newReqV1("PUT", "/policies/1", testMod)
-	f.server.Handler.ServeHTTP(f.recorder, put)
+func TestPoliciesReloadV1Checks(t *testing.T) {
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	dir, err := ioutil.TempDir("", "server_test_reload_checks")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	f.reset()
-	get := newReqV1("GET", "/policies/1", "")
+	defer os.RemoveAll(dir)
 
-	f.server.Handler.ServeHTTP(f.recorder, get)
+	f := newFixture(t)
+	f.server.store = storage.New(storage.InMemoryConfig().WithPolicyDir(dir))
+	f.server.WithBuiltinAllowlist("count").WithStrictImports(true)
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	filename := filepath.Join(dir, "1")
+
+	if err := ioutil.WriteFile(filename, []byte("package a\n\np :- plus(1, 2, x)\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	policy := f.loadPolicy()
-	expected := newPolicy("1", testMod)
-	if !expected.Equal(policy) {
-		t.Errorf("Expected policies to be equal. Expected:\n\n%v\n\nGot:\n\n%v\n", expected, policy)
+	if err := f.v1("POST", "/policies/reload", "", 403, ""); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func TestPoliciesGetRawV1(t *testing.T) {
-	f := newFixture(t)
-	put := newReqV1("PUT", "/policies/1", testMod)
-	f.server.Handler.ServeHTTP(f.recorder, put)
+	if err := f.v1("GET", "/policies/1", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	if err := ioutil.WriteFile(filename, []byte("package a\n\nimport data.x.y\n\np :- y[_] = 1\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	f.reset()
-	get := newReqV1("GET", "/policies/1/raw", "")
+	if err := f.v1("POST", "/policies/reload", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	f.server.Handler.ServeHTTP(f.recorder, get)
+	if err := f.v1("GET", "/policies/1", "", 404, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	if f.recorder.Code != 200 {
-		t.Errorf("Expected success but got %v", f.recorder)
-		return
+	if err := f.v1("PUT", "/data/x/y", `[1]`, 201, ""); err != nil {
+		t.Fatal(err)
 	}
 
-	raw := f.recorder.Body.String()
-	if raw != testMod {
-		t.Errorf("Expected raw string to equal testMod:\n\nExpected:\n\n%v\n\nGot:\n\n%v\n", testMod, raw)
+	if err := f.v1("POST", "/policies/reload", "", 204, ""); err != nil {
+		t.Fatal(err)
 	}
 
+	if err := f.v1("GET", "/data/a/p", "", 200, "true"); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestPoliciesDeleteV1(t *testing.T) {
@@ -810,6 +4248,55 @@ func (f *fixture) reset() {
 	f.recorder = httptest.NewRecorder()
 }
 
+func TestDataPatchRollbackMounted(t *testing.T) {
+
+	ctx := context.Background()
+
+	// The base documents are loaded into the store directly because reads that
+	// span the mount would merge the mounted documents into the result.
+	store := storage.New(storage.InMemoryWithJSONConfig(map[string]interface{}{
+		"x": map[string]interface{}{"a": json.Number("1")},
+	}))
+
+	mounted := storage.NewDataStoreFromReader(strings.NewReader(`{"b": 1}`))
+	if err := store.Mount(mounted, storage.MustParsePath("/mounted")); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := New(ctx, store, ":8182", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{server: server, recorder: httptest.NewRecorder(), t: t}
+
+	if err := f.v1("PATCH", "/data", `[
+		{"op": "replace", "path": "/", "value": {"y": 1}},
+		{"op": "remove", "path": "/x"}
+	]`, 404, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents from the mounted store must not be written to the built-in
+	// store when the patch is undone.
+	txn := storage.NewTransactionOrDie(ctx, f.server.store)
+	result, err := f.server.store.ReadBuiltin(ctx, txn, storage.Path{})
+	f.server.store.Close(ctx, txn)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{"x": map[string]interface{}{"a": json.Number("1")}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected built-in store to contain %v but got: %v", expected, result)
+	}
+
+	if err := f.v1("GET", "/data/mounted/b", "", 200, "1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func executeRequests(t *testing.T, reqs []tr) {
 	f := newFixture(t)
 	for i, req := range reqs {
@@ -0,0 +1,147 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// Span represents the evaluation of a single query frame. Spans follow the
+// OpenTelemetry data model so that they can be forwarded to distributed tracing
+// systems by a SpanExporter. Trace IDs are 16 bytes and span IDs are 8 bytes,
+// both hex encoded.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	Events       []SpanEvent
+}
+
+// SpanEvent represents a trace event emitted while evaluating a query frame.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+// SpanExporter defines the interface for exporting spans produced by query
+// evaluation. Exporters are called after each query is evaluated and are
+// responsible for handling their own errors.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span)
+}
+
+type timedEvent struct {
+	evt  *topdown.Event
+	time time.Time
+}
+
+// spanTracer implements the topdown.Tracer interface by recording events along
+// with the time they were emitted.
+type spanTracer struct {
+	events []timedEvent
+}
+
+func (t *spanTracer) Enabled() bool {
+	return true
+}
+
+func (t *spanTracer) Trace(_ *topdown.Topdown, evt *topdown.Event) {
+	t.events = append(t.events, timedEvent{evt, time.Now()})
+}
+
+// Spans returns a span for each query frame in the recorded events. Spans are
+// linked to their parents using the query IDs of the frames.
+func (t *spanTracer) Spans(traceID string) []*Span {
+
+	spans := []*Span{}
+	byQueryID := map[uint64]*Span{}
+
+	for _, x := range t.events {
+		span, ok := byQueryID[x.evt.QueryID]
+		if !ok {
+			span = &Span{
+				TraceID:   traceID,
+				SpanID:    spanID(x.evt.QueryID),
+				Name:      spanName(x.evt.Node),
+				StartTime: x.time,
+				Attributes: map[string]interface{}{
+					"opa.query_id":  x.evt.QueryID,
+					"opa.parent_id": x.evt.ParentID,
+				},
+			}
+			if parent, ok := byQueryID[x.evt.ParentID]; ok && x.evt.ParentID != x.evt.QueryID {
+				span.ParentSpanID = parent.SpanID
+			}
+			byQueryID[x.evt.QueryID] = span
+			spans = append(spans, span)
+		}
+		span.EndTime = x.time
+		span.Events = append(span.Events, SpanEvent{
+			Name: string(x.evt.Op),
+			Time: x.time,
+			Attributes: map[string]interface{}{
+				"opa.op":   string(x.evt.Op),
+				"opa.node": fmt.Sprint(x.evt.Node),
+			},
+		})
+	}
+
+	return spans
+}
+
+func spanID(qid uint64) string {
+	return fmt.Sprintf("%016x", qid)
+}
+
+func spanName(node interface{}) string {
+	switch node := node.(type) {
+	case *ast.Rule:
+		return fmt.Sprintf("rule %v", node.Name)
+	case ast.Body:
+		return "query"
+	default:
+		return "eval"
+	}
+}
+
+// newSpanTracer returns a tracer for recording spans or nil if the server does
+// not export spans.
+func (s *Server) newSpanTracer() *spanTracer {
+	if s.spanExporter == nil {
+		return nil
+	}
+	return &spanTracer{}
+}
+
+// withSpanTracer returns the tracer to use for evaluation given the tracer
+// requested by the caller.
+func withSpanTracer(tracer topdown.Tracer, spans *spanTracer) topdown.Tracer {
+	if spans == nil {
+		return tracer
+	}
+	if tracer == nil {
+		return spans
+	}
+	return topdown.NewMultiTracer(tracer, spans)
+}
+
+// exportSpans exports the spans recorded by the tracer. The trace ID is
+// generated for each query.
+func (s *Server) exportSpans(ctx context.Context, spans *spanTracer) {
+	if spans == nil || len(spans.events) == 0 {
+		return
+	}
+	s.spanExporter.ExportSpans(ctx, spans.Spans(newRequestID()))
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+type recordingExporter struct {
+	spans [][]*Span
+}
+
+func (e *recordingExporter) ExportSpans(ctx context.Context, spans []*Span) {
+	e.spans = append(e.spans, spans)
+}
+
+func TestSpanExporter(t *testing.T) {
+
+	f := newFixture(t)
+	exporter := &recordingExporter{}
+	f.server.WithSpanExporter(exporter)
+
+	if err := f.v1("PUT", "/policies/test", `package test
+p :- q[x], x > 1
+q[x] :- a = [1, 2], x = a[_]`, 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/test/p?explain=full", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/query?q=data.test.q[x]", "", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected spans to be exported for two queries but got: %v", len(exporter.spans))
+	}
+
+	for _, spans := range exporter.spans {
+
+		if len(spans) < 2 {
+			t.Fatalf("Expected at least two spans but got: %v", spans)
+		}
+
+		root := spans[0]
+		ids := map[string]bool{}
+
+		for _, span := range spans {
+			if span.TraceID != root.TraceID || len(span.TraceID) != 32 {
+				t.Fatalf("Expected spans to share trace ID %v but got: %v", root.TraceID, span.TraceID)
+			}
+			if span.ParentSpanID != "" && !ids[span.ParentSpanID] {
+				t.Fatalf("Expected parent of span %v to precede it but got: %v", span.SpanID, span.ParentSpanID)
+			}
+			if len(span.Events) == 0 || span.EndTime.Before(span.StartTime) {
+				t.Fatalf("Expected span to contain events in order but got: %+v", span)
+			}
+			ids[span.SpanID] = true
+		}
+
+		if root.ParentSpanID != "" {
+			t.Fatalf("Expected root span to have no parent but got: %v", root.ParentSpanID)
+		}
+	}
+
+	if exporter.spans[0][1].Name != "rule p" {
+		t.Fatalf("Expected span for rule p but got: %v", exporter.spans[0][1].Name)
+	}
+}
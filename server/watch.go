@@ -0,0 +1,225 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/topdown"
+)
+
+// watchTriggerID identifies the storage trigger that notifies watches.
+const watchTriggerID = "org.openpolicyagent/server-watch"
+
+// watchEventV1 models the messages sent to clients watching a document. If the
+// document is undefined, the result is omitted.
+type watchEventV1 struct {
+	Result    interface{} `json:"result,omitempty"`
+	Undefined bool        `json:"undefined,omitempty"`
+}
+
+// watch represents a client watching the document referred to by ref. The
+// channel is signalled when the document may have changed.
+type watch struct {
+	ref ast.Ref
+	ch  chan struct{}
+}
+
+// watchers tracks the clients watching documents. Watches are signalled when
+// base documents they depend on are written or when policies change.
+type watchers struct {
+	server *Server
+
+	// access to the watches is guarded by mtx
+	mtx     sync.Mutex
+	watches map[*watch]struct{}
+	closed  chan struct{}
+}
+
+func newWatchers(server *Server) *watchers {
+	return &watchers{
+		server:  server,
+		watches: map[*watch]struct{}{},
+		closed:  make(chan struct{}),
+	}
+}
+
+func (ws *watchers) add(ref ast.Ref) *watch {
+	w := &watch{ref: ref, ch: make(chan struct{}, 1)}
+	ws.mtx.Lock()
+	ws.watches[w] = struct{}{}
+	ws.mtx.Unlock()
+	return w
+}
+
+func (ws *watchers) remove(w *watch) {
+	ws.mtx.Lock()
+	delete(ws.watches, w)
+	ws.mtx.Unlock()
+}
+
+// close stops all watches. Clients are disconnected once their watches stop.
+func (ws *watchers) close() {
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+	select {
+	case <-ws.closed:
+	default:
+		close(ws.closed)
+	}
+}
+
+// notify signals the watches that may be affected by a write to path. If path
+// is nil, all watches are signalled. Signals are coalesced so that notify
+// never blocks.
+func (ws *watchers) notify(path storage.Path) {
+
+	ws.mtx.Lock()
+	defer ws.mtx.Unlock()
+
+	if len(ws.watches) == 0 {
+		return
+	}
+
+	compiler := ws.server.Compiler()
+
+	for w := range ws.watches {
+		if path != nil && !watchDependsOn(compiler, w.ref, path) {
+			continue
+		}
+		select {
+		case w.ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchDependsOn returns true if the document referred to by ref may depend on
+// the base document at path. Virtual documents may depend on any base document.
+func watchDependsOn(compiler *ast.Compiler, ref ast.Ref, path storage.Path) bool {
+
+	if len(compiler.GetRulesWithPrefix(ref)) > 0 {
+		return true
+	}
+
+	for i := 1; i <= len(ref); i++ {
+		if len(compiler.GetRulesExact(ref[:i])) > 0 {
+			return true
+		}
+	}
+
+	refPath, err := storage.NewPathForRef(ref)
+	if err != nil {
+		return true
+	}
+
+	return refPath.HasPrefix(path) || path.HasPrefix(refPath)
+}
+
+// registerTrigger registers the storage trigger that notifies watches when
+// base documents are written.
+func (ws *watchers) registerTrigger(txn storage.Transaction) error {
+	return ws.server.store.Register(txn, watchTriggerID, storage.TriggerConfig{
+		After: func(ctx context.Context, txn storage.Transaction, op storage.PatchOp, path storage.Path, value interface{}) error {
+			ws.notify(path)
+			return nil
+		},
+	})
+}
+
+// watchData streams the value of the document referred to by path to the
+// client. The document is evaluated again each time it may have changed and
+// the value is sent if it differs from the previous value. The stream ends
+// when the client disconnects or the server shuts down.
+func (s *Server) watchData(w http.ResponseWriter, r *http.Request, path ast.Ref, request ast.Value) {
+
+	ctx := r.Context()
+	flusher, _ := w.(http.Flusher)
+
+	// Watches are long-lived so the server's write timeout does not apply to
+	// them.
+	clearWriteDeadline(r)
+
+	watch := s.watchers.add(path)
+	defer s.watchers.remove(watch)
+
+	var prev []byte
+
+	for {
+		bs, err := s.evalWatch(ctx, path, request)
+
+		if err != nil {
+			if prev == nil {
+				handleErrorAuto(w, err)
+				return
+			}
+			bs, _ := json.Marshal(&apiErrorV1{Code: 500, Message: err.Error()})
+			w.Write(append(bs, '\n'))
+			return
+		}
+
+		if prev == nil {
+			w.Header().Add("Content-Type", "application/x-ndjson")
+			w.WriteHeader(200)
+		}
+
+		if !bytes.Equal(bs, prev) {
+			if _, err := w.Write(append(bs, '\n')); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			prev = bs
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.watchers.closed:
+			return
+		case <-watch.ch:
+		}
+	}
+}
+
+// evalWatch returns the serialized watch event for the document referred to by
+// path. The event is serialized before the transaction is closed because the
+// result may refer to documents in storage.
+func (s *Server) evalWatch(ctx context.Context, path ast.Ref, request ast.Value) ([]byte, error) {
+
+	txn, err := s.store.NewTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.store.Close(ctx, txn)
+
+	evalCtx, cancel := s.evalContext(ctx)
+	defer cancel()
+
+	params := topdown.NewQueryParams(evalCtx, s.Compiler(), s.store, txn, request, path)
+	params.Budget = s.newMemoryBudget()
+	params.DepthLimit = s.depthLimit
+
+	qrs, err := topdown.Query(params)
+	if err != nil {
+		return nil, err
+	}
+
+	event := watchEventV1{Undefined: true}
+
+	if !qrs.Undefined() {
+		event = watchEventV1{Result: qrs[0].Result}
+	}
+
+	return json.Marshal(event)
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataWatch(t *testing.T) {
+
+	f := newFixture(t)
+	ts := httptest.NewServer(f.server.Handler)
+	defer ts.Close()
+
+	if err := f.v1("PUT", "/data/x", `{"a": 1}`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	base := openWatch(ctx, t, ts.URL+"/v1/data/x?watch=true")
+	virtual := openWatch(ctx, t, ts.URL+"/v1/data/test/p?watch=true")
+
+	expectWatchEvent(t, base, `{"result":{"a":1}}`)
+	expectWatchEvent(t, virtual, `{"undefined":true}`)
+
+	if err := f.v1("PUT", "/data/y", `1`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("PUT", "/data/x/a", `2`, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectWatchEvent(t, base, `{"result":{"a":2}}`)
+
+	if err := f.v1("PUT", "/policies/test", "package test\np = x :- data.x.a = x", 200, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectWatchEvent(t, virtual, `{"result":2}`)
+
+	if err := f.v1("PUT", "/data/x/a", `3`, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectWatchEvent(t, base, `{"result":{"a":3}}`)
+	expectWatchEvent(t, virtual, `{"result":3}`)
+
+	cancel()
+
+	for i := 0; ; i++ {
+		f.server.watchers.mtx.Lock()
+		n := len(f.server.watchers.watches)
+		f.server.watchers.mtx.Unlock()
+		if n == 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("Expected watches to be removed after clients disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := f.v1("GET", "/data/x?watch=true&explain=full", "", 400, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataWatchShutdown(t *testing.T) {
+
+	f := newFixture(t)
+	ts := httptest.NewServer(f.server.Handler)
+	defer ts.Close()
+
+	watch := openWatch(context.Background(), t, ts.URL+"/v1/data/x?watch=true")
+	expectWatchEvent(t, watch, `{"undefined":true}`)
+
+	f.server.watchers.close()
+
+	if _, err := watch.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected watch to end but got: %v", err)
+	}
+}
+
+func TestDataWatchWriteTimeout(t *testing.T) {
+
+	f := newFixture(t)
+	f.server.WithWriteTimeout(100 * time.Millisecond)
+
+	// The test server uses the HTTP server settings and listener so that the
+	// write timeout applies to the watch.
+	ts := httptest.NewUnstartedServer(f.server.Handler)
+	ts.Config = f.server.httpServer()
+	ts.Listener = connListener{ts.Listener}
+	ts.Start()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch := openWatch(ctx, t, ts.URL+"/v1/data/x?watch=true")
+	expectWatchEvent(t, watch, `{"undefined":true}`)
+
+	time.Sleep(300 * time.Millisecond)
+
+	if err := f.v1("PUT", "/data/x", `1`, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expectWatchEvent(t, watch, `{"result":1}`)
+}
+
+func openWatch(ctx context.Context, t *testing.T, url string) *bufio.Reader {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected watch response: %v", resp)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func expectWatchEvent(t *testing.T, r *bufio.Reader, expected string) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected watch event %v but got error: %v", expected, err)
+	}
+	if strings.TrimSpace(line) != expected {
+		t.Fatalf("Expected watch event %v but got: %v", expected, line)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// isYAMLMediaType returns true if the media type (e.g., the value of a
+// Content-Type header) refers to YAML.
+func isYAMLMediaType(s string) bool {
+	switch strings.TrimSpace(strings.Split(s, ";")[0]) {
+	case "application/yaml", "application/x-yaml", "text/yaml":
+		return true
+	}
+	return false
+}
+
+// acceptsYAML returns true if the Accept header value prefers YAML over JSON.
+// The media types are considered in the order they are listed.
+func acceptsYAML(header string) bool {
+	for _, x := range strings.Split(header, ",") {
+		if isYAMLMediaType(x) {
+			return true
+		}
+		if strings.TrimSpace(strings.Split(x, ";")[0]) == "application/json" {
+			return false
+		}
+	}
+	return false
+}
+
+// jsonBody returns the request body as JSON. If the request body is YAML
+// encoded, it is converted to JSON.
+func jsonBody(r *http.Request) (io.Reader, error) {
+	if !isYAMLMediaType(r.Header.Get("Content-Type")) {
+		return r.Body, nil
+	}
+	bs, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	js, err := yaml.YAMLToJSON(bs)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad YAML")
+	}
+	return bytes.NewReader(js), nil
+}
+
+// yamlHandler wraps the server's router and converts JSON responses to YAML
+// if the client prefers it.
+type yamlHandler struct {
+	inner http.Handler
+}
+
+func (h *yamlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !acceptsYAML(r.Header.Get("Accept")) {
+		h.inner.ServeHTTP(w, r)
+		return
+	}
+	yw := &yamlWriter{ResponseWriter: w, code: 200}
+	defer yw.Close()
+	h.inner.ServeHTTP(yw, r)
+}
+
+// yamlWriter buffers JSON response bodies and writes them as YAML when the
+// writer is closed. Other responses (e.g., streamed results) are written
+// as-is.
+type yamlWriter struct {
+	http.ResponseWriter
+	code    int
+	buf     bytes.Buffer
+	convert bool
+	started bool
+}
+
+func (w *yamlWriter) WriteHeader(code int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.code = code
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.convert = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *yamlWriter) Write(bs []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(200)
+	}
+	if w.convert {
+		return w.buf.Write(bs)
+	}
+	return w.ResponseWriter.Write(bs)
+}
+
+func (w *yamlWriter) Flush() {
+	if w.convert {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close converts the buffered JSON response body to YAML and writes it.
+func (w *yamlWriter) Close() error {
+
+	if !w.convert {
+		return nil
+	}
+
+	if w.buf.Len() == 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+		return nil
+	}
+
+	bs, err := yaml.JSONToYAML(w.buf.Bytes())
+	if err != nil {
+		w.ResponseWriter.WriteHeader(w.code)
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.ResponseWriter.WriteHeader(w.code)
+	_, err = w.ResponseWriter.Write(bs)
+	return err
+}
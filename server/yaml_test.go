@@ -0,0 +1,76 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+)
+
+func TestAcceptsYAML(t *testing.T) {
+
+	tests := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/yaml", true},
+		{"application/x-yaml; charset=utf-8", true},
+		{"application/json, application/yaml", false},
+		{"text/html, application/yaml;q=0.9, application/json;q=0.8", true},
+	}
+
+	for _, tc := range tests {
+		if result := acceptsYAML(tc.header); result != tc.expected {
+			t.Errorf("Expected acceptsYAML(%q) to be %v but got: %v", tc.header, tc.expected, result)
+		}
+	}
+}
+
+func TestDataYAML(t *testing.T) {
+
+	f := newFixture(t)
+
+	put := newReqV1("PUT", "/data/x", "a: 1\nb:\n- c\n- d\n")
+	put.Header.Set("Content-Type", "application/yaml")
+
+	if err := f.executeRequest(put, 201, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	patch := newReqV1("PATCH", "/data/x", "- op: add\n  path: /e\n  value: true\n")
+	patch.Header.Set("Content-Type", "application/yaml")
+
+	if err := f.executeRequest(patch, 204, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.v1("GET", "/data/x", "", 200, `{"a": 1, "b": ["c", "d"], "e": true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := f.recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Expected JSON response by default but got: %v", ct)
+	}
+
+	get := newReqV1("GET", "/data/x", "")
+	get.Header.Set("Accept", "application/yaml")
+
+	f.reset()
+	f.server.Handler.ServeHTTP(f.recorder, get)
+
+	expected := "a: 1\nb:\n- c\n- d\ne: true\n"
+
+	if f.recorder.Code != 200 || f.recorder.Header().Get("Content-Type") != "application/yaml" || f.recorder.Body.String() != expected {
+		t.Fatalf("Expected YAML response %q but got: %v", expected, f.recorder)
+	}
+
+	bad := newReqV1("PUT", "/data/x", "a: [")
+	bad.Header.Set("Content-Type", "application/yaml")
+
+	if err := f.executeRequest(bad, 400, ""); err != nil {
+		t.Fatal(err)
+	}
+}
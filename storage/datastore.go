@@ -108,8 +108,7 @@ func (ds *DataStore) patch(ctx context.Context, op PatchOp, path Path, value int
 	for _, t := range ds.triggers {
 		if t.Before != nil {
 			// TODO(tsandall): use correct transaction.
-			// TODO(tsandall): fix path
-			if err := t.Before(ctx, invalidTXN, op, nil, value); err != nil {
+			if err := t.Before(ctx, invalidTXN, op, path, value); err != nil {
 				return err
 			}
 		}
@@ -133,8 +132,7 @@ func (ds *DataStore) patch(ctx context.Context, op PatchOp, path Path, value int
 	for _, t := range ds.triggers {
 		if t.After != nil {
 			// TODO(tsandall): use correct transaction.
-			// TODO(tsandall): fix path
-			if err := t.After(ctx, invalidTXN, op, nil, value); err != nil {
+			if err := t.After(ctx, invalidTXN, op, path, value); err != nil {
 				return err
 			}
 		}
@@ -45,6 +45,10 @@ const (
 	// WritesNotSupportedErr indicate the caller attempted to perform a write
 	// against a store that does not support them.
 	WritesNotSupportedErr = iota
+
+	// TransactionLimitErr indicates a transaction could not be started
+	// because the maximum number of transactions were open or waiting.
+	TransactionLimitErr = iota
 )
 
 // Error is the error type returned by the storage layer.
@@ -66,6 +70,15 @@ func IsNotFound(err error) bool {
 	return false
 }
 
+// IsTransactionLimit returns true if this error is a TransactionLimitErr.
+func IsTransactionLimit(err error) bool {
+	switch err := err.(type) {
+	case *Error:
+		return err.Code == TransactionLimitErr
+	}
+	return false
+}
+
 // IsInvalidPatch returns true if this error is a InvalidPatchErr.
 func IsInvalidPatch(err error) bool {
 	switch err := err.(type) {
@@ -157,3 +170,10 @@ func writesNotSupportedError() *Error {
 		Message: "writes not supported",
 	}
 }
+
+func transactionLimitError(limit int) *Error {
+	return &Error{
+		Code:    TransactionLimitErr,
+		Message: fmt.Sprintf("transaction limit of %d exceeded", limit),
+	}
+}
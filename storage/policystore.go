@@ -22,6 +22,10 @@ type policyStore struct {
 	policyDir string
 	raw       map[string][]byte
 	modules   map[string]*ast.Module
+
+	// persisted contains the IDs of the policies that were read from or
+	// written to the policy directory.
+	persisted map[string]struct{}
 }
 
 // loadPolicies is the default callback function that will be used when
@@ -52,6 +56,7 @@ func newPolicyStore(policyDir string) *policyStore {
 		policyDir: policyDir,
 		raw:       map[string][]byte{},
 		modules:   map[string]*ast.Module{},
+		persisted: map[string]struct{}{},
 	}
 }
 
@@ -76,35 +81,85 @@ func (p *policyStore) Open(txn Transaction, f func(map[string][]byte) (map[strin
 		return nil
 	}
 
-	info, err := ioutil.ReadDir(p.policyDir)
+	raw, err := p.readPolicyDir()
 	if err != nil {
 		return err
 	}
 
-	raw := map[string][]byte{}
+	mods, err := f(raw)
+	if err != nil {
+		return err
+	}
 
-	for _, i := range info {
+	for id, mod := range mods {
+		if err := p.Add(id, mod, raw[id], false); err != nil {
+			return err
+		}
+		p.persisted[id] = struct{}{}
+	}
 
-		f := i.Name()
-		bs, err := ioutil.ReadFile(filepath.Join(p.policyDir, f))
+	return nil
+}
+
+// Reload re-reads the persisted policies and installs them into the store.
+//
+// Persisted policies replace existing policies with the same ID. Policies that
+// were persisted but whose files have been deleted are removed. Policies that
+// were not persisted are retained. The callback function "f" is invoked with
+// the resulting set of policies and should return an error if they cannot be
+// installed, e.g., because they fail to compile. If the persisted policies
+// cannot be parsed or the callback fails, the store is not modified.
+func (p *policyStore) Reload(txn Transaction, f func(map[string]*ast.Module) error) error {
+
+	if len(p.policyDir) == 0 {
+		return nil
+	}
+
+	raw, err := p.readPolicyDir()
+	if err != nil {
+		return err
+	}
+
+	mods := p.List()
+	persisted := map[string]*ast.Module{}
+	stale := []string{}
 
+	for id := range p.persisted {
+		if _, ok := raw[id]; !ok {
+			delete(mods, id)
+			stale = append(stale, id)
+		}
+	}
+
+	for id, bs := range raw {
+		mod, err := ast.ParseModule(id, string(bs))
 		if err != nil {
 			return err
 		}
-
-		id := p.getID(f)
-		raw[id] = bs
+		if mod == nil {
+			continue
+		}
+		mods[id] = mod
+		persisted[id] = mod
 	}
 
-	mods, err := f(raw)
-	if err != nil {
+	if err := f(mods); err != nil {
 		return err
 	}
 
-	for id, mod := range mods {
+	// The files of stale policies no longer exist so they are removed from
+	// memory only.
+	for _, id := range stale {
+		delete(p.raw, id)
+		delete(p.modules, id)
+		delete(p.persisted, id)
+	}
+
+	for id, mod := range persisted {
 		if err := p.Add(id, mod, raw[id], false); err != nil {
 			return err
 		}
+		p.persisted[id] = struct{}{}
 	}
 
 	return nil
@@ -126,6 +181,7 @@ func (p *policyStore) Add(id string, mod *ast.Module, raw []byte, persist bool)
 		if err := ioutil.WriteFile(filename, raw, 0644); err != nil {
 			return errors.Wrapf(err, "failed to persist definition but new version was installed: %v", id)
 		}
+		p.persisted[id] = struct{}{}
 	}
 
 	return nil
@@ -146,6 +202,7 @@ func (p *policyStore) Remove(id string) error {
 
 	delete(p.raw, id)
 	delete(p.modules, id)
+	delete(p.persisted, id)
 
 	return nil
 }
@@ -168,6 +225,32 @@ func (p *policyStore) GetRaw(id string) ([]byte, error) {
 	return bs, nil
 }
 
+// readPolicyDir returns the raw content of the persisted policies keyed by ID.
+func (p *policyStore) readPolicyDir() (map[string][]byte, error) {
+
+	info, err := ioutil.ReadDir(p.policyDir)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string][]byte{}
+
+	for _, i := range info {
+
+		f := i.Name()
+		bs, err := ioutil.ReadFile(filepath.Join(p.policyDir, f))
+
+		if err != nil {
+			return nil, err
+		}
+
+		id := p.getID(f)
+		raw[id] = bs
+	}
+
+	return raw, nil
+}
+
 func (p *policyStore) getFilename(id string) string {
 	return filepath.Join(p.policyDir, id)
 }
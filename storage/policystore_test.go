@@ -206,6 +206,78 @@ func TestPolicyStoreUpdate(t *testing.T) {
 
 }
 
+func TestPolicyStoreReload(t *testing.T) {
+	f := newFixture()
+	defer f.cleanup()
+
+	mem := f.compile1(`package c
+
+r = true :- true`)
+
+	if err := f.policyStore.Add("mem", mem, nil, false); err != nil {
+		t.Fatalf("Unexpected error on Add(): %v", err)
+	}
+
+	filename := filepath.Join(f.policyStore.policyDir, "testMod1")
+	if err := ioutil.WriteFile(filename, []byte(testMod1), 0644); err != nil {
+		panic(err)
+	}
+
+	if err := f.policyStore.Reload(invalidTXN, compilePolicies); err != nil {
+		t.Fatalf("Unexpected error on Reload(): %v", err)
+	}
+
+	stored, err := f.policyStore.Get("testMod1")
+	if err != nil {
+		t.Fatalf("Unexpected error on Get(): %v", err)
+	}
+
+	if expected := ast.MustParseModule(testMod1); !expected.Equal(stored) {
+		t.Fatalf("Expected %v from policy store but got: %v", expected, stored)
+	}
+
+	if _, err := f.policyStore.Get("mem"); err != nil {
+		t.Fatalf("Expected non-persisted module to be retained but got: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("package a.b\n\np = true :- deadbeef"), 0644); err != nil {
+		panic(err)
+	}
+
+	if err := f.policyStore.Reload(invalidTXN, compilePolicies); err == nil {
+		t.Fatalf("Expected error on Reload() with bad module")
+	}
+
+	bs, err := f.policyStore.GetRaw("testMod1")
+	if err != nil || string(bs) != testMod1 {
+		t.Fatalf("Expected store to be unmodified after failed Reload() but got: %q (err: %v)", bs, err)
+	}
+
+	if err := os.Remove(filename); err != nil {
+		panic(err)
+	}
+
+	if err := f.policyStore.Reload(invalidTXN, compilePolicies); err != nil {
+		t.Fatalf("Unexpected error on Reload(): %v", err)
+	}
+
+	if _, err := f.policyStore.Get("testMod1"); !IsNotFound(err) {
+		t.Fatalf("Expected deleted module to be removed but got: %v", err)
+	}
+
+	if _, err := f.policyStore.Get("mem"); err != nil {
+		t.Fatalf("Expected non-persisted module to be retained but got: %v", err)
+	}
+}
+
+func compilePolicies(mods map[string]*ast.Module) error {
+	c := ast.NewCompiler()
+	if c.Compile(mods); c.Failed() {
+		return c.Errors
+	}
+	return nil
+}
+
 const (
 	testMod1 = `
     package a.b
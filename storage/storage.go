@@ -7,6 +7,7 @@ package storage
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/open-policy-agent/opa/ast"
 )
@@ -15,6 +16,17 @@ import (
 type Config struct {
 	Builtin   Store
 	PolicyDir string
+
+	// MaxTransactions is the maximum number of transactions that may be open
+	// or waiting to start at once. If the limit is zero, the number of
+	// transactions is not limited.
+	MaxTransactions int
+
+	// TransactionTimeout is the maximum amount of time to wait for a
+	// transaction to start when the transaction limit has been reached. If the
+	// timeout is zero, transactions fail immediately when the limit has been
+	// reached.
+	TransactionTimeout time.Duration
 }
 
 // InMemoryConfig returns a new Config for an in-memory storage layer.
@@ -34,6 +46,14 @@ func InMemoryWithJSONConfig(data map[string]interface{}) Config {
 	}
 }
 
+// WithMaxTransactions returns a new Config with the transaction limit
+// configured.
+func (c Config) WithMaxTransactions(n int, timeout time.Duration) Config {
+	c.MaxTransactions = n
+	c.TransactionTimeout = timeout
+	return c
+}
+
 // WithPolicyDir returns a new Config with the policy directory configured.
 func (c Config) WithPolicyDir(dir string) Config {
 	c.PolicyDir = dir
@@ -54,6 +74,11 @@ type Storage struct {
 	mtx    sync.Mutex
 	active map[string]struct{}
 	txn    transaction
+
+	// slots limits the number of transactions that may be open or waiting to
+	// start. If slots is nil, the number of transactions is not limited.
+	slots   chan struct{}
+	timeout time.Duration
 }
 
 type mount struct {
@@ -63,12 +88,17 @@ type mount struct {
 
 // New returns a new instance of the policy engine's storage layer.
 func New(config Config) *Storage {
-	return &Storage{
+	s := &Storage{
 		builtin:     config.Builtin,
 		indices:     newIndices(),
 		policyStore: newPolicyStore(config.PolicyDir),
 		active:      map[string]struct{}{},
+		timeout:     config.TransactionTimeout,
+	}
+	if config.MaxTransactions > 0 {
+		s.slots = make(chan struct{}, config.MaxTransactions)
 	}
+	return s
 }
 
 // Open initializes the storage layer. Open should normally be called
@@ -115,11 +145,35 @@ func (s *Storage) InsertPolicy(txn Transaction, id string, module *ast.Module, r
 	return s.policyStore.Add(id, module, raw, persist)
 }
 
+// ReloadPolicies re-reads the policy modules persisted to disk and installs
+// them into the storage layer. Persisted policy modules replace existing policy
+// modules with the same id. Persisted policy modules whose files were deleted
+// are removed. Policy modules that were not persisted are retained. The
+// callback function "f" is invoked with the resulting set of policy modules,
+// e.g., to compile them. If the persisted policy modules fail to parse or the
+// callback returns an error, the storage layer is not modified.
+func (s *Storage) ReloadPolicies(txn Transaction, f func(map[string]*ast.Module) error) error {
+	return s.policyStore.Reload(txn, f)
+}
+
 // DeletePolicy removes a policy from the storage layer.
 func (s *Storage) DeletePolicy(txn Transaction, id string) error {
 	return s.policyStore.Remove(id)
 }
 
+// Register adds a trigger to the built-in store. The trigger is invoked when
+// documents are written through the storage layer. The caller must hold a
+// transaction.
+func (s *Storage) Register(txn Transaction, id string, config TriggerConfig) error {
+	return s.builtin.Register(id, config)
+}
+
+// Unregister removes a trigger from the built-in store. The caller must hold a
+// transaction.
+func (s *Storage) Unregister(txn Transaction, id string) {
+	s.builtin.Unregister(id)
+}
+
 // Mount adds a store into the storage layer at the given path. If the path
 // conflicts with an existing mount, an error is returned.
 func (s *Storage) Mount(backend Store, path Path) error {
@@ -226,6 +280,17 @@ func (s *Storage) Read(ctx context.Context, txn Transaction, path Path) (interfa
 	return doc, nil
 }
 
+// ReadBuiltin returns the value from the built-in store. Unlike Read, documents
+// from mounted stores are not included in the result.
+func (s *Storage) ReadBuiltin(ctx context.Context, txn Transaction, path Path) (interface{}, error) {
+
+	if err := s.lazyActivate(ctx, s.builtin, txn, nil); err != nil {
+		return nil, err
+	}
+
+	return s.builtin.Read(ctx, txn, path)
+}
+
 // Write updates a value in storage.
 func (s *Storage) Write(ctx context.Context, txn Transaction, op PatchOp, path Path, value interface{}) error {
 
@@ -242,13 +307,30 @@ func (s *Storage) NewTransaction(ctx context.Context) (Transaction, error) {
 }
 
 // NewTransactionWithParams returns a new Transaction.
+//
+// Transactions are serialized: a transaction blocks other transactions from
+// starting until it is closed. As a result, reads performed within a
+// transaction observe a consistent snapshot of storage that is not affected by
+// concurrent writes. If the transaction cannot be started, the caller must not
+// call Close.
+//
+// If the storage layer has been configured with a transaction limit and the
+// limit has been reached, the call waits up to the configured timeout before
+// failing with a TransactionLimitErr.
 func (s *Storage) NewTransactionWithParams(ctx context.Context, params TransactionParams) (Transaction, error) {
 
+	if err := s.acquireSlot(ctx); err != nil {
+		return nil, err
+	}
+
 	s.mtx.Lock()
 	s.txn++
 	txn := s.txn
 
 	if err := s.notifyStoresBegin(ctx, txn, params.Paths); err != nil {
+		s.notifyStoresClose(ctx, txn)
+		s.mtx.Unlock()
+		s.releaseSlot()
 		return nil, err
 	}
 
@@ -259,6 +341,42 @@ func (s *Storage) NewTransactionWithParams(ctx context.Context, params Transacti
 func (s *Storage) Close(ctx context.Context, txn Transaction) {
 	s.notifyStoresClose(ctx, txn)
 	s.mtx.Unlock()
+	s.releaseSlot()
+}
+
+func (s *Storage) acquireSlot(ctx context.Context) error {
+
+	if s.slots == nil {
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if s.timeout <= 0 {
+		return transactionLimitError(cap(s.slots))
+	}
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return transactionLimitError(cap(s.slots))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Storage) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
 }
 
 // BuildIndex causes the storage layer to create an index for the given
@@ -5,9 +5,11 @@
 package storage
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"context"
 
@@ -70,6 +72,41 @@ func TestStorageReadPlugin(t *testing.T) {
 
 }
 
+func TestStorageReadBuiltin(t *testing.T) {
+
+	ctx := context.Background()
+
+	mem1 := NewDataStoreFromReader(strings.NewReader(`{"foo": {"bar": 1}}`))
+	mem2 := NewDataStoreFromReader(strings.NewReader(`{"corge": 2}`))
+
+	store := New(Config{
+		Builtin: mem1,
+	})
+	if err := store.Mount(mem2, MustParsePath("/foo/qux")); err != nil {
+		t.Fatalf("Unexpected mount error: %v", err)
+	}
+
+	txn, err := store.NewTransaction(ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	defer store.Close(ctx, txn)
+
+	result, err := store.ReadBuiltin(ctx, txn, MustParsePath("/foo"))
+	expected := loadExpectedResult(`{"bar": 1}`)
+
+	if err != nil {
+		t.Fatalf("Unexpected read error: %v", err)
+	} else if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Expected %v from built-in store but got: %v", expected, result)
+	}
+
+	if _, err := store.ReadBuiltin(ctx, txn, MustParsePath("/foo/qux/corge")); !IsNotFound(err) {
+		t.Fatalf("Expected not found error for mounted document but got: %v", err)
+	}
+}
+
 func TestStorageIndexingBasicUpdate(t *testing.T) {
 
 	refA := ast.MustParseRef("data.a[i]")
@@ -82,6 +119,38 @@ func TestStorageIndexingBasicUpdate(t *testing.T) {
 	}
 }
 
+func TestStorageTriggers(t *testing.T) {
+
+	store := New(InMemoryConfig())
+	ctx := context.Background()
+	txn := NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	var paths []Path
+
+	err := store.Register(txn, "test", TriggerConfig{
+		After: func(ctx context.Context, txn Transaction, op PatchOp, path Path, value interface{}) error {
+			paths = append(paths, path)
+			return nil
+		},
+	})
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	store.Write(ctx, txn, AddOp, MustParsePath("/a"), map[string]interface{}{})
+	store.Write(ctx, txn, AddOp, MustParsePath("/a/b"), 1)
+	store.Unregister(txn, "test")
+	store.Write(ctx, txn, AddOp, MustParsePath("/a/c"), 2)
+
+	expected := []Path{{"a"}, {"a", "b"}}
+
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Expected trigger paths %v but got: %v", expected, paths)
+	}
+}
+
 func TestStorageTransactionManagement(t *testing.T) {
 
 	store := New(Config{
@@ -122,6 +191,140 @@ func TestStorageTransactionManagement(t *testing.T) {
 
 }
 
+func TestStorageTransactionIsolation(t *testing.T) {
+
+	store := New(Config{
+		Builtin: NewDataStoreFromReader(strings.NewReader(`{"x": "a"}`)),
+	})
+
+	ctx := context.Background()
+	path := MustParsePath("/x")
+
+	txn, err := store.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	done := make(chan error)
+
+	go func() {
+		txn, err := store.NewTransaction(ctx)
+		if err != nil {
+			done <- err
+			return
+		}
+		defer store.Close(ctx, txn)
+		done <- store.Write(ctx, txn, ReplaceOp, path, "b")
+	}()
+
+	// The concurrent write must not be applied while the transaction is open.
+	select {
+	case err := <-done:
+		t.Fatalf("Expected write to block until transaction closed but got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		if v, err := store.Read(ctx, txn, path); err != nil || v != "a" {
+			t.Fatalf("Expected consistent read of original value but got: %v (err: %v)", v, err)
+		}
+	}
+
+	store.Close(ctx, txn)
+
+	if err := <-done; err != nil {
+		t.Fatalf("Unexpected write error: %v", err)
+	}
+
+	txn = NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	if v, err := store.Read(ctx, txn, path); err != nil || v != "b" {
+		t.Fatalf("Expected updated value but got: %v (err: %v)", v, err)
+	}
+}
+
+func TestStorageTransactionBeginError(t *testing.T) {
+
+	store := New(InMemoryConfig())
+	ctx := context.Background()
+
+	if err := store.Mount(beginErrorStore{}, MustParsePath("/foo")); err != nil {
+		t.Fatalf("Unexpected mount error: %v", err)
+	}
+
+	params := NewTransactionParams().WithPaths([]Path{Path{"foo"}})
+	if _, err := store.NewTransactionWithParams(ctx, params); err == nil {
+		t.Fatalf("Expected begin error")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		txn := NewTransactionOrDie(ctx, store)
+		store.Close(ctx, txn)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected transaction lock to be released after begin error")
+	}
+}
+
+func TestStorageTransactionLimit(t *testing.T) {
+
+	ctx := context.Background()
+	store := New(InMemoryConfig().WithMaxTransactions(1, 0))
+
+	txn, err := store.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := store.NewTransaction(ctx); !IsTransactionLimit(err) {
+		t.Fatalf("Expected transaction limit error but got: %v", err)
+	}
+
+	store.Close(ctx, txn)
+
+	txn, err = store.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error after close: %v", err)
+	}
+
+	store.Close(ctx, txn)
+
+	// Transactions wait up to the timeout for the limit to free up.
+	store = New(InMemoryConfig().WithMaxTransactions(1, time.Second))
+	txn = NewTransactionOrDie(ctx, store)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		store.Close(ctx, txn)
+	}()
+
+	txn, err = store.NewTransaction(ctx)
+	if err != nil {
+		t.Fatalf("Expected transaction to start after waiting but got: %v", err)
+	}
+
+	store.Close(ctx, txn)
+}
+
+type beginErrorStore struct {
+	mockStore
+}
+
+func (beginErrorStore) ID() string {
+	return "begin-error-store"
+}
+
+func (beginErrorStore) Begin(ctx context.Context, txn Transaction, params TransactionParams) error {
+	return fmt.Errorf("begin failed")
+}
+
 type mockStore struct {
 	WritesNotSupported
 	TriggersNotSupported
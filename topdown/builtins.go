@@ -24,6 +24,27 @@ func RegisterBuiltinFunc(name ast.Var, fun BuiltinFunc) {
 
 var builtinFunctions map[ast.Var]BuiltinFunc
 
+// evalBuiltinOverride evaluates the expression using the canned value instead
+// of the built-in function. If the built-in function has outputs, the value is
+// unified with the first output. Otherwise, the expression is true if the value
+// is true.
+func evalBuiltinOverride(t *Topdown, expr *ast.Expr, value ast.Value, iter Iterator) error {
+
+	ops := expr.Terms.([]*ast.Term)
+	bi := ast.BuiltinMap[ops[0].Value.(ast.Var)]
+
+	if bi == nil || len(bi.TargetPos) == 0 {
+		if value.Equal(ast.Boolean(true)) {
+			return iter(t)
+		}
+		return nil
+	}
+
+	undo, err := evalEqUnify(t, value, ops[bi.TargetPos[0]+1].Value, nil, iter)
+	t.Unbind(undo)
+	return err
+}
+
 var defaultBuiltinFuncs = map[ast.Var]BuiltinFunc{
 	ast.Equality.Name:      evalEq,
 	ast.GreaterThan.Name:   evalIneq(compareGreaterThan),
@@ -52,6 +73,7 @@ var defaultBuiltinFuncs = map[ast.Var]BuiltinFunc{
 	ast.EndsWith.Name:      evalEndsWith,
 	ast.Upper.Name:         evalUpper,
 	ast.Lower.Name:         evalLower,
+	ast.Trace.Name:         evalTrace,
 }
 
 func init() {
@@ -0,0 +1,33 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"context"
+	"fmt"
+)
+
+// IsCancelErr returns true if the error indicates evaluation was stopped
+// because the context was cancelled or its deadline expired.
+func IsCancelErr(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == CancelErr
+}
+
+// IsDeadlineErr returns true if the error indicates evaluation was stopped
+// because the context's deadline expired. Evaluation stopped by cancelling the
+// context is not a deadline error.
+func IsDeadlineErr(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == CancelErr && e.deadline
+}
+
+func cancelErr(err error) error {
+	return &Error{
+		Code:     CancelErr,
+		Message:  fmt.Sprintf("evaluation cancelled: %v", err),
+		deadline: err == context.DeadlineExceeded,
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestCancel(t *testing.T) {
+
+	compiler := compileModules([]string{`
+		package ex
+		p :- q
+		q :- true
+	`})
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	params := NewQueryParams(cancelled, compiler, store, txn, nil, ast.MustParseRef("data.ex.p"))
+
+	if _, err := Query(params); !IsCancelErr(err) || IsDeadlineErr(err) {
+		t.Fatalf("Expected cancel error but got: %v", err)
+	}
+
+	expired, cancel := context.WithDeadline(ctx, time.Now())
+	defer cancel()
+
+	params = NewQueryParams(expired, compiler, store, txn, nil, ast.MustParseRef("data.ex.p"))
+
+	if _, err := Query(params); !IsCancelErr(err) || !IsDeadlineErr(err) {
+		t.Fatalf("Expected deadline error but got: %v", err)
+	}
+
+	params = NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef("data.ex.p"))
+
+	qrs, err := Query(params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if qrs.Undefined() {
+		t.Fatalf("Expected result but got undefined")
+	}
+}
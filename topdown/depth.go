@@ -0,0 +1,21 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import "fmt"
+
+// IsDepthLimitErr returns true if the error indicates evaluation was stopped
+// because the depth of nested queries exceeded the depth limit.
+func IsDepthLimitErr(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == DepthLimitErr
+}
+
+func depthLimitErr(limit int) error {
+	return &Error{
+		Code:    DepthLimitErr,
+		Message: fmt.Sprintf("evaluation exceeded depth limit of %d nested queries: check for deeply nested rules or comprehensions", limit),
+	}
+}
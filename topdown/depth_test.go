@@ -0,0 +1,58 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestDepthLimit(t *testing.T) {
+
+	compiler := compileModules([]string{`
+		package ex
+		p :- q
+		q :- r
+		r :- true
+	`})
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	tests := []struct {
+		note    string
+		limit   int
+		wantErr bool
+	}{
+		{"unlimited", 0, false},
+		{"sufficient", 3, false},
+		{"exceeded", 2, true},
+	}
+
+	for _, tc := range tests {
+		params := NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef("data.ex.p"))
+		params.DepthLimit = tc.limit
+
+		qrs, err := Query(params)
+
+		if tc.wantErr {
+			if !IsDepthLimitErr(err) {
+				t.Errorf("%v: Expected depth limit error but got: %v", tc.note, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%v: Unexpected error: %v", tc.note, err)
+		} else if qrs.Undefined() {
+			t.Errorf("%v: Expected result but got undefined", tc.note)
+		}
+	}
+}
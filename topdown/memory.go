@@ -0,0 +1,104 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"fmt"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// MemoryBudget tracks an approximation of the memory allocated while
+// evaluating a query. Values are charged against the budget as they are
+// accumulated into comprehensions and virtual documents. When the limit is
+// exceeded, evaluation stops with a MemoryLimitErr.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+}
+
+// NewMemoryBudget returns a new MemoryBudget that allows approximately limit
+// bytes to be allocated.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Limit returns the number of bytes allowed by the budget.
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit
+}
+
+// Used returns the approximate number of bytes charged against the budget.
+func (b *MemoryBudget) Used() int64 {
+	return b.used
+}
+
+// charge adds the approximate size of v to the amount of memory used. If the
+// budget is nil, this function does nothing.
+func (b *MemoryBudget) charge(v ast.Value) error {
+	if b == nil {
+		return nil
+	}
+	b.used += approxSize(v)
+	if b.used > b.limit {
+		return memoryLimitErr(b.limit)
+	}
+	return nil
+}
+
+// IsMemoryLimitErr returns true if the error indicates evaluation was stopped
+// because the memory budget was exceeded.
+func IsMemoryLimitErr(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == MemoryLimitErr
+}
+
+func memoryLimitErr(limit int64) error {
+	return &Error{
+		Code:    MemoryLimitErr,
+		Message: fmt.Sprintf("evaluation exceeded memory limit of %d bytes", limit),
+	}
+}
+
+// approxSize returns a rough estimate of the number of bytes used to represent
+// v. The estimate does not need to be exact; it only needs to grow with the
+// size of the value.
+func approxSize(v ast.Value) int64 {
+	const word = 8
+	switch v := v.(type) {
+	case ast.String:
+		return 2*word + int64(len(v))
+	case ast.Var:
+		return 2*word + int64(len(v))
+	case ast.Number:
+		return 2*word + int64(len(v))
+	case ast.Array:
+		size := int64(3 * word)
+		for _, x := range v {
+			size += word + approxSize(x.Value)
+		}
+		return size
+	case ast.Ref:
+		size := int64(3 * word)
+		for _, x := range v {
+			size += word + approxSize(x.Value)
+		}
+		return size
+	case ast.Object:
+		size := int64(3 * word)
+		for _, item := range v {
+			size += 2*word + approxSize(item[0].Value) + approxSize(item[1].Value)
+		}
+		return size
+	case *ast.Set:
+		size := int64(3 * word)
+		for _, x := range *v {
+			size += word + approxSize(x.Value)
+		}
+		return size
+	default:
+		return 2 * word
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+func TestMemoryBudget(t *testing.T) {
+
+	small := ast.MustParseTerm(`"a"`).Value
+	large := ast.MustParseTerm(`{"a": [1, 2, 3], "b": {"c": "deadbeef"}}`).Value
+
+	if approxSize(large) <= approxSize(small) {
+		t.Fatalf("Expected size of %v to exceed size of %v", large, small)
+	}
+
+	budget := NewMemoryBudget(approxSize(large))
+
+	if err := budget.charge(large); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if budget.Used() != budget.Limit() {
+		t.Fatalf("Expected used to equal limit but got: %v", budget.Used())
+	}
+
+	err := budget.charge(small)
+	if !IsMemoryLimitErr(err) {
+		t.Fatalf("Expected memory limit error but got: %v", err)
+	}
+
+	var none *MemoryBudget
+	if err := none.charge(large); err != nil {
+		t.Fatalf("Expected nil budget to be unlimited but got: %v", err)
+	}
+}
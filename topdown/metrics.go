@@ -0,0 +1,30 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+// Counters records the storage operations performed while evaluating a query.
+// StoreReads counts reads of base documents and index lookups. StoreWrites
+// counts indices built in the storage layer during evaluation.
+type Counters struct {
+	StoreReads  uint64
+	StoreWrites uint64
+}
+
+// NewCounters returns a new Counters object.
+func NewCounters() *Counters {
+	return &Counters{}
+}
+
+func (c *Counters) incrStoreReads() {
+	if c != nil {
+		c.StoreReads++
+	}
+}
+
+func (c *Counters) incrStoreWrites() {
+	if c != nil {
+		c.StoreWrites++
+	}
+}
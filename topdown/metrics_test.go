@@ -0,0 +1,25 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+
+	counters := NewCounters()
+	counters.incrStoreReads()
+	counters.incrStoreReads()
+	counters.incrStoreWrites()
+
+	if counters.StoreReads != 2 || counters.StoreWrites != 1 {
+		t.Fatalf("Expected 2 reads and 1 write but got: %+v", *counters)
+	}
+
+	var none *Counters
+	none.incrStoreReads()
+	none.incrStoreWrites()
+}
@@ -0,0 +1,574 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// PartialEval partially evaluates the query of t. References prefixed by one
+// of the unknowns are not evaluated. Instead, the expressions that contain
+// them are saved and returned as residual queries with the values of the
+// remaining variables plugged in. Rules that depend on the unknowns are inlined
+// into the residual queries.
+//
+// The query is true for some value of the unknowns if any of the residual
+// queries is true for that value. If no residual queries are returned, the
+// query is undefined regardless of the unknowns. If an empty residual query is
+// returned, the query is true regardless of the unknowns.
+//
+// The unknowns must refer to the request document or to base documents, e.g.,
+// "data.users", so that the residual queries can be evaluated without OPA.
+// Rules that depend on the unknowns cannot be referred to by negated
+// expressions or comprehensions. If the unknowns or the query do not satisfy
+// these restrictions, a PartialEvalErr is returned.
+func PartialEval(t *Topdown, unknowns []ast.Ref) ([]ast.Body, error) {
+
+	for _, u := range unknowns {
+		if err := checkUnknown(t.Compiler, u); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &partialEvaluator{
+		compiler: t.Compiler,
+		unknowns: unknowns,
+		rules:    map[*ast.Rule]bool{},
+		exclude:  t.Query.Vars(ast.VarVisitorParams{}),
+	}
+
+	bodies, err := p.inlineBody(t.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ast.Body
+	seen := map[string]struct{}{}
+
+	for _, body := range bodies {
+
+		known, saved := p.split(body)
+		child := t.Child(known, ast.NewValueMap())
+
+		err := Eval(child, func(child *Topdown) error {
+			residual, err := p.plug(saved, child)
+			if err != nil {
+				return err
+			}
+			key := residual.String()
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				result = append(result, residual)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// IsPartialEvalErr returns true if the error indicates the query could not be
+// partially evaluated.
+func IsPartialEvalErr(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == PartialEvalErr
+}
+
+func partialEvalErr(expr *ast.Expr, msg string) error {
+	e := &Error{
+		Code:    PartialEvalErr,
+		Message: fmt.Sprintf("%v: %v", expr, msg),
+	}
+	if expr.Location != nil {
+		e.Message = expr.Location.Format("%v", e.Message)
+	}
+	return e
+}
+
+// checkUnknown returns an error if the unknown does not refer to the request
+// document or to a base document. References to virtual documents cannot be
+// unknown because the residual queries would refer to rules.
+func checkUnknown(compiler *ast.Compiler, u ast.Ref) error {
+
+	if len(u) == 0 || !(u[0].Equal(ast.DefaultRootDocument) || u[0].Equal(ast.RequestRootDocument)) {
+		return &Error{
+			Code:    PartialEvalErr,
+			Message: fmt.Sprintf("unknown %v must refer to %v or %v", u, ast.DefaultRootDocument, ast.RequestRootDocument),
+		}
+	}
+
+	if u[0].Equal(ast.DefaultRootDocument) {
+		prefix := u.GroundPrefix()
+		if len(compiler.GetRulesForVirtualDocument(prefix)) > 0 || len(compiler.GetRulesWithPrefix(prefix)) > 0 {
+			return &Error{
+				Code:    PartialEvalErr,
+				Message: fmt.Sprintf("unknown %v must not refer to virtual documents", u),
+			}
+		}
+	}
+
+	return nil
+}
+
+type partialEvaluator struct {
+	compiler *ast.Compiler
+	unknowns []ast.Ref
+
+	// rules caches whether rules depend on the unknowns.
+	rules map[*ast.Rule]bool
+
+	// exclude contains the variables that may not be generated.
+	exclude ast.VarSet
+	next    int
+}
+
+// isUnknown returns true if the reference may refer to a document that is
+// (or contains) one of the unknowns. Non-ground terms are assumed to match.
+func (p *partialEvaluator) isUnknown(ref ast.Ref) bool {
+	for _, u := range p.unknowns {
+		n := len(ref)
+		if len(u) < n {
+			n = len(u)
+		}
+		match := true
+		for i := 0; i < n && match; i++ {
+			if i == 0 || (ref[i].IsGround() && u[i].IsGround()) {
+				match = ref[i].Equal(u[i])
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// containsUnknowns returns true if x contains a reference to an unknown.
+func (p *partialEvaluator) containsUnknowns(x interface{}) bool {
+	found := false
+	ast.WalkRefs(x, func(ref ast.Ref) bool {
+		if p.isUnknown(ref) {
+			found = true
+		}
+		return found
+	})
+	return found
+}
+
+// dependsOnUnknowns returns true if the reference refers to rules that depend
+// on the unknowns.
+func (p *partialEvaluator) dependsOnUnknowns(ref ast.Ref) bool {
+
+	if !ref[0].Equal(ast.DefaultRootDocument) {
+		return false
+	}
+
+	rules := p.compiler.GetRulesForVirtualDocument(ref)
+	if len(rules) == 0 {
+		rules = p.compiler.GetRulesWithPrefix(ref.GroundPrefix())
+	}
+
+	for _, rule := range rules {
+		if p.ruleDependsOnUnknowns(rule) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *partialEvaluator) ruleDependsOnUnknowns(rule *ast.Rule) bool {
+
+	if result, ok := p.rules[rule]; ok {
+		return result
+	}
+
+	p.rules[rule] = false
+	result := false
+
+	ast.WalkRefs(rule, func(ref ast.Ref) bool {
+		if p.isUnknown(ref) || p.dependsOnUnknowns(ref) {
+			result = true
+		}
+		return result
+	})
+
+	p.rules[rule] = result
+	return result
+}
+
+// generate returns a new variable that does not appear in the query.
+func (p *partialEvaluator) generate() *ast.Term {
+	for {
+		v := ast.Var(fmt.Sprintf("__local%d__", p.next))
+		p.next++
+		if !p.exclude.Contains(v) {
+			return ast.NewTerm(v)
+		}
+	}
+}
+
+// inlineBody returns the bodies obtained by inlining the rules that depend on
+// the unknowns into body. The body is true if any of the returned bodies is
+// true.
+func (p *partialEvaluator) inlineBody(body ast.Body) ([]ast.Body, error) {
+
+	result := []ast.Body{{}}
+
+	for _, expr := range body {
+
+		alternatives, err := p.inlineExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []ast.Body
+
+		for _, prefix := range result {
+			for _, alt := range alternatives {
+				cpy := make(ast.Body, 0, len(prefix)+len(alt))
+				cpy = append(cpy, prefix...)
+				cpy = append(cpy, alt...)
+				next = append(next, cpy)
+			}
+		}
+
+		result = next
+	}
+
+	return result, nil
+}
+
+func (p *partialEvaluator) inlineExpr(expr *ast.Expr) ([]ast.Body, error) {
+
+	var err error
+
+	ast.WalkClosures(expr, func(x interface{}) bool {
+		ast.WalkRefs(x, func(ref ast.Ref) bool {
+			if err == nil && p.dependsOnUnknowns(ref) {
+				err = partialEvalErr(expr, "comprehensions cannot refer to rules that depend on unknowns")
+			}
+			return err != nil
+		})
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var target ast.Ref
+
+	ast.WalkRefs(expr, func(ref ast.Ref) bool {
+		if target == nil && p.dependsOnUnknowns(ref) {
+			target = ref
+		}
+		return target != nil
+	})
+
+	if target == nil {
+		return []ast.Body{{expr}}, nil
+	}
+
+	if expr.Negated {
+		return nil, partialEvalErr(expr, "negated expressions cannot refer to rules that depend on unknowns")
+	}
+
+	rules := p.compiler.GetRulesForVirtualDocument(target)
+	if len(rules) == 0 {
+		return nil, partialEvalErr(expr, fmt.Sprintf("%v refers to multiple rules that depend on unknowns", target))
+	}
+
+	n := len(target)
+	for i := 1; i <= len(target); i++ {
+		if len(p.compiler.GetRulesExact(target[:i])) > 0 {
+			n = i
+			break
+		}
+	}
+
+	suffix := target[n:]
+	var result []ast.Body
+
+	for _, rule := range rules {
+
+		body, key, value := p.rename(rule)
+		v := p.generate()
+		var replacement ast.Value = v.Value
+
+		switch rule.DocKind() {
+		case ast.CompleteDoc:
+			body = append(body, ast.Equality.Expr(v, value))
+			if len(suffix) > 0 {
+				replacement = append(ast.Ref{v}, suffix...)
+			}
+		case ast.PartialSetDoc:
+			if len(suffix) != 1 {
+				return nil, partialEvalErr(expr, fmt.Sprintf("%v must refer to a single element of the set", target))
+			}
+			body = append(body, ast.Equality.Expr(suffix[0], key))
+			replacement = ast.Boolean(true)
+		case ast.PartialObjectDoc:
+			if len(suffix) == 0 {
+				return nil, partialEvalErr(expr, fmt.Sprintf("%v must refer to a single value of the object", target))
+			}
+			body = append(body, ast.Equality.Expr(suffix[0], key), ast.Equality.Expr(v, value))
+			if len(suffix) > 1 {
+				replacement = append(ast.Ref{v}, suffix[1:]...)
+			}
+		}
+
+		x, err := ast.TransformRefs(expr.Copy(), func(ref ast.Ref) (ast.Value, error) {
+			if ref.Equal(target) {
+				return replacement, nil
+			}
+			return ref, nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		bodies, err := p.inlineBody(append(body, x.(*ast.Expr)))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, bodies...)
+	}
+
+	return result, nil
+}
+
+// rename returns a copy of the rule's body, key, and value with the rule's
+// variables replaced by new variables so that they do not conflict with the
+// variables of the query the rule is inlined into.
+func (p *partialEvaluator) rename(rule *ast.Rule) (ast.Body, *ast.Term, *ast.Term) {
+
+	vars := rule.Body.Vars(ast.VarVisitorParams{SkipBuiltinOperators: true})
+	vars.Update(rule.HeadVars())
+
+	mapping := varRenamer{}
+	for _, v := range sortedVars(vars) {
+		if !ast.ReservedVars.Contains(v) {
+			mapping[v] = p.generate().Value.(ast.Var)
+		}
+	}
+
+	cpy := rule.Copy()
+	body, _ := ast.Transform(mapping, cpy.Body)
+
+	for _, term := range []*ast.Term{cpy.Key, cpy.Value} {
+		if term != nil {
+			v, _ := ast.Transform(mapping, term)
+			term.Value = v.(ast.Value)
+		}
+	}
+
+	return body.(ast.Body), cpy.Key, cpy.Value
+}
+
+// varRenamer implements the ast.Transformer interface to replace variables.
+type varRenamer map[ast.Var]ast.Var
+
+func (r varRenamer) Transform(x interface{}) (interface{}, error) {
+	if v, ok := x.(ast.Var); ok {
+		if y, ok := r[v]; ok {
+			return y, nil
+		}
+	}
+	return x, nil
+}
+
+func sortedVars(vars ast.VarSet) []ast.Var {
+	sorted := make([]ast.Var, 0, len(vars))
+	for v := range vars {
+		sorted = append(sorted, v)
+	}
+	sort.Sort(varSlice(sorted))
+	return sorted
+}
+
+type varSlice []ast.Var
+
+func (s varSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s varSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s varSlice) Len() int           { return len(s) }
+
+// split returns the expressions in body that can be evaluated (in an order
+// that is safe) and the expressions that must be saved because they refer to
+// the unknowns or to variables that can only be bound by saved expressions.
+func (p *partialEvaluator) split(body ast.Body) (known, saved ast.Body) {
+
+	var candidates ast.Body
+
+	for _, expr := range body {
+		if !p.containsUnknowns(expr) {
+			candidates = append(candidates, expr)
+			continue
+		}
+		expr, hoisted := p.hoist(expr)
+		candidates = append(candidates, hoisted...)
+		saved = append(saved, expr)
+	}
+
+	// Variables that appear outside of closures must be bound before closures
+	// that refer to them are evaluated.
+	outer := candidates.Vars(ast.VarVisitorParams{SkipClosures: true, SkipBuiltinOperators: true})
+	outer.Update(saved.Vars(ast.VarVisitorParams{SkipClosures: true, SkipBuiltinOperators: true}))
+
+	safe := ast.ReservedVars.Copy()
+	accepted := map[*ast.Expr]bool{}
+
+	for {
+		n := len(known)
+
+		for _, expr := range candidates {
+			if accepted[expr] {
+				continue
+			}
+			vars := expr.Vars(ast.VarVisitorParams{SkipClosures: true, SkipBuiltinOperators: true})
+			vars.Update(expr.Vars(ast.VarVisitorParams{SkipBuiltinOperators: true}).Intersect(outer))
+			output := expr.OutputVars(safe)
+			if len(vars.Diff(safe).Diff(output)) == 0 {
+				accepted[expr] = true
+				known = append(known, expr.Copy())
+				safe.Update(output)
+			}
+		}
+
+		if len(known) == n {
+			break
+		}
+	}
+
+	for i := range saved {
+		saved[i] = saved[i].Copy()
+	}
+
+	for _, expr := range candidates {
+		if !accepted[expr] {
+			saved = append(saved, expr.Copy())
+		}
+	}
+
+	setExprIndices(known)
+	setExprIndices(saved)
+
+	return known, saved
+}
+
+// hoist returns a copy of expr with the references that do not refer to the
+// unknowns replaced by new variables along with the expressions that bind
+// them, e.g., "data.a[_] = request.x" becomes "__local0__ = request.x" and
+// "__local0__ = data.a[_]". This allows the references to be evaluated.
+// Negated expressions and closures are not modified.
+func (p *partialEvaluator) hoist(expr *ast.Expr) (*ast.Expr, ast.Body) {
+
+	if expr.Negated {
+		return expr, nil
+	}
+
+	var hoisted ast.Body
+	var visit func(*ast.Term) *ast.Term
+
+	visit = func(term *ast.Term) *ast.Term {
+		switch v := term.Value.(type) {
+		case ast.Ref:
+			if ast.ReservedVars.Contains(v[0].Value.(ast.Var)) && !p.containsUnknowns(v) {
+				x := p.generate()
+				hoisted = append(hoisted, ast.Equality.Expr(x, term))
+				return x
+			}
+			cpy := make(ast.Ref, len(v))
+			cpy[0] = v[0]
+			for i := 1; i < len(v); i++ {
+				cpy[i] = visit(v[i])
+			}
+			return ast.NewTerm(cpy)
+		case ast.Array:
+			cpy := make(ast.Array, len(v))
+			for i := range v {
+				cpy[i] = visit(v[i])
+			}
+			return ast.NewTerm(cpy)
+		case ast.Object:
+			cpy := make(ast.Object, len(v))
+			for i := range v {
+				cpy[i] = [2]*ast.Term{visit(v[i][0]), visit(v[i][1])}
+			}
+			return ast.NewTerm(cpy)
+		}
+		return term
+	}
+
+	cpy := *expr
+
+	switch ts := expr.Terms.(type) {
+	case []*ast.Term:
+		terms := make([]*ast.Term, len(ts))
+		terms[0] = ts[0]
+		for i := 1; i < len(ts); i++ {
+			terms[i] = visit(ts[i])
+		}
+		cpy.Terms = terms
+	case *ast.Term:
+		cpy.Terms = visit(ts)
+	}
+
+	return &cpy, hoisted
+}
+
+// plug returns the saved expressions with the bindings from t applied. If
+// bound variables cannot be replaced (e.g., because they appear in closures),
+// expressions that bind them are added to the result. Bindings to base
+// documents are resolved so that the result does not depend on storage.
+func (p *partialEvaluator) plug(saved ast.Body, t *Topdown) (ast.Body, error) {
+
+	bindings := ast.NewValueMap()
+
+	for _, v := range sortedVars(saved.Vars(ast.VarVisitorParams{SkipBuiltinOperators: true})) {
+		b := t.Binding(v)
+		if b == nil {
+			continue
+		}
+		resolved, err := ResolveRefs(PlugValue(b, t.Binding), t)
+		if err != nil {
+			return nil, err
+		}
+		bindings.Put(v, resolved)
+	}
+
+	plugged := make(ast.Body, len(saved))
+	for i := range saved {
+		plugged[i] = PlugExpr(saved[i], bindings.Get)
+	}
+
+	var residual ast.Body
+
+	for _, v := range sortedVars(plugged.Vars(ast.VarVisitorParams{SkipBuiltinOperators: true})) {
+		if b := bindings.Get(v); b != nil {
+			residual = append(residual, ast.Equality.Expr(ast.NewTerm(v), ast.NewTerm(b)))
+		}
+	}
+
+	residual = append(residual, plugged...)
+	setExprIndices(residual)
+
+	return residual, nil
+}
+
+func setExprIndices(body ast.Body) {
+	for i := range body {
+		body[i].Index = i
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package topdown
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/storage"
+)
+
+func TestPartialEval(t *testing.T) {
+
+	compiler := compileModules([]string{`
+		package ex
+		import request.user
+		allow :- user = "alice"
+		allow :- data.admins[_] = user
+		deny :- not allow
+		set[x] :- x = user.roles[_]
+		known :- data.admins[_] = "bob"
+	`})
+
+	tests := []struct {
+		note     string
+		query    string
+		unknowns []string
+		expected []string
+		err      string
+	}{
+		{"no unknowns", `data.ex.known`, []string{"request.user"}, []string{""}, ""},
+		{"undefined", `data.admins[_] = "carol"`, []string{"request.user"}, nil, ""},
+		{"save", `request.user = "alice"`, []string{"request.user"}, []string{`eq(request.user, "alice")`}, ""},
+		{"hoist", `data.admins[_] = request.user`, []string{"request.user"}, []string{
+			`eq("bob", request.user)`,
+			`eq("eve", request.user)`,
+		}, ""},
+		{"inline", `data.ex.allow`, []string{"request.user"}, []string{
+			`eq(request.user, "alice")`,
+			`eq("bob", request.user)`,
+			`eq("eve", request.user)`,
+		}, ""},
+		{"inline set", `data.ex.set["dev"]`, []string{"request.user"}, []string{
+			`eq("dev", request.user.roles[__local0__])`,
+		}, ""},
+		{"base document", `data.ex.allow`, []string{"data.admins"}, []string{
+			`eq(data.admins[__local1__], "carol")`,
+		}, ""},
+		{"base document and request", `data.ex.allow`, []string{"data.admins", "request.user"}, []string{
+			`eq(request.user, "alice")`,
+			`eq(data.admins[__local1__], request.user)`,
+		}, ""},
+		{"base document element", `data.admins[0] = x`, []string{"data.admins"}, []string{`eq(data.admins[0], x)`}, ""},
+		{"base document unrelated", `data.ex.known`, []string{"data.users"}, []string{""}, ""},
+		{"unknown virtual document", `data.ex.allow`, []string{"data.ex"}, nil, "unknown data.ex must not refer to virtual documents"},
+		{"unknown rule", `data.ex.allow`, []string{"data.ex.allow"}, nil, "unknown data.ex.allow must not refer to virtual documents"},
+		{"unknown root", `data.ex.allow`, []string{"x.y"}, nil, "unknown x.y must refer to data or request"},
+		{"negation", `data.ex.deny`, []string{"request.user"}, nil, "negated expressions cannot refer to rules that depend on unknowns"},
+		{"comprehension", `x = [y | data.ex.allow, y = 1]`, []string{"request.user"}, nil, "comprehensions cannot refer to rules that depend on unknowns"},
+	}
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryWithJSONConfig(map[string]interface{}{
+		"admins": []interface{}{"bob", "eve"},
+	}))
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	for _, tc := range tests {
+
+		var unknowns []ast.Ref
+		for _, u := range tc.unknowns {
+			unknowns = append(unknowns, ast.MustParseRef(u))
+		}
+
+		query := ast.MustParseBody(tc.query)
+		top := New(ctx, query, compiler, store, txn)
+		top.Request = ast.MustParseTerm(`{"user": "carol"}`).Value
+		result, err := PartialEval(top, unknowns)
+
+		if tc.err != "" {
+			if !IsPartialEvalErr(err) || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%v: expected error containing %q but got: %v", tc.note, tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%v: unexpected error: %v", tc.note, err)
+			continue
+		}
+
+		var strs []string
+		for _, body := range result {
+			strs = append(strs, body.String())
+		}
+
+		if !reflect.DeepEqual(strs, tc.expected) {
+			t.Errorf("%v: expected %v but got %v", tc.note, tc.expected, strs)
+		}
+	}
+}
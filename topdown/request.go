@@ -12,7 +12,9 @@ import (
 )
 
 // MakeRequest returns a request value for the given key/value pairs. Assumes
-// keys are valid import paths.
+// keys are valid import paths. Path elements may be strings (which refer to
+// object keys) or non-negative integers (which refer to array indices).
+// Intermediate arrays are padded with nulls.
 func MakeRequest(pairs [][2]*ast.Term) (ast.Value, error) {
 
 	// Fast-path for the root case.
@@ -20,7 +22,7 @@ func MakeRequest(pairs [][2]*ast.Term) (ast.Value, error) {
 		return pairs[0][1].Value, nil
 	}
 
-	var request ast.Object
+	var request ast.Value
 
 	for _, pair := range pairs {
 
@@ -28,32 +30,114 @@ func MakeRequest(pairs [][2]*ast.Term) (ast.Value, error) {
 			return nil, fmt.Errorf("conflicting request values: check request parameters")
 		}
 
-		if err := ast.IsValidImportPath(pair[0].Value); err != nil {
+		if err := isValidRequestPath(pair[0].Value); err != nil {
 			return nil, errors.Wrapf(err, "invalid request path")
 		}
 
 		k := pair[0].Value.(ast.Ref)
-		obj := makeTree(k[1:], pair[1])
 		var ok bool
-		request, ok = request.Merge(obj)
+		request, ok = setRequestValue(request, k[1:], pair[1])
 
 		if !ok {
 			return nil, fmt.Errorf("conflicting request value %v: check request parameters", k)
 		}
 	}
 
+	if request == nil {
+		return ast.Object{}, nil
+	}
+
 	return request, nil
 }
 
-// makeTree returns an object that represents a document where the value v is the
-// leaf and elements in k represent intermediate objects.
-func makeTree(k ast.Ref, v *ast.Term) ast.Object {
-	var obj ast.Object
-	for i := len(k) - 1; i >= 1; i-- {
-		obj = ast.Object{ast.Item(k[i], v)}
-		v = &ast.Term{Value: obj}
-		obj = ast.Object{}
-	}
-	obj = ast.Object{ast.Item(k[0], v)}
-	return obj
+// isValidRequestPath returns an error if v is not a valid import path or if v
+// contains elements that are neither strings nor non-negative integers.
+func isValidRequestPath(v ast.Value) error {
+	ref, ok := v.(ast.Ref)
+	if !ok || len(ref) == 0 {
+		return ast.IsValidImportPath(v)
+	}
+	if err := ast.IsValidImportPath(ref[0].Value); err != nil {
+		return fmt.Errorf("invalid path %v: path must begin with request or data", v)
+	}
+	for _, e := range ref[1:] {
+		switch x := e.Value.(type) {
+		case ast.String:
+			continue
+		case ast.Number:
+			if i, ok := x.Int(); ok && i >= 0 {
+				continue
+			}
+		}
+		return fmt.Errorf("invalid path %v: path elements must be %vs or non-negative integers", v, ast.StringTypeName)
+	}
+	return nil
+}
+
+// setRequestValue returns the document obtained by setting the value at path
+// in doc to v. If doc already contains a value at the path, objects are merged
+// and other values conflict. Null array elements are treated as padding and
+// may be replaced. The second return value is false if there is a conflict.
+func setRequestValue(doc ast.Value, path ast.Ref, v *ast.Term) (ast.Value, bool) {
+
+	if len(path) == 0 {
+		if doc == nil {
+			return v.Value, true
+		}
+		a, ok1 := doc.(ast.Object)
+		b, ok2 := v.Value.(ast.Object)
+		if !ok1 || !ok2 {
+			return nil, false
+		}
+		return a.Merge(b)
+	}
+
+	switch path[0].Value.(type) {
+	case ast.String:
+		var obj ast.Object
+		if doc != nil {
+			var ok bool
+			if obj, ok = doc.(ast.Object); !ok {
+				return nil, false
+			}
+		}
+		for i := range obj {
+			if obj[i][0].Equal(path[0]) {
+				child, ok := setRequestValue(obj[i][1].Value, path[1:], v)
+				if !ok {
+					return nil, false
+				}
+				cpy := append(ast.Object{}, obj...)
+				cpy[i] = ast.Item(path[0], ast.NewTerm(child))
+				return cpy, true
+			}
+		}
+		child, _ := setRequestValue(nil, path[1:], v)
+		return append(append(ast.Object{}, obj...), ast.Item(path[0], ast.NewTerm(child))), true
+	case ast.Number:
+		idx, _ := path[0].Value.(ast.Number).Int()
+		var arr ast.Array
+		if doc != nil {
+			var ok bool
+			if arr, ok = doc.(ast.Array); !ok {
+				return nil, false
+			}
+		}
+		cpy := append(ast.Array{}, arr...)
+		for len(cpy) <= idx {
+			cpy = append(cpy, ast.NullTerm())
+		}
+		var curr ast.Value
+		if _, ok := cpy[idx].Value.(ast.Null); !ok {
+			curr = cpy[idx].Value
+		}
+		child, ok := setRequestValue(curr, path[1:], v)
+		if !ok {
+			return nil, false
+		}
+		cpy[idx] = ast.NewTerm(child)
+		return cpy, true
+	}
+
+	return nil, false
 }
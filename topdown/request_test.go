@@ -42,9 +42,25 @@ func TestMakeRequest(t *testing.T) {
 		{"conflicting vars-4",
 			[][2]string{{`a.b`, `"c"`}, {`a`, `100`}},
 			fmt.Errorf("conflicting request value request.a: check request parameters")},
+		{"array index", [][2]string{{`a[0]`, `1`}}, `{"a": [1]}`},
+		{"array index padding", [][2]string{{`a[2]`, `1`}}, `{"a": [null, null, 1]}`},
+		{"array index mixed",
+			[][2]string{{`a.b[2].c`, `1`}, {`a.b[0]`, `"x"`}, {`a.b[2].d`, `2`}},
+			`{"a": {"b": ["x", null, {"c": 1, "d": 2}]}}`},
+		{"array index existing", [][2]string{{`a`, `[1]`}, {`a[2]`, `3`}}, `{"a": [1, null, 3]}`},
+		{"array index conflict",
+			[][2]string{{`a[0]`, `1`}, {`a[0]`, `2`}},
+			fmt.Errorf("conflicting request value request.a[0]: check request parameters")},
+		{"array index conflict object",
+			[][2]string{{`a.b`, `1`}, {`a[0]`, `2`}},
+			fmt.Errorf("conflicting request value request.a[0]: check request parameters")},
 		{"bad path",
-			[][2]string{{`a[1]`, `1`}},
-			fmt.Errorf("invalid request path: invalid path request.a[1]: path elements must be strings"),
+			[][2]string{{`a[-1]`, `1`}},
+			fmt.Errorf("invalid request path: invalid path request.a[-1]: path elements must be strings or non-negative integers"),
+		},
+		{"bad path var",
+			[][2]string{{`a[x]`, `1`}},
+			fmt.Errorf("invalid request path: invalid path request.a[x]: path elements must be strings or non-negative integers"),
 		},
 	}
 
@@ -27,11 +27,24 @@ type Topdown struct {
 	Store    *storage.Storage
 	Tracer   Tracer
 	Context  context.Context
+	Budget   *MemoryBudget
+	Counters *Counters
+
+	// BuiltinOverrides maps built-in function names to values that are used
+	// instead of calling the function, e.g., to stub functions in tests.
+	BuiltinOverrides map[ast.Var]ast.Value
+
+	// DepthLimit is the maximum depth of nested queries (e.g., rule bodies
+	// and comprehensions) that may be evaluated. If the limit is exceeded,
+	// evaluation stops with a DepthLimitErr. If the limit is zero, depth is
+	// not limited.
+	DepthLimit int
 
 	txn   storage.Transaction
 	cache *contextcache
 	qid   uint64
 	redos *redoStack
+	depth int
 }
 
 // ResetQueryIDs resets the query ID generator. This is only for test purposes.
@@ -126,6 +139,7 @@ func (t *Topdown) Child(query ast.Body, locals *ast.ValueMap) *Topdown {
 	cpy.Previous = t
 	cpy.Index = 0
 	cpy.qid = qidFactory.Next()
+	cpy.depth = t.depth + 1
 	return &cpy
 }
 
@@ -159,6 +173,8 @@ func (t *Topdown) Resolve(ref ast.Ref) (interface{}, error) {
 		return nil, err
 	}
 
+	t.Counters.incrStoreReads()
+
 	return t.Store.Read(t.Context, t.txn, path)
 }
 
@@ -208,6 +224,14 @@ func (t *Topdown) traceFail(node interface{}) {
 	}
 }
 
+func (t *Topdown) traceNote(node interface{}) {
+	if t.tracingEnabled() {
+		evt := t.makeEvent(NoteOp, node)
+		t.flushRedos(evt)
+		t.Tracer.Trace(t, evt)
+	}
+}
+
 func (t *Topdown) tracingEnabled() bool {
 	return t.Tracer != nil && t.Tracer.Enabled()
 }
@@ -298,6 +322,10 @@ func newContextCache() *contextcache {
 type Error struct {
 	Code    int
 	Message string
+
+	// deadline is true if evaluation was cancelled because the context's
+	// deadline expired.
+	deadline bool
 }
 
 const (
@@ -314,6 +342,22 @@ const (
 	// TypeErr indicates evaluation stopped because an expression was applied to
 	// a value of an inappropriate type.
 	TypeErr = iota
+
+	// MemoryLimitErr indicates evaluation stopped because the values
+	// accumulated during evaluation exceeded the memory budget.
+	MemoryLimitErr = iota
+
+	// DepthLimitErr indicates evaluation stopped because the depth of nested
+	// queries exceeded the depth limit.
+	DepthLimitErr = iota
+
+	// CancelErr indicates evaluation stopped because the context was
+	// cancelled or its deadline expired.
+	CancelErr = iota
+
+	// PartialEvalErr indicates the query could not be partially evaluated
+	// because it uses a construct that is not supported with unknowns.
+	PartialEvalErr = iota
 )
 
 func (e *Error) Error() string {
@@ -532,7 +576,24 @@ type QueryParams struct {
 	Transaction storage.Transaction
 	Request     ast.Value
 	Tracer      Tracer
+	Budget      *MemoryBudget
+	Counters    *Counters
 	Path        ast.Ref
+
+	// DepthLimit is the maximum depth of nested queries that may be evaluated.
+	DepthLimit int
+
+	// BuiltinOverrides maps built-in function names to values that are used
+	// instead of calling the function.
+	BuiltinOverrides map[ast.Var]ast.Value
+
+	// Types indicates whether query results should include type annotations.
+	Types bool
+
+	// Limit is the maximum number of results to return. If the limit is
+	// reached, evaluation stops. If the limit is zero, all results are
+	// returned.
+	Limit int
 }
 
 // NewQueryParams returns a new QueryParams.
@@ -552,6 +613,10 @@ func (q *QueryParams) NewTopdown(body ast.Body) *Topdown {
 	t := New(q.Context, body, q.Compiler, q.Store, q.Transaction)
 	t.Request = q.Request
 	t.Tracer = q.Tracer
+	t.Budget = q.Budget
+	t.Counters = q.Counters
+	t.DepthLimit = q.DepthLimit
+	t.BuiltinOverrides = q.BuiltinOverrides
 	return t
 }
 
@@ -559,6 +624,8 @@ func (q *QueryParams) NewTopdown(body ast.Body) *Topdown {
 type QueryResult struct {
 	Result   interface{}            // Result contains the document referred to by the params Path.
 	Bindings map[string]interface{} // Bindings contains values for variables in the params Request.
+	Trace    []*Event               // Trace contains the events emitted while producing the result if the params Tracer includes a BufferTracer.
+	Types    interface{}            // Types contains the type annotations for the Result if the params Types field is set. See ValueToTypes.
 }
 
 func (qr *QueryResult) String() string {
@@ -582,7 +649,20 @@ func (qrs *QueryResultSet) Add(qr *QueryResult) {
 // the params' Request field contains values that are non-ground (i.e., they
 // contain variables), then the result may contain multiple entries.
 func Query(params *QueryParams) (QueryResultSet, error) {
-	return queryN(params)
+	qrs := QueryResultSet{}
+	err := queryN(params, func(qr *QueryResult) error {
+		qrs.Add(qr)
+		return nil
+	})
+	return qrs, err
+}
+
+// QueryEach is like Query except that the iterator is called with each result
+// as it is produced instead of returning the results once evaluation has
+// finished. If the iterator returns an error, evaluation stops and the error is
+// returned.
+func QueryEach(params *QueryParams, iter func(*QueryResult) error) error {
+	return queryN(params, iter)
 }
 
 // queryOne returns a QueryResultSet containing the value of the document
@@ -593,11 +673,16 @@ func queryOne(params *QueryParams) (QueryResultSet, error) {
 	query := ast.NewBody(ast.Equality.Expr(ast.RefTerm(params.Path...), ast.Wildcard))
 	t := params.NewTopdown(query)
 	var result interface{} = struct{}{}
+	var types interface{}
 	var err error
 
 	err = Eval(t, func(t *Topdown) error {
 		val := PlugValue(ast.Wildcard.Value, t.Binding)
 		result, err = ValueToInterface(val, t)
+		if err != nil || !params.Types {
+			return err
+		}
+		types, err = ValueToTypes(val, t)
 		return err
 	})
 
@@ -609,22 +694,22 @@ func queryOne(params *QueryParams) (QueryResultSet, error) {
 		return nil, nil
 	}
 
-	return QueryResultSet{&QueryResult{result, nil}}, nil
+	return QueryResultSet{&QueryResult{Result: result, Types: types}}, nil
 }
 
-// queryN returns a QueryResultSet containing the values of the document
-// referred to by the params Path field. There may be zero or more values
-// depending on the values of the params' Request field.
+// queryN calls the iterator with the values of the document referred to by the
+// params Path field. There may be zero or more values depending on the values
+// of the params' Request field.
 //
 // For example, if the request refers to one or more undefined documents, the
 // set will be empty. On the other hand, if the request contain non-ground
 // references where there are multiple valid sets of bindings, the result set
 // may contain multiple values.
-func queryN(params *QueryParams) (QueryResultSet, error) {
+func queryN(params *QueryParams, iter func(*QueryResult) error) error {
 
-	qrs := QueryResultSet{}
+	n := 0
 	vars := ast.NewVarSet()
-	resolver := resolver{params.Context, params.Store, params.Transaction}
+	resolver := resolver{params.Context, params.Store, params.Transaction, params.Counters}
 
 	vis := ast.NewVarVisitor().WithParams(ast.VarVisitorParams{
 		SkipRefHead:  true,
@@ -636,6 +721,12 @@ func queryN(params *QueryParams) (QueryResultSet, error) {
 
 	err := evalRequest(params, func(root *Topdown) error {
 
+		buf := findBufferTracer(params.Tracer)
+		start := 0
+		if buf != nil {
+			start = len(*buf)
+		}
+
 		params.Request = PlugValue(root.Request, root.Binding)
 		result, err := queryOne(params)
 
@@ -643,6 +734,12 @@ func queryN(params *QueryParams) (QueryResultSet, error) {
 			return err
 		}
 
+		var trace []*Event
+		if buf != nil {
+			trace = make([]*Event, len(*buf)-start)
+			copy(trace, (*buf)[start:])
+		}
+
 		bindings := map[string]interface{}{}
 		for v := range vars {
 			binding, err := ValueToInterface(PlugValue(v, root.Binding), resolver)
@@ -652,13 +749,29 @@ func queryN(params *QueryParams) (QueryResultSet, error) {
 			bindings[v.String()] = binding
 		}
 
-		qrs.Add(&QueryResult{result[0].Result, bindings})
+		if err := iter(&QueryResult{result[0].Result, bindings, trace, result[0].Types}); err != nil {
+			return err
+		}
+
+		if n++; params.Limit > 0 && n >= params.Limit {
+			return ErrLimitReached
+		}
+
 		return nil
 	})
 
-	return qrs, err
+	if err == ErrLimitReached {
+		err = nil
+	}
+
+	return err
 }
 
+// ErrLimitReached can be returned by iterators to stop evaluation once the
+// maximum number of results have been collected. Query uses it to implement
+// QueryParams.Limit and does not return it to the caller.
+var ErrLimitReached = fmt.Errorf("result limit reached")
+
 // evalRequest evaluates the params' request field. The iterator is called with
 // the plugged request.
 func evalRequest(params *QueryParams, iter Iterator) error {
@@ -687,9 +800,10 @@ type Resolver interface {
 }
 
 type resolver struct {
-	context context.Context
-	store   *storage.Storage
-	txn     storage.Transaction
+	context  context.Context
+	store    *storage.Storage
+	txn      storage.Transaction
+	counters *Counters
 }
 
 func (r resolver) Resolve(ref ast.Ref) (interface{}, error) {
@@ -697,6 +811,7 @@ func (r resolver) Resolve(ref ast.Ref) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	r.counters.incrStoreReads()
 	return r.store.Read(r.context, r.txn, path)
 }
 
@@ -770,6 +885,109 @@ func ValueToInterface(v ast.Value, resolver Resolver) (interface{}, error) {
 	}
 }
 
+// ValueToTypes returns a structure parallel to the value returned by
+// ValueToInterface that describes the type of each value. Scalars are described
+// by one of "null", "boolean", "integer", "float", or "string". Arrays and sets
+// are described by objects of the form {"type": "array"|"set", "items": [...]}
+// and objects are described by {"type": "object", "properties": {...}}. If the
+// value is a reference, the reference is fetched from storage.
+func ValueToTypes(v ast.Value, resolver Resolver) (interface{}, error) {
+	switch v := v.(type) {
+	case ast.Null:
+		return "null", nil
+	case ast.Boolean:
+		return "boolean", nil
+	case ast.Number:
+		return numberType(json.Number(v)), nil
+	case ast.String:
+		return "string", nil
+	case ast.Array:
+		items := []interface{}{}
+		for _, x := range v {
+			x1, err := ValueToTypes(x.Value, resolver)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, x1)
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case ast.Object:
+		props := map[string]interface{}{}
+		for _, x := range v {
+			k, err := ValueToInterface(x[0].Value, resolver)
+			if err != nil {
+				return nil, err
+			}
+			asStr, stringKey := k.(string)
+			if !stringKey {
+				return nil, fmt.Errorf("object key type %T", k)
+			}
+			v, err := ValueToTypes(x[1].Value, resolver)
+			if err != nil {
+				return nil, err
+			}
+			props[asStr] = v
+		}
+		return map[string]interface{}{"type": "object", "properties": props}, nil
+	case *ast.Set:
+		items := []interface{}{}
+		for _, x := range *v {
+			x1, err := ValueToTypes(x.Value, resolver)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, x1)
+		}
+		return map[string]interface{}{"type": "set", "items": items}, nil
+	case ast.Ref:
+		x, err := resolver.Resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		return interfaceToTypes(x), nil
+	default:
+		return nil, fmt.Errorf("unbound value: %v", v)
+	}
+}
+
+// interfaceToTypes returns the type annotations for a base document. Base
+// documents do not contain sets.
+func interfaceToTypes(x interface{}) interface{} {
+	switch x := x.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return numberType(x)
+	case float64:
+		return numberType(json.Number(fmt.Sprint(x)))
+	case string:
+		return "string"
+	case []interface{}:
+		items := make([]interface{}, len(x))
+		for i := range x {
+			items[i] = interfaceToTypes(x[i])
+		}
+		return map[string]interface{}{"type": "array", "items": items}
+	case map[string]interface{}:
+		props := make(map[string]interface{}, len(x))
+		for k := range x {
+			props[k] = interfaceToTypes(x[k])
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	default:
+		return fmt.Sprintf("%T", x)
+	}
+}
+
+func numberType(n json.Number) string {
+	if _, err := n.Int64(); err == nil {
+		return "integer"
+	}
+	return "float"
+}
+
 // ValueToSlice returns the underlying Go value associated with an AST value.
 // If the value is a reference, the reference is fetched from storage.
 func ValueToSlice(v ast.Value, resolver Resolver) ([]interface{}, error) {
@@ -851,6 +1069,16 @@ func ValueToStrings(v ast.Value, resolver Resolver) ([]string, error) {
 
 func eval(t *Topdown, iter Iterator) error {
 
+	if t.DepthLimit > 0 && t.depth > t.DepthLimit {
+		return depthLimitErr(t.DepthLimit)
+	}
+
+	if t.Context != nil {
+		if err := t.Context.Err(); err != nil {
+			return cancelErr(err)
+		}
+	}
+
 	if t.Index >= len(t.Query) {
 		return iter(t)
 	}
@@ -934,6 +1162,9 @@ func evalExpr(t *Topdown, iter Iterator) error {
 	expr := PlugExpr(t.Current(), t.Binding)
 	switch tt := expr.Terms.(type) {
 	case []*ast.Term:
+		if value, ok := t.BuiltinOverrides[tt[0].Value.(ast.Var)]; ok {
+			return evalBuiltinOverride(t, expr, value, iter)
+		}
 		builtin, ok := builtinFunctions[tt[0].Value.(ast.Var)]
 		if !ok {
 			return typeErrUnsupportedBuiltin(expr)
@@ -1539,6 +1770,14 @@ func evalRefRulePartialObjectDocFull(t *Topdown, ref ast.Ref, rules []*ast.Rule,
 
 			keys.Put(key, value)
 
+			if err := t.Budget.charge(key); err != nil {
+				return err
+			}
+
+			if err := t.Budget.charge(value); err != nil {
+				return err
+			}
+
 			result = append(result, ast.Item(&ast.Term{Value: key}, &ast.Term{Value: value}))
 			child.traceExit(rule)
 			child.traceRedo(rule)
@@ -1633,6 +1872,9 @@ func evalRefRulePartialSetDocFull(t *Topdown, ref ast.Ref, rules []*ast.Rule, it
 
 		err := eval(child, func(child *Topdown) error {
 			value := PlugValue(rule.Key.Value, child.Binding)
+			if err := t.Budget.charge(value); err != nil {
+				return err
+			}
 			result.Add(&ast.Term{Value: value})
 			child.traceExit(rule)
 			child.traceRedo(rule)
@@ -1855,7 +2097,11 @@ func evalTermsComprehension(t *Topdown, comp ast.Value, iter Iterator) error {
 		r := ast.Array{}
 		c := t.Child(comp.Body, t.Locals)
 		err := Eval(c, func(c *Topdown) error {
-			r = append(r, PlugTerm(comp.Term, c.Binding))
+			term := PlugTerm(comp.Term, c.Binding)
+			if err := t.Budget.charge(term.Value); err != nil {
+				return err
+			}
+			r = append(r, term)
 			return nil
 		})
 		if err != nil {
@@ -1879,6 +2125,7 @@ func evalTermsIndexed(t *Topdown, iter Iterator, indexed ast.Ref, nonIndexed *as
 
 		// Iterate the bindings for the indexed term that when applied to the reference
 		// would locate the non-indexed value obtained above.
+		t.Counters.incrStoreReads()
 		return t.Store.Index(t.txn, indexed, value, func(bindings *ast.ValueMap) error {
 			var prev *Undo
 
@@ -2065,6 +2312,8 @@ func indexBuildLazy(t *Topdown, ref ast.Ref) (bool, error) {
 		}
 	}
 
+	t.Counters.incrStoreWrites()
+
 	if err := t.Store.BuildIndex(t.Context, t.txn, ref); err != nil {
 		switch err := err.(type) {
 		case *storage.Error:
@@ -244,6 +244,37 @@ func TestPlugValue(t *testing.T) {
 	}
 }
 
+func TestValueToTypes(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryWithJSONConfig(map[string]interface{}{
+		"a": []interface{}{json.Number("1"), "x"},
+	}))
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	top := New(ctx, nil, nil, store, txn)
+	value := ast.MustParseTerm(`{"b": {1.5}, "c": [null, true], "d": data.a}`).Value
+
+	result, err := ValueToTypes(value, top)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var expected interface{}
+	if err := util.UnmarshalJSON([]byte(`{"type": "object", "properties": {
+		"b": {"type": "set", "items": ["float"]},
+		"c": {"type": "array", "items": ["null", "boolean"]},
+		"d": {"type": "array", "items": ["integer", "string"]}
+	}}`), &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	if util.Compare(expected, result) != 0 {
+		t.Fatalf("Expected %v but got: %v", expected, result)
+	}
+}
+
 func TestTopDownCompleteDoc(t *testing.T) {
 	tests := []struct {
 		note     string
@@ -1364,6 +1395,96 @@ func TestTopDownUnsupportedBuiltin(t *testing.T) {
 
 }
 
+func TestTopDownBuiltinOverrides(t *testing.T) {
+
+	compiler := compileModules([]string{`
+		package ex
+		p = y :- to_number("deadbeef", x), plus(x, 1, y)
+		q :- re_match("^a$", "b")
+		r :- x = "a", upper(x, "A")
+	`})
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	tests := []struct {
+		note      string
+		path      string
+		overrides map[ast.Var]ast.Value
+		expected  interface{}
+	}{
+		{"output", "data.ex.p", map[ast.Var]ast.Value{"to_number": ast.Number("7")}, json.Number("8")},
+		{"no output", "data.ex.q", map[ast.Var]ast.Value{"re_match": ast.Boolean(true)}, true},
+		{"no output false", "data.ex.q", map[ast.Var]ast.Value{"re_match": ast.Boolean(false)}, nil},
+		{"output mismatch", "data.ex.r", map[ast.Var]ast.Value{"upper": ast.String("B")}, nil},
+		{"not overridden", "data.ex.r", map[ast.Var]ast.Value{"lower": ast.String("B")}, true},
+	}
+
+	for _, tc := range tests {
+		params := NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef(tc.path))
+		params.BuiltinOverrides = tc.overrides
+
+		qrs, err := Query(params)
+		if err != nil {
+			t.Errorf("%v: Unexpected error: %v", tc.note, err)
+			continue
+		}
+
+		if tc.expected == nil {
+			if !qrs.Undefined() {
+				t.Errorf("%v: Expected undefined result but got: %v", tc.note, qrs)
+			}
+			continue
+		}
+
+		if qrs.Undefined() || !reflect.DeepEqual(qrs[0].Result, tc.expected) {
+			t.Errorf("%v: Expected %v but got: %v", tc.note, tc.expected, qrs)
+		}
+	}
+}
+
+func TestTopDownQueryLimit(t *testing.T) {
+
+	compiler := compileModules([]string{`
+		package ex
+		p[x] :- a = [1, 2, 3, 4], a[x] = _
+	`})
+
+	ctx := context.Background()
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	request := ast.MustParseTerm(`{"y": data.ex.p[i]}`).Value
+
+	tests := []struct {
+		note     string
+		limit    int
+		expected int
+	}{
+		{"unlimited", 0, 4},
+		{"limited", 2, 2},
+		{"above", 10, 4},
+	}
+
+	for _, tc := range tests {
+		params := NewQueryParams(ctx, compiler, store, txn, request, ast.MustParseRef("data.ex.p"))
+		params.Limit = tc.limit
+
+		qrs, err := Query(params)
+		if err != nil {
+			t.Errorf("%v: Unexpected error: %v", tc.note, err)
+			continue
+		}
+
+		if len(qrs) != tc.expected {
+			t.Errorf("%v: Expected %v results but got: %v", tc.note, tc.expected, qrs)
+		}
+	}
+}
+
 type contextPropagationMock struct{}
 
 // contextPropagationStore will accumulate values from the contexts provided to
@@ -1667,7 +1788,7 @@ func parseJSON(input string) interface{} {
 
 func parseQueryResultSetJSON(input [][2]string) (result QueryResultSet) {
 	for i := range input {
-		result.Add(&QueryResult{parseJSON(input[i][0]), parseJSON(input[i][1]).(map[string]interface{})})
+		result.Add(&QueryResult{Result: parseJSON(input[i][0]), Bindings: parseJSON(input[i][1]).(map[string]interface{})})
 	}
 	return result
 }
@@ -10,6 +10,7 @@ import (
 	"strings"
 
 	"github.com/open-policy-agent/opa/ast"
+	"github.com/pkg/errors"
 )
 
 // Op defines the types of tracing events.
@@ -30,6 +31,10 @@ const (
 
 	// FailOp is emitted when an expression evaluates to false.
 	FailOp Op = "Fail"
+
+	// NoteOp is emitted when an expression invokes the trace built-in. The
+	// event's node is the expression with the message plugged in.
+	NoteOp Op = "Note"
 )
 
 // Event contains state associated with a tracing event.
@@ -59,6 +64,24 @@ func (evt *Event) HasExpr() bool {
 	return ok
 }
 
+// Message returns the message of a note event. If the event is not a note,
+// the message is empty.
+func (evt *Event) Message() string {
+	if evt.Op != NoteOp {
+		return ""
+	}
+	expr, ok := evt.Node.(*ast.Expr)
+	if !ok {
+		return ""
+	}
+	terms, ok := expr.Terms.([]*ast.Term)
+	if !ok || len(terms) != 2 {
+		return ""
+	}
+	s, _ := terms[1].Value.(ast.String)
+	return string(s)
+}
+
 // Equal returns true if this event is equal to the other event.
 func (evt *Event) Equal(other *Event) bool {
 	if evt.Op != other.Op {
@@ -125,6 +148,50 @@ func (b *BufferTracer) Trace(t *Topdown, evt *Event) {
 	*b = append(*b, evt)
 }
 
+// MultiTracer implements the Tracer interface by forwarding events to each of
+// the tracers it contains.
+type MultiTracer []Tracer
+
+// NewMultiTracer returns a new MultiTracer for the tracers.
+func NewMultiTracer(tracers ...Tracer) MultiTracer {
+	return MultiTracer(tracers)
+}
+
+// Enabled returns true if any of the tracers are enabled.
+func (m MultiTracer) Enabled() bool {
+	for _, tracer := range m {
+		if tracer.Enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// Trace forwards the event to each of the enabled tracers.
+func (m MultiTracer) Trace(t *Topdown, evt *Event) {
+	for _, tracer := range m {
+		if tracer.Enabled() {
+			tracer.Trace(t, evt)
+		}
+	}
+}
+
+// findBufferTracer returns the BufferTracer that receives events from tracer
+// or nil if there is none.
+func findBufferTracer(tracer Tracer) *BufferTracer {
+	switch tracer := tracer.(type) {
+	case *BufferTracer:
+		return tracer
+	case MultiTracer:
+		for _, x := range tracer {
+			if buf := findBufferTracer(x); buf != nil {
+				return buf
+			}
+		}
+	}
+	return nil
+}
+
 // PrettyTrace pretty prints the trace to the writer.
 func PrettyTrace(w io.Writer, trace []*Event) {
 	depths := depths{}
@@ -160,6 +227,24 @@ func formatEventSpaces(event *Event, depth int) int {
 	return depth + 1
 }
 
+// evalTrace emits a note containing the message if tracing is enabled.
+func evalTrace(t *Topdown, expr *ast.Expr, iter Iterator) error {
+	ops := expr.Terms.([]*ast.Term)
+
+	msg, err := ValueToString(ops[1].Value, t)
+	if err != nil {
+		return errors.Wrapf(err, "%v: message must be a string", ast.Trace.Name)
+	}
+
+	// The note contains the message so that the trace can be interpreted
+	// without the bindings of the query.
+	note := ast.Trace.Expr(ast.StringTerm(msg))
+	note.Location = expr.Location
+	t.traceNote(note)
+
+	return iter(t)
+}
+
 // depths is a helper for computing the depth of an event. Events within the
 // same query all have the same depth. The depth of query is
 // depth(parent(query))+1.
@@ -51,6 +51,72 @@ func TestEventEqual(t *testing.T) {
 
 }
 
+func TestTraceNote(t *testing.T) {
+
+	ctx := context.Background()
+	compiler := compileModules([]string{`package test
+	p :- trace("hello"), x = 1, trace("world")
+	q :- x = 1, trace(x)`})
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	buf := NewBufferTracer()
+	params := NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef("data.test.p"))
+	params.Tracer = buf
+
+	qrs, err := Query(params)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if qrs.Undefined() {
+		t.Fatalf("Expected result but got undefined")
+	}
+
+	notes := []string{}
+	for _, evt := range *buf {
+		if evt.Op == NoteOp {
+			notes = append(notes, evt.Message())
+		}
+	}
+
+	if len(notes) != 2 || notes[0] != "hello" || notes[1] != "world" {
+		t.Fatalf("Expected notes [hello world] but got: %v", notes)
+	}
+
+	params = NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef("data.test.q"))
+
+	if _, err := Query(params); err == nil || !strings.Contains(err.Error(), "trace: message must be a string") {
+		t.Fatalf("Expected type error but got: %v", err)
+	}
+}
+
+func TestMultiTracer(t *testing.T) {
+
+	ctx := context.Background()
+	compiler := compileModules([]string{`package test
+	p[x] :- a = [1, 2], x = a[_]`})
+	store := storage.New(storage.InMemoryConfig())
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Close(ctx, txn)
+
+	buf1 := NewBufferTracer()
+	buf2 := NewBufferTracer()
+	params := NewQueryParams(ctx, compiler, store, txn, nil, ast.MustParseRef("data.test.p"))
+	params.Tracer = NewMultiTracer(buf1, buf2)
+
+	if _, err := Query(params); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(*buf1) == 0 || len(*buf1) != len(*buf2) {
+		t.Fatalf("Expected events to be forwarded to each tracer but got: %d and %d", len(*buf1), len(*buf2))
+	}
+
+	if findBufferTracer(params.Tracer) != buf1 {
+		t.Fatalf("Expected to find first buffer tracer")
+	}
+}
+
 func TestPrettyTrace(t *testing.T) {
 	module := `
 	package test
@@ -7,7 +7,11 @@ package util
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // UnmarshalJSON parses the JSON encoded data and stores the result in the value
@@ -30,3 +34,132 @@ func NewJSONDecoder(r io.Reader) *json.Decoder {
 	decoder.UseNumber()
 	return decoder
 }
+
+// StrictJSONDecoder decodes JSON values like the decoder returned by
+// NewJSONDecoder except that object keys that do not match a field in the
+// destination struct are rejected.
+type StrictJSONDecoder struct {
+	decoder *json.Decoder
+}
+
+// NewStrictJSONDecoder returns a new decoder that reads from r and rejects
+// object keys that do not match a field in the destination struct.
+//
+// This function is intended to be used when decoding structured messages where
+// a misspelled field should be reported rather than silently ignored.
+func NewStrictJSONDecoder(r io.Reader) *StrictJSONDecoder {
+	return &StrictJSONDecoder{decoder: json.NewDecoder(r)}
+}
+
+// Decode reads the next JSON value from the input and stores it in the value
+// pointed to by x.
+func (d *StrictJSONDecoder) Decode(x interface{}) error {
+	var raw json.RawMessage
+	if err := d.decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if err := checkUnknownFields(raw, reflect.TypeOf(x)); err != nil {
+		return err
+	}
+	return UnmarshalJSON(raw, x)
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkUnknownFields returns an error if the JSON value contains an object key
+// that does not match a field of the struct it would be decoded into. Values
+// that do not match the shape of t are ignored here and reported when the
+// value is decoded. Types that implement json.Unmarshaler are not checked.
+func checkUnknownFields(bs []byte, t reflect.Type) error {
+
+	for t.Kind() == reflect.Ptr {
+		if t.Implements(jsonUnmarshalerType) {
+			return nil
+		}
+		t = t.Elem()
+	}
+
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(bs, &obj); err != nil {
+			return nil
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, ok := jsonField(t, k)
+			if !ok {
+				return fmt.Errorf("json: unknown field %q", k)
+			}
+			if err := checkUnknownFields(obj[k], f.Type); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var arr []json.RawMessage
+		if err := json.Unmarshal(bs, &arr); err != nil {
+			return nil
+		}
+		for _, elem := range arr {
+			if err := checkUnknownFields(elem, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(bs, &obj); err != nil {
+			return nil
+		}
+		for _, elem := range obj {
+			if err := checkUnknownFields(elem, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonField returns the field of struct type t that the object key would be
+// decoded into. Like encoding/json, keys are matched against field names
+// case-insensitively and fields of embedded structs are promoted.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if ef, ok := jsonField(ft, key); ok {
+					return ef, true
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,50 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewStrictJSONDecoder(t *testing.T) {
+
+	type op struct {
+		Op    string      `json:"op"`
+		Value interface{} `json:"value"`
+	}
+
+	var x op
+	if err := NewStrictJSONDecoder(strings.NewReader(`{"op": "add", "value": 1}`)).Decode(&x); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if x.Value != json.Number("1") {
+		t.Fatalf("Expected value to be decoded as json.Number but got: %T", x.Value)
+	}
+
+	err := NewStrictJSONDecoder(strings.NewReader(`{"operation": "add"}`)).Decode(&x)
+	if err == nil || !strings.Contains(err.Error(), `"operation"`) {
+		t.Fatalf("Expected unknown field error but got: %v", err)
+	}
+
+	// Structs nested in slices are checked. Objects decoded into interface
+	// values are not.
+	var xs []op
+	if err := NewStrictJSONDecoder(strings.NewReader(`[{"OP": "add", "value": {"a": 1}}]`)).Decode(&xs); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	err = NewStrictJSONDecoder(strings.NewReader(`[{"op": "add"}, {"op": "add", "path": "/"}]`)).Decode(&xs)
+	if err == nil || err.Error() != `json: unknown field "path"` {
+		t.Fatalf("Expected unknown field error but got: %v", err)
+	}
+
+	err = NewStrictJSONDecoder(strings.NewReader(`{"op": 1}`)).Decode(&x)
+	if _, ok := err.(*json.UnmarshalTypeError); !ok {
+		t.Fatalf("Expected type error but got: %v", err)
+	}
+}